@@ -11,6 +11,7 @@ import (
 	"time"
 
 	"gopkg.d7z.net/cache-proxy/pkg/app"
+	"gopkg.d7z.net/cache-proxy/pkg/utils"
 )
 
 const shutdownTimeout = 10 * time.Second
@@ -27,11 +28,12 @@ func main() {
 
 	doc, err := app.Load(*configPath)
 	if err != nil {
-		_, _ = fmt.Fprintln(os.Stderr, err)
+		_, _ = fmt.Fprintln(os.Stderr, utils.Redact(err.Error()))
 		os.Exit(1)
 	}
+	utils.SetSecrets(doc.Secrets())
 	if err := app.Validate(doc); err != nil {
-		_, _ = fmt.Fprintln(os.Stderr, err)
+		_, _ = fmt.Fprintln(os.Stderr, utils.Redact(err.Error()))
 		os.Exit(1)
 	}
 	if *validateOnly {
@@ -40,11 +42,11 @@ func main() {
 
 	runtime, err := app.Open(context.Background(), doc, *configPath)
 	if err != nil {
-		_, _ = fmt.Fprintln(os.Stderr, err)
+		_, _ = fmt.Fprintln(os.Stderr, utils.Redact(err.Error()))
 		os.Exit(1)
 	}
 	if err := runtime.Start(); err != nil {
-		_, _ = fmt.Fprintln(os.Stderr, err)
+		_, _ = fmt.Fprintln(os.Stderr, utils.Redact(err.Error()))
 		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
 		_ = runtime.Close(shutdownCtx)
 		cancel()
@@ -53,8 +55,15 @@ func main() {
 	slog.Info("cache proxy started", "bind", doc.Server.Bind, "backend", doc.Server.Backend, "metrics_path", doc.Metrics.Path)
 
 	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-	<-sigs
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range sigs {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		if err := runtime.Reload(context.Background()); err != nil {
+			slog.Error("config reload failed", "err", err)
+		}
+	}
 
 	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
 	defer cancel()
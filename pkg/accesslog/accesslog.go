@@ -0,0 +1,295 @@
+package accesslog
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.d7z.net/cache-proxy/pkg/config"
+	"gopkg.d7z.net/cache-proxy/pkg/utils"
+)
+
+const (
+	FormatJSON     = "json"
+	FormatCombined = "combined"
+
+	defaultMaxBackups = 5
+)
+
+// Entry is one access log line.
+type Entry struct {
+	Time      time.Time     `json:"time"`
+	Remote    string        `json:"remote"`
+	Instance  string        `json:"instance"`
+	Mode      string        `json:"mode"`
+	Method    string        `json:"method"`
+	Path      string        `json:"path"`
+	Proto     string        `json:"proto"`
+	Status    int           `json:"status"`
+	Bytes     int64         `json:"bytes"`
+	Cache     string        `json:"cache,omitempty"`
+	Upstream  string        `json:"upstream,omitempty"`
+	TTFB      time.Duration `json:"-"`
+	Duration  time.Duration `json:"-"`
+	Referer   string        `json:"referer,omitempty"`
+	UserAgent string        `json:"user_agent,omitempty"`
+}
+
+type jsonEntry struct {
+	Entry
+	TTFBMs     float64 `json:"ttfb_ms"`
+	DurationMs float64 `json:"duration_ms"`
+}
+
+// Validate checks an access log config without opening it.
+func Validate(cfg config.AccessLogConfig) error {
+	switch cfg.Format {
+	case "", FormatJSON, FormatCombined:
+	default:
+		return fmt.Errorf("access_log format %q must be json or combined", cfg.Format)
+	}
+	if cfg.SampleRate < 0 || cfg.SampleRate > 1 {
+		return errors.New("access_log sample_rate must be between 0 and 1")
+	}
+	if cfg.MaxBackups < 0 {
+		return errors.New("access_log max_backups must not be negative")
+	}
+	return nil
+}
+
+// Logger writes sampled access log lines. A nil Logger discards everything.
+type Logger struct {
+	mu     sync.Mutex
+	out    io.Writer
+	closer io.Closer
+	format string
+	sample float64
+}
+
+// New opens the access log described by cfg, or returns nil when it is disabled.
+func New(cfg config.AccessLogConfig) (*Logger, error) {
+	if err := Validate(cfg); err != nil {
+		return nil, err
+	}
+	logger := &Logger{format: cfg.Format, sample: cfg.SampleRate}
+	if logger.format == "" {
+		logger.format = FormatJSON
+	}
+	if logger.sample == 0 {
+		logger.sample = 1
+	}
+	switch strings.TrimSpace(cfg.Path) {
+	case "":
+		return nil, nil
+	case "stderr", "-":
+		logger.out = os.Stderr
+	default:
+		backups := cfg.MaxBackups
+		if backups == 0 {
+			backups = defaultMaxBackups
+		}
+		file, err := openRotatingFile(cfg.Path, cfg.MaxSize.Bytes(), backups)
+		if err != nil {
+			return nil, err
+		}
+		logger.out, logger.closer = file, file
+	}
+	return logger, nil
+}
+
+// NewWriter returns a logger writing every line to w.
+func NewWriter(w io.Writer, format string) *Logger {
+	if format == "" {
+		format = FormatJSON
+	}
+	return &Logger{out: w, format: format, sample: 1}
+}
+
+func (l *Logger) Close() error {
+	if l == nil || l.closer == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.closer.Close()
+}
+
+// sampled reports whether a request with status should be logged. Server
+// errors are always kept.
+func (l *Logger) sampled(status int) bool {
+	return l.sample >= 1 || status >= http.StatusInternalServerError || rand.Float64() < l.sample
+}
+
+func (l *Logger) Log(entry Entry) {
+	if l == nil || !l.sampled(entry.Status) {
+		return
+	}
+	var line []byte
+	if l.format == FormatCombined {
+		line = combinedLine(entry)
+	} else {
+		data, err := json.Marshal(jsonEntry{
+			Entry:      entry,
+			TTFBMs:     milliseconds(entry.TTFB),
+			DurationMs: milliseconds(entry.Duration),
+		})
+		if err != nil {
+			return
+		}
+		line = append(data, '\n')
+	}
+	l.mu.Lock()
+	_, _ = l.out.Write(line)
+	l.mu.Unlock()
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// combinedLine renders entry in the Apache combined format followed by the
+// cache-proxy specific fields.
+func combinedLine(entry Entry) []byte {
+	var b strings.Builder
+	host, _, err := net.SplitHostPort(entry.Remote)
+	if err != nil {
+		host = entry.Remote
+	}
+	b.WriteString(dash(host))
+	b.WriteString(" - - [")
+	b.WriteString(entry.Time.Format("02/Jan/2006:15:04:05 -0700"))
+	b.WriteString("] ")
+	b.WriteString(strconv.Quote(entry.Method + " " + entry.Path + " " + entry.Proto))
+	fmt.Fprintf(&b, " %d %d ", entry.Status, entry.Bytes)
+	b.WriteString(strconv.Quote(dash(entry.Referer)))
+	b.WriteByte(' ')
+	b.WriteString(strconv.Quote(dash(entry.UserAgent)))
+	fmt.Fprintf(&b, " instance=%s mode=%s cache=%s upstream=%s ttfb_ms=%.3f duration_ms=%.3f\n",
+		dash(entry.Instance), dash(entry.Mode), dash(entry.Cache), dash(entry.Upstream),
+		milliseconds(entry.TTFB), milliseconds(entry.Duration))
+	return []byte(b.String())
+}
+
+func dash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+type annotationsKey struct{}
+
+type annotations struct {
+	mu       sync.Mutex
+	upstream string
+}
+
+// SetUpstream records the upstream that served the request on ctx. It is a
+// no-op when the request is not being logged.
+func SetUpstream(ctx context.Context, upstream string) {
+	if upstream == "" {
+		return
+	}
+	if note, ok := ctx.Value(annotationsKey{}).(*annotations); ok {
+		note.mu.Lock()
+		note.upstream = utils.Redact(upstream)
+		note.mu.Unlock()
+	}
+}
+
+// Serve runs next and logs the outcome.
+func (l *Logger) Serve(w http.ResponseWriter, req *http.Request, instance, mode string, next http.Handler) {
+	if l == nil {
+		next.ServeHTTP(w, req)
+		return
+	}
+	start := time.Now()
+	note := &annotations{}
+	recorder := &responseRecorder{ResponseWriter: w, start: start}
+	target := req.RequestURI
+	if target == "" {
+		target = req.URL.RequestURI()
+	}
+	next.ServeHTTP(recorder, req.WithContext(context.WithValue(req.Context(), annotationsKey{}, note)))
+
+	status := recorder.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	note.mu.Lock()
+	upstream := note.upstream
+	note.mu.Unlock()
+	l.Log(Entry{
+		Time:      start,
+		Remote:    req.RemoteAddr,
+		Instance:  instance,
+		Mode:      mode,
+		Method:    req.Method,
+		Path:      target,
+		Proto:     req.Proto,
+		Status:    status,
+		Bytes:     recorder.bytes,
+		Cache:     w.Header().Get("X-Cache"),
+		Upstream:  upstream,
+		TTFB:      recorder.ttfb,
+		Duration:  time.Since(start),
+		Referer:   req.Referer(),
+		UserAgent: req.UserAgent(),
+	})
+}
+
+type responseRecorder struct {
+	http.ResponseWriter
+	start  time.Time
+	status int
+	bytes  int64
+	ttfb   time.Duration
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 && status >= http.StatusOK {
+		r.status = status
+		r.ttfb = time.Since(r.start)
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+	n, err := r.ResponseWriter.Write(p)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// ReadFrom keeps the underlying writer's sendfile path for cached bodies.
+func (r *responseRecorder) ReadFrom(src io.Reader) (int64, error) {
+	if r.status == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+	n, err := io.Copy(r.ResponseWriter, src)
+	r.bytes += n
+	return n, err
+}
+
+func (r *responseRecorder) Flush() {
+	if r.status == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+	_ = http.NewResponseController(r.ResponseWriter).Flush()
+}
+
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
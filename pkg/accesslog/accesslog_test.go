@@ -0,0 +1,73 @@
+package accesslog
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gopkg.d7z.net/cache-proxy/pkg/config"
+)
+
+func TestRotatingFileKeepsMaxBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	file, err := openRotatingFile(path, 10, 2)
+	require.NoError(t, err)
+	for _, line := range []string{"aaaaaaaa\n", "bbbbbbbb\n", "cccccccc\n", "dddddddd\n"} {
+		_, err := file.Write([]byte(line))
+		require.NoError(t, err)
+	}
+	require.NoError(t, file.Close())
+
+	for name, want := range map[string]string{
+		path:        "dddddddd\n",
+		path + ".1": "cccccccc\n",
+		path + ".2": "bbbbbbbb\n",
+	} {
+		data, err := os.ReadFile(name)
+		require.NoError(t, err)
+		require.Equal(t, want, string(data))
+	}
+	require.NoFileExists(t, path+".3")
+}
+
+func TestSamplingKeepsServerErrors(t *testing.T) {
+	var out bytes.Buffer
+	logger := NewWriter(&out, FormatJSON)
+	logger.sample = 0.0000001
+	for i := 0; i < 100; i++ {
+		logger.Log(Entry{Status: http.StatusOK})
+	}
+	logger.Log(Entry{Status: http.StatusBadGateway})
+	require.Equal(t, 1, strings.Count(out.String(), "\n"))
+	require.Contains(t, out.String(), `"status":502`)
+}
+
+func TestServeRecordsCombinedLine(t *testing.T) {
+	var out bytes.Buffer
+	logger := NewWriter(&out, FormatCombined)
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		SetUpstream(req.Context(), "https://mirror.example")
+		w.Header().Set("X-Cache", "HIT")
+		_, _ = w.Write([]byte("hello"))
+	})
+	req := httptest.NewRequest(http.MethodGet, "/debian/dists/stable/Release", nil)
+	logger.Serve(httptest.NewRecorder(), req, "debian", config.ModeFile, next)
+
+	line := out.String()
+	require.Contains(t, line, `"GET /debian/dists/stable/Release HTTP/1.1" 200 5`)
+	require.Contains(t, line, "instance=debian mode=file cache=HIT upstream=https://mirror.example")
+}
+
+func TestNewDisabledWithoutPath(t *testing.T) {
+	logger, err := New(config.AccessLogConfig{})
+	require.NoError(t, err)
+	require.Nil(t, logger)
+	_, err = New(config.AccessLogConfig{Path: "stderr", Format: "xml"})
+	require.ErrorContains(t, err, "must be json or combined")
+}
@@ -0,0 +1,79 @@
+package accesslog
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// rotatingFile appends to path and, once maxSize would be exceeded, shifts it
+// to path.1, path.1 to path.2 and so on, keeping at most maxBackups files.
+// A zero maxSize never rotates.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+	r := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	r.file, r.size = file, info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	_ = os.Remove(r.backup(r.maxBackups))
+	for i := r.maxBackups - 1; i >= 1; i-- {
+		_ = os.Rename(r.backup(i), r.backup(i+1))
+	}
+	renameErr := os.Rename(r.path, r.backup(1))
+	if err := r.open(); err != nil {
+		return err
+	}
+	return renameErr
+}
+
+func (r *rotatingFile) backup(index int) string {
+	return fmt.Sprintf("%s.%d", r.path, index)
+}
+
+func (r *rotatingFile) Close() error {
+	return r.file.Close()
+}
@@ -20,6 +20,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"gopkg.d7z.net/blobfs"
 
+	"gopkg.d7z.net/cache-proxy/pkg/accesslog"
 	"gopkg.d7z.net/cache-proxy/pkg/bus"
 	"gopkg.d7z.net/cache-proxy/pkg/config"
 	"gopkg.d7z.net/cache-proxy/pkg/health"
@@ -49,6 +50,8 @@ type App struct {
 	probes    *health.ProbeScheduler
 	bus       *bus.Bus
 	status    *appStatus
+	warm      warmJobs
+	accessLog atomic.Pointer[accesslog.Logger]
 
 	entries       map[string]*proxyruntime.Entry
 	handlers      []proxyruntime.Instance
@@ -56,6 +59,14 @@ type App struct {
 	pathHandlers  map[string]http.Handler
 	pathPrefixes  []string
 	bindHandlers  map[string]http.Handler
+	access        accessGuards
+	networks      clientNetworks
+	limits        rateLimits
+	releaseAges   releaseAgeOverrides
+	pathAccess    map[string]routeGuard
+	bindAccess    map[string]routeGuard
+	tls           map[string]*tlsReloader
+	starting      map[string]struct{}
 	bindServers   map[string]*http.Server
 	bindListeners map[string]net.Listener
 	mainServer    *http.Server
@@ -136,6 +147,18 @@ func Validate(doc *config.Document) error {
 	if err := validateServerConfig(&docCopy); err != nil {
 		return err
 	}
+	if _, err := newAccessGuards(&docCopy); err != nil {
+		return err
+	}
+	if _, err := newClientNetworks(&docCopy); err != nil {
+		return err
+	}
+	if _, err := newRateLimits(&docCopy, nil); err != nil {
+		return err
+	}
+	if _, err := newReleaseAgeOverrides(&docCopy); err != nil {
+		return err
+	}
 	store, err := blobfs.Open(dir, appBlobFSConfig())
 	if err != nil {
 		return err
@@ -152,10 +175,14 @@ func Validate(doc *config.Document) error {
 	b := bus.NewWithRegisterer(registry)
 	sched := scheduler.New(b, store, registry)
 	validateCtx, validateCancel := context.WithCancel(context.Background())
-	_, err = planEntries(context.Background(), &docCopy, store, stats, downloads, sched, nil, b)
+	entries, err := planEntries(context.Background(), &docCopy, store, stats, downloads, sched, nil, b)
 	sched.Start(validateCtx)
 	defer validateCancel()
 	defer func() { _ = sched.Stop(validateCtx) }()
+	if err != nil {
+		return err
+	}
+	_, err = newTLSReloaders(&docCopy, entries)
 	return err
 }
 
@@ -163,11 +190,28 @@ func Open(ctx context.Context, doc *config.Document, configPath string) (*App, e
 	if doc == nil {
 		return nil, errors.New("config document is nil")
 	}
+	utils.SetSecrets(doc.Secrets())
 	normalizeDocument(doc)
 	utils.CleanStaleTempFiles(24 * time.Hour)
 	if err := validateServerConfig(doc); err != nil {
 		return nil, err
 	}
+	access, err := newAccessGuards(doc)
+	if err != nil {
+		return nil, err
+	}
+	networks, err := newClientNetworks(doc)
+	if err != nil {
+		return nil, err
+	}
+	limits, err := newRateLimits(doc, nil)
+	if err != nil {
+		return nil, err
+	}
+	releaseAges, err := newReleaseAgeOverrides(doc)
+	if err != nil {
+		return nil, err
+	}
 	if err := os.MkdirAll(doc.Server.Backend, 0o755); err != nil {
 		return nil, err
 	}
@@ -179,6 +223,9 @@ func Open(ctx context.Context, doc *config.Document, configPath string) (*App, e
 	metricsReg := prometheus.NewRegistry()
 	metricsReg.MustRegister(metrics.NewBlobFSCollector(store))
 	stats := httpcache.NewStats(metricsReg)
+	if err := stats.Access().Load(ctx, store, registryTenant, accessIndexPath); err != nil {
+		slog.Warn("failed to load access index", "err", err)
+	}
 	downloads := httpcache.NewDownloadLimiter(doc.Storage.Download.MaxActive, doc.Storage.Download.MaxActivePerInstance)
 
 	b := bus.NewWithRegisterer(metricsReg)
@@ -202,6 +249,16 @@ func Open(ctx context.Context, doc *config.Document, configPath string) (*App, e
 		cleanupOpenFailure()
 		return nil, err
 	}
+	tlsReloaders, err := newTLSReloaders(doc, entries)
+	if err != nil {
+		cleanupOpenFailure()
+		return nil, err
+	}
+	accessLog, err := accesslog.New(doc.Server.AccessLog)
+	if err != nil {
+		cleanupOpenFailure()
+		return nil, fmt.Errorf("access log: %w", err)
+	}
 
 	app := &App{
 		config:        doc,
@@ -217,30 +274,42 @@ func Open(ctx context.Context, doc *config.Document, configPath string) (*App, e
 		entries:       entries,
 		pathHandlers:  map[string]http.Handler{},
 		bindHandlers:  map[string]http.Handler{},
+		access:        access,
+		networks:      networks,
+		limits:        limits,
+		releaseAges:   releaseAges,
+		tls:           tlsReloaders,
 		bindServers:   map[string]*http.Server{},
 		bindListeners: map[string]net.Listener{},
 		lifecycleCtx:  lifecycleCtx,
 		stopRuntime:   stopRuntime,
 	}
+	app.accessLog.Store(accessLog)
 	if err := app.prepareHandlers(lifecycleCtx); err != nil {
+		_ = accessLog.Close()
 		cleanupOpenFailure()
 		return nil, err
 	}
 	sched.Start(lifecycleCtx)
 	status.start(lifecycleCtx, app, b)
 
-	sched.Register(scheduler.TaskDef{
+	app.registerSystemTasks()
+
+	app.mainServer = &http.Server{Addr: doc.Server.Bind, Handler: app}
+	app.checkOrphans(lifecycleCtx)
+	return app, nil
+}
+
+func (a *App) registerSystemTasks() {
+	a.scheduler.Register(scheduler.TaskDef{
 		Key:      scheduler.NewTaskKey("_system", scheduler.TypeBlobGC, ""),
-		Interval: doc.Storage.GC.Blob.Duration(),
+		Interval: a.config.Storage.GC.Blob.Duration(),
 		Handler: func(ctx context.Context) (*scheduler.TaskOutcome, error) {
-			_, err := app.store.RunGC(ctx, blobfs.GCOptions{Compact: true})
+			_, err := a.store.RunGC(ctx, blobfs.GCOptions{Compact: true})
 			return nil, err
 		},
 	})
-
-	app.mainServer = &http.Server{Addr: doc.Server.Bind, Handler: app}
-	app.checkOrphans(lifecycleCtx)
-	return app, nil
+	a.registerQuotaTasks()
 }
 
 func (a *App) ServeHTTP(w http.ResponseWriter, req *http.Request) {
@@ -249,36 +318,70 @@ func (a *App) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		http.Error(w, "proxy not ready", http.StatusServiceUnavailable)
 		return
 	}
-	a.routesMu.RLock()
-	defer a.routesMu.RUnlock()
-
-	if req.Method == http.MethodGet && req.URL.Path == "/" {
-		a.serveHome(w, req)
-		return
-	}
-	if strings.HasPrefix(req.URL.Path, statusAPIPath) {
-		a.serveStatus(w, req)
+	if strings.HasPrefix(req.URL.Path, adminAPIPath) {
+		a.routesMu.RLock()
+		permitted := a.networks.server.permits(req)
+		a.routesMu.RUnlock()
+		if !permitted {
+			a.deny(w, req, nil)
+			return
+		}
+		a.serveAdmin(w, req)
 		return
 	}
-	if req.URL.Path == a.config.Metrics.Path {
-		metricsAuthMiddleware(a.config.Metrics.Token, promhttp.HandlerFor(
-			prometheus.Gatherers{prometheus.DefaultGatherer, a.metricsReg},
-			promhttp.HandlerOpts{},
-		)).ServeHTTP(w, req)
+	if a.serveServerRoute(w, req) {
 		return
 	}
+	// The routes lock is released before proxying, so a reload does not wait
+	// for in-flight downloads.
+	a.routesMu.RLock()
 	prefix := a.matchProxyPrefix(req.URL.Path)
 	handler := a.pathHandlers[prefix]
+	guard := a.pathAccess[prefix]
+	a.routesMu.RUnlock()
 	if handler == nil {
 		http.NotFound(w, req)
 		return
 	}
+	w, ok := a.admit(w, req, guard)
+	if !ok {
+		return
+	}
 	next := req.Clone(req.Context())
 	next.Header = req.Header.Clone()
 	next.Header.Set("X-Cache-Proxy-Prefix", prefix)
 	http.StripPrefix(prefix, handler).ServeHTTP(w, next)
 }
 
+// serveServerRoute serves the home page, status API and metrics, and reports
+// whether req was answered.
+func (a *App) serveServerRoute(w http.ResponseWriter, req *http.Request) bool {
+	a.routesMu.RLock()
+	defer a.routesMu.RUnlock()
+
+	if a.serverRoute(req) {
+		if _, ok := a.admit(w, req, routeGuard{access: a.access.server, networks: a.networks.server}); !ok {
+			return true
+		}
+	}
+	if req.Method == http.MethodGet && req.URL.Path == "/" {
+		a.serveHome(w, req)
+		return true
+	}
+	if strings.HasPrefix(req.URL.Path, statusAPIPath) {
+		a.serveStatus(w, req)
+		return true
+	}
+	if req.URL.Path == a.config.Metrics.Path {
+		bearerAuthMiddleware(a.config.Metrics.Token, promhttp.HandlerFor(
+			prometheus.Gatherers{prometheus.DefaultGatherer, a.metricsReg},
+			promhttp.HandlerOpts{},
+		)).ServeHTTP(w, req)
+		return true
+	}
+	return false
+}
+
 func (a *App) Start() error {
 	a.lifecycleMu.Lock()
 	defer a.lifecycleMu.Unlock()
@@ -310,22 +413,27 @@ func (a *App) Start() error {
 	a.started = true
 	a.ready.Store(true)
 	go func() {
-		if err := a.mainServer.Serve(mainListener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		if err := a.mainServer.Serve(a.tlsListener(a.config.Server.Bind, mainListener)); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			slog.Error("main server error", "addr", a.config.Server.Bind, "err", err)
 		}
 	}()
 	for addr, listener := range prepared {
-		server := &http.Server{Addr: addr, Handler: bindDispatchHandler{app: a, addr: addr}}
-		a.bindServers[addr] = server
-		go func(server *http.Server, listener net.Listener) {
-			if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
-				slog.Error("bind server error", "addr", server.Addr, "err", err)
-			}
-		}(server, listener)
+		a.serveBind(addr, listener)
 	}
 	return nil
 }
 
+func (a *App) serveBind(addr string, listener net.Listener) {
+	server := &http.Server{Addr: addr, Handler: bindDispatchHandler{app: a, addr: addr}}
+	a.bindServers[addr] = server
+	listener = a.tlsListener(addr, listener)
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("bind server error", "addr", server.Addr, "err", err)
+		}
+	}()
+}
+
 func (a *App) Close(ctx context.Context) error {
 	if ctx == nil {
 		ctx = context.Background()
@@ -361,8 +469,10 @@ func (a *App) Close(ctx context.Context) error {
 		joined = errors.Join(joined, handler.Stop(ctx))
 	}
 	if a.store != nil {
+		a.saveAccessIndex(ctx)
 		joined = errors.Join(joined, a.store.Close())
 	}
+	joined = errors.Join(joined, a.accessLog.Swap(nil).Close())
 	return joined
 }
 
@@ -380,6 +490,24 @@ func (h bindHomeHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	h.next.ServeHTTP(w, req)
 }
 
+type accessLogHandler struct {
+	app   *App
+	entry *proxyruntime.Entry
+	next  http.Handler
+}
+
+func (h accessLogHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h.app.routesMu.RLock()
+	_, starting := h.app.starting[h.entry.Name]
+	h.app.routesMu.RUnlock()
+	if starting {
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "instance not ready", http.StatusServiceUnavailable)
+		return
+	}
+	h.app.accessLog.Load().Serve(w, req, h.entry.Name, h.entry.Mode, h.next)
+}
+
 type bindDispatchHandler struct {
 	app  *App
 	addr string
@@ -393,47 +521,152 @@ func (h bindDispatchHandler) ServeHTTP(w http.ResponseWriter, req *http.Request)
 	}
 	h.app.routesMu.RLock()
 	next := h.app.bindHandlers[h.addr]
+	guard := h.app.bindAccess[h.addr]
 	h.app.routesMu.RUnlock()
 	if next == nil {
 		http.NotFound(w, req)
 		return
 	}
+	w, ok := h.app.admit(w, req, guard)
+	if !ok {
+		return
+	}
 	next.ServeHTTP(w, req)
 }
 
 func (a *App) prepareHandlers(ctx context.Context) error {
 	for _, name := range proxyruntime.SortedNames(a.entries) {
 		entry := a.entries[name]
+		started, err := startEntry(ctx, entry)
+		if err != nil {
+			a.stopHandlers()
+			return err
+		}
+		if started {
+			a.handlers = append(a.handlers, entry.Runtime)
+		}
+	}
+	a.pathHandlers, a.pathPrefixes, a.bindHandlers = a.buildRoutes(a.entries)
+	a.pathAccess, a.bindAccess = routeAccess(a.entries, a.access, a.networks, a.limits, a.releaseAges)
+	return nil
+}
+
+func startEntry(ctx context.Context, entry *proxyruntime.Entry) (bool, error) {
+	if !entry.Enabled || entry.Runtime == nil {
+		return false, nil
+	}
+	entryCtx, entryCancel := context.WithCancel(ctx)
+	entry.Ctx = entryCtx
+	entry.Cancel = entryCancel
+	if err := entry.Runtime.Start(entryCtx); err != nil {
+		entryCancel()
+		return false, fmt.Errorf("instance %s: %w", entry.Name, err)
+	}
+	return true, nil
+}
+
+func (a *App) buildRoutes(entries map[string]*proxyruntime.Entry) (map[string]http.Handler, []string, map[string]http.Handler) {
+	pathHandlers := map[string]http.Handler{}
+	bindHandlers := map[string]http.Handler{}
+	var pathPrefixes []string
+	for _, name := range proxyruntime.SortedNames(entries) {
+		entry := entries[name]
 		if !entry.Enabled || entry.Runtime == nil {
 			continue
 		}
-		entryCtx, entryCancel := context.WithCancel(ctx)
-		entry.Ctx = entryCtx
-		entry.Cancel = entryCancel
-		if err := entry.Runtime.Start(entryCtx); err != nil {
-			entryCancel()
-			a.stopHandlers()
-			return fmt.Errorf("instance %s: %w", entry.Name, err)
-		}
-		a.handlers = append(a.handlers, entry.Runtime)
 		if entry.Path != "" {
-			a.pathHandlers[entry.Path] = entry.Runtime
-			a.pathPrefixes = append(a.pathPrefixes, entry.Path)
+			pathHandlers[entry.Path] = accessLogHandler{app: a, entry: entry, next: entry.Runtime}
+			pathPrefixes = append(pathPrefixes, entry.Path)
 			continue
 		}
-		a.bindHandlers[entry.Bind] = bindHomeHandler{
+		bindHandlers[entry.Bind] = bindHomeHandler{
 			app:   a,
 			entry: entry,
-			next:  entry.Runtime,
+			next:  accessLogHandler{app: a, entry: entry, next: entry.Runtime},
 		}
 	}
-	sort.Slice(a.pathPrefixes, func(i, j int) bool {
-		if len(a.pathPrefixes[i]) == len(a.pathPrefixes[j]) {
-			return a.pathPrefixes[i] > a.pathPrefixes[j]
+	sort.Slice(pathPrefixes, func(i, j int) bool {
+		if len(pathPrefixes[i]) == len(pathPrefixes[j]) {
+			return pathPrefixes[i] > pathPrefixes[j]
 		}
-		return len(a.pathPrefixes[i]) > len(a.pathPrefixes[j])
+		return len(pathPrefixes[i]) > len(pathPrefixes[j])
 	})
-	return nil
+	return pathHandlers, pathPrefixes, bindHandlers
+}
+
+// routeGuard combines the CIDR filter, access guard and rate limit of a
+// route. Entry is nil for server pages.
+type routeGuard struct {
+	entry      *proxyruntime.Entry
+	access     *accessGuard
+	networks   *cidrFilter
+	limits     *clientLimiter
+	releaseAge *releaseAgeOverride
+}
+
+// admit reports whether req may use the route and returns the writer to serve
+// it with. CIDR lists are checked before credentials, and the rate limit
+// applies to the authenticated identity when there is one. The release age
+// header is dropped for clients the route does not allowlist, and the
+// identity is passed on in httpcache.IdentityHeader.
+func (a *App) admit(w http.ResponseWriter, req *http.Request, guard routeGuard) (http.ResponseWriter, bool) {
+	if !guard.networks.permits(req) {
+		a.deny(w, req, guard.entry)
+		return nil, false
+	}
+	identity, ok := guard.access.authorize(w, req)
+	if ok {
+		guard.releaseAge.sanitize(req, identity)
+		req.Header.Del(httpcache.IdentityHeader)
+		if identity != "" {
+			req.Header.Set(httpcache.IdentityHeader, identity)
+		}
+	}
+	if !ok || guard.limits == nil {
+		return w, ok
+	}
+	key := guard.limits.clientKey(req, identity)
+	if wait := guard.limits.allow(key); wait > 0 {
+		a.throttle(w, req, guard.entry, wait)
+		return nil, false
+	}
+	return guard.limits.shape(w, req, key), true
+}
+
+// routeAccess maps each route of entries to its instance guards.
+func routeAccess(entries map[string]*proxyruntime.Entry, guards accessGuards, networks clientNetworks, limits rateLimits, releaseAges releaseAgeOverrides) (map[string]routeGuard, map[string]routeGuard) {
+	pathAccess := map[string]routeGuard{}
+	bindAccess := map[string]routeGuard{}
+	for name, entry := range entries {
+		if !entry.Enabled || entry.Runtime == nil {
+			continue
+		}
+		guard := routeGuard{
+			entry:      entry,
+			access:     guards.instances[name],
+			networks:   networks.instances[name],
+			limits:     limits[name],
+			releaseAge: releaseAges[name],
+		}
+		if entry.Path != "" {
+			pathAccess[entry.Path] = guard
+			continue
+		}
+		bindAccess[entry.Bind] = guard
+	}
+	return pathAccess, bindAccess
+}
+
+// serverRoute reports whether req targets a server-wide page guarded by
+// server.access. The metrics endpoint keeps its own token when one is set.
+func (a *App) serverRoute(req *http.Request) bool {
+	switch {
+	case req.URL.Path == "/", strings.HasPrefix(req.URL.Path, statusAPIPath):
+		return true
+	case req.URL.Path == a.config.Metrics.Path:
+		return a.config.Metrics.Token == ""
+	}
+	return false
 }
 
 func (a *App) stopHandlers() {
@@ -459,7 +692,7 @@ func (a *App) matchProxyPrefix(target string) string {
 	return ""
 }
 
-func metricsAuthMiddleware(token string, next http.Handler) http.HandlerFunc {
+func bearerAuthMiddleware(token string, next http.Handler) http.HandlerFunc {
 	if token == "" {
 		return next.ServeHTTP
 	}
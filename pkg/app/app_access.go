@@ -0,0 +1,224 @@
+package app
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"gopkg.d7z.net/cache-proxy/pkg/config"
+)
+
+const accessRealm = "cache-proxy"
+
+// accessGuard enforces an access block. A nil guard allows every request.
+type accessGuard struct {
+	mode          string
+	tokens        [][sha256.Size]byte
+	users         map[string][]byte
+	anonymousRead bool
+
+	// verified caches successful bcrypt checks; bcrypt is too slow to run
+	// on every request of a package download.
+	verified sync.Map
+}
+
+// accessGuards holds the server guard and the effective guard per instance.
+type accessGuards struct {
+	server    *accessGuard
+	instances map[string]*accessGuard
+}
+
+func newAccessGuards(doc *config.Document) (accessGuards, error) {
+	server, err := newAccessGuard(doc.Server.Access, "")
+	if err != nil {
+		return accessGuards{}, fmt.Errorf("server access: %w", err)
+	}
+	guards := accessGuards{server: server, instances: map[string]*accessGuard{}}
+	for _, decl := range doc.Instances {
+		name := strings.TrimSpace(decl.Name)
+		cfg := doc.Server.Access
+		if decl.Access != nil {
+			cfg = *decl.Access
+		}
+		mode := ""
+		if selected, err := decl.SelectMode(); err == nil {
+			mode = selected.Mode
+		}
+		guard, err := newAccessGuard(cfg, mode)
+		if err != nil {
+			return accessGuards{}, fmt.Errorf("instance %s access: %w", name, err)
+		}
+		guards.instances[name] = guard
+	}
+	return guards, nil
+}
+
+func newAccessGuard(cfg config.AccessConfig, mode string) (*accessGuard, error) {
+	if len(cfg.Tokens) == 0 && strings.TrimSpace(cfg.Htpasswd) == "" {
+		return nil, nil
+	}
+	guard := &accessGuard{mode: mode, anonymousRead: cfg.AnonymousRead}
+	for i, token := range cfg.Tokens {
+		if strings.TrimSpace(token) == "" {
+			return nil, fmt.Errorf("token %d is empty", i)
+		}
+		guard.tokens = append(guard.tokens, sha256.Sum256([]byte(token)))
+	}
+	if path := strings.TrimSpace(cfg.Htpasswd); path != "" {
+		users, err := loadHtpasswd(path)
+		if err != nil {
+			return nil, err
+		}
+		guard.users = users
+	}
+	return guard, nil
+}
+
+// loadHtpasswd reads user:hash lines. Only bcrypt hashes are accepted.
+func loadHtpasswd(path string) (map[string][]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("htpasswd: %w", err)
+	}
+	defer func() { _ = file.Close() }()
+	users := map[string][]byte{}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(text, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("htpasswd %s line %d: expected user:hash", path, line)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("htpasswd %s line %d: user %s: only bcrypt hashes are supported", path, line, user)
+		}
+		users[user] = []byte(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("htpasswd %s: %w", path, err)
+	}
+	return users, nil
+}
+
+// authorize reports whether req may proceed, writing the challenge otherwise,
+// and returns the authenticated identity. Accepted credentials are removed so
+// they are never passed upstream.
+func (g *accessGuard) authorize(w http.ResponseWriter, req *http.Request) (string, bool) {
+	if g == nil {
+		return "", true
+	}
+	auth := req.Header.Get("Authorization")
+	if auth == "" && g.anonymousRead && readRequest(req) {
+		return "", true
+	}
+	if auth != "" {
+		if identity, ok := g.authenticate(auth); ok {
+			req.Header.Del("Authorization")
+			return identity, true
+		}
+	}
+	g.challenge(w)
+	return "", false
+}
+
+// readRequest reports whether req only reads from the proxy. Git fetches use
+// POST to git-upload-pack.
+func readRequest(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	case http.MethodPost:
+		return strings.HasSuffix(req.URL.Path, "/git-upload-pack")
+	}
+	return false
+}
+
+// authenticate accepts a bearer token, basic credentials checked against the
+// htpasswd users or a token given as password, and a bare token as sent by
+// cargo. The identity is the htpasswd user or the token's position.
+func (g *accessGuard) authenticate(auth string) (string, bool) {
+	scheme, value, _ := strings.Cut(auth, " ")
+	switch strings.ToLower(scheme) {
+	case "bearer":
+		return g.validToken(strings.TrimSpace(value))
+	case "basic":
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil {
+			return "", false
+		}
+		user, password, ok := strings.Cut(string(decoded), ":")
+		if !ok {
+			return "", false
+		}
+		if g.validUser(user, password) {
+			return "user:" + user, true
+		}
+		return g.validToken(password)
+	default:
+		return g.validToken(strings.TrimSpace(auth))
+	}
+}
+
+func (g *accessGuard) validToken(token string) (string, bool) {
+	if token == "" {
+		return "", false
+	}
+	actual := sha256.Sum256([]byte(token))
+	match := -1
+	for i, expected := range g.tokens {
+		if hmac.Equal(expected[:], actual[:]) {
+			match = i
+		}
+	}
+	if match < 0 {
+		return "", false
+	}
+	return fmt.Sprintf("token:%d", match), true
+}
+
+func (g *accessGuard) validUser(user, password string) bool {
+	hash, ok := g.users[user]
+	if !ok {
+		return false
+	}
+	key := sha256.Sum256([]byte(user + "\x00" + password))
+	if _, ok := g.verified.Load(key); ok {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return false
+	}
+	g.verified.Store(key, struct{}{})
+	return true
+}
+
+// challenge answers 401 in the form the mode's clients understand.
+func (g *accessGuard) challenge(w http.ResponseWriter) {
+	switch g.mode {
+	case config.ModeOCI:
+		w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", accessRealm))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte(`{"errors":[{"code":"UNAUTHORIZED","message":"authentication required"}]}` + "\n"))
+		return
+	case config.ModeCargo:
+		w.Header().Set("WWW-Authenticate", "Cargo")
+	case config.ModeNPM:
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Bearer realm=%q", accessRealm))
+	default:
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", accessRealm))
+	}
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
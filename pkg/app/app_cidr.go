@@ -0,0 +1,160 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"gopkg.d7z.net/cache-proxy/pkg/config"
+	"gopkg.d7z.net/cache-proxy/pkg/proxy/shared/deny"
+	proxyruntime "gopkg.d7z.net/cache-proxy/pkg/runtime"
+)
+
+// cacheDenied is the cache outcome recorded for requests rejected by a CIDR
+// list or a package deny rule.
+const cacheDenied = deny.Cache
+
+// cidrFilter enforces allow/deny lists against the client address. A nil
+// filter permits every client.
+type cidrFilter struct {
+	allow   []netip.Prefix
+	deny    []netip.Prefix
+	trusted []netip.Prefix
+}
+
+// clientNetworks holds the server filter and the effective filter per
+// instance.
+type clientNetworks struct {
+	server    *cidrFilter
+	instances map[string]*cidrFilter
+}
+
+func newClientNetworks(doc *config.Document) (clientNetworks, error) {
+	trusted, err := parsePrefixes(doc.Server.TrustedProxies)
+	if err != nil {
+		return clientNetworks{}, fmt.Errorf("server trusted_proxies: %w", err)
+	}
+	server, err := newCIDRFilter(doc.Server.AllowCIDRs, doc.Server.DenyCIDRs, trusted)
+	if err != nil {
+		return clientNetworks{}, fmt.Errorf("server %w", err)
+	}
+	networks := clientNetworks{server: server, instances: map[string]*cidrFilter{}}
+	for _, decl := range doc.Instances {
+		name := strings.TrimSpace(decl.Name)
+		allow, deny := doc.Server.AllowCIDRs, doc.Server.DenyCIDRs
+		if decl.AllowCIDRs != nil {
+			allow = decl.AllowCIDRs
+		}
+		if decl.DenyCIDRs != nil {
+			deny = decl.DenyCIDRs
+		}
+		filter, err := newCIDRFilter(allow, deny, trusted)
+		if err != nil {
+			return clientNetworks{}, fmt.Errorf("instance %s %w", name, err)
+		}
+		networks.instances[name] = filter
+	}
+	return networks, nil
+}
+
+func newCIDRFilter(allow, deny []string, trusted []netip.Prefix) (*cidrFilter, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+	filter := &cidrFilter{trusted: trusted}
+	var err error
+	if filter.allow, err = parsePrefixes(allow); err != nil {
+		return nil, fmt.Errorf("allow_cidrs: %w", err)
+	}
+	if filter.deny, err = parsePrefixes(deny); err != nil {
+		return nil, fmt.Errorf("deny_cidrs: %w", err)
+	}
+	return filter, nil
+}
+
+// parsePrefixes parses CIDR prefixes; a bare address matches only itself.
+func parsePrefixes(values []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if !strings.Contains(value, "/") {
+			addr, err := netip.ParseAddr(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %q", value)
+			}
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr %q", value)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// permits reports whether the client of req may proceed. Deny entries win
+// over allow entries; with an allow list only matching clients pass.
+func (f *cidrFilter) permits(req *http.Request) bool {
+	if f == nil {
+		return true
+	}
+	addr := clientAddr(req, f.trusted)
+	if containsAddr(f.deny, addr) {
+		return false
+	}
+	return len(f.allow) == 0 || containsAddr(f.allow, addr)
+}
+
+// clientAddr returns the peer address or, when the peer is a trusted proxy,
+// the right-most X-Forwarded-For address that is not a trusted proxy.
+func clientAddr(req *http.Request, trusted []netip.Prefix) netip.Addr {
+	addr := parseRemoteAddr(req.RemoteAddr)
+	if !containsAddr(trusted, addr) {
+		return addr
+	}
+	var hops []string
+	for _, value := range req.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			return netip.Addr{}
+		}
+		addr = hop.Unmap()
+		if !containsAddr(trusted, addr) {
+			return addr
+		}
+	}
+	return addr
+}
+
+func parseRemoteAddr(remote string) netip.Addr {
+	if addrPort, err := netip.ParseAddrPort(remote); err == nil {
+		return addrPort.Addr().Unmap()
+	}
+	addr, _ := netip.ParseAddr(remote)
+	return addr.Unmap()
+}
+
+// deny answers 403 and records the denial for instance routes.
+func (a *App) deny(w http.ResponseWriter, req *http.Request, entry *proxyruntime.Entry) {
+	if entry != nil {
+		a.stats.RecordRequest(entry.Name, entry.Mode, req.Method, cacheDenied, http.StatusForbidden, 0)
+	}
+	w.Header().Set("X-Cache", cacheDenied)
+	http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+}
@@ -14,6 +14,7 @@ import (
 
 	"gopkg.d7z.net/cache-proxy/pkg/proxy/shared/httpcache"
 	proxyruntime "gopkg.d7z.net/cache-proxy/pkg/runtime"
+	"gopkg.d7z.net/cache-proxy/pkg/utils"
 )
 
 type homeRepositoryAttribute struct {
@@ -52,6 +53,7 @@ type homeInstance struct {
 	SetupCopy        string
 	Requests         string
 	HitRate          string
+	Denied           string
 	DiskUsage        string
 	StatusColor      string
 	StatusLabel      string
@@ -154,6 +156,9 @@ func buildHomeInstance(entry *proxyruntime.Entry, baseURL string, req *http.Requ
 	}
 	hi.Requests = formatCompact(s.Requests)
 	hi.HitRate = formatHitRate(s.Cache)
+	if denied := s.Cache[cacheDenied]; denied > 0 {
+		hi.Denied = formatCompact(denied)
+	}
 	hi.DiskUsage = formatBytes(diskBytes)
 	if src, ok := entry.Runtime.(proxyruntime.StatusSource); ok {
 		hi.StatusColor, hi.StatusLabel, hi.StatusExtra = src.DashboardStatus()
@@ -224,7 +229,7 @@ func buildHomeRepository(repository proxyruntime.RepositoryStatus, i18n map[stri
 		LastTry:         lastTry,
 		LastTryTitle:    lastTryTitle,
 		Warning:         repository.Warning,
-		LastError:       repository.LastError,
+		LastError:       utils.Redact(repository.LastError),
 		Attributes:      attributes,
 	}
 }
@@ -283,7 +288,11 @@ func instURL(entry *proxyruntime.Entry, baseURL string, req *http.Request) strin
 		if entry.Home.DisplayURL != "" {
 			return entry.Home.DisplayURL
 		}
-		return bindURL(req, entry.Bind)
+		url := bindURL(req, entry.Bind)
+		if _, rest, ok := strings.Cut(url, "://"); ok && entry.TLS != nil {
+			url = "https://" + rest
+		}
+		return url
 	}
 	return baseURL + entry.Path
 }
@@ -28,11 +28,13 @@ func cacheHitRate(cache map[string]uint64) (float64, bool) {
 	var total uint64
 	var hits uint64
 	for cacheResult, count := range cache {
-		total += count
 		switch strings.ToUpper(cacheResult) {
+		case cacheDenied, cacheThrottled:
+			continue
 		case "HIT", "FRESH", "REFRESH", "STALE", "GENERATION":
 			hits += count
 		}
+		total += count
 	}
 	if total == 0 {
 		return 0, false
@@ -9,6 +9,7 @@ import (
 
 	"gopkg.d7z.net/blobfs"
 
+	"gopkg.d7z.net/cache-proxy/pkg/accesslog"
 	"gopkg.d7z.net/cache-proxy/pkg/bus"
 	"gopkg.d7z.net/cache-proxy/pkg/config"
 	"gopkg.d7z.net/cache-proxy/pkg/health"
@@ -23,6 +24,8 @@ const DefaultMaxActiveDownloadsPerInstance = 64
 const DefaultStatusDiskSampleInterval = 15 * time.Minute
 const DefaultStatusDiskHistoryWindow = 24 * time.Hour
 const DefaultStatusEventLimit = 500
+const DefaultQuotaLowWater = 90
+const DefaultQuotaInterval = 10 * time.Minute
 
 var driverSet = builtinDrivers
 
@@ -111,6 +114,12 @@ func normalizeDocument(doc *config.Document) {
 	if doc.Storage.Download.MaxActivePerInstance <= 0 {
 		doc.Storage.Download.MaxActivePerInstance = DefaultMaxActiveDownloadsPerInstance
 	}
+	if doc.Storage.Quota.LowWater == 0 {
+		doc.Storage.Quota.LowWater = DefaultQuotaLowWater
+	}
+	if doc.Storage.Quota.Interval <= 0 {
+		doc.Storage.Quota.Interval = config.Duration(DefaultQuotaInterval)
+	}
 }
 
 func validateServerConfig(doc *config.Document) error {
@@ -135,6 +144,12 @@ func validateServerConfig(doc *config.Document) error {
 	if doc.Server.Status.EventLimit <= 0 {
 		return errors.New("server status event_limit must be positive")
 	}
+	if doc.Storage.Quota.LowWater <= 0 || doc.Storage.Quota.LowWater >= 100 {
+		return errors.New("storage quota low_water must be between 1 and 99")
+	}
+	if err := accesslog.Validate(doc.Server.AccessLog); err != nil {
+		return fmt.Errorf("server %w", err)
+	}
 	return nil
 }
 
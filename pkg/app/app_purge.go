@@ -0,0 +1,183 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/bmatcuk/doublestar/v4"
+
+	proxyruntime "gopkg.d7z.net/cache-proxy/pkg/runtime"
+)
+
+const adminAPIPath = "/-/admin/"
+
+type purgeRequest struct {
+	Instance string `json:"instance"`
+	Path     string `json:"path,omitempty"`
+	Glob     string `json:"glob,omitempty"`
+	DryRun   bool   `json:"dry_run,omitempty"`
+}
+
+type purgedObject struct {
+	Path   string `json:"path"`
+	Object string `json:"object"`
+	Size   int64  `json:"size"`
+}
+
+type purgeResult struct {
+	Instance  string         `json:"instance"`
+	DryRun    bool           `json:"dry_run"`
+	Objects   []purgedObject `json:"objects"`
+	Purged    int            `json:"purged"`
+	Failed    int            `json:"failed,omitempty"`
+	Reclaimed int64          `json:"reclaimed_bytes"`
+}
+
+func (a *App) serveAdmin(w http.ResponseWriter, req *http.Request) {
+	a.routesMu.RLock()
+	token := a.config.Server.Admin.Token
+	a.routesMu.RUnlock()
+	if token == "" {
+		http.NotFound(w, req)
+		return
+	}
+	switch {
+	case req.URL.Path == "/-/admin/purge":
+		bearerAuthMiddleware(token, http.HandlerFunc(a.servePurge)).ServeHTTP(w, req)
+	case req.URL.Path == warmAPIPath || strings.HasPrefix(req.URL.Path, warmAPIPath+"/"):
+		bearerAuthMiddleware(token, http.HandlerFunc(a.serveWarm)).ServeHTTP(w, req)
+	case req.URL.Path == "/-/admin/reload":
+		bearerAuthMiddleware(token, http.HandlerFunc(a.serveReload)).ServeHTTP(w, req)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (a *App) servePurge(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	var body purgeRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 1<<20)).Decode(&body); err != nil {
+		writeStatusError(w, req, http.StatusBadRequest, fmt.Errorf("invalid purge request: %w", err))
+		return
+	}
+	entry := a.entry(body.Instance)
+	if entry == nil {
+		writeStatusError(w, req, http.StatusNotFound, fmt.Errorf("unknown instance %q", body.Instance))
+		return
+	}
+	match, target, err := purgeMatcher(body)
+	if err != nil {
+		writeStatusError(w, req, http.StatusBadRequest, err)
+		return
+	}
+
+	startedAt := time.Now()
+	result, err := a.purge(req, entry, match, body.DryRun)
+	finishedAt := time.Now()
+	if err != nil {
+		writeStatusError(w, req, http.StatusInternalServerError, err)
+		return
+	}
+	event := taskEvent{
+		Storage:    entry.Name,
+		TaskType:   "purge",
+		Target:     target,
+		StartedAt:  startedAt.Format(time.RFC3339),
+		FinishedAt: finishedAt.Format(time.RFC3339),
+		DurationMS: finishedAt.Sub(startedAt).Milliseconds(),
+		Result:     "unchanged",
+		ReasonCode: "no_match",
+		Detail:     fmt.Sprintf("matched=%d failed=%d", len(result.Objects), result.Failed),
+		Reclaimed:  result.Reclaimed,
+	}
+	if len(result.Objects) > 0 {
+		event.Result = "updated"
+		event.ReasonCode = "purged"
+		if body.DryRun {
+			event.ReasonCode = "dry_run"
+		}
+	}
+	if a.status != nil {
+		a.status.appendEvent(event)
+	}
+	writeStatusJSON(w, req, result)
+}
+
+// purgeMatcher returns a predicate over request paths for an exact path or a
+// doublestar glob, plus the target recorded in the purge event.
+func purgeMatcher(body purgeRequest) (func(string) bool, string, error) {
+	switch {
+	case body.Path != "" && body.Glob != "":
+		return nil, "", errors.New("path and glob are mutually exclusive")
+	case body.Path != "":
+		cleanPath := strings.TrimPrefix(path.Clean("/"+body.Path), "/")
+		if cleanPath == "" || cleanPath == "." {
+			return nil, "", errors.New("path is required")
+		}
+		return func(candidate string) bool { return candidate == cleanPath }, cleanPath, nil
+	case body.Glob != "":
+		pattern := strings.TrimPrefix(body.Glob, "/")
+		if !doublestar.ValidatePattern(pattern) {
+			return nil, "", fmt.Errorf("invalid glob %q", body.Glob)
+		}
+		return func(candidate string) bool { return doublestar.MatchUnvalidated(pattern, candidate) }, pattern, nil
+	default:
+		return nil, "", errors.New("path or glob is required")
+	}
+}
+
+func (a *App) purge(req *http.Request, entry *proxyruntime.Entry, match func(string) bool, dryRun bool) (purgeResult, error) {
+	ctx := req.Context()
+	result := purgeResult{Instance: entry.Name, DryRun: dryRun, Objects: []purgedObject{}}
+	mapper, _ := entry.Runtime.(proxyruntime.PurgeMapper)
+	err := fs.WalkDir(a.store.TenantFS(entry.Name), ".", func(objectPath string, item fs.DirEntry, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil || item.IsDir() {
+			return nil
+		}
+		requestPath := objectPath
+		if mapper != nil {
+			mapped, ok := mapper.PurgePath(objectPath)
+			if !ok {
+				return nil
+			}
+			requestPath = mapped
+		}
+		if !match(requestPath) && !match(objectPath) {
+			return nil
+		}
+		info, infoErr := item.Info()
+		if infoErr != nil {
+			return nil
+		}
+		if !dryRun {
+			if err := a.store.DeleteObject(ctx, entry.Name, objectPath); err != nil {
+				slog.Warn("purge object failed", "instance", entry.Name, "path", objectPath, "err", err)
+				result.Failed++
+				return nil
+			}
+			a.stats.Access().Forget(entry.Name, objectPath)
+		}
+		result.Objects = append(result.Objects, purgedObject{Path: requestPath, Object: objectPath, Size: info.Size()})
+		result.Purged++
+		result.Reclaimed += info.Size()
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return result, err
+	}
+	return result, nil
+}
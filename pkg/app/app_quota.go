@@ -0,0 +1,90 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"gopkg.d7z.net/cache-proxy/pkg/config"
+	"gopkg.d7z.net/cache-proxy/pkg/proxy/shared/httpcache"
+	proxyruntime "gopkg.d7z.net/cache-proxy/pkg/runtime"
+	"gopkg.d7z.net/cache-proxy/pkg/scheduler"
+)
+
+// accessIndexPath is where the registry tenant keeps the times cached objects
+// were last served, so eviction order survives restarts.
+const accessIndexPath = "access.json"
+
+func (a *App) registerQuotaTasks() {
+	storage := a.config.Storage
+	interval := storage.Quota.Interval.Duration()
+	for _, name := range proxyruntime.SortedNames(a.entries) {
+		entry := a.entries[name]
+		if entry.Quota <= 0 {
+			continue
+		}
+		tenants := []string{entry.Name}
+		a.scheduler.Register(scheduler.TaskDef{
+			Key:      scheduler.NewTaskKey(entry.Name, scheduler.TypeQuotaEvict, ""),
+			Interval: interval,
+			Handler: func(ctx context.Context) (*scheduler.TaskOutcome, error) {
+				return a.evictQuota(ctx, storage, tenants, entry.Quota)
+			},
+		})
+	}
+	systemKey := scheduler.NewTaskKey("_system", scheduler.TypeQuotaEvict, "")
+	if storage.Quota.Limit <= 0 {
+		a.scheduler.Unregister(systemKey)
+		return
+	}
+	tenants := proxyruntime.SortedNames(a.entries)
+	a.scheduler.Register(scheduler.TaskDef{
+		Key:      systemKey,
+		Interval: interval,
+		Handler: func(ctx context.Context) (*scheduler.TaskOutcome, error) {
+			return a.evictQuota(ctx, storage, tenants, storage.Quota.Limit)
+		},
+	})
+}
+
+func (a *App) evictQuota(ctx context.Context, storage config.StorageConfig, tenants []string, limit config.Size) (*scheduler.TaskOutcome, error) {
+	target := limit.Bytes() / 100 * int64(storage.Quota.LowWater)
+	evictors := map[string]httpcache.UnitEvictor{}
+	for _, tenant := range tenants {
+		if entry := a.entry(tenant); entry != nil {
+			if evictor, ok := entry.Runtime.(httpcache.UnitEvictor); ok {
+				evictors[tenant] = evictor
+			}
+		}
+	}
+	result, err := httpcache.EvictStoreTenants(ctx, a.store, a.stats.Access(), tenants, evictors, limit.Bytes(), target, storage.Cleanup)
+	a.saveAccessIndex(ctx)
+	if err != nil {
+		return nil, err
+	}
+	outcome := &scheduler.TaskOutcome{
+		Result:         "unchanged",
+		ReasonCode:     "within_quota",
+		Detail:         fmt.Sprintf("usage=%d limit=%d", result.Usage, limit.Bytes()),
+		ReclaimedBytes: result.ReclaimedBytes,
+	}
+	if result.Evicted > 0 {
+		outcome.Result = "updated"
+		outcome.ReasonCode = "evicted"
+		if storage.Cleanup.DryRun {
+			outcome.ReasonCode = "dry_run"
+		}
+		outcome.Detail = fmt.Sprintf("usage=%d limit=%d evicted=%d", result.Usage, limit.Bytes(), result.Evicted)
+	}
+	return outcome, nil
+}
+
+func (a *App) saveAccessIndex(ctx context.Context) {
+	if err := a.store.MkdirAll(registryTenant+"/", 0o755); err != nil {
+		slog.Warn("failed to prepare registry tenant", "err", err)
+		return
+	}
+	if err := a.stats.Access().Save(ctx, a.store, registryTenant, accessIndexPath); err != nil {
+		slog.Warn("failed to save access index", "err", err)
+	}
+}
@@ -0,0 +1,242 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.d7z.net/cache-proxy/pkg/config"
+	proxyruntime "gopkg.d7z.net/cache-proxy/pkg/runtime"
+)
+
+// cacheThrottled is the cache outcome recorded for requests rejected by a
+// rate limit.
+const cacheThrottled = "THROTTLED"
+
+// rateLimitIdle is how long an untouched bucket is kept before it is pruned.
+const rateLimitIdle = 10 * time.Minute
+
+// tokenBucket refills at rate tokens per second up to capacity.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take removes n tokens and returns how long the caller must wait for the
+// bucket to cover them. The bucket may go negative so waiting writers are
+// served in order.
+func (b *tokenBucket) take(now time.Time, rate, capacity, n float64) time.Duration {
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / rate * float64(time.Second))
+}
+
+// clientLimiter enforces a rate_limit block per client. A nil limiter
+// imposes no limit.
+type clientLimiter struct {
+	cfg     config.RateLimitConfig
+	trusted []netip.Prefix
+
+	mu       sync.Mutex
+	requests map[string]*tokenBucket
+	bytes    map[string]*tokenBucket
+	pruned   time.Time
+}
+
+// rateLimits holds the effective limiter per instance.
+type rateLimits map[string]*clientLimiter
+
+// newRateLimits builds the limiter of every instance. Limiters whose settings
+// did not change are taken over from previous so reloads keep their state.
+func newRateLimits(doc *config.Document, previous rateLimits) (rateLimits, error) {
+	trusted, err := parsePrefixes(doc.Server.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("server trusted_proxies: %w", err)
+	}
+	if err := validateRateLimit(doc.Server.RateLimit); err != nil {
+		return nil, fmt.Errorf("server rate_limit: %w", err)
+	}
+	limits := rateLimits{}
+	for _, decl := range doc.Instances {
+		name := strings.TrimSpace(decl.Name)
+		cfg := doc.Server.RateLimit
+		if decl.RateLimit != nil {
+			cfg = *decl.RateLimit
+		}
+		if err := validateRateLimit(cfg); err != nil {
+			return nil, fmt.Errorf("instance %s rate_limit: %w", name, err)
+		}
+		if cfg.RequestsPerSecond == 0 && cfg.BytesPerSecond == 0 {
+			continue
+		}
+		if old := previous[name]; old != nil && old.cfg == cfg && equalPrefixes(old.trusted, trusted) {
+			limits[name] = old
+			continue
+		}
+		limits[name] = &clientLimiter{
+			cfg:      cfg,
+			trusted:  trusted,
+			requests: map[string]*tokenBucket{},
+			bytes:    map[string]*tokenBucket{},
+		}
+	}
+	return limits, nil
+}
+
+func validateRateLimit(cfg config.RateLimitConfig) error {
+	switch {
+	case cfg.RequestsPerSecond < 0:
+		return errors.New("requests_per_second must not be negative")
+	case cfg.Burst < 0:
+		return errors.New("burst must not be negative")
+	case cfg.BytesPerSecond < 0:
+		return errors.New("bytes_per_second must not be negative")
+	}
+	return nil
+}
+
+func equalPrefixes(a, b []netip.Prefix) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// clientKey identifies the client of req: its authenticated identity or,
+// without one, its address.
+func (l *clientLimiter) clientKey(req *http.Request, identity string) string {
+	if identity != "" {
+		return identity
+	}
+	return "addr:" + clientAddr(req, l.trusted).String()
+}
+
+func (l *clientLimiter) burst() float64 {
+	if l.cfg.Burst > 0 {
+		return float64(l.cfg.Burst)
+	}
+	return math.Max(1, math.Ceil(l.cfg.RequestsPerSecond))
+}
+
+// allow takes one request token for key and returns the wait until the next
+// request would be admitted when none is left.
+func (l *clientLimiter) allow(key string) time.Duration {
+	if l == nil || l.cfg.RequestsPerSecond == 0 {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.prune(now)
+	bucket := l.requests[key]
+	if bucket == nil {
+		bucket = &tokenBucket{tokens: l.burst(), last: now}
+		l.requests[key] = bucket
+	}
+	wait := bucket.take(now, l.cfg.RequestsPerSecond, l.burst(), 1)
+	if wait > 0 {
+		// Rejected requests do not consume tokens.
+		bucket.tokens++
+	}
+	return wait
+}
+
+// reserve takes n byte tokens for key and returns how long to wait first.
+func (l *clientLimiter) reserve(key string, n int) time.Duration {
+	rate := float64(l.cfg.BytesPerSecond)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.prune(now)
+	bucket := l.bytes[key]
+	if bucket == nil {
+		bucket = &tokenBucket{tokens: rate, last: now}
+		l.bytes[key] = bucket
+	}
+	return bucket.take(now, rate, rate, float64(n))
+}
+
+// prune drops buckets that have been idle long enough to be full again.
+func (l *clientLimiter) prune(now time.Time) {
+	if now.Sub(l.pruned) < time.Minute {
+		return
+	}
+	l.pruned = now
+	for _, buckets := range []map[string]*tokenBucket{l.requests, l.bytes} {
+		for key, bucket := range buckets {
+			if now.Sub(bucket.last) > rateLimitIdle {
+				delete(buckets, key)
+			}
+		}
+	}
+}
+
+// shape wraps w so response bodies are paced to bytes_per_second.
+func (l *clientLimiter) shape(w http.ResponseWriter, req *http.Request, key string) http.ResponseWriter {
+	if l == nil || l.cfg.BytesPerSecond == 0 {
+		return w
+	}
+	return &shapedWriter{ResponseWriter: w, req: req, limiter: l, key: key}
+}
+
+type shapedWriter struct {
+	http.ResponseWriter
+	req     *http.Request
+	limiter *clientLimiter
+	key     string
+}
+
+func (w *shapedWriter) Write(p []byte) (int, error) {
+	chunk := int(max(1, w.limiter.cfg.BytesPerSecond.Bytes()/10))
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), chunk)
+		if wait := w.limiter.reserve(w.key, n); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-w.req.Context().Done():
+				timer.Stop()
+				return written, w.req.Context().Err()
+			case <-timer.C:
+			}
+		}
+		m, err := w.ResponseWriter.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (w *shapedWriter) Flush() {
+	_ = http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *shapedWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// throttle answers 429 and records the rejection.
+func (a *App) throttle(w http.ResponseWriter, req *http.Request, entry *proxyruntime.Entry, wait time.Duration) {
+	a.stats.RecordRequest(entry.Name, entry.Mode, req.Method, cacheThrottled, http.StatusTooManyRequests, 0)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	w.Header().Set("X-Cache", cacheThrottled)
+	http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+}
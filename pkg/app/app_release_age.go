@@ -0,0 +1,73 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"gopkg.d7z.net/cache-proxy/pkg/config"
+	"gopkg.d7z.net/cache-proxy/pkg/proxy/shared/httpcache"
+)
+
+// releaseAgeOverrides holds the release age override per instance.
+type releaseAgeOverrides map[string]*releaseAgeOverride
+
+// newReleaseAgeOverrides builds the override of every instance.
+func newReleaseAgeOverrides(doc *config.Document) (releaseAgeOverrides, error) {
+	trusted, err := parsePrefixes(doc.Server.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("server trusted_proxies: %w", err)
+	}
+	overrides := releaseAgeOverrides{}
+	for _, decl := range doc.Instances {
+		name := strings.TrimSpace(decl.Name)
+		override, err := newReleaseAgeOverride(decl.ReleaseAgeOverride, trusted)
+		if err != nil {
+			return nil, fmt.Errorf("instance %s release_age_override: %w", name, err)
+		}
+		overrides[name] = override
+	}
+	return overrides, nil
+}
+
+// releaseAgeOverride lists the client networks and htpasswd users that may
+// send httpcache.ReleaseAgeHeader. A nil override admits nobody.
+type releaseAgeOverride struct {
+	networks   []netip.Prefix
+	identities map[string]bool
+	trusted    []netip.Prefix
+}
+
+// newReleaseAgeOverride sorts entries into addresses or CIDRs and user names.
+func newReleaseAgeOverride(entries []string, trusted []netip.Prefix) (*releaseAgeOverride, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	override := &releaseAgeOverride{identities: map[string]bool{}, trusted: trusted}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if _, err := netip.ParseAddr(entry); err != nil && !strings.Contains(entry, "/") {
+			override.identities["user:"+entry] = true
+			continue
+		}
+		prefixes, err := parsePrefixes([]string{entry})
+		if err != nil {
+			return nil, err
+		}
+		override.networks = append(override.networks, prefixes...)
+	}
+	return override, nil
+}
+
+// sanitize drops the release age header unless the client of req is
+// allowlisted.
+func (o *releaseAgeOverride) sanitize(req *http.Request, identity string) {
+	if req.Header.Get(httpcache.ReleaseAgeHeader) == "" {
+		return
+	}
+	if o != nil && ((identity != "" && o.identities[identity]) || containsAddr(o.networks, clientAddr(req, o.trusted))) {
+		return
+	}
+	req.Header.Del(httpcache.ReleaseAgeHeader)
+}
@@ -0,0 +1,365 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"gopkg.d7z.net/cache-proxy/pkg/accesslog"
+	"gopkg.d7z.net/cache-proxy/pkg/bus"
+	"gopkg.d7z.net/cache-proxy/pkg/config"
+	"gopkg.d7z.net/cache-proxy/pkg/health"
+	proxyruntime "gopkg.d7z.net/cache-proxy/pkg/runtime"
+	"gopkg.d7z.net/cache-proxy/pkg/scheduler"
+	"gopkg.d7z.net/cache-proxy/pkg/utils"
+)
+
+type reloadDiff struct {
+	added   []string
+	removed []string
+	changed []string
+	planned []config.Instance
+}
+
+func (d reloadDiff) replaced() []string {
+	return append(append([]string(nil), d.removed...), d.changed...)
+}
+
+// Reload re-reads the config file and applies it without a restart.
+func (a *App) Reload(ctx context.Context) error {
+	if a.configPath == "" {
+		return errors.New("reload requires a config file")
+	}
+	doc, err := config.LoadFile(a.configPath)
+	if err != nil {
+		return err
+	}
+	return a.ReloadDocument(ctx, doc)
+}
+
+// ReloadDocument applies doc to the running app. Added instances are started,
+// removed ones drained, and changed ones swapped atomically; unchanged
+// instances keep serving untouched. Any error before the swap leaves the old
+// config running; a changed instance that fails to start after its
+// predecessor stopped is reported once the new config is in place.
+func (a *App) ReloadDocument(ctx context.Context, doc *config.Document) error {
+	if doc == nil {
+		return errors.New("config document is nil")
+	}
+	a.lifecycleMu.Lock()
+	defer a.lifecycleMu.Unlock()
+	if a.closed.Load() {
+		return errors.New("app is closed")
+	}
+	// Both documents' secrets are redacted while doc is applied; afterwards
+	// only those of the document left running are.
+	utils.SetSecrets(append(a.config.Secrets(), doc.Secrets()...))
+	defer func() { utils.SetSecrets(a.config.Secrets()) }()
+	normalizeDocument(doc)
+	if err := validateServerConfig(doc); err != nil {
+		return err
+	}
+	old := a.config
+	if doc.Server.Bind != old.Server.Bind || doc.Server.Backend != old.Server.Backend {
+		return errors.New("changing server.bind or server.backend requires a restart")
+	}
+	if err := Validate(doc); err != nil {
+		return err
+	}
+	access, err := newAccessGuards(doc)
+	if err != nil {
+		return err
+	}
+	networks, err := newClientNetworks(doc)
+	if err != nil {
+		return err
+	}
+	limits, err := newRateLimits(doc, a.limits)
+	if err != nil {
+		return err
+	}
+	releaseAges, err := newReleaseAgeOverrides(doc)
+	if err != nil {
+		return err
+	}
+	// Status buffers are sized at startup.
+	doc.Server.Status = old.Server.Status
+
+	diff, err := diffInstances(old, doc)
+	if err != nil {
+		return err
+	}
+	staging := scheduler.New(bus.New(), nil, nil)
+	probes := health.NewStagedProbeScheduler()
+	subset := *doc
+	subset.Instances = diff.planned
+	planned, err := planEntries(ctx, &subset, a.store, a.stats, a.downloads, staging, probes, a.bus)
+	if err != nil {
+		return err
+	}
+	defs, factories := staging.Pending()
+
+	entries := make(map[string]*proxyruntime.Entry, len(a.entries))
+	for name, entry := range a.entries {
+		entries[name] = entry
+	}
+	for _, name := range diff.replaced() {
+		delete(entries, name)
+	}
+	for name, entry := range planned {
+		entries[name] = entry
+	}
+	pathHandlers, pathPrefixes, bindHandlers := a.buildRoutes(entries)
+	pathAccess, bindAccess := routeAccess(entries, access, networks, limits, releaseAges)
+	tlsReloaders, err := newTLSReloaders(doc, entries)
+	if err != nil {
+		return err
+	}
+	if a.started {
+		for addr := range a.bindListeners {
+			if _, used := bindHandlers[addr]; used && (a.tls[addr] == nil) != (tlsReloaders[addr] == nil) {
+				return fmt.Errorf("enabling or disabling tls on %s requires a restart", addr)
+			}
+		}
+		if (a.tls[doc.Server.Bind] == nil) != (tlsReloaders[doc.Server.Bind] == nil) {
+			return errors.New("enabling or disabling server tls requires a restart")
+		}
+	}
+
+	listeners := map[string]net.Listener{}
+	closeListeners := func() {
+		for _, item := range listeners {
+			_ = item.Close()
+		}
+	}
+	if a.started {
+		for addr := range bindHandlers {
+			if _, exists := a.bindListeners[addr]; exists {
+				continue
+			}
+			listener, err := net.Listen("tcp", addr)
+			if err != nil {
+				closeListeners()
+				return fmt.Errorf("listen %s: %w", addr, err)
+			}
+			listeners[addr] = listener
+		}
+	}
+
+	accessLog := a.accessLog.Load()
+	if doc.Server.AccessLog != old.Server.AccessLog {
+		if accessLog, err = accesslog.New(doc.Server.AccessLog); err != nil {
+			closeListeners()
+			return fmt.Errorf("access log: %w", err)
+		}
+	}
+
+	// Added instances start before the swap, so a failure still leaves the
+	// old config running. Their probes stay staged until then.
+	var started []*proxyruntime.Entry
+	for _, name := range diff.added {
+		entry := planned[name]
+		if entry == nil {
+			continue
+		}
+		ok, err := startEntry(a.lifecycleCtx, entry)
+		if err != nil {
+			for _, entry := range started {
+				stopEntry(entry)
+			}
+			closeListeners()
+			if accessLog != a.accessLog.Load() {
+				_ = accessLog.Close()
+			}
+			return err
+		}
+		if ok {
+			started = append(started, entry)
+		}
+	}
+
+	replaced := make([]*proxyruntime.Entry, 0, len(diff.removed)+len(diff.changed))
+	for _, name := range diff.replaced() {
+		replaced = append(replaced, a.entries[name])
+	}
+	a.routesMu.Lock()
+	a.config = doc
+	a.entries = entries
+	a.pathHandlers = pathHandlers
+	a.pathPrefixes = pathPrefixes
+	a.bindHandlers = bindHandlers
+	a.access = access
+	a.networks = networks
+	a.limits = limits
+	a.releaseAges = releaseAges
+	a.pathAccess = pathAccess
+	a.bindAccess = bindAccess
+	a.tls = tlsReloaders
+	// Replacements answer 503 until their predecessors drained and they
+	// started.
+	a.starting = make(map[string]struct{}, len(diff.changed))
+	for _, name := range diff.changed {
+		a.starting[name] = struct{}{}
+	}
+	a.handlers = a.handlers[:0]
+	for _, name := range proxyruntime.SortedNames(entries) {
+		if entry := entries[name]; entry.Enabled && entry.Runtime != nil {
+			a.handlers = append(a.handlers, entry.Runtime)
+		}
+	}
+	a.routesMu.Unlock()
+	if previous := a.accessLog.Swap(accessLog); previous != accessLog {
+		_ = previous.Close()
+	}
+
+	for addr, listener := range listeners {
+		a.bindListeners[addr] = listener
+		a.serveBind(addr, listener)
+	}
+	for addr, server := range a.bindServers {
+		if _, used := bindHandlers[addr]; used {
+			continue
+		}
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+		_ = server.Shutdown(shutdownCtx)
+		cancel()
+		delete(a.bindServers, addr)
+		delete(a.bindListeners, addr)
+	}
+
+	// Replaced instances stop, tasks included, before their replacements
+	// start, so two runtimes never run background work on one tenant.
+	for _, name := range diff.replaced() {
+		a.scheduler.UnregisterInstance(name)
+	}
+	for _, entry := range replaced {
+		stopEntry(entry)
+	}
+	a.probes.Adopt(probes)
+	for _, def := range defs {
+		a.scheduler.Register(def)
+	}
+	for _, factory := range factories {
+		a.scheduler.RegisterFactory(factory)
+	}
+	a.registerSystemTasks()
+	a.downloads.Update(doc.Storage.Download.MaxActive, doc.Storage.Download.MaxActivePerInstance)
+	var startErr error
+	for _, name := range diff.changed {
+		if entry := planned[name]; entry != nil {
+			if _, err := startEntry(a.lifecycleCtx, entry); err != nil {
+				slog.Error("replaced instance failed to start", "instance", name, "err", err)
+				startErr = errors.Join(startErr, err)
+				continue
+			}
+		}
+		a.routesMu.Lock()
+		delete(a.starting, name)
+		a.routesMu.Unlock()
+	}
+	saveRegistry(ctx, a.store, doc)
+
+	detail := fmt.Sprintf("added=%d removed=%d changed=%d", len(diff.added), len(diff.removed), len(diff.changed))
+	slog.Info("configuration reloaded",
+		"added", strings.Join(diff.added, ","),
+		"removed", strings.Join(diff.removed, ","),
+		"changed", strings.Join(diff.changed, ","),
+	)
+	if a.status != nil {
+		now := time.Now().Format(time.RFC3339)
+		a.status.appendEvent(taskEvent{
+			Storage:    "_system",
+			TaskType:   "config_reload",
+			Target:     "/",
+			StartedAt:  now,
+			FinishedAt: now,
+			Result:     "updated",
+			Detail:     detail,
+		})
+	}
+	return startErr
+}
+
+func stopEntry(entry *proxyruntime.Entry) {
+	if entry == nil {
+		return
+	}
+	if entry.Runtime != nil && entry.Enabled {
+		ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+		if err := entry.Runtime.Stop(ctx); err != nil {
+			slog.Warn("instance drain failed", "instance", entry.Name, "err", err)
+		}
+		cancel()
+	}
+	if entry.Cancel != nil {
+		entry.Cancel()
+	}
+}
+
+// diffInstances compares instance declarations by name. Changes to settings
+// every driver reads at plan time mark all instances as changed.
+func diffInstances(old, next *config.Document) (reloadDiff, error) {
+	var diff reloadDiff
+	global := old.Storage.Cleanup != next.Storage.Cleanup || old.Metrics.Path != next.Metrics.Path
+	previous := map[string][]byte{}
+	for _, decl := range old.Instances {
+		data, err := yaml.Marshal(decl)
+		if err != nil {
+			return diff, err
+		}
+		previous[strings.TrimSpace(decl.Name)] = data
+	}
+	seen := map[string]struct{}{}
+	for _, decl := range next.Instances {
+		name := strings.TrimSpace(decl.Name)
+		seen[name] = struct{}{}
+		data, err := yaml.Marshal(decl)
+		if err != nil {
+			return diff, err
+		}
+		before, exists := previous[name]
+		switch {
+		case !exists:
+			diff.added = append(diff.added, name)
+		case global || !bytes.Equal(before, data):
+			diff.changed = append(diff.changed, name)
+		default:
+			continue
+		}
+		diff.planned = append(diff.planned, decl)
+	}
+	for _, decl := range old.Instances {
+		name := strings.TrimSpace(decl.Name)
+		if _, ok := seen[name]; !ok {
+			diff.removed = append(diff.removed, name)
+		}
+	}
+	return diff, nil
+}
+
+func (a *App) serveReload(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if err := a.Reload(context.WithoutCancel(req.Context())); err != nil {
+		writeStatusError(w, req, http.StatusUnprocessableEntity, err)
+		return
+	}
+	writeStatusJSON(w, req, map[string]any{"reloaded": true})
+}
+
+func (a *App) entry(name string) *proxyruntime.Entry {
+	a.routesMu.RLock()
+	defer a.routesMu.RUnlock()
+	return a.entries[name]
+}
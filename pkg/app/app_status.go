@@ -17,6 +17,7 @@ import (
 	"gopkg.d7z.net/cache-proxy/pkg/config"
 	"gopkg.d7z.net/cache-proxy/pkg/proxy/shared/httpcache"
 	"gopkg.d7z.net/cache-proxy/pkg/scheduler"
+	"gopkg.d7z.net/cache-proxy/pkg/utils"
 )
 
 const statusAPIPath = "/-/status/"
@@ -49,6 +50,7 @@ type taskEvent struct {
 	ReasonCode string `json:"reason_code,omitempty"`
 	Detail     string `json:"detail,omitempty"`
 	Message    string `json:"message,omitempty"`
+	Reclaimed  int64  `json:"reclaimed_bytes,omitempty"`
 }
 
 type appStatus struct {
@@ -145,14 +147,15 @@ func (s *appStatus) observeTaskRun(run scheduler.TaskRun) {
 		ReasonCode: run.ReasonCode,
 		Detail:     run.Detail,
 		Message:    taskRunMessage(run),
+		Reclaimed:  run.ReclaimedBytes,
 	})
 }
 
 func taskRunMessage(run scheduler.TaskRun) string {
 	if run.Message != "" {
-		return run.Message
+		return utils.Redact(run.Message)
 	}
-	return run.Err
+	return utils.Redact(run.Err)
 }
 
 func (s *appStatus) appendEvent(event taskEvent) {
@@ -480,6 +483,6 @@ func writeStatusJSON(w http.ResponseWriter, req *http.Request, payload any) {
 }
 
 func writeStatusError(w http.ResponseWriter, req *http.Request, status int, err error) {
-	resp := httpcache.ErrorResponse(status, err)
+	resp := httpcache.ErrorResponse(status, errors.New(utils.Redact(err.Error())))
 	_ = resp.FlushClose(req, w)
 }
@@ -8,6 +8,7 @@ import (
 
 	"gopkg.d7z.net/cache-proxy/pkg/proxy/shared/httpcache"
 	proxyruntime "gopkg.d7z.net/cache-proxy/pkg/runtime"
+	"gopkg.d7z.net/cache-proxy/pkg/utils"
 )
 
 type networkStatus struct {
@@ -156,12 +157,12 @@ func (s *networkStatus) addNetworkEdge(
 		state = "unknown"
 	}
 	edge := networkEdge{
-		ID:                     instance.ID + "->" + upstreamID + ":" + upstreamURL,
+		ID:                     instance.ID + "->" + upstreamID + ":" + utils.Redact(upstreamURL),
 		From:                   instance.ID,
 		To:                     upstreamID,
 		Instance:               entry.Name,
 		Mode:                   entry.Mode,
-		UpstreamURL:            upstreamURL,
+		UpstreamURL:            utils.Redact(upstreamURL),
 		UpstreamHost:           host,
 		Requests:               upstream.Requests,
 		Errors:                 upstream.Errors,
@@ -172,7 +173,7 @@ func (s *networkStatus) addNetworkEdge(
 		ErrorRate:              upstream.ErrorRate,
 		LatencyMS:              upstream.LatencySeconds * 1000,
 		LastStatus:             upstream.LastStatus,
-		LastError:              upstream.LastError,
+		LastError:              utils.Redact(upstream.LastError),
 	}
 	if !upstream.LastUsedAt.IsZero() {
 		edge.LastUsedAt = upstream.LastUsedAt.Format(time.RFC3339)
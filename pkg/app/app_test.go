@@ -2,11 +2,22 @@ package app
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"sync/atomic"
 	"testing"
@@ -14,13 +25,16 @@ import (
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
 	"gopkg.in/yaml.v3"
 
 	"gopkg.d7z.net/cache-proxy/pkg/bus"
 	"gopkg.d7z.net/cache-proxy/pkg/config"
 	"gopkg.d7z.net/cache-proxy/pkg/proxy/file"
+	"gopkg.d7z.net/cache-proxy/pkg/proxy/shared/httpcache"
 	proxyruntime "gopkg.d7z.net/cache-proxy/pkg/runtime"
 	"gopkg.d7z.net/cache-proxy/pkg/scheduler"
+	"gopkg.d7z.net/cache-proxy/pkg/utils"
 )
 
 func TestValidateRejectsConflictingPaths(t *testing.T) {
@@ -74,6 +88,368 @@ func TestFileProxyCachesImmutableObjects(t *testing.T) {
 	require.Equal(t, int64(1), upstreamRequests.Load())
 }
 
+func TestAccessLogRecordsCacheOutcomeAndUpstream(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "hello")
+	}))
+	defer upstream.Close()
+
+	logPath := filepath.Join(t.TempDir(), "access.log")
+	doc := testDocument(t.TempDir(), []config.Instance{
+		fileInstance(t, "files", "/files", upstream.URL, file.Policy{
+			DefaultPolicy: config.PolicyImmutable,
+			BusyPolicy:    config.BusyPolicyBypass,
+		}),
+	})
+	doc.Server.AccessLog = config.AccessLogConfig{Path: logPath}
+	app := openApp(t, ctx, doc)
+	require.Equal(t, "hello", requestBody(t, app, http.MethodGet, "/files/a.txt"))
+	require.Equal(t, "hello", requestBody(t, app, http.MethodGet, "/files/a.txt"))
+	closeApp(t, app)
+
+	data, err := os.ReadFile(logPath)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 2)
+	var entries []map[string]any
+	for _, line := range lines {
+		var entry map[string]any
+		require.NoError(t, json.Unmarshal([]byte(line), &entry))
+		entries = append(entries, entry)
+	}
+	require.Equal(t, "files", entries[0]["instance"])
+	require.Equal(t, config.ModeFile, entries[0]["mode"])
+	require.Equal(t, "/files/a.txt", entries[0]["path"])
+	require.Equal(t, float64(http.StatusOK), entries[0]["status"])
+	require.Equal(t, float64(5), entries[0]["bytes"])
+	require.Equal(t, "MISS", entries[0]["cache"])
+	require.Equal(t, upstream.URL, entries[0]["upstream"])
+	require.Contains(t, entries[0], "ttfb_ms")
+	require.Equal(t, "HIT", entries[1]["cache"])
+}
+
+func TestValidateRejectsInvalidAccessLog(t *testing.T) {
+	doc := testDocument(t.TempDir(), nil)
+	doc.Server.AccessLog = config.AccessLogConfig{Path: "stderr", SampleRate: 2}
+	require.ErrorContains(t, Validate(doc), "sample_rate")
+}
+
+func TestAccessBlockGuardsInstancesAndHomePage(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "hello")
+	}))
+	defer upstream.Close()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("wonderland"), bcrypt.MinCost)
+	require.NoError(t, err)
+	htpasswd := filepath.Join(t.TempDir(), "htpasswd")
+	require.NoError(t, os.WriteFile(htpasswd, []byte("# users\nalice:"+string(hash)+"\n"), 0o600))
+
+	public := fileInstance(t, "public", "/public", upstream.URL, file.Policy{})
+	public.Access = &config.AccessConfig{}
+	readonly := fileInstance(t, "readonly", "/readonly", upstream.URL, file.Policy{})
+	readonly.Access = &config.AccessConfig{Tokens: []string{"s3cret"}, AnonymousRead: true}
+	doc := testDocument(t.TempDir(), []config.Instance{
+		fileInstance(t, "files", "/files", upstream.URL, file.Policy{}),
+		public,
+		readonly,
+	})
+	doc.Server.Access = config.AccessConfig{Tokens: []string{"s3cret"}, Htpasswd: htpasswd}
+	app := openApp(t, ctx, doc)
+	defer closeApp(t, app)
+
+	serve := func(method, target string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		rec := httptest.NewRecorder()
+		app.ServeHTTP(rec, req)
+		return rec
+	}
+	basic := func(user, password string) http.Header {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.SetBasicAuth(user, password)
+		return req.Header
+	}
+
+	rec := serve(http.MethodGet, "/", nil)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	require.Equal(t, `Basic realm="cache-proxy"`, rec.Header().Get("WWW-Authenticate"))
+	require.Equal(t, http.StatusUnauthorized, serve(http.MethodGet, "/files/a.txt", nil).Code)
+	require.Equal(t, http.StatusUnauthorized, serve(http.MethodGet, "/files/a.txt", basic("alice", "wrong")).Code)
+	require.Equal(t, http.StatusOK, serve(http.MethodGet, "/files/a.txt", basic("alice", "wonderland")).Code)
+	require.Equal(t, http.StatusOK, serve(http.MethodGet, "/files/a.txt", basic("ci", "s3cret")).Code)
+	require.Equal(t, http.StatusOK, serve(http.MethodGet, "/files/a.txt", http.Header{"Authorization": {"Bearer s3cret"}}).Code)
+	require.Equal(t, http.StatusOK, serve(http.MethodGet, "/", http.Header{"Authorization": {"Bearer s3cret"}}).Code)
+
+	require.Equal(t, http.StatusOK, serve(http.MethodGet, "/public/a.txt", nil).Code)
+	require.Equal(t, http.StatusOK, serve(http.MethodGet, "/readonly/a.txt", nil).Code)
+	require.Equal(t, http.StatusUnauthorized, serve(http.MethodPost, "/readonly/a.txt", nil).Code)
+	require.Equal(t, http.StatusUnauthorized, serve(http.MethodGet, "/readonly/a.txt", basic("alice", "wonderland")).Code)
+}
+
+func TestAccessChallengeMatchesMode(t *testing.T) {
+	oci := &accessGuard{mode: config.ModeOCI}
+	rec := httptest.NewRecorder()
+	_, ok := oci.authorize(rec, httptest.NewRequest(http.MethodGet, "/v2/", nil))
+	require.False(t, ok)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	require.Equal(t, "registry/2.0", rec.Header().Get("Docker-Distribution-API-Version"))
+	require.Contains(t, rec.Body.String(), `"UNAUTHORIZED"`)
+
+	cargo := &accessGuard{mode: config.ModeCargo, tokens: [][32]byte{sha256.Sum256([]byte("crates"))}}
+	rec = httptest.NewRecorder()
+	_, ok = cargo.authorize(rec, httptest.NewRequest(http.MethodGet, "/config.json", nil))
+	require.False(t, ok)
+	require.Equal(t, "Cargo", rec.Header().Get("WWW-Authenticate"))
+	req := httptest.NewRequest(http.MethodGet, "/config.json", nil)
+	req.Header.Set("Authorization", "crates")
+	identity, ok := cargo.authorize(httptest.NewRecorder(), req)
+	require.True(t, ok)
+	require.Equal(t, "token:0", identity)
+}
+
+func TestAdmitPassesOnIdentity(t *testing.T) {
+	guard := routeGuard{access: &accessGuard{mode: config.ModeOCI, tokens: [][32]byte{sha256.Sum256([]byte("s3cret"))}, anonymousRead: true}}
+	req := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+	req.Header.Set(httpcache.IdentityHeader, "user:forged")
+	_, ok := (&App{}).admit(httptest.NewRecorder(), req, guard)
+	require.True(t, ok)
+	require.Empty(t, req.Header.Get(httpcache.IdentityHeader))
+
+	req.Header.Set("Authorization", "Bearer s3cret")
+	_, ok = (&App{}).admit(httptest.NewRecorder(), req, guard)
+	require.True(t, ok)
+	require.Equal(t, "token:0", req.Header.Get(httpcache.IdentityHeader))
+	require.Empty(t, req.Header.Get("Authorization"))
+}
+
+func TestValidateRejectsNonBcryptHtpasswd(t *testing.T) {
+	htpasswd := filepath.Join(t.TempDir(), "htpasswd")
+	require.NoError(t, os.WriteFile(htpasswd, []byte("bob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"), 0o600))
+	doc := testDocument(t.TempDir(), nil)
+	doc.Server.Access = config.AccessConfig{Htpasswd: htpasswd}
+	require.ErrorContains(t, Validate(doc), "only bcrypt hashes are supported")
+}
+
+func TestCIDRListsDenyClientsAndRecordStats(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "hello")
+	}))
+	defer upstream.Close()
+
+	open := fileInstance(t, "open", "/open", upstream.URL, file.Policy{})
+	open.AllowCIDRs = []string{}
+	doc := testDocument(t.TempDir(), []config.Instance{
+		fileInstance(t, "files", "/files", upstream.URL, file.Policy{}),
+		open,
+	})
+	doc.Server.AllowCIDRs = []string{"10.0.0.0/8"}
+	doc.Server.DenyCIDRs = []string{"10.9.0.0/16"}
+	doc.Server.TrustedProxies = []string{"192.0.2.1"}
+	app := openApp(t, ctx, doc)
+	defer closeApp(t, app)
+
+	serve := func(target, peer, forwarded string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.RemoteAddr = peer + ":41000"
+		if forwarded != "" {
+			req.Header.Set("X-Forwarded-For", forwarded)
+		}
+		rec := httptest.NewRecorder()
+		app.ServeHTTP(rec, req)
+		return rec
+	}
+
+	require.Equal(t, http.StatusOK, serve("/files/a.txt", "10.1.2.3", "").Code)
+	rec := serve("/files/a.txt", "203.0.113.5", "")
+	require.Equal(t, http.StatusForbidden, rec.Code)
+	require.Equal(t, cacheDenied, rec.Header().Get("X-Cache"))
+	require.Equal(t, http.StatusForbidden, serve("/files/a.txt", "10.9.1.1", "").Code)
+	require.Equal(t, http.StatusOK, serve("/files/a.txt", "192.0.2.1", "203.0.113.5, 10.1.2.3").Code)
+	require.Equal(t, http.StatusForbidden, serve("/files/a.txt", "192.0.2.1", "10.1.2.3, 203.0.113.5").Code)
+	require.Equal(t, http.StatusForbidden, serve("/files/a.txt", "203.0.113.5", "10.1.2.3").Code)
+	require.Equal(t, http.StatusForbidden, serve("/", "203.0.113.5", "").Code)
+
+	require.Equal(t, http.StatusOK, serve("/open/a.txt", "203.0.113.5", "").Code)
+	require.Equal(t, http.StatusForbidden, serve("/open/a.txt", "10.9.1.1", "").Code)
+
+	snapshot := app.stats.Snapshot()
+	require.Equal(t, uint64(4), snapshot.Instances["files"].Cache[cacheDenied])
+	require.Equal(t, uint64(1), snapshot.Instances["open"].Cache[cacheDenied])
+}
+
+func TestRateLimitThrottlesPerClient(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "hello")
+	}))
+	defer upstream.Close()
+
+	limited := fileInstance(t, "limited", "/limited", upstream.URL, file.Policy{})
+	limited.RateLimit = &config.RateLimitConfig{RequestsPerSecond: 0.5, Burst: 2}
+	limited.Access = &config.AccessConfig{Tokens: []string{"ci"}, AnonymousRead: true}
+	doc := testDocument(t.TempDir(), []config.Instance{
+		limited,
+		fileInstance(t, "files", "/files", upstream.URL, file.Policy{}),
+	})
+	app := openApp(t, ctx, doc)
+	defer closeApp(t, app)
+
+	serve := func(target, peer, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.RemoteAddr = peer + ":41000"
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		app.ServeHTTP(rec, req)
+		return rec
+	}
+
+	require.Equal(t, http.StatusOK, serve("/limited/a.txt", "10.0.0.1", "").Code)
+	require.Equal(t, http.StatusOK, serve("/limited/a.txt", "10.0.0.1", "").Code)
+	rec := serve("/limited/a.txt", "10.0.0.1", "")
+	require.Equal(t, http.StatusTooManyRequests, rec.Code)
+	require.Equal(t, "2", rec.Header().Get("Retry-After"))
+	require.Equal(t, cacheThrottled, rec.Header().Get("X-Cache"))
+	require.Equal(t, http.StatusOK, serve("/limited/a.txt", "10.0.0.2", "").Code)
+	require.Equal(t, http.StatusOK, serve("/files/a.txt", "10.0.0.1", "").Code)
+
+	// Authenticated clients share one bucket across addresses.
+	require.Equal(t, http.StatusOK, serve("/limited/a.txt", "10.0.0.3", "ci").Code)
+	require.Equal(t, http.StatusOK, serve("/limited/a.txt", "10.0.0.4", "ci").Code)
+	require.Equal(t, http.StatusTooManyRequests, serve("/limited/a.txt", "10.0.0.5", "ci").Code)
+
+	snapshot := app.stats.Snapshot()
+	require.Equal(t, uint64(2), snapshot.Instances["limited"].Cache[cacheThrottled])
+}
+
+func TestRateLimitShapesResponseBytes(t *testing.T) {
+	limiter := &clientLimiter{
+		cfg:      config.RateLimitConfig{BytesPerSecond: 10000},
+		requests: map[string]*tokenBucket{},
+		bytes:    map[string]*tokenBucket{},
+	}
+	rec := httptest.NewRecorder()
+	w := limiter.shape(rec, httptest.NewRequest(http.MethodGet, "/", nil), "addr:10.0.0.1")
+	start := time.Now()
+	n, err := w.Write(make([]byte, 15000))
+	require.NoError(t, err)
+	require.Equal(t, 15000, n)
+	require.Equal(t, 15000, rec.Body.Len())
+	require.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+}
+
+func TestValidateRejectsInvalidCIDR(t *testing.T) {
+	doc := testDocument(t.TempDir(), nil)
+	doc.Server.DenyCIDRs = []string{"10.0.0.0/33"}
+	require.ErrorContains(t, Validate(doc), `server deny_cidrs: invalid cidr "10.0.0.0/33"`)
+	doc.Server.DenyCIDRs = nil
+	doc.Server.TrustedProxies = []string{"proxy.internal"}
+	require.ErrorContains(t, Validate(doc), `server trusted_proxies: invalid address "proxy.internal"`)
+}
+
+func TestValidateRejectsDenyRules(t *testing.T) {
+	instance := fileInstance(t, "files", "/files", "https://example.invalid", file.Policy{})
+	instance.Deny = []string{"pkg"}
+	require.ErrorContains(t, Validate(testDocument(t.TempDir(), []config.Instance{instance})), "instance files: deny is not supported in file mode")
+}
+
+func TestReleaseAgeOverrideSanitizesHeader(t *testing.T) {
+	override, err := newReleaseAgeOverride([]string{"10.0.0.0/8", "ci"}, nil)
+	require.NoError(t, err)
+	check := func(o *releaseAgeOverride, peer, identity string) string {
+		req := httptest.NewRequest(http.MethodGet, "/npm/pkg", nil)
+		req.RemoteAddr = peer + ":41000"
+		req.Header.Set(httpcache.ReleaseAgeHeader, "0")
+		o.sanitize(req, identity)
+		return req.Header.Get(httpcache.ReleaseAgeHeader)
+	}
+	require.Equal(t, "0", check(override, "10.1.2.3", ""))
+	require.Equal(t, "0", check(override, "203.0.113.5", "user:ci"))
+	require.Empty(t, check(override, "203.0.113.5", "token:0"))
+	require.Empty(t, check(nil, "10.1.2.3", "user:ci"))
+
+	_, err = newReleaseAgeOverride([]string{"10.0.0.0/33"}, nil)
+	require.Error(t, err)
+}
+
+func TestValidateRejectsMinReleaseAge(t *testing.T) {
+	instance := fileInstance(t, "files", "/files", "https://example.invalid", file.Policy{})
+	instance.MinReleaseAge = config.Duration(time.Hour)
+	require.ErrorContains(t, Validate(testDocument(t.TempDir(), []config.Instance{instance})), "instance files: min_release_age is not supported in file mode")
+}
+
+func TestStartServesTLSAndReloadsCertificate(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeTestCertificate(t, certFile, keyFile, "first")
+	doc := testDocument(t.TempDir(), nil)
+	doc.Server.TLS = &config.TLSConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: certFile}
+	app := openApp(t, ctx, doc)
+	require.NoError(t, app.Start())
+	defer closeApp(t, app)
+	addr := app.mainListener.Addr().String()
+
+	handshake := func(withClientCert bool) (string, error) {
+		pool := x509.NewCertPool()
+		data, err := os.ReadFile(certFile)
+		require.NoError(t, err)
+		require.True(t, pool.AppendCertsFromPEM(data))
+		clientCfg := &tls.Config{RootCAs: pool, ServerName: "localhost"}
+		if withClientCert {
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			require.NoError(t, err)
+			clientCfg.Certificates = []tls.Certificate{cert}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientCfg}}
+		defer client.CloseIdleConnections()
+		resp, err := client.Get("https://" + addr + "/")
+		if err != nil {
+			return "", err
+		}
+		_ = resp.Body.Close()
+		return resp.TLS.PeerCertificates[0].Subject.CommonName, nil
+	}
+
+	_, err := handshake(false)
+	require.Error(t, err)
+	name, err := handshake(true)
+	require.NoError(t, err)
+	require.Equal(t, "first", name)
+
+	writeTestCertificate(t, certFile, keyFile, "second")
+	reloader := app.tls[doc.Server.Bind]
+	reloader.mu.Lock()
+	reloader.checked = time.Time{}
+	reloader.mu.Unlock()
+	name, err = handshake(true)
+	require.NoError(t, err)
+	require.Equal(t, "second", name)
+}
+
+func TestValidateRejectsMissingTLSCertificate(t *testing.T) {
+	doc := testDocument(t.TempDir(), nil)
+	doc.Server.TLS = &config.TLSConfig{CertFile: "/nonexistent/tls.crt", KeyFile: "/nonexistent/tls.key"}
+	require.ErrorContains(t, Validate(doc), "server tls")
+}
+
 func TestMetricsRequireBearerToken(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
@@ -96,6 +472,309 @@ func TestMetricsRequireBearerToken(t *testing.T) {
 	require.Equal(t, http.StatusOK, rec.Code)
 }
 
+func TestAdminPurgeDeletesMatchingObjects(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var upstreamRequests atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamRequests.Add(1)
+		_, _ = io.WriteString(w, "hello")
+	}))
+	defer upstream.Close()
+
+	doc := testDocument(t.TempDir(), []config.Instance{
+		fileInstance(t, "files", "/files", upstream.URL, file.Policy{DefaultPolicy: config.PolicyImmutable}),
+	})
+	doc.Server.Admin.Token = "secret"
+	app := openApp(t, ctx, doc)
+	defer closeApp(t, app)
+
+	requestBody(t, app, http.MethodGet, "/files/a.txt")
+	requestBody(t, app, http.MethodGet, "/files/b.bin")
+	require.Equal(t, int64(2), upstreamRequests.Load())
+
+	purge := func(token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/-/admin/purge", strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		app.ServeHTTP(rec, req)
+		return rec
+	}
+	require.Equal(t, http.StatusUnauthorized, purge("", `{"instance":"files","glob":"**/*.txt"}`).Code)
+	require.Equal(t, http.StatusBadRequest, purge("secret", `{"instance":"files"}`).Code)
+	require.Equal(t, http.StatusNotFound, purge("secret", `{"instance":"missing","path":"a.txt"}`).Code)
+
+	rec := purge("secret", `{"instance":"files","glob":"**/*.txt","dry_run":true}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var result purgeResult
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &result))
+	require.True(t, result.DryRun)
+	require.Equal(t, 1, result.Purged)
+	requestBody(t, app, http.MethodGet, "/files/a.txt")
+	require.Equal(t, int64(2), upstreamRequests.Load())
+
+	rec = purge("secret", `{"instance":"files","glob":"**/*.txt"}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &result))
+	require.Equal(t, 1, result.Purged)
+	require.Equal(t, "file/a.txt", result.Objects[0].Object)
+	require.Equal(t, int64(5), result.Reclaimed)
+
+	requestBody(t, app, http.MethodGet, "/files/a.txt")
+	requestBody(t, app, http.MethodGet, "/files/b.bin")
+	require.Equal(t, int64(3), upstreamRequests.Load())
+
+	events := app.status.taskEvents(10)
+	require.NotEmpty(t, events)
+	last := events[len(events)-1]
+	require.Equal(t, "purge", last.TaskType)
+	require.Equal(t, "files", last.Storage)
+	require.Equal(t, "purged", last.ReasonCode)
+}
+
+func TestAdminPurgeDisabledWithoutToken(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	app := openApp(t, ctx, testDocument(t.TempDir(), nil))
+	defer closeApp(t, app)
+
+	req := httptest.NewRequest(http.MethodPost, "/-/admin/purge", strings.NewReader(`{}`))
+	rec := httptest.NewRecorder()
+	app.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestAdminWarmReplaysPathsThroughInstance(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var upstreamRequests atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamRequests.Add(1)
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = io.WriteString(w, "hello")
+	}))
+	defer upstream.Close()
+
+	doc := testDocument(t.TempDir(), []config.Instance{
+		fileInstance(t, "files", "/files", upstream.URL, file.Policy{DefaultPolicy: config.PolicyImmutable}),
+	})
+	doc.Server.Admin.Token = "secret"
+	app := openApp(t, ctx, doc)
+	defer closeApp(t, app)
+
+	req := httptest.NewRequest(http.MethodPost, "/-/admin/warm", strings.NewReader(`{"instance":"files","paths":["a.txt","/files/b.txt","missing"]}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	app.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusAccepted, rec.Code)
+	var job warmJob
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &job))
+	require.Equal(t, "/-/admin/warm/"+job.ID, rec.Header().Get("Location"))
+
+	require.Eventually(t, func() bool {
+		req := httptest.NewRequest(http.MethodGet, "/-/admin/warm/"+job.ID, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		app.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &job))
+		return job.State == "done"
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Len(t, job.Paths, 3)
+	require.Equal(t, "/a.txt", job.Paths[0].Path)
+	require.Equal(t, "warmed", job.Paths[0].State)
+	require.Equal(t, "MISS", job.Paths[0].Cache)
+	require.Equal(t, "/b.txt", job.Paths[1].Path)
+	require.Equal(t, "warmed", job.Paths[1].State)
+	require.Equal(t, "failed", job.Paths[2].State)
+	require.Equal(t, http.StatusNotFound, job.Paths[2].Status)
+
+	require.Equal(t, "hello", requestBody(t, app, http.MethodGet, "/files/a.txt"))
+	require.Equal(t, "hello", requestBody(t, app, http.MethodGet, "/files/b.txt"))
+	require.Equal(t, int64(3), upstreamRequests.Load())
+}
+
+func TestAdminWarmFollowsReloadedInstance(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	arrived, release := make(chan struct{}, 1), make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/a.txt" {
+			arrived <- struct{}{}
+			<-release
+		}
+		_, _ = io.WriteString(w, "hello")
+	}))
+	defer upstream.Close()
+
+	backend := t.TempDir()
+	doc := testDocument(backend, []config.Instance{
+		fileInstance(t, "files", "/files", upstream.URL, file.Policy{DefaultPolicy: config.PolicyImmutable}),
+	})
+	doc.Server.Admin.Token = "secret"
+	app := openApp(t, ctx, doc)
+	defer closeApp(t, app)
+
+	req := httptest.NewRequest(http.MethodPost, "/-/admin/warm", strings.NewReader(`{"instance":"files","paths":["a.txt","b.txt"]}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	app.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusAccepted, rec.Code)
+	var job warmJob
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &job))
+	<-arrived
+
+	next := testDocument(backend, []config.Instance{
+		fileInstance(t, "more", "/more", upstream.URL, file.Policy{DefaultPolicy: config.PolicyImmutable}),
+	})
+	next.Server.Admin.Token = "secret"
+	reloaded := make(chan error, 1)
+	go func() { reloaded <- app.ReloadDocument(ctx, next) }()
+	require.Eventually(t, func() bool { return app.entry("files") == nil }, 5*time.Second, 10*time.Millisecond)
+	close(release)
+	require.NoError(t, <-reloaded)
+
+	var finished *warmJob
+	require.Eventually(t, func() bool {
+		finished = app.warm.get(job.ID).snapshot()
+		return finished.State == "failed"
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, "skipped", finished.Paths[1].State)
+}
+
+func TestReloadDocumentAppliesInstanceDiff(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	upstreamFor := func(body string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, body)
+		}))
+	}
+	first := upstreamFor("first")
+	defer first.Close()
+	second := upstreamFor("second")
+	defer second.Close()
+
+	backend := t.TempDir()
+	app := openApp(t, ctx, testDocument(backend, []config.Instance{
+		fileInstance(t, "files", "/files", first.URL, file.Policy{DefaultPolicy: config.PolicyBypass}),
+	}))
+	defer closeApp(t, app)
+	require.Equal(t, "first", requestBody(t, app, http.MethodGet, "/files/a.txt"))
+
+	require.NoError(t, app.ReloadDocument(ctx, testDocument(backend, []config.Instance{
+		fileInstance(t, "files", "/files", second.URL, file.Policy{DefaultPolicy: config.PolicyBypass}),
+		fileInstance(t, "more", "/more", first.URL, file.Policy{DefaultPolicy: config.PolicyBypass}),
+	})))
+	require.Equal(t, "second", requestBody(t, app, http.MethodGet, "/files/a.txt"))
+	require.Equal(t, "first", requestBody(t, app, http.MethodGet, "/more/a.txt"))
+
+	err := app.ReloadDocument(ctx, testDocument(backend, []config.Instance{
+		fileInstance(t, "files", "/files", second.URL, file.Policy{DefaultPolicy: config.PolicyBypass}),
+		fileInstance(t, "dupe", "/files", first.URL, file.Policy{DefaultPolicy: config.PolicyBypass}),
+	}))
+	require.Error(t, err)
+	require.Equal(t, "first", requestBody(t, app, http.MethodGet, "/more/a.txt"))
+	require.Error(t, app.ReloadDocument(ctx, testDocument(t.TempDir(), nil)))
+
+	require.NoError(t, app.ReloadDocument(ctx, testDocument(backend, []config.Instance{
+		fileInstance(t, "more", "/more", first.URL, file.Policy{DefaultPolicy: config.PolicyBypass}),
+	})))
+	req := httptest.NewRequest(http.MethodGet, "/files/a.txt", nil)
+	rec := httptest.NewRecorder()
+	app.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusNotFound, rec.Code)
+	require.Equal(t, "first", requestBody(t, app, http.MethodGet, "/more/a.txt"))
+}
+
+func TestReloadReplacesRedactedSecrets(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	t.Setenv("CACHE_PROXY_TEST_OLD_TOKEN", "old-metrics-token")
+	t.Setenv("CACHE_PROXY_TEST_NEW_TOKEN", "new-metrics-token")
+	backend := t.TempDir()
+	decode := func(env string) *config.Document {
+		doc, err := config.Decode(strings.NewReader(`
+server:
+  bind: 127.0.0.1:0
+  backend: ` + backend + `
+metrics:
+  path: /metrics
+  token: ${env:` + env + `}
+`))
+		require.NoError(t, err)
+		doc.Storage = testDocument(backend, nil).Storage
+		return doc
+	}
+
+	app := openApp(t, ctx, decode("CACHE_PROXY_TEST_OLD_TOKEN"))
+	defer closeApp(t, app)
+	require.Equal(t, "[REDACTED]", utils.Redact("old-metrics-token"))
+
+	require.NoError(t, app.ReloadDocument(ctx, decode("CACHE_PROXY_TEST_NEW_TOKEN")))
+	require.Equal(t, "old-metrics-token", utils.Redact("old-metrics-token"))
+	require.Equal(t, "[REDACTED]", utils.Redact("new-metrics-token"))
+}
+
+func TestReloadDoesNotWaitForInFlightDownloads(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	arrived, release := make(chan struct{}, 1), make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/slow.bin") {
+			arrived <- struct{}{}
+			<-release
+		}
+		_, _ = io.WriteString(w, "done")
+	}))
+	defer slow.Close()
+	defer close(release)
+
+	backend := t.TempDir()
+	files := fileInstance(t, "files", "/files", slow.URL, file.Policy{DefaultPolicy: config.PolicyBypass})
+	app := openApp(t, ctx, testDocument(backend, []config.Instance{files}))
+	defer closeApp(t, app)
+
+	served := make(chan int, 1)
+	go func() {
+		rec := httptest.NewRecorder()
+		app.ServeHTTP(rec, httptest.NewRequestWithContext(ctx, http.MethodGet, "/files/slow.bin", nil))
+		served <- rec.Code
+	}()
+	<-arrived
+
+	reloaded := make(chan error, 1)
+	go func() {
+		reloaded <- app.ReloadDocument(ctx, testDocument(backend, []config.Instance{
+			files,
+			fileInstance(t, "more", "/more", slow.URL, file.Policy{DefaultPolicy: config.PolicyBypass}),
+		}))
+	}()
+	select {
+	case err := <-reloaded:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "reload waited for the in-flight download")
+	}
+	require.Equal(t, "done", requestBody(t, app, http.MethodGet, "/more/a.txt"))
+	require.Empty(t, served)
+
+	release <- struct{}{}
+	require.Equal(t, http.StatusOK, <-served)
+}
+
 func TestHomePageRendersConfiguredInstances(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
@@ -982,6 +1661,29 @@ func yamlNode(t *testing.T, value any) *yaml.Node {
 	return doc.Content[0]
 }
 
+func writeTestCertificate(t *testing.T, certFile, keyFile, commonName string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+}
+
 func requestBody(t *testing.T, handler http.Handler, method, target string) string {
 	t.Helper()
 	req := httptest.NewRequest(method, target, nil)
@@ -0,0 +1,154 @@
+package app
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"gopkg.d7z.net/cache-proxy/pkg/config"
+	proxyruntime "gopkg.d7z.net/cache-proxy/pkg/runtime"
+)
+
+// tlsCheckInterval bounds how often handshakes stat the certificate files.
+const tlsCheckInterval = 5 * time.Second
+
+// tlsReloader serves the certificate and client CA bundle of a TLSConfig and
+// reloads them when the files change on disk. A failed reload keeps the
+// previous material.
+type tlsReloader struct {
+	cfg config.TLSConfig
+
+	mu      sync.Mutex
+	current *tls.Config
+	stamp   string
+	checked time.Time
+}
+
+func newTLSReloader(cfg config.TLSConfig) (*tlsReloader, error) {
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return nil, errors.New("tls requires cert_file and key_file")
+	}
+	r := &tlsReloader{cfg: cfg}
+	stamp, err := r.fileStamp()
+	if err != nil {
+		return nil, err
+	}
+	current, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	r.current, r.stamp, r.checked = current, stamp, time.Now()
+	return r, nil
+}
+
+// fileStamp summarizes the size and modification time of the TLS files.
+func (r *tlsReloader) fileStamp() (string, error) {
+	stamp := ""
+	for _, name := range []string{r.cfg.CertFile, r.cfg.KeyFile, r.cfg.ClientCAFile} {
+		if name == "" {
+			continue
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			return "", fmt.Errorf("tls: %w", err)
+		}
+		stamp += fmt.Sprintf("%s:%d:%d;", name, info.Size(), info.ModTime().UnixNano())
+	}
+	return stamp, nil
+}
+
+func (r *tlsReloader) load() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("tls: %w", err)
+	}
+	result := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+	if r.cfg.ClientCAFile != "" {
+		data, err := os.ReadFile(r.cfg.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("tls: no certificates in client_ca_file %s", r.cfg.ClientCAFile)
+		}
+		result.ClientCAs = pool
+		result.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return result, nil
+}
+
+func (r *tlsReloader) config() *tls.Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.checked) < tlsCheckInterval {
+		return r.current
+	}
+	r.checked = time.Now()
+	stamp, err := r.fileStamp()
+	if err != nil || stamp == r.stamp {
+		return r.current
+	}
+	current, err := r.load()
+	if err != nil {
+		slog.Warn("tls reload failed, keeping previous certificate", "cert_file", r.cfg.CertFile, "err", err)
+		return r.current
+	}
+	slog.Info("tls certificate reloaded", "cert_file", r.cfg.CertFile)
+	r.current, r.stamp = current, stamp
+	return current
+}
+
+// newTLSReloaders builds the reloaders for the main bind and every dedicated
+// bind that configures TLS, keyed by listen address.
+func newTLSReloaders(doc *config.Document, entries map[string]*proxyruntime.Entry) (map[string]*tlsReloader, error) {
+	reloaders := map[string]*tlsReloader{}
+	if doc.Server.TLS != nil {
+		r, err := newTLSReloader(*doc.Server.TLS)
+		if err != nil {
+			return nil, fmt.Errorf("server %w", err)
+		}
+		reloaders[doc.Server.Bind] = r
+	}
+	for _, name := range proxyruntime.SortedNames(entries) {
+		entry := entries[name]
+		if !entry.Enabled || entry.Bind == "" || entry.TLS == nil {
+			continue
+		}
+		r, err := newTLSReloader(*entry.TLS)
+		if err != nil {
+			return nil, fmt.Errorf("instance %s: %w", name, err)
+		}
+		reloaders[entry.Bind] = r
+	}
+	return reloaders, nil
+}
+
+// tlsListener wraps listener with TLS when addr has a reloader. The current
+// reloader is looked up per handshake so config reloads take effect.
+func (a *App) tlsListener(addr string, listener net.Listener) net.Listener {
+	if a.tls[addr] == nil {
+		return listener
+	}
+	return tls.NewListener(listener, &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			a.routesMu.RLock()
+			r := a.tls[addr]
+			a.routesMu.RUnlock()
+			if r == nil {
+				return nil, fmt.Errorf("tls disabled for %s", addr)
+			}
+			return r.config(), nil
+		},
+	})
+}
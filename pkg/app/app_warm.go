@@ -0,0 +1,334 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	proxyruntime "gopkg.d7z.net/cache-proxy/pkg/runtime"
+	"gopkg.d7z.net/cache-proxy/pkg/scheduler"
+)
+
+const (
+	warmAPIPath     = "/-/admin/warm"
+	warmMaxPaths    = 10000
+	warmMaxAttempts = 3
+	warmJobTimeout  = 6 * time.Hour
+	warmJobHistory  = 32
+)
+
+type warmRequest struct {
+	Instance string   `json:"instance"`
+	Paths    []string `json:"paths"`
+}
+
+type warmPath struct {
+	Path   string `json:"path"`
+	State  string `json:"state"`
+	Status int    `json:"status,omitempty"`
+	Cache  string `json:"cache,omitempty"`
+	Bytes  int64  `json:"bytes,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type warmJob struct {
+	mu         sync.Mutex
+	ID         string     `json:"id"`
+	Instance   string     `json:"instance"`
+	State      string     `json:"state"`
+	CreatedAt  time.Time  `json:"created_at"`
+	FinishedAt time.Time  `json:"finished_at,omitzero"`
+	Paths      []warmPath `json:"paths"`
+}
+
+func (j *warmJob) key() scheduler.TaskKey {
+	return scheduler.NewTaskKey(j.Instance, scheduler.TypeCacheWarm, j.ID)
+}
+
+func (j *warmJob) snapshot() *warmJob {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return &warmJob{
+		ID:         j.ID,
+		Instance:   j.Instance,
+		State:      j.State,
+		CreatedAt:  j.CreatedAt,
+		FinishedAt: j.FinishedAt,
+		Paths:      append([]warmPath(nil), j.Paths...),
+	}
+}
+
+func (j *warmJob) update(fn func(*warmJob)) {
+	j.mu.Lock()
+	fn(j)
+	j.mu.Unlock()
+}
+
+type warmJobs struct {
+	mu   sync.Mutex
+	jobs map[string]*warmJob
+}
+
+func (w *warmJobs) add(job *warmJob) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.jobs == nil {
+		w.jobs = map[string]*warmJob{}
+	}
+	w.jobs[job.ID] = job
+	if len(w.jobs) <= warmJobHistory {
+		return
+	}
+	var finished []*warmJob
+	for _, item := range w.jobs {
+		if snapshot := item.snapshot(); !snapshot.FinishedAt.IsZero() {
+			finished = append(finished, snapshot)
+		}
+	}
+	sort.Slice(finished, func(i, j int) bool { return finished[i].FinishedAt.Before(finished[j].FinishedAt) })
+	for _, item := range finished {
+		if len(w.jobs) <= warmJobHistory {
+			break
+		}
+		delete(w.jobs, item.ID)
+	}
+}
+
+func (w *warmJobs) get(id string) *warmJob {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.jobs[id]
+}
+
+func (w *warmJobs) list() []*warmJob {
+	w.mu.Lock()
+	items := make([]*warmJob, 0, len(w.jobs))
+	for _, job := range w.jobs {
+		items = append(items, job)
+	}
+	w.mu.Unlock()
+	result := make([]*warmJob, 0, len(items))
+	for _, job := range items {
+		result = append(result, job.snapshot())
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].CreatedAt.Before(result[j].CreatedAt) })
+	return result
+}
+
+func (a *App) serveWarm(w http.ResponseWriter, req *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(req.URL.Path, warmAPIPath), "/")
+	switch {
+	case id == "" && req.Method == http.MethodPost:
+		a.startWarm(w, req)
+	case id == "" && (req.Method == http.MethodGet || req.Method == http.MethodHead):
+		writeStatusJSON(w, req, map[string]any{"jobs": a.warm.list()})
+	case id != "" && (req.Method == http.MethodGet || req.Method == http.MethodHead || req.Method == http.MethodDelete):
+		job := a.warm.get(id)
+		if job == nil {
+			writeStatusError(w, req, http.StatusNotFound, fmt.Errorf("unknown warm job %q", id))
+			return
+		}
+		if req.Method == http.MethodDelete {
+			a.scheduler.Cancel(job.key())
+		}
+		writeStatusJSON(w, req, job.snapshot())
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (a *App) startWarm(w http.ResponseWriter, req *http.Request) {
+	var body warmRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 4<<20)).Decode(&body); err != nil {
+		writeStatusError(w, req, http.StatusBadRequest, fmt.Errorf("invalid warm request: %w", err))
+		return
+	}
+	entry := a.entry(body.Instance)
+	if entry == nil || !entry.Enabled || entry.Runtime == nil {
+		writeStatusError(w, req, http.StatusNotFound, fmt.Errorf("unknown instance %q", body.Instance))
+		return
+	}
+	if len(body.Paths) == 0 || len(body.Paths) > warmMaxPaths {
+		writeStatusError(w, req, http.StatusBadRequest, fmt.Errorf("paths must contain 1 to %d entries", warmMaxPaths))
+		return
+	}
+	job := &warmJob{
+		ID:        strconv.FormatInt(time.Now().UnixNano(), 36),
+		Instance:  entry.Name,
+		State:     "pending",
+		CreatedAt: time.Now(),
+		Paths:     make([]warmPath, 0, len(body.Paths)),
+	}
+	for _, item := range body.Paths {
+		job.Paths = append(job.Paths, warmPath{Path: warmRequestPath(entry, item), State: "pending"})
+	}
+	a.warm.add(job)
+	err := a.scheduler.Submit(scheduler.TaskDef{
+		Key:     job.key(),
+		Timeout: warmJobTimeout,
+		Handler: func(ctx context.Context) (*scheduler.TaskOutcome, error) {
+			return a.runWarm(ctx, job)
+		},
+	})
+	if err != nil {
+		job.update(func(j *warmJob) {
+			j.State = "failed"
+			j.FinishedAt = time.Now()
+		})
+		writeStatusError(w, req, http.StatusServiceUnavailable, err)
+		return
+	}
+	data, err := json.Marshal(job.snapshot())
+	if err != nil {
+		writeStatusError(w, req, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Location", warmAPIPath+"/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	_, _ = w.Write(data)
+}
+
+// warmRequestPath accepts paths relative to the instance or including its
+// listen path prefix.
+func warmRequestPath(entry *proxyruntime.Entry, target string) string {
+	cleanPath := path.Clean("/" + strings.TrimSpace(target))
+	if entry.Path != "" {
+		if trimmed, ok := strings.CutPrefix(cleanPath, entry.Path+"/"); ok {
+			cleanPath = "/" + trimmed
+		}
+	}
+	return cleanPath
+}
+
+// runWarm resolves the instance again before each path, so a job submitted
+// before a reload warms through the runtime that currently serves the
+// instance and fails once the instance is removed.
+func (a *App) runWarm(ctx context.Context, job *warmJob) (*scheduler.TaskOutcome, error) {
+	job.update(func(j *warmJob) { j.State = "running" })
+	var warmed, failed int
+	var gone error
+	for i := range job.Paths {
+		if ctx.Err() != nil {
+			break
+		}
+		entry := a.entry(job.Instance)
+		if entry == nil || !entry.Enabled || entry.Runtime == nil {
+			gone = fmt.Errorf("instance %q is no longer configured", job.Instance)
+			break
+		}
+		result := a.warmPath(ctx, entry, job.Paths[i].Path)
+		job.update(func(j *warmJob) { j.Paths[i] = result })
+		if result.State == "warmed" {
+			warmed++
+		} else {
+			failed++
+		}
+	}
+	state := "done"
+	if errors.Is(ctx.Err(), context.Canceled) {
+		state = "cancelled"
+	} else if ctx.Err() != nil || gone != nil {
+		state = "failed"
+	}
+	job.update(func(j *warmJob) {
+		j.State = state
+		j.FinishedAt = time.Now()
+		for i := range j.Paths {
+			if j.Paths[i].State == "pending" {
+				j.Paths[i].State = "skipped"
+			}
+		}
+	})
+	detail := fmt.Sprintf("paths=%d warmed=%d failed=%d", len(job.Paths), warmed, failed)
+	if err := ctx.Err(); err != nil {
+		return &scheduler.TaskOutcome{Detail: detail}, err
+	}
+	if gone != nil {
+		return &scheduler.TaskOutcome{Detail: detail}, gone
+	}
+	outcome := &scheduler.TaskOutcome{Result: "updated", ReasonCode: "warmed", Detail: detail}
+	if failed > 0 {
+		outcome.ReasonCode = "partial"
+	}
+	return outcome, nil
+}
+
+// warmPath replays a GET through the instance handler so resolvers, policies
+// and the download limiter apply exactly as for client requests.
+func (a *App) warmPath(ctx context.Context, entry *proxyruntime.Entry, target string) warmPath {
+	result := warmPath{Path: target, State: "failed"}
+	for attempt := 1; attempt <= warmMaxAttempts; attempt++ {
+		if err := a.downloads.Wait(ctx, entry.Name); err != nil {
+			result.Error = err.Error()
+			return result
+		}
+		req := (&http.Request{
+			Method:     http.MethodGet,
+			URL:        &url.URL{Path: target},
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{"User-Agent": []string{"cache-proxy-warm"}},
+			Host:       "cache-proxy",
+			RequestURI: target,
+		}).WithContext(ctx)
+		if entry.Path != "" {
+			req.Header.Set("X-Cache-Proxy-Prefix", entry.Path)
+		}
+		rec := &warmResponseWriter{header: http.Header{}}
+		entry.Runtime.ServeHTTP(rec, req)
+		result.Status = rec.statusCode()
+		result.Cache = rec.header.Get("X-Cache")
+		result.Bytes = rec.bytes
+		result.Error = ""
+		if result.Status >= 200 && result.Status < 300 {
+			result.State = "warmed"
+			return result
+		}
+		result.Error = http.StatusText(result.Status)
+		if rec.header.Get("Retry-After") == "" {
+			return result
+		}
+	}
+	return result
+}
+
+type warmResponseWriter struct {
+	header http.Header
+	status int
+	bytes  int64
+}
+
+func (w *warmResponseWriter) Header() http.Header { return w.header }
+
+func (w *warmResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *warmResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.bytes += int64(len(p))
+	return len(p), nil
+}
+
+func (w *warmResponseWriter) statusCode() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
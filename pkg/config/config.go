@@ -2,10 +2,14 @@ package config
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"net/url"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -37,6 +41,7 @@ const (
 	PolicyBypass     = "bypass"
 	PolicyImmutable  = "immutable"
 	PolicyRevalidate = "revalidate"
+	PolicyUpstream   = "upstream"
 
 	BusyPolicyBypass = "bypass"
 	BusyPolicyStale  = "stale"
@@ -55,13 +60,67 @@ type Document struct {
 	Metrics   MetricsConfig `yaml:"metrics"`
 	Storage   StorageConfig `yaml:"storage"`
 	Instances []Instance    `yaml:"instances"`
+
+	secrets []string
+}
+
+// Secrets returns the values resolved from secret references while decoding
+// the document.
+func (d *Document) Secrets() []string {
+	return append([]string(nil), d.secrets...)
 }
 
 type ServerConfig struct {
-	Bind      string             `yaml:"bind"`
-	Backend   string             `yaml:"backend"`
-	PublicURL string             `yaml:"public_url,omitempty"`
-	Status    ServerStatusConfig `yaml:"status"`
+	Bind           string             `yaml:"bind"`
+	Backend        string             `yaml:"backend"`
+	PublicURL      string             `yaml:"public_url,omitempty"`
+	Status         ServerStatusConfig `yaml:"status"`
+	Admin          AdminConfig        `yaml:"admin,omitempty"`
+	AccessLog      AccessLogConfig    `yaml:"access_log,omitempty"`
+	Access         AccessConfig       `yaml:"access,omitempty"`
+	TLS            *TLSConfig         `yaml:"tls,omitempty"`
+	AllowCIDRs     []string           `yaml:"allow_cidrs,omitempty"`
+	DenyCIDRs      []string           `yaml:"deny_cidrs,omitempty"`
+	TrustedProxies []string           `yaml:"trusted_proxies,omitempty"`
+	RateLimit      RateLimitConfig    `yaml:"rate_limit,omitempty"`
+}
+
+// RateLimitConfig limits each client, identified by its authenticated
+// identity or address. Zero values disable the corresponding limit.
+type RateLimitConfig struct {
+	RequestsPerSecond float64 `yaml:"requests_per_second,omitempty"`
+	Burst             int     `yaml:"burst,omitempty"`
+	BytesPerSecond    Size    `yaml:"bytes_per_second,omitempty"`
+}
+
+// TLSConfig serves a listener over TLS. Setting ClientCAFile requires clients
+// to present a certificate signed by one of its CAs.
+type TLSConfig struct {
+	CertFile     string `yaml:"cert_file"`
+	KeyFile      string `yaml:"key_file"`
+	ClientCAFile string `yaml:"client_ca_file,omitempty"`
+}
+
+// AccessConfig restricts who may use the proxy. With no tokens and no
+// htpasswd file every client is allowed.
+type AccessConfig struct {
+	Tokens        []string `yaml:"tokens,omitempty"`
+	Htpasswd      string   `yaml:"htpasswd,omitempty"`
+	AnonymousRead bool     `yaml:"anonymous_read,omitempty"`
+}
+
+// AccessLogConfig enables the per-request access log. An empty Path disables
+// it; "stderr" writes to standard error.
+type AccessLogConfig struct {
+	Path       string  `yaml:"path,omitempty"`
+	Format     string  `yaml:"format,omitempty"`
+	MaxSize    Size    `yaml:"max_size,omitempty"`
+	MaxBackups int     `yaml:"max_backups,omitempty"`
+	SampleRate float64 `yaml:"sample_rate,omitempty"`
+}
+
+type AdminConfig struct {
+	Token string `yaml:"token,omitempty"`
 }
 
 type ServerStatusConfig struct {
@@ -80,6 +139,7 @@ type StorageConfig struct {
 	Cleanup      CleanupConfig  `yaml:"cleanup"`
 	OrphanPolicy string         `yaml:"orphan_policy,omitempty"`
 	Download     DownloadConfig `yaml:"download"`
+	Quota        QuotaConfig    `yaml:"quota"`
 }
 
 type GCConfig struct {
@@ -96,6 +156,12 @@ type DownloadConfig struct {
 	MaxActivePerInstance int `yaml:"max_active_per_instance"`
 }
 
+type QuotaConfig struct {
+	Limit    Size     `yaml:"limit,omitempty"`
+	LowWater int      `yaml:"low_water,omitempty"`
+	Interval Duration `yaml:"interval,omitempty"`
+}
+
 func DefaultCleanupConfig() CleanupConfig {
 	return CleanupConfig{
 		DryRun:    false,
@@ -104,21 +170,31 @@ func DefaultCleanupConfig() CleanupConfig {
 }
 
 type Instance struct {
-	Name    string     `yaml:"name"`
-	Enabled bool       `yaml:"enabled"`
-	File    *ModeBlock `yaml:"file,omitempty"`
-	Git     *ModeBlock `yaml:"git,omitempty"`
-	OCI     *ModeBlock `yaml:"oci,omitempty"`
-	NPM     *ModeBlock `yaml:"npm,omitempty"`
-	Go      *ModeBlock `yaml:"go,omitempty"`
-	Maven   *ModeBlock `yaml:"maven,omitempty"`
-	Cargo   *ModeBlock `yaml:"cargo,omitempty"`
-	PyPI    *ModeBlock `yaml:"pypi,omitempty"`
-	Flatpak *ModeBlock `yaml:"flatpak,omitempty"`
-	APK     *ModeBlock `yaml:"apk,omitempty"`
-	DEB     *ModeBlock `yaml:"deb,omitempty"`
-	RPM     *ModeBlock `yaml:"rpm,omitempty"`
-	Pacman  *ModeBlock `yaml:"pacman,omitempty"`
+	Name          string           `yaml:"name"`
+	Enabled       bool             `yaml:"enabled"`
+	Quota         Size             `yaml:"quota,omitempty"`
+	Access        *AccessConfig    `yaml:"access,omitempty"`
+	AllowCIDRs    []string         `yaml:"allow_cidrs,omitempty"`
+	DenyCIDRs     []string         `yaml:"deny_cidrs,omitempty"`
+	RateLimit     *RateLimitConfig `yaml:"rate_limit,omitempty"`
+	Deny          []string         `yaml:"deny,omitempty"`
+	MinReleaseAge Duration         `yaml:"min_release_age,omitempty"`
+	// ReleaseAgeOverride lists the client networks and htpasswd users allowed
+	// to send the release age override header.
+	ReleaseAgeOverride []string   `yaml:"release_age_override,omitempty"`
+	File               *ModeBlock `yaml:"file,omitempty"`
+	Git                *ModeBlock `yaml:"git,omitempty"`
+	OCI                *ModeBlock `yaml:"oci,omitempty"`
+	NPM                *ModeBlock `yaml:"npm,omitempty"`
+	Go                 *ModeBlock `yaml:"go,omitempty"`
+	Maven              *ModeBlock `yaml:"maven,omitempty"`
+	Cargo              *ModeBlock `yaml:"cargo,omitempty"`
+	PyPI               *ModeBlock `yaml:"pypi,omitempty"`
+	Flatpak            *ModeBlock `yaml:"flatpak,omitempty"`
+	APK                *ModeBlock `yaml:"apk,omitempty"`
+	DEB                *ModeBlock `yaml:"deb,omitempty"`
+	RPM                *ModeBlock `yaml:"rpm,omitempty"`
+	Pacman             *ModeBlock `yaml:"pacman,omitempty"`
 }
 
 type TransportConfig struct {
@@ -131,6 +207,70 @@ type TransportConfig struct {
 	MaxIdleConns       int                 `yaml:"max_idle_conns,omitempty"`
 	MaxConnsPerHost    int                 `yaml:"max_conns_per_host,omitempty"`
 	Health             *health.ConfigPatch `yaml:"health,omitempty"`
+	Auth               UpstreamAuthList    `yaml:"auth,omitempty"`
+	TLS                *UpstreamTLSConfig  `yaml:"tls,omitempty"`
+}
+
+// UpstreamAuthConfig authenticates upstream requests with basic, bearer or a
+// custom header. Upstream limits it to URLs under that prefix; without it the
+// credentials go to every configured upstream.
+type UpstreamAuthConfig struct {
+	Upstream string `yaml:"upstream,omitempty"`
+	Type     string `yaml:"type"`
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+	Token    string `yaml:"token,omitempty"`
+	Header   string `yaml:"header,omitempty"`
+	Value    string `yaml:"value,omitempty"`
+}
+
+// UpstreamAuthList accepts a single auth block or a list of them.
+type UpstreamAuthList []UpstreamAuthConfig
+
+func (l *UpstreamAuthList) UnmarshalYAML(value *yaml.Node) error {
+	var list []UpstreamAuthConfig
+	block := &ModeBlock{Node: value}
+	if value.Kind == yaml.MappingNode {
+		var single UpstreamAuthConfig
+		if err := block.DecodeStrict(&single); err != nil {
+			return err
+		}
+		list = []UpstreamAuthConfig{single}
+	} else if err := block.DecodeStrict(&list); err != nil {
+		return err
+	}
+	for i := range list {
+		if err := list[i].validate(); err != nil {
+			return fmt.Errorf("transport auth %d: %w", i, err)
+		}
+	}
+	*l = list
+	return nil
+}
+
+func (a *UpstreamAuthConfig) validate() error {
+	switch a.Type {
+	case "basic":
+		if a.Username == "" || a.Password == "" {
+			return errors.New("basic auth requires username and password")
+		}
+	case "bearer":
+		if a.Token == "" {
+			return errors.New("bearer auth requires token")
+		}
+	case "header":
+		if a.Header == "" || a.Value == "" {
+			return errors.New("header auth requires header and value")
+		}
+	default:
+		return fmt.Errorf("unsupported auth type %q", a.Type)
+	}
+	if a.Upstream != "" {
+		if parsed, err := url.Parse(a.Upstream); err != nil || parsed.Host == "" {
+			return fmt.Errorf("invalid auth upstream %q", a.Upstream)
+		}
+	}
+	return nil
 }
 
 type SelectedMode struct {
@@ -220,9 +360,29 @@ func LoadFile(path string) (*Document, error) {
 	return Decode(file)
 }
 
+// Decode parses a config document. ${env:NAME} and ${file:/path} references
+// in any string value are resolved first.
 func Decode(r io.Reader) (*Document, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+	var secrets []string
+	found, err := resolveSecrets(&root, &secrets)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		if data, err = yaml.Marshal(&root); err != nil {
+			return nil, err
+		}
+	}
 	var doc Document
-	decoder := yaml.NewDecoder(r)
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
 	decoder.KnownFields(true)
 	if err := decoder.Decode(&doc); err != nil {
 		return nil, err
@@ -232,6 +392,7 @@ func Decode(r io.Reader) (*Document, error) {
 			return nil, fmt.Errorf("invalid instance name %q: must match %s", inst.Name, validNameRE.String())
 		}
 	}
+	doc.secrets = secrets
 	return &doc, nil
 }
 
@@ -368,3 +529,96 @@ func (f *Freshness) unmarshal(text string) error {
 	*f = Freshness(parsed)
 	return nil
 }
+
+// StaleWindows extend freshness: within WhileRevalidate past fresh_for the
+// cached copy is served while revalidating in the background, and within
+// IfError upstream failures are masked by the cached copy.
+type StaleWindows struct {
+	WhileRevalidate Freshness `json:"staleWhileRevalidate,omitempty" yaml:"stale_while_revalidate,omitempty"`
+	IfError         Freshness `json:"staleIfError,omitempty" yaml:"stale_if_error,omitempty"`
+}
+
+// Merge returns w with unset windows taken from fallback.
+func (w StaleWindows) Merge(fallback StaleWindows) StaleWindows {
+	if w.WhileRevalidate.IsUnset() {
+		w.WhileRevalidate = fallback.WhileRevalidate
+	}
+	if w.IfError.IsUnset() {
+		w.IfError = fallback.IfError
+	}
+	return w
+}
+
+type Size int64
+
+var sizeUnits = []struct {
+	suffix string
+	scale  int64
+}{
+	{suffix: "KiB", scale: 1 << 10},
+	{suffix: "MiB", scale: 1 << 20},
+	{suffix: "GiB", scale: 1 << 30},
+	{suffix: "TiB", scale: 1 << 40},
+	{suffix: "KB", scale: 1000},
+	{suffix: "MB", scale: 1000 * 1000},
+	{suffix: "GB", scale: 1000 * 1000 * 1000},
+	{suffix: "TB", scale: 1000 * 1000 * 1000 * 1000},
+	{suffix: "B", scale: 1},
+}
+
+func (s Size) Bytes() int64 { return int64(s) }
+
+func (s Size) String() string {
+	if s <= 0 {
+		return ""
+	}
+	for i := 3; i >= 0; i-- {
+		if unit := sizeUnits[i]; int64(s)%unit.scale == 0 {
+			return strconv.FormatInt(int64(s)/unit.scale, 10) + unit.suffix
+		}
+	}
+	return strconv.FormatInt(int64(s), 10)
+}
+
+func (s Size) MarshalYAML() (any, error) {
+	if s <= 0 {
+		return nil, nil
+	}
+	return s.String(), nil
+}
+
+func (s *Size) UnmarshalYAML(value *yaml.Node) error {
+	if value == nil || value.Value == "" {
+		*s = 0
+		return nil
+	}
+	return s.unmarshal(value.Value)
+}
+
+func (s *Size) unmarshal(text string) error {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		*s = 0
+		return nil
+	}
+	number, scale := text, int64(1)
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(text, unit.suffix) {
+			number, scale = strings.TrimSpace(strings.TrimSuffix(text, unit.suffix)), unit.scale
+			break
+		}
+	}
+	parsed, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return fmt.Errorf("invalid size %q", text)
+	}
+	if parsed < 0 {
+		return fmt.Errorf("size must not be negative: %q", text)
+	}
+	bytes := parsed * float64(scale)
+	if bytes > math.MaxInt64 {
+		return fmt.Errorf("size is too large: %q", text)
+	}
+	*s = Size(bytes)
+	return nil
+}
@@ -1,12 +1,16 @@
 package config
 
 import (
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/require"
 	"gopkg.in/yaml.v3"
+
+	"gopkg.d7z.net/cache-proxy/pkg/utils"
 )
 
 func TestExpirationYAML(t *testing.T) {
@@ -66,6 +70,36 @@ func TestFreshnessYAML(t *testing.T) {
 	}
 }
 
+func TestSizeYAML(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    Size
+		wantErr bool
+	}{
+		{name: "unset", input: "", want: 0},
+		{name: "bytes", input: "1024", want: 1024},
+		{name: "binary", input: "200GiB", want: Size(200 << 30)},
+		{name: "decimal", input: "1.5GB", want: Size(1500 * 1000 * 1000)},
+		{name: "spaced", input: "512 MiB", want: Size(512 << 20)},
+		{name: "negative", input: "-1GiB", wantErr: true},
+		{name: "invalid", input: "abc", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got Size
+			err := yaml.Unmarshal([]byte(tt.input), &got)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+	require.Equal(t, "200GiB", Size(200<<30).String())
+}
+
 func TestDecodeDocument(t *testing.T) {
 	doc, err := Decode(strings.NewReader(`
 server:
@@ -87,9 +121,14 @@ storage:
   download:
     max_active: 32
     max_active_per_instance: 6
+  quota:
+    limit: 500GiB
+    low_water: 80
+    interval: 5m
 instances:
   - name: files
     enabled: true
+    quota: 200GiB
     file:
       expire_after: 720h
       route:
@@ -108,7 +147,11 @@ instances:
 	require.Equal(t, "secret", doc.Metrics.Token)
 	require.Equal(t, 32, doc.Storage.Download.MaxActive)
 	require.Equal(t, 6, doc.Storage.Download.MaxActivePerInstance)
+	require.Equal(t, Size(500<<30), doc.Storage.Quota.Limit)
+	require.Equal(t, 80, doc.Storage.Quota.LowWater)
+	require.Equal(t, Duration(5*time.Minute), doc.Storage.Quota.Interval)
 	require.Len(t, doc.Instances, 1)
+	require.Equal(t, Size(200<<30), doc.Instances[0].Quota)
 	spec, err := doc.Instances[0].SelectMode()
 	require.NoError(t, err)
 	require.Equal(t, ModeFile, spec.Mode)
@@ -168,6 +211,77 @@ instances:
 	require.Nil(t, cfg.Transport.Health.DegradeRate)
 }
 
+func TestDecodeResolvesSecretReferences(t *testing.T) {
+	secretFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(secretFile, []byte("file-secret-value\n"), 0o600))
+	t.Setenv("CACHE_PROXY_TEST_SECRET", "env: secret #1")
+	doc, err := Decode(strings.NewReader(`
+metrics:
+  token: ${file:` + secretFile + `}
+instances:
+  - name: registry
+    enabled: true
+    oci:
+      route:
+        path: /registry
+      auth:
+        password: pre-${env:CACHE_PROXY_TEST_SECRET}
+`))
+	require.NoError(t, err)
+	require.Equal(t, "file-secret-value", doc.Metrics.Token)
+	selected, err := doc.Instances[0].SelectMode()
+	require.NoError(t, err)
+	var cfg struct {
+		Auth struct {
+			Password string `yaml:"password"`
+		} `yaml:"auth"`
+	}
+	require.NoError(t, selected.Block.Node.Decode(&cfg))
+	require.Equal(t, "pre-env: secret #1", cfg.Auth.Password)
+	require.ElementsMatch(t, []string{"file-secret-value", "env: secret #1"}, doc.Secrets())
+	utils.SetSecrets(doc.Secrets())
+	require.Equal(t, "token=[REDACTED] password=pre-[REDACTED]", utils.Redact("token=file-secret-value password=pre-env: secret #1"))
+
+	_, err = Decode(strings.NewReader("metrics:\n  token: ${env:CACHE_PROXY_TEST_UNSET}\n"))
+	require.ErrorContains(t, err, "line 2: secret ${env:CACHE_PROXY_TEST_UNSET}: variable is not set")
+}
+
+func TestDecodeTransportAuth(t *testing.T) {
+	var transport TransportConfig
+	require.NoError(t, yaml.Unmarshal([]byte("auth: {type: bearer, token: t}\n"), &transport))
+	require.Equal(t, UpstreamAuthList{{Type: "bearer", Token: "t"}}, transport.Auth)
+	require.NoError(t, yaml.Unmarshal([]byte(`
+auth:
+  - type: basic
+    upstream: https://repo.example/maven
+    username: ci
+    password: secret
+  - type: header
+    header: X-JFrog-Art-Api
+    value: key
+`), &transport))
+	require.Len(t, transport.Auth, 2)
+	require.ErrorContains(t, yaml.Unmarshal([]byte("auth: {type: bearer}\n"), &transport), "bearer auth requires token")
+	require.ErrorContains(t, yaml.Unmarshal([]byte("auth: {type: basic, user: ci}\n"), &transport), "field user not found")
+}
+
+func TestDecodeTransportTLSValidatesFiles(t *testing.T) {
+	decode := func(text string) (TransportConfig, error) {
+		var transport TransportConfig
+		err := yaml.Unmarshal([]byte(text), &transport)
+		return transport, err
+	}
+	transport, err := decode("tls: {server_name: mirror.internal, min_version: \"1.3\"}\n")
+	require.NoError(t, err)
+	require.Equal(t, "mirror.internal", transport.TLS.ServerName)
+	_, err = decode("tls: {min_version: \"1.4\"}\n")
+	require.ErrorContains(t, err, "min_version")
+	_, err = decode("tls: {client_cert: a.pem}\n")
+	require.ErrorContains(t, err, "must be set together")
+	_, err = decode("tls: {ca_file: /nonexistent/ca.pem}\n")
+	require.ErrorContains(t, err, "no such file")
+}
+
 func TestDecodeRejectsRemovedCleanupFields(t *testing.T) {
 	_, err := Decode(strings.NewReader(`
 storage:
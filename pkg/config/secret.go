@@ -0,0 +1,64 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// secretRefRE matches ${env:NAME} and ${file:/path} references.
+var secretRefRE = regexp.MustCompile(`\$\{(env|file):([^}]+)\}`)
+
+// resolveSecrets replaces secret references in every scalar of node and
+// appends the resolved values to secrets. It reports whether any reference
+// was found.
+func resolveSecrets(node *yaml.Node, secrets *[]string) (bool, error) {
+	if node == nil {
+		return false, nil
+	}
+	if node.Kind == yaml.ScalarNode {
+		if !secretRefRE.MatchString(node.Value) {
+			return false, nil
+		}
+		var resolveErr error
+		node.Value = secretRefRE.ReplaceAllStringFunc(node.Value, func(ref string) string {
+			match := secretRefRE.FindStringSubmatch(ref)
+			value, err := lookupSecret(match[1], strings.TrimSpace(match[2]))
+			if err != nil && resolveErr == nil {
+				resolveErr = fmt.Errorf("line %d: %w", node.Line, err)
+			}
+			*secrets = append(*secrets, value)
+			return value
+		})
+		return true, resolveErr
+	}
+	found := false
+	for _, child := range node.Content {
+		ok, err := resolveSecrets(child, secrets)
+		if err != nil {
+			return false, err
+		}
+		found = found || ok
+	}
+	return found, nil
+}
+
+func lookupSecret(kind, name string) (string, error) {
+	switch kind {
+	case "env":
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("secret ${env:%s}: variable is not set", name)
+		}
+		return value, nil
+	default:
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return "", fmt.Errorf("secret ${file:%s}: %w", name, err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+}
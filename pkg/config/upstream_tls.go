@@ -0,0 +1,77 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// UpstreamTLSConfig customizes TLS to upstreams: extra trusted CAs, a client
+// certificate, the verified server name and the minimum protocol version.
+type UpstreamTLSConfig struct {
+	CAFile     string `yaml:"ca_file,omitempty"`
+	ClientCert string `yaml:"client_cert,omitempty"`
+	ClientKey  string `yaml:"client_key,omitempty"`
+	ServerName string `yaml:"server_name,omitempty"`
+	MinVersion string `yaml:"min_version,omitempty"`
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func (c *UpstreamTLSConfig) UnmarshalYAML(value *yaml.Node) error {
+	type plain UpstreamTLSConfig
+	if err := (&ModeBlock{Node: value}).DecodeStrict((*plain)(c)); err != nil {
+		return err
+	}
+	if _, err := c.ClientConfig(); err != nil {
+		return fmt.Errorf("transport tls: %w", err)
+	}
+	return nil
+}
+
+// ClientConfig loads the referenced files into a client tls.Config. The CA
+// bundle is added to the system roots.
+func (c *UpstreamTLSConfig) ClientConfig() (*tls.Config, error) {
+	result := &tls.Config{ServerName: c.ServerName, MinVersion: tls.VersionTLS12}
+	if c.MinVersion != "" {
+		version, ok := tlsVersions[c.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("min_version %q must be one of 1.0, 1.1, 1.2, 1.3", c.MinVersion)
+		}
+		result.MinVersion = version
+	}
+	if c.CAFile != "" {
+		data, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates in ca_file %s", c.CAFile)
+		}
+		result.RootCAs = pool
+	}
+	if (c.ClientCert == "") != (c.ClientKey == "") {
+		return nil, errors.New("client_cert and client_key must be set together")
+	}
+	if c.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(c.ClientCert, c.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		result.Certificates = []tls.Certificate{cert}
+	}
+	return result, nil
+}
@@ -95,12 +95,27 @@ func New(name, mode string, cfg Config, upstreams []string, stats StatsRecorder,
 
 func (h *ServiceHealth) SetBus(b *bus.Bus) { h.bus = b }
 
+// SetProbeTransport replaces the transport of the active probe client. The
+// probe timeout still bounds response headers.
+func (h *ServiceHealth) SetProbeTransport(transport *http.Transport) {
+	transport.ResponseHeaderTimeout = h.config.ProbeTimeout
+	h.probeClient = &http.Client{Transport: transport}
+}
+
 // SetProbeScheduler attaches the shared active probe scheduler.
-func (h *ServiceHealth) SetProbeScheduler(s *ProbeScheduler) { h.probeScheduler = s }
+func (h *ServiceHealth) SetProbeScheduler(s *ProbeScheduler) {
+	h.lifecycleMu.Lock()
+	h.probeScheduler = s
+	h.lifecycleMu.Unlock()
+	s.attach(h)
+}
 
 func (h *ServiceHealth) notifyProbeScheduler() {
-	if h.probeScheduler != nil {
-		h.probeScheduler.notify()
+	h.lifecycleMu.Lock()
+	scheduler := h.probeScheduler
+	h.lifecycleMu.Unlock()
+	if scheduler != nil {
+		scheduler.notify()
 	}
 }
 
@@ -219,7 +234,7 @@ func (h *ServiceHealth) WeightedUpstreams(upstreams []string) []WeightedUpstream
 			result = append(result, WeightedUpstream{URL: url, Weight: 1.0})
 		}
 	}
-	sort.Slice(result, func(i, j int) bool {
+	sort.SliceStable(result, func(i, j int) bool {
 		return result[i].Weight > result[j].Weight
 	})
 	return result
@@ -952,6 +952,35 @@ func TestProbeSchedulerWakesWhenTargetIsAdded(t *testing.T) {
 	collectProbeTimes(t, requests, 1, time.Second)
 }
 
+func TestStagedProbeSchedulerProbesOnlyAfterAdopt(t *testing.T) {
+	requests := make(chan time.Time, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- time.Now()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := newProbeScheduler(ctx, probeSchedulerConfig{MinHostInterval: 5 * time.Millisecond})
+	defer func() { require.NoError(t, s.Stop(context.Background())) }()
+
+	staged := NewStagedProbeScheduler()
+	h := New("test", "apk", fastProbeConfig(), []string{server.URL}, nil, "ua")
+	addActiveProbeResource(h, "repo", "probe", server.URL)
+	h.SetProbeScheduler(staged)
+	h.Start(ctx)
+	defer func() { require.NoError(t, h.Stop(context.Background())) }()
+
+	select {
+	case <-requests:
+		t.Fatal("staged scheduler probed before adopt")
+	case <-time.After(50 * time.Millisecond):
+	}
+	s.Adopt(staged)
+	collectProbeTimes(t, requests, 1, time.Second)
+}
+
 func TestProbeSchedulerUsesCanaryCooldownForOpenUpstream(t *testing.T) {
 	requests := make(chan time.Time, 1)
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -1389,3 +1418,13 @@ func BenchmarkAggregateState(b *testing.B) {
 		h.AggregateState()
 	}
 }
+
+func TestSetProbeTransportKeepsProbeTimeout(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ProbeTimeout = 3 * time.Second
+	h := New("test", "file", cfg, []string{"https://upstream.example"}, nil, "test")
+	transport := &http.Transport{ResponseHeaderTimeout: time.Minute}
+	h.SetProbeTransport(transport)
+	require.Same(t, transport, h.probeClient.Transport)
+	require.Equal(t, 3*time.Second, transport.ResponseHeaderTimeout)
+}
@@ -31,6 +31,10 @@ type ProbeScheduler struct {
 	services map[*ServiceHealth]struct{}
 	jobs     map[probeJobKey]*probeJob
 	hosts    map[string]*probeHost
+	// A staged scheduler runs no probes and holds its services in attached
+	// until Adopt.
+	staged   bool
+	attached map[*ServiceHealth]struct{}
 }
 
 type probeJobKey struct {
@@ -94,6 +98,51 @@ func newProbeScheduler(parent context.Context, cfg probeSchedulerConfig) *ProbeS
 	return s
 }
 
+// NewStagedProbeScheduler returns a probe scheduler that runs no probes, for
+// planning a config that may still be rejected. Services attached to it move
+// to a running scheduler with Adopt once the plan is applied.
+func NewStagedProbeScheduler() *ProbeScheduler {
+	return &ProbeScheduler{
+		wake:     make(chan struct{}, 1),
+		services: map[*ServiceHealth]struct{}{},
+		jobs:     map[probeJobKey]*probeJob{},
+		hosts:    map[string]*probeHost{},
+		staged:   true,
+		attached: map[*ServiceHealth]struct{}{},
+	}
+}
+
+// Adopt moves the services attached to staged to s and registers the ones
+// already started.
+func (s *ProbeScheduler) Adopt(staged *ProbeScheduler) {
+	if s == nil || staged == nil {
+		return
+	}
+	staged.mu.Lock()
+	services := staged.attached
+	staged.attached = map[*ServiceHealth]struct{}{}
+	staged.services = map[*ServiceHealth]struct{}{}
+	staged.mu.Unlock()
+	for h := range services {
+		h.lifecycleMu.Lock()
+		h.probeScheduler = s
+		running := h.running && !h.stopping
+		h.lifecycleMu.Unlock()
+		if running {
+			s.register(h)
+		}
+	}
+}
+
+func (s *ProbeScheduler) attach(h *ServiceHealth) {
+	if s == nil || !s.staged {
+		return
+	}
+	s.mu.Lock()
+	s.attached[h] = struct{}{}
+	s.mu.Unlock()
+}
+
 func (s *ProbeScheduler) register(h *ServiceHealth) {
 	if s == nil || h == nil {
 		return
@@ -122,7 +171,7 @@ func (s *ProbeScheduler) unregister(h *ServiceHealth) {
 
 // Stop cancels the scheduler and waits for its goroutines to exit.
 func (s *ProbeScheduler) Stop(ctx context.Context) error {
-	if s == nil {
+	if s == nil || s.staged {
 		return nil
 	}
 	if ctx == nil {
@@ -16,10 +16,13 @@ import (
 const defaultCleanupInterval = 6 * time.Hour
 
 type Policy struct {
+	config.StaleWindows `yaml:",inline"`
+
 	IndexFreshFor   config.Freshness `json:"indexFreshFor,omitempty" yaml:"index_fresh_for,omitempty"`
 	IndexBusyPolicy string           `json:"indexBusyPolicy,omitempty" yaml:"index_busy_policy,omitempty"`
 	CratePolicy     string           `json:"cratePolicy,omitempty" yaml:"crate_policy,omitempty"`
 	AuthRequired    bool             `json:"authRequired,omitempty" yaml:"auth_required,omitempty"`
+	NegativeTTL     config.Duration  `json:"negativeTTL,omitempty" yaml:"negative_ttl,omitempty"`
 }
 
 type Block struct {
@@ -64,9 +67,13 @@ func (Driver) Plan(_ context.Context, plan *proxyruntime.InstancePlan) error {
 		Transport:       block.Transport,
 		BusyPolicy:      block.IndexBusyPolicy,
 		DefaultFreshFor: block.IndexFreshFor,
+		DefaultStale:    block.StaleWindows,
+		NegativeTTL:     block.NegativeTTL,
 		DownloadLimiter: plan.Downloads(),
+		Deny:            plan.Deny(),
+		MinReleaseAge:   plan.MinReleaseAge(),
 	}
-	h := newHandler(plan.Name(), runtime, plan.Store(), newResolver(&block.Policy, plan.Store(), plan.Name()), plan.Stats())
+	h := newHandler(plan.Name(), runtime, plan.Store(), newResolver(&block.Policy, plan.Store(), plan.Name(), plan.Deny(), plan.MinReleaseAge() > 0), plan.Stats())
 	plan.Scheduler().Register(scheduler.TaskDef{
 		Key:      scheduler.NewTaskKey(plan.Name(), scheduler.TypeExpireCleanup, ""),
 		Interval: defaultCleanupInterval,
@@ -102,5 +109,8 @@ func validatePolicy(instance string, policy *Policy) error {
 	if policy.IndexFreshFor > 0 && policy.IndexFreshFor.Duration() < time.Second {
 		return fmt.Errorf("instance %s: cargo index fresh_for must be at least 1s", instance)
 	}
+	if policy.NegativeTTL < 0 {
+		return fmt.Errorf("instance %s: cargo negative_ttl must not be negative", instance)
+	}
 	return nil
 }
@@ -13,6 +13,7 @@ import (
 	"gopkg.d7z.net/blobfs"
 
 	"gopkg.d7z.net/cache-proxy/pkg/config"
+	"gopkg.d7z.net/cache-proxy/pkg/proxy/shared/deny"
 	"gopkg.d7z.net/cache-proxy/pkg/proxy/shared/httpcache"
 )
 
@@ -20,14 +21,17 @@ type resolver struct {
 	policy *Policy
 	store  *blobfs.Store
 	name   string
+	deny   *deny.List
+	// filterIndex rewrites index files for min_release_age.
+	filterIndex bool
 
 	cfgMu     sync.Mutex
 	cfgCached bool
 	cfgDL     string
 }
 
-func newResolver(policy *Policy, store *blobfs.Store, name string) *resolver {
-	return &resolver{policy: policy, store: store, name: name}
+func newResolver(policy *Policy, store *blobfs.Store, name string, denyList *deny.List, filterIndex bool) *resolver {
+	return &resolver{policy: policy, store: store, name: name, deny: denyList, filterIndex: filterIndex}
 }
 
 func (r *resolver) Resolve(req *http.Request) (httpcache.Route, error) {
@@ -52,22 +56,31 @@ func (r *resolver) Resolve(req *http.Request) (httpcache.Route, error) {
 	case strings.HasPrefix(lookupPath, "api/v1/crates/") && strings.HasSuffix(lookupPath, "/download"):
 		objectPath := "cargo/crates/" + strings.TrimPrefix(lookupPath, "api/v1/crates/")
 		targetURL := r.crateTargetURL(req.Context(), lookupPath)
-		return httpcache.Route{
+		route := httpcache.Route{
 			ObjectPath:         objectPath,
 			UpstreamPath:       lookupPath,
 			TargetURL:          targetURL,
 			AllowedTargetHosts: targetHost(targetURL),
 			Policy:             r.policy.CratePolicy,
 			BusyPolicy:         config.BusyPolicyBypass,
-		}, nil
+		}
+		if parts := strings.Split(strings.TrimPrefix(lookupPath, "api/v1/crates/"), "/"); len(parts) == 3 {
+			route.Denied = r.deny.Match(parts[0], parts[1])
+		}
+		return route, nil
 	default:
-		return httpcache.Route{
+		route := httpcache.Route{
 			ObjectPath:   "cargo/index/" + lookupPath,
 			UpstreamPath: lookupPath,
 			Policy:       config.PolicyRevalidate,
 			FreshFor:     r.policy.IndexFreshFor,
 			BusyPolicy:   r.policy.IndexBusyPolicy,
-		}, nil
+		}
+		if r.deny != nil || r.filterIndex {
+			route.RewriteKind = "cargo-index"
+			route.Denied = r.deny.Match(path.Base(lookupPath), "")
+		}
+		return route, nil
 	}
 }
 
@@ -22,19 +22,29 @@ import (
 const defaultCleanupInterval = 6 * time.Hour
 
 type Policy struct {
+	config.StaleWindows `yaml:",inline"`
+
 	PassHeaders   []string         `json:"passHeaders,omitempty" yaml:"pass_headers,omitempty"`
 	DefaultPolicy string           `json:"defaultPolicy,omitempty" yaml:"default_policy,omitempty"`
 	FreshFor      config.Freshness `json:"freshFor,omitempty" yaml:"fresh_for,omitempty"`
+	MinFreshFor   config.Duration  `json:"minFreshFor,omitempty" yaml:"min_fresh_for,omitempty"`
+	MaxFreshFor   config.Duration  `json:"maxFreshFor,omitempty" yaml:"max_fresh_for,omitempty"`
 	BusyPolicy    string           `json:"busyPolicy,omitempty" yaml:"busy_policy,omitempty"`
 	Rules         []Rule           `json:"rules,omitempty" yaml:"rules,omitempty"`
+	NegativeTTL   config.Duration  `json:"negativeTTL,omitempty" yaml:"negative_ttl,omitempty"`
 }
 
 type Rule struct {
+	config.StaleWindows `yaml:",inline"`
+
 	Match       string            `json:"match,omitempty" yaml:"match,omitempty"`
 	Policy      string            `json:"policy,omitempty" yaml:"policy,omitempty"`
 	FreshFor    config.Freshness  `json:"freshFor,omitempty" yaml:"fresh_for,omitempty"`
+	MinFreshFor config.Duration   `json:"minFreshFor,omitempty" yaml:"min_fresh_for,omitempty"`
+	MaxFreshFor config.Duration   `json:"maxFreshFor,omitempty" yaml:"max_fresh_for,omitempty"`
 	BusyPolicy  string            `json:"busyPolicy,omitempty" yaml:"busy_policy,omitempty"`
 	ExpireAfter config.Expiration `json:"expireAfter,omitempty" yaml:"expire_after,omitempty"`
+	NegativeTTL config.Duration   `json:"negativeTTL,omitempty" yaml:"negative_ttl,omitempty"`
 }
 
 type Block struct {
@@ -118,6 +128,7 @@ func (Driver) Plan(_ context.Context, plan *proxyruntime.InstancePlan) error {
 	sh := health.New(plan.Name(), config.ModeFile, healthCfg, upstreams, plan.Stats(), probeUserAgent)
 	sh.SetProbeScheduler(plan.ProbeScheduler())
 	sh.SetBus(plan.Bus())
+	httpcache.ConfigureProbeTransport(sh, plan.Name(), block.Transport)
 	base := httpcache.NewHandler(plan.Name(), httpcache.RuntimeConfig{
 		Mode:            config.ModeFile,
 		ExpireAfter:     expireAfter,
@@ -126,6 +137,8 @@ func (Driver) Plan(_ context.Context, plan *proxyruntime.InstancePlan) error {
 		PassHeaders:     append([]string(nil), block.PassHeaders...),
 		BusyPolicy:      block.BusyPolicy,
 		DefaultFreshFor: block.FreshFor,
+		DefaultStale:    block.StaleWindows,
+		NegativeTTL:     block.NegativeTTL,
 		DownloadLimiter: plan.Downloads(),
 	}, plan.Store(), fileResolver{policy: &block.Policy}, plan.Stats(), sh)
 	handler := &handler{base: base, sh: sh}
@@ -157,6 +170,8 @@ func (r fileResolver) Resolve(req *http.Request) (httpcache.Route, error) {
 		UpstreamPath: cleanPath,
 		Policy:       r.policy.DefaultPolicy,
 		FreshFor:     r.policy.FreshFor,
+		MinFreshFor:  r.policy.MinFreshFor,
+		MaxFreshFor:  r.policy.MaxFreshFor,
 		BusyPolicy:   r.policy.BusyPolicy,
 	}
 	for _, rule := range r.policy.Rules {
@@ -169,9 +184,19 @@ func (r fileResolver) Resolve(req *http.Request) (httpcache.Route, error) {
 		if rule.FreshFor != 0 {
 			route.FreshFor = rule.FreshFor
 		}
+		if rule.MinFreshFor > 0 {
+			route.MinFreshFor = rule.MinFreshFor
+		}
+		if rule.MaxFreshFor > 0 {
+			route.MaxFreshFor = rule.MaxFreshFor
+		}
 		if rule.BusyPolicy != "" {
 			route.BusyPolicy = rule.BusyPolicy
 		}
+		route.Stale = rule.StaleWindows.Merge(route.Stale)
+		if rule.NegativeTTL > 0 {
+			route.NegativeTTL = rule.NegativeTTL
+		}
 		if !rule.ExpireAfter.IsUnset() {
 			route.ExpireAfter = rule.ExpireAfter
 		}
@@ -179,16 +204,32 @@ func (r fileResolver) Resolve(req *http.Request) (httpcache.Route, error) {
 	return route, nil
 }
 
+// NegativeRoutes reports whether any rule sets its own negative_ttl.
+func (r fileResolver) NegativeRoutes() bool {
+	for _, rule := range r.policy.Rules {
+		if rule.NegativeTTL > 0 {
+			return true
+		}
+	}
+	return false
+}
+
 func validatePolicy(policy *Policy) error {
 	if err := filerepo.ValidatePassHeaders(policy.PassHeaders); err != nil {
 		return err
 	}
-	if err := filerepo.ValidatePolicy(config.ModeFile, policy.DefaultPolicy); err != nil {
+	if err := validateCachePolicy(policy.DefaultPolicy); err != nil {
 		return err
 	}
 	if err := filerepo.ValidateBusyPolicy(config.ModeFile, policy.BusyPolicy); err != nil {
 		return err
 	}
+	if policy.NegativeTTL < 0 {
+		return errors.New("file negative_ttl must not be negative")
+	}
+	if err := validateFreshClamp("file", policy.MinFreshFor, policy.MaxFreshFor); err != nil {
+		return err
+	}
 	for i, rule := range policy.Rules {
 		if strings.TrimSpace(rule.Match) == "" {
 			return fmt.Errorf("file rule %d: match is empty", i)
@@ -197,13 +238,38 @@ func validatePolicy(policy *Policy) error {
 			return fmt.Errorf("file rule %d: invalid match %q", i, rule.Match)
 		}
 		if rule.Policy != "" {
-			if err := filerepo.ValidatePolicy(config.ModeFile, rule.Policy); err != nil {
+			if err := validateCachePolicy(rule.Policy); err != nil {
 				return err
 			}
 		}
 		if err := filerepo.ValidateBusyPolicy(config.ModeFile, rule.BusyPolicy); err != nil {
 			return err
 		}
+		if rule.NegativeTTL < 0 {
+			return fmt.Errorf("file rule %d: negative_ttl must not be negative", i)
+		}
+		if err := validateFreshClamp(fmt.Sprintf("file rule %d:", i), rule.MinFreshFor, rule.MaxFreshFor); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateCachePolicy also accepts the upstream policy, which only file mode
+// supports.
+func validateCachePolicy(policy string) error {
+	if policy == config.PolicyUpstream {
+		return nil
+	}
+	return filerepo.ValidatePolicy(config.ModeFile, policy)
+}
+
+func validateFreshClamp(scope string, minFreshFor, maxFreshFor config.Duration) error {
+	if minFreshFor < 0 || maxFreshFor < 0 {
+		return fmt.Errorf("%s min_fresh_for and max_fresh_for must not be negative", scope)
+	}
+	if maxFreshFor > 0 && minFreshFor > maxFreshFor {
+		return fmt.Errorf("%s min_fresh_for must not exceed max_fresh_for", scope)
 	}
 	return nil
 }
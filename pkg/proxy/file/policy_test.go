@@ -71,3 +71,24 @@ func TestHandlerStopClosesHealthBeforeBase(t *testing.T) {
 	require.NoError(t, h.Start(ctx))
 	require.NoError(t, h.Stop(context.Background()))
 }
+
+func TestResolverAppliesFreshClampsAndValidatesThem(t *testing.T) {
+	policy := &Policy{
+		DefaultPolicy: config.PolicyUpstream,
+		MaxFreshFor:   config.Duration(time.Hour),
+		Rules: []Rule{{
+			Match:       "releases/**",
+			MinFreshFor: config.Duration(10 * time.Minute),
+		}},
+	}
+	require.NoError(t, validatePolicy(policy))
+	route, err := fileResolver{policy: policy}.Resolve(httptest.NewRequest(http.MethodGet, "/releases/v1.tar.gz", nil))
+	require.NoError(t, err)
+	require.Equal(t, config.PolicyUpstream, route.Policy)
+	require.Equal(t, config.Duration(10*time.Minute), route.MinFreshFor)
+	require.Equal(t, config.Duration(time.Hour), route.MaxFreshFor)
+
+	policy.Rules[0].MinFreshFor = config.Duration(2 * time.Hour)
+	policy.Rules[0].MaxFreshFor = config.Duration(time.Hour)
+	require.ErrorContains(t, validatePolicy(policy), "min_fresh_for must not exceed max_fresh_for")
+}
@@ -58,3 +58,15 @@ func isLowerHex(value string) bool {
 	}
 	return true
 }
+
+// PurgePath maps cached objects back to their request path. Published metadata
+// generations are never purged; refresh replaces them.
+func (h *Handler) PurgePath(objectPath string) (string, bool) {
+	if strings.HasPrefix(objectPath, metadataRoot+"/") {
+		return "", false
+	}
+	if cleanPath, ok := strings.CutPrefix(objectPath, "flatpak/metadata-cache/"); ok {
+		return cleanPath, true
+	}
+	return strings.TrimPrefix(objectPath, "flatpak/"), true
+}
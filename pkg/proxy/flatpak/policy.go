@@ -22,6 +22,8 @@ const (
 )
 
 type Policy struct {
+	config.StaleWindows `yaml:",inline"`
+
 	MetadataFreshFor   config.Freshness  `json:"metadataFreshFor,omitempty" yaml:"metadata_fresh_for,omitempty"`
 	MetadataBusyPolicy string            `json:"metadataBusyPolicy,omitempty" yaml:"metadata_busy_policy,omitempty"`
 	DescriptorRewrite  *bool             `json:"descriptorRewrite,omitempty" yaml:"descriptor_rewrite,omitempty"`
@@ -90,6 +92,7 @@ func (Driver) Plan(_ context.Context, plan *proxyruntime.InstancePlan) error {
 	sh := health.New(plan.Name(), config.ModeFlatpak, healthCfg, upstreams, plan.Stats(), probeUserAgent)
 	sh.SetProbeScheduler(plan.ProbeScheduler())
 	sh.SetBus(plan.Bus())
+	httpcache.ConfigureProbeTransport(sh, plan.Name(), block.Transport)
 
 	runtimeCfg := httpcache.RuntimeConfig{
 		Mode:            config.ModeFlatpak,
@@ -98,6 +101,7 @@ func (Driver) Plan(_ context.Context, plan *proxyruntime.InstancePlan) error {
 		Transport:       block.Transport,
 		BusyPolicy:      block.MetadataBusyPolicy,
 		DefaultFreshFor: block.MetadataFreshFor,
+		DefaultStale:    block.StaleWindows,
 		DownloadLimiter: plan.Downloads(),
 	}
 	handler := NewHandler(
@@ -14,6 +14,7 @@ import (
 	"gopkg.d7z.net/blobfs"
 
 	"gopkg.d7z.net/cache-proxy/pkg/config"
+	"gopkg.d7z.net/cache-proxy/pkg/proxy/shared/deny"
 	"gopkg.d7z.net/cache-proxy/pkg/proxy/shared/httpcache"
 )
 
@@ -33,6 +34,7 @@ const (
 type Handler struct {
 	name   string
 	policy *Policy
+	deny   *deny.List
 	store  *blobfs.Store
 	base   *httpcache.Handler
 }
@@ -44,7 +46,7 @@ type moduleRequest struct {
 	cacheKey   string
 }
 
-func NewHandler(name string, expireAfter config.Expiration, upstreams []string, transport *config.TransportConfig, policy *Policy, store *blobfs.Store, stats *httpcache.Stats, downloads *httpcache.DownloadLimiter) (*Handler, error) {
+func NewHandler(name string, expireAfter config.Expiration, upstreams []string, transport *config.TransportConfig, policy *Policy, denyList *deny.List, store *blobfs.Store, stats *httpcache.Stats, downloads *httpcache.DownloadLimiter) (*Handler, error) {
 	if policy == nil {
 		policy = &Policy{}
 	}
@@ -56,10 +58,13 @@ func NewHandler(name string, expireAfter config.Expiration, upstreams []string,
 		Transport:          transport,
 		BusyPolicy:         policy.ModuleBusyPolicy,
 		DefaultFreshFor:    policy.ModuleFreshFor,
+		DefaultStale:       policy.StaleWindows,
+		NegativeTTL:        policy.NegativeTTL,
 		AllowedTargetHosts: sumDBTargetHosts(policy),
 		DownloadLimiter:    downloads,
-	}, store, &resolver{policy: policy}, stats, nil)
-	return &Handler{name: name, policy: policy, store: store, base: base}, nil
+		Deny:               denyList,
+	}, store, &resolver{policy: policy, deny: denyList}, stats, nil)
+	return &Handler{name: name, policy: policy, deny: denyList, store: store, base: base}, nil
 }
 
 func sumDBTargetHosts(policy *Policy) []string {
@@ -79,7 +84,7 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		http.NotFound(w, req)
 		return
 	}
-	route, err := (&resolver{policy: h.policy}).Resolve(req)
+	route, err := (&resolver{policy: h.policy, deny: h.deny}).Resolve(req)
 	if err != nil {
 		if errors.Is(err, fs.ErrNotExist) {
 			http.Error(w, err.Error(), http.StatusNotFound)
@@ -111,6 +116,7 @@ func (h *Handler) Cleanup(ctx context.Context, opts config.CleanupConfig) error
 
 type resolver struct {
 	policy *Policy
+	deny   *deny.List
 }
 
 func (r *resolver) Resolve(req *http.Request) (httpcache.Route, error) {
@@ -136,6 +142,13 @@ func (r *resolver) Resolve(req *http.Request) (httpcache.Route, error) {
 		route.Policy = r.policy.ZipPolicy
 		route.BusyPolicy = config.BusyPolicyBypass
 	}
+	if r.deny != nil {
+		route.Denied = r.deny.Match(moduleReq.modulePath, moduleVersion(moduleReq))
+		if moduleReq.kind == moduleRequestList {
+			route.RewriteKind = "go-list"
+			route.Package = moduleReq.modulePath
+		}
+	}
 	return route, nil
 }
 
@@ -208,6 +221,15 @@ func parseModuleRequest(target string) (moduleRequest, error) {
 	return moduleRequest{}, fs.ErrNotExist
 }
 
+// moduleVersion returns the version a request fetches, or "" for list and
+// latest queries.
+func moduleVersion(req moduleRequest) string {
+	if req.kind == moduleRequestList || req.kind == moduleRequestLatest {
+		return ""
+	}
+	return req.version
+}
+
 func unsupportedQueryError(query string) error {
 	return fmt.Errorf("go module query %q requires direct source resolution, which this proxy disables: %w", query, fs.ErrNotExist)
 }
@@ -25,6 +25,8 @@ type SumDBConfig struct {
 }
 
 type Config struct {
+	config.StaleWindows `yaml:",inline"`
+
 	SumDB                    *SumDBConfig     `json:"sumdb,omitempty" yaml:"sumdb,omitempty"`
 	GOPrivate                []string         `json:"goprivate,omitempty" yaml:"goprivate,omitempty"`
 	DisableModuleFetchHeader bool             `json:"disableModuleFetchHeader,omitempty" yaml:"disable_module_fetch_header,omitempty"`
@@ -34,6 +36,7 @@ type Config struct {
 	ZipPolicy                string           `json:"zipPolicy,omitempty" yaml:"zip_policy,omitempty"`
 	SumDBFreshFor            config.Freshness `json:"sumdbFreshFor,omitempty" yaml:"sumdb_fresh_for,omitempty"`
 	SumDBBusyPolicy          string           `json:"sumdbBusyPolicy,omitempty" yaml:"sumdb_busy_policy,omitempty"`
+	NegativeTTL              config.Duration  `json:"negativeTTL,omitempty" yaml:"negative_ttl,omitempty"`
 }
 
 type Policy = Config
@@ -66,7 +69,7 @@ func (Driver) Plan(_ context.Context, plan *proxyruntime.InstancePlan) error {
 	if expireAfter.IsUnset() {
 		expireAfter = config.DefaultExpireAfter
 	}
-	handler, err := NewHandler(plan.Name(), expireAfter, block.Proxies, block.Transport, &block.Config, plan.Store(), plan.Stats(), plan.Downloads())
+	handler, err := NewHandler(plan.Name(), expireAfter, block.Proxies, block.Transport, &block.Config, plan.Deny(), plan.Store(), plan.Stats(), plan.Downloads())
 	if err != nil {
 		return fmt.Errorf("instance %s: %w", plan.Name(), err)
 	}
@@ -177,6 +180,9 @@ func validateBlock(proxies []string, cfg *Config) error {
 	if cfg.SumDBFreshFor > 0 && cfg.SumDBFreshFor.Duration() < time.Second {
 		return fmt.Errorf("go sumdb fresh_for must be at least 1s")
 	}
+	if cfg.NegativeTTL < 0 {
+		return fmt.Errorf("go negative_ttl must not be negative")
+	}
 	return nil
 }
 
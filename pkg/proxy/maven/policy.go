@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"gopkg.d7z.net/cache-proxy/pkg/config"
+	"gopkg.d7z.net/cache-proxy/pkg/proxy/shared/deny"
 	"gopkg.d7z.net/cache-proxy/pkg/proxy/shared/httpcache"
 	proxyruntime "gopkg.d7z.net/cache-proxy/pkg/runtime"
 	"gopkg.d7z.net/cache-proxy/pkg/scheduler"
@@ -18,6 +19,8 @@ import (
 const defaultCleanupInterval = 6 * time.Hour
 
 type Policy struct {
+	config.StaleWindows `yaml:",inline"`
+
 	MetadataFreshFor   config.Freshness `json:"metadataFreshFor,omitempty" yaml:"metadata_fresh_for,omitempty"`
 	MetadataBusyPolicy string           `json:"metadataBusyPolicy,omitempty" yaml:"metadata_busy_policy,omitempty"`
 	ChecksumPolicy     string           `json:"checksumPolicy,omitempty" yaml:"checksum_policy,omitempty"`
@@ -26,6 +29,7 @@ type Policy struct {
 	ReleasePolicy      string           `json:"releasePolicy,omitempty" yaml:"release_policy,omitempty"`
 	SnapshotPolicy     string           `json:"snapshotPolicy,omitempty" yaml:"snapshot_policy,omitempty"`
 	SnapshotFreshFor   config.Freshness `json:"snapshotFreshFor,omitempty" yaml:"snapshot_fresh_for,omitempty"`
+	NegativeTTL        config.Duration  `json:"negativeTTL,omitempty" yaml:"negative_ttl,omitempty"`
 }
 
 type Block struct {
@@ -68,8 +72,10 @@ func (Driver) Plan(_ context.Context, plan *proxyruntime.InstancePlan) error {
 		Upstreams:       []string{strings.TrimSpace(block.Upstream)},
 		Transport:       block.Transport,
 		BusyPolicy:      config.BusyPolicyBypass,
+		DefaultStale:    block.StaleWindows,
+		NegativeTTL:     block.NegativeTTL,
 		DownloadLimiter: plan.Downloads(),
-	}, plan.Store(), newResolver(&block.Policy), plan.Stats(), nil)
+	}, plan.Store(), newResolver(&block.Policy, plan.Deny()), plan.Stats(), nil)
 	plan.Scheduler().Register(scheduler.TaskDef{
 		Key:      scheduler.NewTaskKey(plan.Name(), scheduler.TypeExpireCleanup, ""),
 		Interval: defaultCleanupInterval,
@@ -132,12 +138,20 @@ func validate(policy *Policy) error {
 	if policy.SnapshotFreshFor > 0 && policy.SnapshotFreshFor.Duration() < time.Second {
 		return fmt.Errorf("maven snapshot fresh_for must be at least 1s")
 	}
+	if policy.NegativeTTL < 0 {
+		return fmt.Errorf("maven negative_ttl must not be negative")
+	}
 	return nil
 }
 
-type resolver struct{ policy *Policy }
+type resolver struct {
+	policy *Policy
+	deny   *deny.List
+}
 
-func newResolver(policy *Policy) *resolver { return &resolver{policy: policy} }
+func newResolver(policy *Policy, denyList *deny.List) *resolver {
+	return &resolver{policy: policy, deny: denyList}
+}
 
 func (r *resolver) Resolve(req *http.Request) (httpcache.Route, error) {
 	lookupPath := strings.TrimPrefix(path.Clean("/"+req.URL.Path), "/")
@@ -152,6 +166,9 @@ func (r *resolver) Resolve(req *http.Request) (httpcache.Route, error) {
 		UpstreamPath: lookupPath,
 		Policy:       r.defaultPolicy(lookupPath),
 	}
+	if r.deny != nil {
+		route.Denied = r.deny.Match(coordinates(lookupPath))
+	}
 	if isMetadataPath(lookupPath) {
 		route.Policy = config.PolicyRevalidate
 		route.FreshFor = r.policy.MetadataFreshFor
@@ -176,6 +193,20 @@ func (r *resolver) defaultPolicy(lookupPath string) string {
 	return r.policy.ReleasePolicy
 }
 
+// coordinates returns group:artifact and version of an artifact path such as
+// org/example/lib/1.0/lib-1.0.jar. Artifact level metadata has no version.
+func coordinates(lookupPath string) (string, string) {
+	parts := strings.Split(lookupPath, "/")
+	n := len(parts)
+	if n >= 3 && strings.HasPrefix(parts[n-1], "maven-metadata.xml") {
+		return strings.Join(parts[:n-2], ".") + ":" + parts[n-2], ""
+	}
+	if n < 4 || !strings.HasPrefix(parts[n-1], parts[n-3]+"-") {
+		return "", ""
+	}
+	return strings.Join(parts[:n-3], ".") + ":" + parts[n-3], parts[n-2]
+}
+
 func isSnapshotPath(lookupPath string) bool {
 	return strings.Contains(lookupPath, "-SNAPSHOT") || strings.Contains(lookupPath, "/SNAPSHOT/")
 }
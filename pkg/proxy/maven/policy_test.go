@@ -0,0 +1,23 @@
+package maven
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gopkg.d7z.net/cache-proxy/pkg/config"
+)
+
+func TestValidateRejectsUpstreamPolicy(t *testing.T) {
+	policy := &Policy{ReleasePolicy: config.PolicyUpstream}
+	applyDefaults(policy)
+	err := validate(policy)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid maven release policy")
+
+	policy = &Policy{ChecksumPolicy: config.PolicyUpstream}
+	applyDefaults(policy)
+	err = validate(policy)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid maven checksum policy")
+}
@@ -16,10 +16,13 @@ import (
 const defaultCleanupInterval = 6 * time.Hour
 
 type Policy struct {
+	config.StaleWindows `yaml:",inline"`
+
 	MetadataPolicy     string           `json:"metadataPolicy,omitempty" yaml:"metadata_policy,omitempty"`
 	MetadataFreshFor   config.Freshness `json:"metadataFreshFor,omitempty" yaml:"metadata_fresh_for,omitempty"`
 	MetadataBusyPolicy string           `json:"metadataBusyPolicy,omitempty" yaml:"metadata_busy_policy,omitempty"`
 	TarballPolicy      string           `json:"tarballPolicy,omitempty" yaml:"tarball_policy,omitempty"`
+	NegativeTTL        config.Duration  `json:"negativeTTL,omitempty" yaml:"negative_ttl,omitempty"`
 }
 
 type Block struct {
@@ -71,8 +74,13 @@ func (Driver) Plan(_ context.Context, plan *proxyruntime.InstancePlan) error {
 		Transport:       block.Transport,
 		BusyPolicy:      block.MetadataBusyPolicy,
 		DefaultFreshFor: block.MetadataFreshFor,
+		DefaultStale:    block.StaleWindows,
+		NegativeTTL:     block.NegativeTTL,
 		DownloadLimiter: plan.Downloads(),
-	}, plan.Store(), New(&block.Policy), plan.Stats(), nil)
+		Deny:            plan.Deny(),
+		MinReleaseAge:   plan.MinReleaseAge(),
+		Snapshots:       true,
+	}, plan.Store(), &Resolver{cfg: &block.Policy, deny: plan.Deny()}, plan.Stats(), nil)
 	plan.Scheduler().Register(scheduler.TaskDef{
 		Key:      scheduler.NewTaskKey(plan.Name(), scheduler.TypeExpireCleanup, ""),
 		Interval: defaultCleanupInterval,
@@ -102,5 +110,8 @@ func validate(policy *Policy) error {
 	if policy.MetadataFreshFor > 0 && policy.MetadataFreshFor.Duration() < time.Second {
 		return fmt.Errorf("npm metadata fresh_for must be at least 1s")
 	}
+	if policy.NegativeTTL < 0 {
+		return fmt.Errorf("npm negative_ttl must not be negative")
+	}
 	return nil
 }
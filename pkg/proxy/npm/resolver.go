@@ -7,11 +7,13 @@ import (
 	"strings"
 
 	"gopkg.d7z.net/cache-proxy/pkg/config"
+	"gopkg.d7z.net/cache-proxy/pkg/proxy/shared/deny"
 	"gopkg.d7z.net/cache-proxy/pkg/proxy/shared/httpcache"
 )
 
 type Resolver struct {
-	cfg *Policy
+	cfg  *Policy
+	deny *deny.List
 }
 
 func New(cfg *Policy) *Resolver {
@@ -31,15 +33,18 @@ func (r *Resolver) Resolve(req *http.Request) (httpcache.Route, error) {
 	}
 	if strings.HasSuffix(cleanPath, ".tgz") {
 		match := r.resolveResource("tarball")
+		name, version := tarballVersion(cleanPath)
 		return httpcache.Route{
 			ObjectPath:   "npm/tarballs/" + objectPath,
 			UpstreamPath: upstreamPath,
 			Policy:       match.policy,
 			FreshFor:     match.freshFor,
 			ExpireAfter:  match.expireAfter,
+			Denied:       r.deny.Match(name, version),
 		}, nil
 	}
 	match := r.resolveResource("metadata")
+	name, version := metadataVersion(cleanPath)
 	return httpcache.Route{
 		ObjectPath:   "npm/metadata/" + httpcache.HashKey(objectPath),
 		UpstreamPath: upstreamPath,
@@ -47,9 +52,45 @@ func (r *Resolver) Resolve(req *http.Request) (httpcache.Route, error) {
 		FreshFor:     match.freshFor,
 		ExpireAfter:  match.expireAfter,
 		RewriteKind:  "npm-metadata",
+		Denied:       r.deny.Match(name, version),
+		Package:      name,
 	}, nil
 }
 
+// tarballVersion parses <name>/-/<basename>-<version>.tgz.
+func tarballVersion(cleanPath string) (string, string) {
+	name, file, ok := strings.Cut(cleanPath, "/-/")
+	if !ok {
+		return "", ""
+	}
+	version, ok := strings.CutPrefix(strings.TrimSuffix(file, ".tgz"), path.Base(name)+"-")
+	if !ok {
+		return "", ""
+	}
+	return name, version
+}
+
+// metadataVersion parses <name> and <name>/<version> document paths; scoped
+// names span two segments.
+func metadataVersion(cleanPath string) (string, string) {
+	if strings.HasPrefix(cleanPath, "-/") {
+		return "", ""
+	}
+	segments := strings.Split(cleanPath, "/")
+	nameLen := 1
+	if strings.HasPrefix(cleanPath, "@") {
+		nameLen = 2
+	}
+	if len(segments) < nameLen {
+		return "", ""
+	}
+	name := strings.Join(segments[:nameLen], "/")
+	if len(segments) == nameLen+1 {
+		return name, segments[nameLen]
+	}
+	return name, ""
+}
+
 type npmMatch struct {
 	policy      string
 	freshFor    config.Freshness
@@ -1,12 +1,17 @@
 package npm
 
 import (
+	"io"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/require"
+	"gopkg.d7z.net/blobfs"
 
 	"gopkg.d7z.net/cache-proxy/pkg/config"
+	"gopkg.d7z.net/cache-proxy/pkg/proxy/shared/deny"
 	"gopkg.d7z.net/cache-proxy/pkg/proxy/shared/httpcache"
 )
 
@@ -147,6 +152,17 @@ func TestValidateRejectsInvalidTarballPolicy(t *testing.T) {
 	require.Contains(t, err.Error(), "invalid npm tarball policy")
 }
 
+func TestValidateRejectsUpstreamPolicy(t *testing.T) {
+	policy := &Policy{
+		MetadataPolicy:     config.PolicyUpstream,
+		MetadataBusyPolicy: config.BusyPolicyStale,
+		TarballPolicy:      config.PolicyImmutable,
+	}
+	err := validate(policy)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid npm metadata policy")
+}
+
 func TestValidateRejectsInvalidBusyPolicy(t *testing.T) {
 	policy := &Policy{
 		MetadataPolicy:     config.PolicyRevalidate,
@@ -189,3 +205,78 @@ func TestValidateAcceptsBusyStale(t *testing.T) {
 	err := validate(policy)
 	require.NoError(t, err)
 }
+
+func TestDenyBlocksTarballsAndFiltersMetadata(t *testing.T) {
+	upstreamRequests := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamRequests++
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"name":"pkg","dist-tags":{"latest":"1.1.0"},"versions":{"1.0.0":{},"1.1.0":{}}}`)
+	}))
+	defer upstream.Close()
+	store, err := blobfs.Open(t.TempDir(), blobfs.DefaultConfig())
+	require.NoError(t, err)
+	defer store.Close()
+	list, err := deny.Parse(config.ModeNPM, []string{"pkg@>=1.1.0"})
+	require.NoError(t, err)
+	cfg := &Policy{MetadataPolicy: config.PolicyBypass, TarballPolicy: config.PolicyImmutable}
+	handler := httpcache.NewHandler("npm", httpcache.RuntimeConfig{
+		Mode:      config.ModeNPM,
+		Upstreams: []string{upstream.URL},
+		Deny:      list,
+	}, store, &Resolver{cfg: cfg, deny: list}, httpcache.NewStats(prometheus.NewRegistry()), nil)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/pkg/-/pkg-1.1.0.tgz", nil))
+	require.Equal(t, http.StatusForbidden, rec.Code)
+	require.Equal(t, deny.Cache, rec.Header().Get("X-Cache"))
+	require.Contains(t, rec.Body.String(), `pkg 1.1.0 is blocked by deny rule "pkg@>=1.1.0"`)
+	require.Zero(t, upstreamRequests)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/pkg", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.JSONEq(t, `{"name":"pkg","dist-tags":{"latest":"1.0.0"},"versions":{"1.0.0":{}}}`, rec.Body.String())
+}
+
+func TestSnapshotViewSharesCachedMetadata(t *testing.T) {
+	upstreamRequests := 0
+	var upstreamURL string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamRequests++
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"name":"pkg","dist-tags":{"latest":"1.1.0"},
+			"versions":{"1.0.0":{"dist":{"tarball":"`+upstreamURL+`/pkg/-/pkg-1.0.0.tgz"}},"1.1.0":{}},
+			"time":{"1.0.0":"2026-01-10T08:00:00Z","1.1.0":"2026-01-16T08:00:00Z"}}`)
+	}))
+	defer upstream.Close()
+	upstreamURL = upstream.URL
+	store, err := blobfs.Open(t.TempDir(), blobfs.DefaultConfig())
+	require.NoError(t, err)
+	defer store.Close()
+	cfg := &Policy{MetadataPolicy: config.PolicyImmutable, TarballPolicy: config.PolicyImmutable}
+	handler := httpcache.NewHandler("npm", httpcache.RuntimeConfig{
+		Mode:      config.ModeNPM,
+		Upstreams: []string{upstream.URL},
+		Snapshots: true,
+	}, store, New(cfg), httpcache.NewStats(prometheus.NewRegistry()), nil)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/pkg", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), `"1.1.0"`)
+
+	req := httptest.NewRequest(http.MethodGet, "http://proxy.example/@2026-01-15/pkg", nil)
+	req.Header.Set("X-Cache-Proxy-Prefix", "/npm")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.JSONEq(t, `{"name":"pkg","dist-tags":{"latest":"1.0.0"},
+		"versions":{"1.0.0":{"dist":{"tarball":"http://proxy.example/npm/@2026-01-15/pkg/-/pkg-1.0.0.tgz"}}},
+		"time":{"1.0.0":"2026-01-10T08:00:00Z"}}`, rec.Body.String())
+	require.Equal(t, 1, upstreamRequests)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/@2026-02-30/pkg", nil))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+}
@@ -15,6 +15,7 @@ import (
 
 	"gopkg.d7z.net/blobfs"
 	"gopkg.d7z.net/cache-proxy/pkg/config"
+	"gopkg.d7z.net/cache-proxy/pkg/proxy/shared/deny"
 	"gopkg.d7z.net/cache-proxy/pkg/proxy/shared/httpcache"
 	"gopkg.d7z.net/cache-proxy/pkg/utils"
 )
@@ -28,12 +29,24 @@ type tokenCacheEntry struct {
 
 func newHandler(name string, block Block, expireAfter config.Expiration, store *blobfs.Store, stats *httpcache.Stats, downloads *httpcache.DownloadLimiter) *handler {
 	client := utils.DefaultHttpClientWrapper()
-	httpcache.ConfigureClientTransport(client, name, block.Transport)
+	httpcache.ConfigureClientTransport(client, name, nil, block.Transport)
+	var registries map[string]*registry
+	fallback := &registry{endpoints: newEndpoints(block.Upstream, block.Auth, block.Mirrors), policy: &block.Policy}
+	if len(block.Upstreams) > 0 {
+		registries = make(map[string]*registry, len(block.Upstreams))
+		for host, upstream := range block.Upstreams {
+			policy := upstream.policy(block.Policy)
+			registries[host] = &registry{host: host, endpoints: newEndpoints(upstream.upstreamURL(host), policy.Auth, upstream.Mirrors), policy: &policy}
+		}
+		fallback = registries[dockerHubHost]
+	}
 	return &handler{
 		name:             name,
-		upstream:         strings.TrimRight(block.Upstream, "/"),
 		expireAfter:      expireAfter,
 		policy:           &block.Policy,
+		registries:       registries,
+		fallback:         fallback,
+		hosted:           block.Hosted,
 		store:            store,
 		stats:            stats,
 		client:           client,
@@ -43,10 +56,51 @@ func newHandler(name string, block Block, expireAfter config.Expiration, store *
 	}
 }
 
+func newEndpoints(upstream string, auth *AuthConfig, mirrors []Mirror) []*endpoint {
+	endpoints := []*endpoint{{url: strings.TrimRight(upstream, "/"), auth: auth}}
+	for _, mirror := range mirrors {
+		endpoints = append(endpoints, &endpoint{url: strings.TrimRight(mirror.URL, "/"), auth: mirror.Auth})
+	}
+	return endpoints
+}
+
+// endpointURLs returns the URLs of every endpoint, for upstream health.
+func (h *handler) endpointURLs() []string {
+	registries := []*registry{h.fallback}
+	for _, reg := range h.registries {
+		registries = append(registries, reg)
+	}
+	var urls []string
+	seen := map[string]struct{}{}
+	for _, reg := range registries {
+		if reg == nil {
+			continue
+		}
+		for _, e := range reg.endpoints {
+			if _, ok := seen[e.url]; !ok {
+				seen[e.url] = struct{}{}
+				urls = append(urls, e.url)
+			}
+		}
+	}
+	return urls
+}
+
 func (h *handler) Start(ctx context.Context) error {
+	if h.health != nil {
+		h.health.Start(ctx)
+	}
 	return nil
 }
 
+// DashboardStatus reports aggregate OCI upstream health.
+func (h *handler) DashboardStatus() (color, label, extra string) {
+	if h.health == nil {
+		return "", "", ""
+	}
+	return h.health.DashboardStatus()
+}
+
 func (h *handler) purgeExpiredTokens() {
 	h.auth.tokenMu.Lock()
 	h.trimTokenCacheLocked(time.Now(), "")
@@ -86,54 +140,128 @@ func (h *handler) trimTokenCacheLocked(now time.Time, keepKey string) {
 }
 
 func (h *handler) Stop(ctx context.Context) error {
+	if h.health != nil {
+		if err := h.health.Stop(ctx); err != nil {
+			return err
+		}
+	}
 	return utils.WaitGroupContext(ctx, &h.wait)
 }
 
+// Cleanup deletes expired refs, then the blobs no remaining ref lists. Blobs
+// fetched after the cleanup started are kept, since their ref may have been
+// written after the walk passed it. Hosted content is never expired; only
+// abandoned uploads are removed.
 func (h *handler) Cleanup(ctx context.Context, opts config.CleanupConfig) error {
+	started := time.Now().UTC()
 	deleted := 0
-	return fs.WalkDir(h.store.TenantFS(h.name), "oci/refs", func(current string, entry fs.DirEntry, err error) error {
+	live := map[string]struct{}{}
+	err := fs.WalkDir(h.store.TenantFS(h.name), "oci/refs", func(current string, entry fs.DirEntry, err error) error {
 		if ctx.Err() != nil {
 			return ctx.Err()
 		}
-		if opts.BatchSize > 0 && deleted >= opts.BatchSize {
-			return fs.SkipAll
-		}
 		if err != nil || entry.IsDir() || path.Base(current) != "state.yaml" {
 			return nil
 		}
 		state, readErr := h.readState(ctx, current)
-		if readErr != nil || h.stateExpired(state) {
-			if opts.DryRun {
-				deleted++
-				slog.Info("oci cleanup dry-run delete", "instance", h.name, "prefix", path.Dir(current))
-				return nil
-			}
-			if removeErr := h.deleteTree(ctx, path.Dir(current)); removeErr != nil && !errors.Is(removeErr, context.Canceled) {
-				slog.Info("oci cleanup delete failed", "instance", h.name, "prefix", path.Dir(current), "err", removeErr)
-			} else {
-				deleted++
+		if readErr == nil && (!h.stateExpired(state) || h.withinStale(state, h.policy.WhileRevalidate) || h.withinStale(state, h.policy.IfError)) {
+			for _, digest := range state.BlobDigests {
+				live[digest] = struct{}{}
 			}
+			return nil
+		}
+		if opts.BatchSize > 0 && deleted >= opts.BatchSize {
+			return nil
+		}
+		if opts.DryRun {
+			deleted++
+			slog.Info("oci cleanup dry-run delete", "instance", h.name, "prefix", path.Dir(current))
+			return nil
+		}
+		if removeErr := h.deleteTree(ctx, path.Dir(current)); removeErr != nil && !errors.Is(removeErr, context.Canceled) {
+			slog.Info("oci cleanup delete failed", "instance", h.name, "prefix", path.Dir(current), "err", removeErr)
+		} else {
+			deleted++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := h.collectHostedBlobs(ctx, live); err != nil {
+		return err
+	}
+	if deleted, err = h.cleanupUploads(ctx, opts, deleted); err != nil {
+		return err
+	}
+	return fs.WalkDir(h.store.TenantFS(h.name), "oci/blobs", func(current string, entry fs.DirEntry, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if opts.BatchSize > 0 && deleted >= opts.BatchSize {
+			return fs.SkipAll
+		}
+		if err != nil || entry.IsDir() {
+			return nil
+		}
+		algo, digest := path.Split(strings.TrimPrefix(current, "oci/blobs/"))
+		if _, ok := live[strings.TrimSuffix(algo, "/")+":"+digest]; ok {
+			return nil
+		}
+		info, statErr := h.store.StatObject(ctx, h.name, current)
+		if fetchedAt, parseErr := time.Parse(time.RFC3339Nano, info.Options["fetched-at"]); statErr != nil || parseErr != nil || fetchedAt.After(started) {
+			return nil
+		}
+		deleted++
+		if opts.DryRun {
+			slog.Info("oci cleanup dry-run delete", "instance", h.name, "blob", current)
+			return nil
+		}
+		if removeErr := h.store.DeleteObject(ctx, h.name, current); removeErr != nil && !errors.Is(removeErr, context.Canceled) {
+			slog.Info("oci cleanup delete failed", "instance", h.name, "blob", current, "err", removeErr)
 		}
 		return nil
 	})
 }
 
 func (h *handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h.wait.Add(1)
+	defer h.wait.Done()
+
+	resolved, err := h.resolve(req)
+	if err == nil && resolved.hosted {
+		status, bytes, hostedErr := h.serveHosted(req.Context(), w, req, resolved)
+		if hostedErr != nil {
+			slog.Info("oci hosted request failed", "instance", h.name, "method", req.Method, "path", req.URL.Path, "err", hostedErr)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			h.stats.RecordRequest(h.name, config.ModeOCI, req.Method, "ERROR", http.StatusInternalServerError, 0)
+			return
+		}
+		h.stats.RecordRequest(h.name, config.ModeOCI, req.Method, hostedCache, status, bytes)
+		return
+	}
 	if req.Method != http.MethodGet && req.Method != http.MethodHead {
 		w.Header().Set("Allow", "GET, HEAD")
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 		h.stats.RecordRequest(h.name, config.ModeOCI, req.Method, "ERROR", http.StatusMethodNotAllowed, 0)
 		return
 	}
-	h.wait.Add(1)
-	defer h.wait.Done()
-
-	resolved, err := resolveRequest(req, h.policy)
+	if err == nil && resolved.registry == nil {
+		w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+		w.WriteHeader(http.StatusOK)
+		h.stats.RecordRequest(h.name, config.ModeOCI, req.Method, "HIT", http.StatusOK, 0)
+		return
+	}
 	if err != nil {
 		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		h.stats.RecordRequest(h.name, config.ModeOCI, req.Method, "ERROR", http.StatusNotFound, 0)
 		return
 	}
+	if message := h.denied(resolved); message != "" {
+		deny.Write(w, message)
+		h.stats.RecordRequest(h.name, config.ModeOCI, req.Method, deny.Cache, http.StatusForbidden, 0)
+		return
+	}
 	status, cache, bytes, err := h.serve(req.Context(), w, req, resolved)
 	if err != nil {
 		slog.Info("oci proxy failed", "instance", h.name, "method", req.Method, "path", req.URL.Path, "err", err)
@@ -144,24 +272,38 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	h.stats.RecordRequest(h.name, config.ModeOCI, req.Method, cache, status, bytes)
 }
 
+// denied checks manifests by tag or digest, blobs by digest and tag lists
+// against the deny rules of the repository.
+func (h *handler) denied(resolved request) string {
+	switch resolved.kind {
+	case requestManifest:
+		return h.deny.Match(resolved.repo, resolved.ref)
+	case requestBlob:
+		return h.deny.Match(resolved.repo, resolved.digest)
+	case requestTags:
+		return h.deny.Match(resolved.repo, "")
+	}
+	return ""
+}
+
 func (h *handler) serve(ctx context.Context, w http.ResponseWriter, req *http.Request, resolved request) (int, string, uint64, error) {
 	if resolved.match.policy == config.PolicyBypass || resolved.kind == requestPing || resolved.kind == requestTags || resolved.kind == requestBypass {
-		return h.serveRemote(ctx, w, req, resolved.upstreamPath, "BYPASS", nil)
+		return h.serveRemote(ctx, w, req, resolved, "BYPASS", nil)
 	}
 	switch resolved.kind {
-	case requestManifest:
+	case requestManifest, requestReferrers:
 		return h.serveManifest(ctx, w, req, resolved)
 	case requestBlob:
 		return h.serveBlob(ctx, w, req, resolved)
 	default:
-		return h.serveRemote(ctx, w, req, resolved.upstreamPath, "BYPASS", nil)
+		return h.serveRemote(ctx, w, req, resolved, "BYPASS", nil)
 	}
 }
 
 func (h *handler) serveManifest(ctx context.Context, w http.ResponseWriter, req *http.Request, resolved request) (int, string, uint64, error) {
 	statePath := h.refStatePath(resolved.repo, resolved.ref)
 	state, err := h.readState(ctx, statePath)
-	if err == nil && !h.stateExpired(state) {
+	if err == nil && !h.stateExpired(state) && (!resolved.revalidate || h.fresh(state)) {
 		if status, bytes, cacheErr := h.serveCachedObject(ctx, w, req, h.refManifestPath(resolved.repo, resolved.ref), "HIT"); cacheErr == nil {
 			slog.Debug("oci manifest cache hit", "instance", h.name, "repo", resolved.repo, "ref", resolved.ref)
 			return status, "HIT", bytes, nil
@@ -169,12 +311,19 @@ func (h *handler) serveManifest(ctx context.Context, w http.ResponseWriter, req
 	}
 
 	staleState := state
-	status, bytes, fetchErr := h.fetchManifest(ctx, w, req, resolved)
+	if staleState.Repo != "" && h.withinStale(staleState, h.policy.WhileRevalidate) {
+		if status, bytes, cacheErr := h.serveCachedObject(ctx, w, req, h.refManifestPath(resolved.repo, resolved.ref), "STALE"); cacheErr == nil {
+			h.refreshManifestInBackground(ctx, req, resolved)
+			return status, "STALE", bytes, nil
+		}
+	}
+	staleOnError := staleState.Repo != "" && (!h.stateExpired(staleState) || resolved.match.busyPolicy == config.BusyPolicyStale || h.withinStale(staleState, h.policy.IfError))
+	status, bytes, fetchErr := h.fetchManifest(ctx, w, req, resolved, staleOnError)
 	if fetchErr == nil {
 		slog.Debug("oci manifest fetched", "instance", h.name, "repo", resolved.repo, "ref", resolved.ref)
 		return status, "MISS", bytes, nil
 	}
-	if resolved.match.busyPolicy == config.BusyPolicyStale && staleState.Repo != "" {
+	if staleOnError {
 		slog.Debug("oci manifest fetch failed, serving stale", "instance", h.name, "repo", resolved.repo, "ref", resolved.ref, "err", fetchErr)
 		if staleStatus, staleBytes, cacheErr := h.serveCachedObject(ctx, w, req, h.refManifestPath(resolved.repo, resolved.ref), "STALE"); cacheErr == nil {
 			return staleStatus, "STALE", staleBytes, nil
@@ -183,25 +332,32 @@ func (h *handler) serveManifest(ctx context.Context, w http.ResponseWriter, req
 	return 0, "", 0, fetchErr
 }
 
+// serveBlob serves blobs from the digest-keyed blob area shared by all
+// repositories. Missing blobs are only cached, and blobs pushed to hosted
+// repositories only served, when a live ref of the repository lists them.
 func (h *handler) serveBlob(ctx context.Context, w http.ResponseWriter, req *http.Request, resolved request) (int, string, uint64, error) {
-	state, err := h.findBlobState(ctx, resolved.repo, resolved.digest)
-	if err == nil {
-		if status, bytes, cacheErr := h.serveCachedObject(ctx, w, req, h.refBlobPath(state.Repo, state.Ref, resolved.digest), "HIT"); cacheErr == nil {
-			slog.Debug("oci blob cache hit", "instance", h.name, "repo", resolved.repo, "digest", resolved.digest)
-			return status, "HIT", bytes, nil
+	objectPath := h.blobPath(resolved.digest)
+	if info, err := h.store.StatObject(ctx, h.name, objectPath); err == nil && info.Options[hostedOption] != "" {
+		// Pushed blobs may be private; only serve them where a cached ref
+		// shows the upstream has them too.
+		if _, err := h.findBlobState(ctx, resolved.repo, resolved.digest); err != nil {
+			return h.serveRemote(ctx, w, req, resolved, "BYPASS", nil)
 		}
 	}
-	if err != nil {
+	if status, bytes, cacheErr := h.serveCachedObject(ctx, w, req, objectPath, "HIT"); cacheErr == nil {
+		slog.Debug("oci blob cache hit", "instance", h.name, "repo", resolved.repo, "digest", resolved.digest)
+		return status, "HIT", bytes, nil
+	}
+	if _, err := h.findBlobState(ctx, resolved.repo, resolved.digest); err != nil {
 		slog.Debug("oci blob not found in refs, bypass", "instance", h.name, "repo", resolved.repo, "digest", resolved.digest)
-		return h.serveRemote(ctx, w, req, resolved.upstreamPath, "BYPASS", nil)
+		return h.serveRemote(ctx, w, req, resolved, "BYPASS", nil)
 	}
-	objectPath := h.refBlobPath(state.Repo, state.Ref, resolved.digest)
 	if _, downloading := h.downloads.LoadOrStore(objectPath, struct{}{}); downloading {
 		slog.Debug("oci blob already downloading, bypass", "instance", h.name, "repo", resolved.repo, "digest", resolved.digest)
-		return h.serveRemote(ctx, w, req, resolved.upstreamPath, "BYPASS", nil)
+		return h.serveRemote(ctx, w, req, resolved, "BYPASS", nil)
 	}
 	slog.Debug("oci blob miss, fetching", "instance", h.name, "repo", resolved.repo, "digest", resolved.digest)
-	return h.fetchBlob(ctx, w, req, resolved, state)
+	return h.fetchBlob(ctx, w, req, resolved)
 }
 
 func (h *handler) serveCachedObject(ctx context.Context, w http.ResponseWriter, req *http.Request, objectPath, cache string) (int, uint64, error) {
@@ -211,6 +367,7 @@ func (h *handler) serveCachedObject(ctx context.Context, w http.ResponseWriter,
 	}
 	defer reader.Close()
 	info := reader.Info()
+	h.stats.Access().Touch(h.name, objectPath)
 	headers := map[string]string{
 		"Content-Length": info.Options["content-length"],
 		"Content-Type":   info.Options["content-type"],
@@ -227,8 +384,8 @@ func (h *handler) serveCachedObject(ctx context.Context, w http.ResponseWriter,
 	return h.writeResponse(w, req.Method, http.StatusOK, headers, reader)
 }
 
-func (h *handler) serveRemote(ctx context.Context, w http.ResponseWriter, req *http.Request, upstreamPath, cache string, headers map[string]string) (int, string, uint64, error) {
-	response, err := h.remoteRequest(ctx, req.Method, upstreamPath, headers)
+func (h *handler) serveRemote(ctx context.Context, w http.ResponseWriter, req *http.Request, resolved request, cache string, headers map[string]string) (int, string, uint64, error) {
+	response, err := h.remoteRequest(ctx, resolved, req.Method, resolved.upstreamPath, headers, nil)
 	if err != nil {
 		return 0, "", 0, err
 	}
@@ -238,10 +395,12 @@ func (h *handler) serveRemote(ctx context.Context, w http.ResponseWriter, req *h
 }
 
 func (h *handler) putObjectFromReader(ctx context.Context, objectPath string, body io.Reader, size int64, headers http.Header, extra map[string]string) error {
+	now := time.Now().UTC().Format(time.RFC3339Nano)
 	meta := map[string]string{
 		"content-type":   headers.Get("Content-Type"),
 		"content-length": strconv.FormatInt(size, 10),
-		"fetched-at":     time.Now().UTC().Format(time.RFC3339Nano),
+		"fetched-at":     now,
+		"accessed-at":    now,
 	}
 	for _, key := range []string{"ETag", "Last-Modified", "Docker-Content-Digest"} {
 		if value := headers.Get(key); value != "" {
@@ -274,8 +433,8 @@ func (h *handler) refManifestPath(repo, ref string) string {
 	return path.Join(h.refDir(repo, ref), "manifest")
 }
 
-func (h *handler) refBlobPath(repo, ref, digest string) string {
-	return path.Join(h.refDir(repo, ref), "blobs", strings.ReplaceAll(digest, ":", "/"))
+func (h *handler) blobPath(digest string) string {
+	return path.Join("oci/blobs", strings.ReplaceAll(digest, ":", "/"))
 }
 
 func (h *handler) refDir(repo, ref string) string {
@@ -16,7 +16,7 @@ import (
 
 const maxTokenResponseSize = 1 << 20 // 1MB
 
-func (h *handler) retryChallenge(ctx context.Context, method, targetURL string, headers map[string]string, response *http.Response) (*http.Response, error) {
+func (h *handler) retryChallenge(ctx context.Context, e *endpoint, method, targetURL string, headers map[string]string, response *http.Response) (*http.Response, error) {
 	challenge, ok := parseOCIChallenge(response.Header.Get("WWW-Authenticate"))
 	if !ok {
 		return nil, nil
@@ -25,13 +25,13 @@ func (h *handler) retryChallenge(ctx context.Context, method, targetURL string,
 	var auth string
 	switch strings.ToLower(challenge.scheme) {
 	case "bearer":
-		token, err := h.ociBearerToken(ctx, challenge)
+		token, err := h.ociBearerToken(ctx, e, challenge)
 		if err != nil {
 			return nil, err
 		}
 		auth = "Bearer " + token
 	case "basic":
-		auth = h.basicAuthorization()
+		auth = e.basicAuthorization()
 	}
 	if auth == "" {
 		return nil, nil
@@ -48,22 +48,22 @@ func (h *handler) retryChallenge(ctx context.Context, method, targetURL string,
 	return h.client.Do(request)
 }
 
-func (h *handler) staticAuthorization() string {
-	if h.policy.Auth == nil || strings.ToLower(h.policy.Auth.Type) != "bearer" || h.policy.Auth.Token == "" {
+func (e *endpoint) staticAuthorization() string {
+	if e.auth == nil || strings.ToLower(e.auth.Type) != "bearer" || e.auth.Token == "" {
 		return ""
 	}
-	return "Bearer " + h.policy.Auth.Token
+	return "Bearer " + e.auth.Token
 }
 
-func (h *handler) basicAuthorization() string {
-	if h.policy.Auth == nil || strings.ToLower(h.policy.Auth.Type) != "basic" {
+func (e *endpoint) basicAuthorization() string {
+	if e.auth == nil || strings.ToLower(e.auth.Type) != "basic" {
 		return ""
 	}
-	return "Basic " + base64.StdEncoding.EncodeToString([]byte(h.policy.Auth.Username+":"+h.policy.Auth.Password))
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(e.auth.Username+":"+e.auth.Password))
 }
 
-func (h *handler) ociBearerToken(ctx context.Context, challenge ociChallenge) (string, error) {
-	key := challenge.realm + "\x00" + challenge.params["service"] + "\x00" + challenge.params["scope"]
+func (h *handler) ociBearerToken(ctx context.Context, e *endpoint, challenge ociChallenge) (string, error) {
+	key := e.url + "\x00" + challenge.realm + "\x00" + challenge.params["service"] + "\x00" + challenge.params["scope"]
 	now := time.Now()
 	h.auth.tokenMu.Lock()
 	h.trimTokenCacheLocked(now, "")
@@ -74,7 +74,7 @@ func (h *handler) ociBearerToken(ctx context.Context, challenge ociChallenge) (s
 	h.auth.tokenMu.Unlock()
 
 	value, err, _ := h.auth.group.Do(key, func() (any, error) {
-		token, expire, err := h.fetchBearerToken(ctx, challenge, time.Now())
+		token, expire, err := h.fetchBearerToken(ctx, e, challenge, time.Now())
 		if err != nil {
 			return "", err
 		}
@@ -94,7 +94,7 @@ func (h *handler) ociBearerToken(ctx context.Context, challenge ociChallenge) (s
 	return token, nil
 }
 
-func (h *handler) fetchBearerToken(ctx context.Context, challenge ociChallenge, now time.Time) (string, time.Time, error) {
+func (h *handler) fetchBearerToken(ctx context.Context, e *endpoint, challenge ociChallenge, now time.Time) (string, time.Time, error) {
 	tokenURL, err := url.Parse(challenge.realm)
 	if err != nil || tokenURL.Scheme == "" || tokenURL.Host == "" {
 		return "", time.Time{}, errors.New("invalid OCI token realm")
@@ -111,7 +111,7 @@ func (h *handler) fetchBearerToken(ctx context.Context, challenge ociChallenge,
 		return "", time.Time{}, err
 	}
 	request.Header.Set("User-Agent", h.client.UserAgent)
-	if basic := h.basicAuthorization(); basic != "" {
+	if basic := e.basicAuthorization(); basic != "" {
 		request.Header.Set("Authorization", basic)
 	}
 	response, err := h.client.Do(request)
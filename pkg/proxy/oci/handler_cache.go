@@ -25,31 +25,49 @@ import (
 	"gopkg.d7z.net/cache-proxy/pkg/utils"
 )
 
-func (h *handler) fetchManifest(ctx context.Context, w http.ResponseWriter, req *http.Request, resolved request) (int, uint64, error) {
+// fetchManifest stores and serves the upstream manifest. With staleOnError,
+// upstream 5xx responses are returned as errors so the caller can fall back
+// to the cached copy.
+func (h *handler) fetchManifest(ctx context.Context, w http.ResponseWriter, req *http.Request, resolved request, staleOnError bool) (int, uint64, error) {
 	h.stats.AddActiveDownload(h.name, config.ModeOCI, 1)
 	defer h.stats.AddActiveDownload(h.name, config.ModeOCI, -1)
 
-	slog.Debug("oci fetch manifest", "instance", h.name, "repo", resolved.repo, "ref", resolved.ref, "upstream", h.upstream)
-	response, err := h.remoteRequest(ctx, http.MethodGet, resolved.upstreamPath, map[string]string{"Accept": manifestAccept})
+	slog.Debug("oci fetch manifest", "instance", h.name, "repo", resolved.repo, "ref", resolved.ref, "upstream", resolved.registry.endpoints[0].url)
+	var verify func(*http.Response) error
+	if resolved.byDigest() {
+		verify = verifyManifest(resolved.ref)
+	}
+	response, err := h.remoteRequest(ctx, resolved, http.MethodGet, resolved.upstreamPath, map[string]string{"Accept": manifestAccept}, verify)
+	if err == nil && response.StatusCode == http.StatusNotFound && resolved.kind == requestReferrers {
+		_ = response.Body.Close()
+		response, err = h.remoteRequest(ctx, resolved, http.MethodGet, referrersTagPath(resolved), map[string]string{"Accept": manifestAccept}, nil)
+	}
 	if err != nil {
 		return 0, 0, err
 	}
 	defer response.Body.Close()
+	if staleOnError && response.StatusCode >= http.StatusInternalServerError {
+		return 0, 0, fmt.Errorf("oci manifest upstream returned %d", response.StatusCode)
+	}
 	if response.StatusCode != http.StatusOK {
 		return h.copyRemote(w, req, response, "BYPASS")
 	}
 
-	tempFile, size, err := utils.TempFileFromReader(io.LimitReader(response.Body, 50<<20))
+	tempFile, size, err := utils.TempFileFromReader(io.LimitReader(response.Body, maxManifestSize))
 	if err != nil {
 		return 0, 0, err
 	}
 	defer tempFile.Close()
 	defer os.Remove(tempFile.Name())
-	if size > 50<<20 {
+	if size > maxManifestSize {
 		return 0, 0, fmt.Errorf("oci manifest exceeds size limit")
 	}
 
 	manifestDigest := response.Header.Get("Docker-Content-Digest")
+	if resolved.byDigest() {
+		// The body was checked against the requested digest already.
+		manifestDigest = resolved.ref
+	}
 	if manifestDigest != "" {
 		if err := verifyDigestReader(manifestDigest, tempFile); err != nil {
 			return 0, 0, err
@@ -83,11 +101,18 @@ func (h *handler) fetchManifest(ctx context.Context, w http.ResponseWriter, req
 		BlobDigests:    blobDigests,
 	}
 
+	// A referrers index is not content addressed, so clients get no digest.
+	digestHeader := manifestDigest
+	if resolved.kind == requestReferrers {
+		digestHeader = ""
+	}
+	now := time.Now().UTC().Format(time.RFC3339Nano)
 	meta := map[string]string{
 		"content-type":          response.Header.Get("Content-Type"),
 		"content-length":        strconv.FormatInt(size, 10),
-		"fetched-at":            time.Now().UTC().Format(time.RFC3339Nano),
-		"docker-content-digest": manifestDigest,
+		"fetched-at":            now,
+		"accessed-at":           now,
+		"docker-content-digest": digestHeader,
 	}
 	if v := response.Header.Get("ETag"); v != "" {
 		meta["etag"] = v
@@ -116,15 +141,15 @@ func (h *handler) fetchManifest(ctx context.Context, w http.ResponseWriter, req
 		"ETag":                  response.Header.Get("ETag"),
 		"Last-Modified":         response.Header.Get("Last-Modified"),
 		"X-Cache":               "MISS",
-		"Docker-Content-Digest": manifestDigest,
+		"Docker-Content-Digest": digestHeader,
 	}
 	status, bytes, err := h.writeResponse(w, req.Method, http.StatusOK, headers, tempFile)
 	return status, bytes, err
 }
 
-func (h *handler) fetchBlob(ctx context.Context, w http.ResponseWriter, req *http.Request, resolved request, state refState) (int, string, uint64, error) {
-	slog.Debug("oci fetch blob", "instance", h.name, "repo", resolved.repo, "digest", resolved.digest, "upstream", h.upstream)
-	objectPath := h.refBlobPath(state.Repo, state.Ref, resolved.digest)
+func (h *handler) fetchBlob(ctx context.Context, w http.ResponseWriter, req *http.Request, resolved request) (int, string, uint64, error) {
+	slog.Debug("oci fetch blob", "instance", h.name, "repo", resolved.repo, "digest", resolved.digest, "upstream", resolved.registry.endpoints[0].url)
+	objectPath := h.blobPath(resolved.digest)
 	cleanupDownload := true
 	defer func() {
 		if cleanupDownload {
@@ -132,7 +157,7 @@ func (h *handler) fetchBlob(ctx context.Context, w http.ResponseWriter, req *htt
 		}
 	}()
 
-	response, err := h.remoteRequest(ctx, http.MethodGet, resolved.upstreamPath, nil)
+	response, err := h.remoteRequest(ctx, resolved, http.MethodGet, resolved.upstreamPath, nil, nil)
 	if err != nil {
 		return 0, "", 0, err
 	}
@@ -205,7 +230,10 @@ func (h *handler) writeState(ctx context.Context, state refState) error {
 	if err != nil {
 		return err
 	}
-	return h.storeObject(ctx, h.refStatePath(state.Repo, state.Ref), bytes.NewReader(data), map[string]string{"content-type": "application/yaml"})
+	return h.storeObject(ctx, h.refStatePath(state.Repo, state.Ref), bytes.NewReader(data), map[string]string{
+		"content-type": "application/yaml",
+		"fetched-at":   state.FetchedAt.UTC().Format(time.RFC3339Nano),
+	})
 }
 
 func (h *handler) findBlobState(ctx context.Context, repo, digest string) (refState, error) {
@@ -244,11 +272,55 @@ func (h *handler) findBlobState(ctx context.Context, repo, digest string) (refSt
 	return matched, nil
 }
 
+// fresh reports whether revalidated content fetched for state is within
+// fresh_for.
+func (h *handler) fresh(state refState) bool {
+	return h.policy.FreshFor.IsForever() || time.Now().Before(state.FetchedAt.Add(h.policy.FreshFor.Duration()))
+}
+
+// referrersTagPath returns the manifest path of the fallback tag that lists
+// the referrers of a digest on registries without the referrers API.
+func referrersTagPath(resolved request) string {
+	repoPath, _, _ := strings.Cut(resolved.upstreamPath, "/referrers/")
+	return repoPath + "/manifests/" + strings.Replace(resolved.digest, ":", "-", 1)
+}
+
 func (h *handler) stateExpired(state refState) bool {
 	expireAfter := effectiveExpire(state.ExpireAfter, h.expireAfter)
 	return !expireAfter.IsNever() && !expireAfter.IsUnset() && time.Now().After(state.FetchedAt.Add(expireAfter.Duration()))
 }
 
+// withinStale reports whether an expired state is at most window past its
+// expiry.
+func (h *handler) withinStale(state refState, window config.Freshness) bool {
+	if window.IsUnset() {
+		return false
+	}
+	expireAfter := effectiveExpire(state.ExpireAfter, h.expireAfter)
+	if window.IsForever() || expireAfter.IsNever() || expireAfter.IsUnset() {
+		return true
+	}
+	return time.Now().Before(state.FetchedAt.Add(expireAfter.Duration() + window.Duration()))
+}
+
+func (h *handler) refreshManifestInBackground(ctx context.Context, req *http.Request, resolved request) {
+	key := h.refStatePath(resolved.repo, resolved.ref)
+	if _, refreshing := h.downloads.LoadOrStore(key, struct{}{}); refreshing {
+		return
+	}
+	bgCtx := context.WithoutCancel(ctx)
+	bgReq := req.Clone(bgCtx)
+	bgReq.Method = http.MethodGet
+	h.wait.Add(1)
+	go func() {
+		defer h.wait.Done()
+		defer h.downloads.Delete(key)
+		if _, _, err := h.fetchManifest(bgCtx, discardResponseWriter{header: http.Header{}}, bgReq, resolved, false); err != nil {
+			slog.Debug("oci background manifest refresh failed", "instance", h.name, "repo", resolved.repo, "ref", resolved.ref, "err", err)
+		}
+	}()
+}
+
 func (h *handler) deleteTree(ctx context.Context, prefix string) error {
 	var objects []string
 	if err := fs.WalkDir(h.store.TenantFS(h.name), prefix, func(current string, entry fs.DirEntry, err error) error {
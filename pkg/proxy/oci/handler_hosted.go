@@ -0,0 +1,583 @@
+package oci
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"gopkg.d7z.net/cache-proxy/pkg/config"
+	"gopkg.d7z.net/cache-proxy/pkg/proxy/shared/httpcache"
+	"gopkg.d7z.net/cache-proxy/pkg/utils"
+)
+
+const hostedCache = "HOSTED"
+
+// hostedOption marks blobs stored by a push rather than fetched from an
+// upstream. Proxied repositories only serve them when a cached ref lists them.
+const hostedOption = "hosted"
+
+// hostedUploadTTL is how long Cleanup keeps an unfinished blob upload.
+const hostedUploadTTL = 24 * time.Hour
+
+var (
+	hostedRepoName = regexp.MustCompile(`^[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*(/[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*)*$`)
+	hostedTag      = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._-]{0,127}$`)
+	hostedDigest   = regexp.MustCompile(`^sha256:[0-9a-f]{64}$`)
+	uploadID       = regexp.MustCompile(`^[0-9A-Za-z]{1,64}$`)
+)
+
+// serveHosted serves a hosted repository from the store. Reads follow the
+// access rules of the instance; writes also need an authenticated client.
+func (h *handler) serveHosted(ctx context.Context, w http.ResponseWriter, req *http.Request, resolved request) (int, uint64, error) {
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	if !hostedRepoName.MatchString(resolved.repo) {
+		return writeHostedError(w, http.StatusBadRequest, "NAME_INVALID", "invalid repository name")
+	}
+	read := req.Method == http.MethodGet || req.Method == http.MethodHead
+	if !read && req.Header.Get(httpcache.IdentityHeader) == "" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="cache-proxy"`)
+		return writeHostedError(w, http.StatusUnauthorized, "UNAUTHORIZED", "authentication required")
+	}
+	switch {
+	case resolved.kind == requestUpload:
+		return h.serveUpload(ctx, w, req, resolved)
+	case resolved.kind == requestManifest && read:
+		return h.serveHostedManifest(ctx, w, req, resolved)
+	case resolved.kind == requestManifest && req.Method == http.MethodPut:
+		return h.putHostedManifest(ctx, w, req, resolved)
+	case resolved.kind == requestManifest && req.Method == http.MethodDelete:
+		return h.deleteHostedManifest(ctx, w, resolved)
+	case resolved.kind == requestBlob && read:
+		return h.serveHostedBlob(ctx, w, req, resolved)
+	case resolved.kind == requestTags && read:
+		return h.serveHostedTags(w, req, resolved)
+	}
+	return writeHostedError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "operation not supported")
+}
+
+func (h *handler) serveHostedManifest(ctx context.Context, w http.ResponseWriter, req *http.Request, resolved request) (int, uint64, error) {
+	digest, err := h.hostedManifestDigest(ctx, resolved.repo, resolved.ref)
+	if err != nil {
+		return writeHostedError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest unknown")
+	}
+	return h.serveCachedObject(ctx, w, req, h.hostedManifestPath(resolved.repo, digest), hostedCache)
+}
+
+// hostedManifestDigest returns the digest of the manifest ref names in repo,
+// following tags.
+func (h *handler) hostedManifestDigest(ctx context.Context, repo, ref string) (string, error) {
+	if hostedDigest.MatchString(ref) {
+		_, err := h.store.StatObject(ctx, h.name, h.hostedManifestPath(repo, ref))
+		return ref, err
+	}
+	if !hostedTag.MatchString(ref) {
+		return "", fs.ErrNotExist
+	}
+	info, err := h.store.StatObject(ctx, h.name, h.hostedTagPath(repo, ref))
+	if err != nil {
+		return "", err
+	}
+	return info.Options["docker-content-digest"], nil
+}
+
+// putHostedManifest stores a pushed manifest and tags it. Every blob it lists
+// must already be stored.
+func (h *handler) putHostedManifest(ctx context.Context, w http.ResponseWriter, req *http.Request, resolved request) (int, uint64, error) {
+	byDigest := hostedDigest.MatchString(resolved.ref)
+	if !byDigest && !hostedTag.MatchString(resolved.ref) {
+		return writeHostedError(w, http.StatusBadRequest, "TAG_INVALID", "invalid tag")
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxManifestSize+1))
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(body) > maxManifestSize {
+		return writeHostedError(w, http.StatusRequestEntityTooLarge, "SIZE_INVALID", "manifest exceeds size limit")
+	}
+	if !json.Valid(body) {
+		return writeHostedError(w, http.StatusBadRequest, "MANIFEST_INVALID", "manifest is not valid JSON")
+	}
+	sum := sha256.Sum256(body)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	if byDigest && resolved.ref != digest {
+		return writeHostedError(w, http.StatusBadRequest, "DIGEST_INVALID", "manifest does not match digest "+resolved.ref)
+	}
+	blobs := collectBlobDigests(bytes.NewReader(body))
+	for _, blob := range blobs {
+		if !hostedDigest.MatchString(blob) {
+			return writeHostedError(w, http.StatusBadRequest, "MANIFEST_BLOB_UNKNOWN", "blob unknown: "+blob)
+		}
+		if _, err := h.store.StatObject(ctx, h.name, h.blobPath(blob)); err != nil {
+			return writeHostedError(w, http.StatusBadRequest, "MANIFEST_BLOB_UNKNOWN", "blob unknown: "+blob)
+		}
+	}
+	for _, blob := range blobs {
+		if err := h.linkHostedBlob(ctx, resolved.repo, blob); err != nil {
+			return 0, 0, err
+		}
+	}
+	headers := http.Header{"Content-Type": {req.Header.Get("Content-Type")}, "Docker-Content-Digest": {digest}}
+	if err := h.putObjectFromReader(ctx, h.hostedManifestPath(resolved.repo, digest), bytes.NewReader(body), int64(len(body)), headers, pinned(nil)); err != nil {
+		return 0, 0, err
+	}
+	if !byDigest {
+		if err := h.storeObject(ctx, h.hostedTagPath(resolved.repo, resolved.ref), strings.NewReader(digest), pinned(map[string]string{"docker-content-digest": digest})); err != nil {
+			return 0, 0, err
+		}
+	}
+	slog.Info("oci hosted manifest pushed", "instance", h.name, "repo", resolved.repo, "ref", resolved.ref, "digest", digest, "identity", req.Header.Get(httpcache.IdentityHeader))
+	w.Header().Set("Location", hostedURL(req, resolved.repo, "manifests", digest))
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.WriteHeader(http.StatusCreated)
+	return http.StatusCreated, 0, nil
+}
+
+// deleteHostedManifest deletes a tag, or a manifest together with the tags
+// that point at it and the blob links no remaining manifest of the repository
+// needs.
+func (h *handler) deleteHostedManifest(ctx context.Context, w http.ResponseWriter, resolved request) (int, uint64, error) {
+	digest, err := h.hostedManifestDigest(ctx, resolved.repo, resolved.ref)
+	if err != nil {
+		return writeHostedError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest unknown")
+	}
+	if digest != resolved.ref {
+		if err := h.store.DeleteObject(ctx, h.name, h.hostedTagPath(resolved.repo, resolved.ref)); err != nil {
+			return 0, 0, err
+		}
+		w.WriteHeader(http.StatusAccepted)
+		return http.StatusAccepted, 0, nil
+	}
+	tags, _ := fs.ReadDir(h.store.TenantFS(h.name), path.Join(h.hostedDir(resolved.repo), "_tags"))
+	for _, tag := range tags {
+		tagPath := h.hostedTagPath(resolved.repo, tag.Name())
+		if info, err := h.store.StatObject(ctx, h.name, tagPath); err == nil && info.Options["docker-content-digest"] == digest {
+			if err := h.store.DeleteObject(ctx, h.name, tagPath); err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+	released, err := h.hostedManifestBlobs(ctx, h.hostedManifestPath(resolved.repo, digest))
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := h.store.DeleteObject(ctx, h.name, h.hostedManifestPath(resolved.repo, digest)); err != nil {
+		return 0, 0, err
+	}
+	if err := h.unlinkHostedBlobs(ctx, resolved.repo, released); err != nil {
+		return 0, 0, err
+	}
+	w.WriteHeader(http.StatusAccepted)
+	return http.StatusAccepted, 0, nil
+}
+
+// unlinkHostedBlobs drops the blob links of repo that no stored manifest of
+// repo lists. Links of blobs in released go at once; other links are kept for
+// hostedUploadTTL, since a push links its blobs before it stores the
+// manifest. Unlinked blobs are cached content again and may be evicted.
+func (h *handler) unlinkHostedBlobs(ctx context.Context, repo string, released []string) error {
+	referenced := map[string]struct{}{}
+	err := fs.WalkDir(h.store.TenantFS(h.name), path.Join(h.hostedDir(repo), "_manifests"), func(current string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return nil
+		}
+		blobs, readErr := h.hostedManifestBlobs(ctx, current)
+		if readErr != nil {
+			return readErr
+		}
+		for _, blob := range blobs {
+			referenced[blob] = struct{}{}
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	var links []string
+	err = fs.WalkDir(h.store.TenantFS(h.name), path.Join(h.hostedDir(repo), "_layers"), func(current string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return nil
+		}
+		digest := path.Base(path.Dir(current)) + ":" + path.Base(current)
+		if _, ok := referenced[digest]; ok {
+			return nil
+		}
+		if !slices.Contains(released, digest) {
+			info, statErr := h.store.StatObject(ctx, h.name, current)
+			if linkedAt, parseErr := time.Parse(time.RFC3339Nano, info.Options["linked-at"]); statErr != nil || parseErr != nil || time.Since(linkedAt) < hostedUploadTTL {
+				return nil
+			}
+		}
+		links = append(links, current)
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for _, link := range links {
+		if err := h.store.DeleteObject(ctx, h.name, link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *handler) hostedManifestBlobs(ctx context.Context, manifestPath string) ([]string, error) {
+	reader, err := h.store.OpenObject(ctx, h.name, manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return collectBlobDigests(reader), nil
+}
+
+// serveHostedBlob serves blobs pushed or mounted into the repository.
+func (h *handler) serveHostedBlob(ctx context.Context, w http.ResponseWriter, req *http.Request, resolved request) (int, uint64, error) {
+	if !hostedDigest.MatchString(resolved.digest) {
+		return writeHostedError(w, http.StatusNotFound, "BLOB_UNKNOWN", "blob unknown")
+	}
+	if _, err := h.store.StatObject(ctx, h.name, h.hostedLayerPath(resolved.repo, resolved.digest)); err != nil {
+		return writeHostedError(w, http.StatusNotFound, "BLOB_UNKNOWN", "blob unknown")
+	}
+	return h.serveCachedObject(ctx, w, req, h.blobPath(resolved.digest), hostedCache)
+}
+
+// serveHostedTags lists the tags of the repository in order, paginated with
+// the n and last parameters.
+func (h *handler) serveHostedTags(w http.ResponseWriter, req *http.Request, resolved request) (int, uint64, error) {
+	entries, err := fs.ReadDir(h.store.TenantFS(h.name), path.Join(h.hostedDir(resolved.repo), "_tags"))
+	if err != nil {
+		return writeHostedError(w, http.StatusNotFound, "NAME_UNKNOWN", "repository unknown")
+	}
+	last := req.URL.Query().Get("last")
+	tags := []string{}
+	for _, entry := range entries {
+		if entry.Name() > last {
+			tags = append(tags, entry.Name())
+		}
+	}
+	if n, err := strconv.Atoi(req.URL.Query().Get("n")); err == nil && n >= 0 && n < len(tags) {
+		tags = tags[:n]
+	}
+	body, err := json.Marshal(map[string]any{"name": resolved.repo, "tags": tags})
+	if err != nil {
+		return 0, 0, err
+	}
+	headers := map[string]string{
+		"Content-Type":   "application/json",
+		"Content-Length": strconv.Itoa(len(body)),
+		"X-Cache":        hostedCache,
+	}
+	return h.writeResponse(w, req.Method, http.StatusOK, headers, bytes.NewReader(body))
+}
+
+// serveUpload runs the blob upload flow. POST starts an upload, mounts a
+// stored blob or takes a whole blob at once; PATCH appends a chunk and PUT
+// completes the upload against its digest.
+func (h *handler) serveUpload(ctx context.Context, w http.ResponseWriter, req *http.Request, resolved request) (int, uint64, error) {
+	if resolved.ref == "" {
+		if req.Method != http.MethodPost {
+			return writeHostedError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "operation not supported")
+		}
+		return h.startUpload(ctx, w, req, resolved)
+	}
+	id := resolved.ref
+	if !uploadID.MatchString(id) {
+		return writeHostedError(w, http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN", "upload unknown")
+	}
+	if state, err := h.readUpload(ctx, id); err != nil || state.Repo != resolved.repo {
+		return writeHostedError(w, http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN", "upload unknown")
+	}
+	size, err := h.uploadSize(id)
+	if err != nil {
+		return 0, 0, err
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		return uploadStatus(w, req, resolved.repo, id, size, http.StatusNoContent)
+	case http.MethodPatch:
+		if contentRange := req.Header.Get("Content-Range"); contentRange != "" {
+			start, _, _ := strings.Cut(strings.TrimPrefix(contentRange, "bytes "), "-")
+			if offset, err := strconv.ParseInt(start, 10, 64); err != nil || offset != size {
+				w.Header().Set("Range", uploadRange(size))
+				return writeHostedError(w, http.StatusRequestedRangeNotSatisfiable, "BLOB_UPLOAD_INVALID", "chunk does not continue the upload")
+			}
+		}
+		if err := h.storeObject(ctx, uploadChunkPath(id, size), req.Body, pinned(nil)); err != nil {
+			return 0, 0, err
+		}
+		if size, err = h.uploadSize(id); err != nil {
+			return 0, 0, err
+		}
+		return uploadStatus(w, req, resolved.repo, id, size, http.StatusAccepted)
+	case http.MethodPut:
+		return h.finishUpload(ctx, w, req, resolved.repo, id)
+	case http.MethodDelete:
+		if err := h.deleteTree(ctx, uploadDir(id)); err != nil {
+			return 0, 0, err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return http.StatusNoContent, 0, nil
+	}
+	return writeHostedError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "operation not supported")
+}
+
+func (h *handler) startUpload(ctx context.Context, w http.ResponseWriter, req *http.Request, resolved request) (int, uint64, error) {
+	query := req.URL.Query()
+	if mount := query.Get("mount"); hostedDigest.MatchString(mount) {
+		if _, err := h.store.StatObject(ctx, h.name, h.blobPath(mount)); err == nil {
+			if err := h.linkHostedBlob(ctx, resolved.repo, mount); err != nil {
+				return 0, 0, err
+			}
+			slog.Debug("oci hosted blob mounted", "instance", h.name, "repo", resolved.repo, "digest", mount, "from", query.Get("from"))
+			return blobCreated(w, req, resolved.repo, mount)
+		}
+	}
+	if digest := query.Get("digest"); digest != "" {
+		return h.commitBlob(ctx, w, req, resolved.repo, digest, req.Body)
+	}
+	id := rand.Text()
+	data, err := yaml.Marshal(&uploadState{Repo: resolved.repo, StartedAt: time.Now().UTC()})
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := h.storeObject(ctx, path.Join(uploadDir(id), "upload.yaml"), bytes.NewReader(data), pinned(map[string]string{"content-type": "application/yaml"})); err != nil {
+		return 0, 0, err
+	}
+	return uploadStatus(w, req, resolved.repo, id, 0, http.StatusAccepted)
+}
+
+// finishUpload completes an upload with the chunks so far and the request
+// body, then drops the upload.
+func (h *handler) finishUpload(ctx context.Context, w http.ResponseWriter, req *http.Request, repo, id string) (int, uint64, error) {
+	entries, err := fs.ReadDir(h.store.TenantFS(h.name), uploadDir(id))
+	if err != nil {
+		return 0, 0, err
+	}
+	var readers []io.Reader
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), "chunk-") {
+			continue
+		}
+		reader, err := h.store.OpenObject(ctx, h.name, path.Join(uploadDir(id), entry.Name()))
+		if err != nil {
+			return 0, 0, err
+		}
+		defer reader.Close()
+		readers = append(readers, reader)
+	}
+	status, written, err := h.commitBlob(ctx, w, req, repo, req.URL.Query().Get("digest"), io.MultiReader(append(readers, req.Body)...))
+	if err == nil && status == http.StatusCreated {
+		if removeErr := h.deleteTree(ctx, uploadDir(id)); removeErr != nil {
+			slog.Info("oci hosted upload delete failed", "instance", h.name, "upload", id, "err", removeErr)
+		}
+	}
+	return status, written, err
+}
+
+// commitBlob verifies body against digest and stores it as a blob of repo.
+func (h *handler) commitBlob(ctx context.Context, w http.ResponseWriter, req *http.Request, repo, digest string, body io.Reader) (int, uint64, error) {
+	if !hostedDigest.MatchString(digest) {
+		return writeHostedError(w, http.StatusBadRequest, "DIGEST_INVALID", "invalid digest")
+	}
+	tempFile, size, err := utils.TempFileFromReader(body)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tempFile.Close()
+	defer os.Remove(tempFile.Name())
+	if err := verifyDigestReader(digest, tempFile); err != nil {
+		return writeHostedError(w, http.StatusBadRequest, "DIGEST_INVALID", err.Error())
+	}
+	if _, err := tempFile.Seek(0, io.SeekStart); err != nil {
+		return 0, 0, err
+	}
+	if _, err := h.store.StatObject(ctx, h.name, h.blobPath(digest)); err != nil {
+		headers := http.Header{"Content-Type": {"application/octet-stream"}, "Docker-Content-Digest": {digest}}
+		if err := h.putObjectFromReader(ctx, h.blobPath(digest), tempFile, size, headers, map[string]string{hostedOption: "true"}); err != nil {
+			return 0, 0, err
+		}
+	}
+	if err := h.linkHostedBlob(ctx, repo, digest); err != nil {
+		return 0, 0, err
+	}
+	return blobCreated(w, req, repo, digest)
+}
+
+// linkHostedBlob records that repo holds a stored blob. Linked blobs are never
+// removed by Cleanup or quota eviction.
+func (h *handler) linkHostedBlob(ctx context.Context, repo, digest string) error {
+	meta := map[string]string{"docker-content-digest": digest, "linked-at": time.Now().UTC().Format(time.RFC3339Nano)}
+	return h.storeObject(ctx, h.hostedLayerPath(repo, digest), strings.NewReader(digest), pinned(meta))
+}
+
+// pinned sets httpcache.PinnedOption in meta. Pushed content has no upstream
+// copy, so quota eviction must keep it.
+func pinned(meta map[string]string) map[string]string {
+	if meta == nil {
+		meta = map[string]string{}
+	}
+	meta[httpcache.PinnedOption] = "true"
+	return meta
+}
+
+func (h *handler) readUpload(ctx context.Context, id string) (uploadState, error) {
+	reader, err := h.store.OpenObject(ctx, h.name, path.Join(uploadDir(id), "upload.yaml"))
+	if err != nil {
+		return uploadState{}, err
+	}
+	defer reader.Close()
+	var state uploadState
+	if err := yaml.NewDecoder(reader).Decode(&state); err != nil {
+		return uploadState{}, err
+	}
+	return state, nil
+}
+
+// uploadSize returns the bytes received by an upload: the offset of its last
+// chunk plus the chunk's size.
+func (h *handler) uploadSize(id string) (int64, error) {
+	entries, err := fs.ReadDir(h.store.TenantFS(h.name), uploadDir(id))
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, entry := range entries {
+		offset, ok := strings.CutPrefix(entry.Name(), "chunk-")
+		if !ok {
+			continue
+		}
+		start, err := strconv.ParseInt(offset, 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return 0, err
+		}
+		size = max(size, start+info.Size())
+	}
+	return size, nil
+}
+
+// collectHostedBlobs adds the blobs linked into hosted repositories to live.
+func (h *handler) collectHostedBlobs(ctx context.Context, live map[string]struct{}) error {
+	return fs.WalkDir(h.store.TenantFS(h.name), "oci/hosted", func(current string, entry fs.DirEntry, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil || entry.IsDir() || path.Base(path.Dir(path.Dir(current))) != "_layers" {
+			return nil
+		}
+		live[path.Base(path.Dir(current))+":"+path.Base(current)] = struct{}{}
+		return nil
+	})
+}
+
+// cleanupUploads deletes uploads started more than hostedUploadTTL ago and
+// returns the updated deletion count.
+func (h *handler) cleanupUploads(ctx context.Context, opts config.CleanupConfig, deleted int) (int, error) {
+	entries, err := fs.ReadDir(h.store.TenantFS(h.name), "oci/uploads")
+	if err != nil {
+		return deleted, nil
+	}
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			return deleted, ctx.Err()
+		}
+		if opts.BatchSize > 0 && deleted >= opts.BatchSize {
+			break
+		}
+		state, readErr := h.readUpload(ctx, entry.Name())
+		if readErr != nil || time.Since(state.StartedAt) < hostedUploadTTL {
+			continue
+		}
+		deleted++
+		if opts.DryRun {
+			slog.Info("oci cleanup dry-run delete", "instance", h.name, "upload", entry.Name())
+			continue
+		}
+		if removeErr := h.deleteTree(ctx, uploadDir(entry.Name())); removeErr != nil {
+			slog.Info("oci cleanup delete failed", "instance", h.name, "upload", entry.Name(), "err", removeErr)
+		}
+	}
+	return deleted, nil
+}
+
+func uploadStatus(w http.ResponseWriter, req *http.Request, repo, id string, size int64, status int) (int, uint64, error) {
+	w.Header().Set("Location", hostedURL(req, repo, "blobs", "uploads", id))
+	w.Header().Set("Docker-Upload-UUID", id)
+	w.Header().Set("Range", uploadRange(size))
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(status)
+	return status, 0, nil
+}
+
+// uploadRange formats the received bytes as the inclusive Range header
+// registries send, which reads 0-0 before the first byte.
+func uploadRange(size int64) string {
+	return fmt.Sprintf("0-%d", max(size-1, 0))
+}
+
+func blobCreated(w http.ResponseWriter, req *http.Request, repo, digest string) (int, uint64, error) {
+	w.Header().Set("Location", hostedURL(req, repo, "blobs", digest))
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(http.StatusCreated)
+	return http.StatusCreated, 0, nil
+}
+
+func writeHostedError(w http.ResponseWriter, status int, code, message string) (int, uint64, error) {
+	body, _ := json.Marshal(map[string]any{"errors": []map[string]string{{"code": code, "message": message}}})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	written, _ := w.Write(append(body, '\n'))
+	return status, uint64(written), nil
+}
+
+// hostedURL returns the client path of a hosted repository resource.
+func hostedURL(req *http.Request, repo string, elems ...string) string {
+	return strings.TrimRight(req.Header.Get("X-Cache-Proxy-Prefix"), "/") + "/" + path.Join(append([]string{"v2", repo}, elems...)...)
+}
+
+func (h *handler) hostedDir(repo string) string {
+	return path.Join("oci/hosted", repo)
+}
+
+func (h *handler) hostedManifestPath(repo, digest string) string {
+	return path.Join(h.hostedDir(repo), "_manifests", strings.ReplaceAll(digest, ":", "/"))
+}
+
+func (h *handler) hostedTagPath(repo, tag string) string {
+	return path.Join(h.hostedDir(repo), "_tags", tag)
+}
+
+func (h *handler) hostedLayerPath(repo, digest string) string {
+	return path.Join(h.hostedDir(repo), "_layers", strings.ReplaceAll(digest, ":", "/"))
+}
+
+func uploadDir(id string) string {
+	return path.Join("oci/uploads", id)
+}
+
+// uploadChunkPath names chunks by their offset, so they sort in upload order.
+func uploadChunkPath(id string, offset int64) string {
+	return path.Join(uploadDir(id), fmt.Sprintf("chunk-%020d", offset))
+}
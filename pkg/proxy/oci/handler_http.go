@@ -1,7 +1,9 @@
 package oci
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"io"
 	"log/slog"
 	"net/http"
@@ -9,13 +11,85 @@ import (
 	"sync"
 	"time"
 
+	"gopkg.d7z.net/cache-proxy/pkg/accesslog"
 	"gopkg.d7z.net/cache-proxy/pkg/config"
 	"gopkg.d7z.net/cache-proxy/pkg/proxy/shared/httpcache"
 	"gopkg.d7z.net/cache-proxy/pkg/utils"
 )
 
-func (h *handler) remoteRequest(ctx context.Context, method, upstreamPath string, headers map[string]string) (*http.Response, error) {
-	targetURL := h.upstream + "/" + httpcache.EscapePath(strings.TrimLeft(upstreamPath, "/"))
+// remoteRequest sends a request for resolved to its registry. Requests by
+// digest may go to any endpoint, healthiest first, and move on to the next
+// one when an endpoint fails, answers with an error status or, when verify is
+// set, serves a response verify rejects. Everything else is pinned to the
+// primary, so tags resolve the same way on every request.
+func (h *handler) remoteRequest(ctx context.Context, resolved request, method, upstreamPath string, headers map[string]string, verify func(*http.Response) error) (*http.Response, error) {
+	endpoints := resolved.registry.endpoints[:1]
+	if resolved.byDigest() {
+		endpoints = h.weightedEndpoints(resolved.registry)
+	}
+	for i, e := range endpoints {
+		response, err := h.endpointRequest(ctx, e, method, upstreamPath, headers)
+		if err == nil && response.StatusCode < http.StatusBadRequest && verify != nil {
+			if err = verify(response); err != nil {
+				_ = response.Body.Close()
+				response = nil
+			}
+		}
+		if i+1 == len(endpoints) {
+			return response, err
+		}
+		if err == nil && response.StatusCode < http.StatusBadRequest {
+			return response, nil
+		}
+		if err == nil {
+			_ = response.Body.Close()
+		}
+		slog.Debug("oci upstream failover", "instance", h.name, "method", method, "path", upstreamPath, "from", e.url, "err", err)
+	}
+	return nil, errors.New("oci registry has no endpoints")
+}
+
+// verifyManifest buffers a manifest fetched by digest and checks it against
+// that digest, so a mirror serving other content is failed over.
+func verifyManifest(digest string) func(*http.Response) error {
+	return func(response *http.Response) error {
+		data, err := io.ReadAll(io.LimitReader(response.Body, maxManifestSize+1))
+		if err != nil {
+			return err
+		}
+		if err := verifyDigestReader(digest, bytes.NewReader(data)); err != nil {
+			return err
+		}
+		response.Body = struct {
+			io.Reader
+			io.Closer
+		}{bytes.NewReader(data), response.Body}
+		return nil
+	}
+}
+
+// weightedEndpoints orders the endpoints of reg by health weight, keeping
+// configuration order between equal weights.
+func (h *handler) weightedEndpoints(reg *registry) []*endpoint {
+	if h.health == nil || len(reg.endpoints) == 1 {
+		return reg.endpoints
+	}
+	byURL := make(map[string]*endpoint, len(reg.endpoints))
+	urls := make([]string, 0, len(reg.endpoints))
+	for _, e := range reg.endpoints {
+		byURL[e.url] = e
+		urls = append(urls, e.url)
+	}
+	weighted := h.health.WeightedUpstreams(urls)
+	endpoints := make([]*endpoint, 0, len(weighted))
+	for _, wu := range weighted {
+		endpoints = append(endpoints, byURL[wu.URL])
+	}
+	return endpoints
+}
+
+func (h *handler) endpointRequest(ctx context.Context, e *endpoint, method, upstreamPath string, headers map[string]string) (*http.Response, error) {
+	targetURL := e.url + "/" + httpcache.EscapePath(strings.TrimLeft(upstreamPath, "/"))
 	request, err := http.NewRequestWithContext(ctx, method, targetURL, nil)
 	if err != nil {
 		return nil, err
@@ -24,24 +98,26 @@ func (h *handler) remoteRequest(ctx context.Context, method, upstreamPath string
 	for key, value := range headers {
 		request.Header.Set(key, value)
 	}
-	if auth := h.staticAuthorization(); auth != "" {
+	if auth := e.staticAuthorization(); auth != "" {
 		request.Header.Set("Authorization", auth)
 	}
 	slog.Debug("oci upstream request", "instance", h.name, "method", method, "url", targetURL)
-	release := h.stats.BeginUpstreamRequest(h.name, config.ModeOCI, h.upstream)
+	release := h.stats.BeginUpstreamRequest(h.name, config.ModeOCI, e.url)
 	start := time.Now()
 	response, err := h.client.Do(request)
 	latency := time.Since(start)
 	if err != nil {
 		release()
-		h.stats.RecordUpstreamRequest(h.name, config.ModeOCI, h.upstream, method, 0, latency, 0)
+		h.stats.RecordUpstreamRequest(h.name, config.ModeOCI, e.url, method, 0, latency, 0)
+		h.recordHealth(e, 0, latency, err)
 		return nil, err
 	}
 	if response.StatusCode == http.StatusUnauthorized {
-		retry, retryErr := h.retryChallenge(ctx, method, targetURL, headers, response)
+		retry, retryErr := h.retryChallenge(ctx, e, method, targetURL, headers, response)
 		if retryErr != nil {
 			release()
-			h.stats.RecordUpstreamRequest(h.name, config.ModeOCI, h.upstream, method, 0, latency, 0)
+			h.stats.RecordUpstreamRequest(h.name, config.ModeOCI, e.url, method, 0, latency, 0)
+			h.recordHealth(e, 0, latency, retryErr)
 			return nil, retryErr
 		}
 		if retry != nil {
@@ -52,18 +128,30 @@ func (h *handler) remoteRequest(ctx context.Context, method, upstreamPath string
 	h.stats.RecordUpstreamRequest(
 		h.name,
 		config.ModeOCI,
-		h.upstream,
+		e.url,
 		method,
 		response.StatusCode,
 		latency,
 		ociContentLength(response),
 	)
+	h.recordHealth(e, response.StatusCode, latency, nil)
 	slog.Debug("oci upstream response", "instance", h.name, "method", method, "url", targetURL, "status", response.StatusCode)
+	accesslog.SetUpstream(ctx, e.url)
 	response.Body = utils.NewRateLimitReader(h.client.WrapBody(response.Body))
 	response.Body = &closeCallbackBody{ReadCloser: response.Body, done: release}
 	return response, nil
 }
 
+func (h *handler) recordHealth(e *endpoint, status int, latency time.Duration, err error) {
+	switch {
+	case h.health == nil:
+	case err != nil:
+		h.health.RecordFailure(e.url, err)
+	default:
+		h.health.RecordResult(e.url, status, latency)
+	}
+}
+
 type closeCallbackBody struct {
 	io.ReadCloser
 	done func()
@@ -83,6 +171,12 @@ func ociContentLength(response *http.Response) uint64 {
 	return uint64(response.ContentLength)
 }
 
+type discardResponseWriter struct{ header http.Header }
+
+func (w discardResponseWriter) Header() http.Header         { return w.header }
+func (w discardResponseWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (w discardResponseWriter) WriteHeader(int)             {}
+
 func (h *handler) copyRemote(w http.ResponseWriter, req *http.Request, response *http.Response, cache string) (int, uint64, error) {
 	return h.writeResponse(w, req.Method, response.StatusCode, objectHeaders(response.Header, int(response.ContentLength), cache), response.Body)
 }
@@ -0,0 +1,186 @@
+package oci
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.d7z.net/cache-proxy/pkg/proxy/shared/httpcache"
+	"gopkg.d7z.net/cache-proxy/pkg/utils"
+)
+
+type quotaBlob struct {
+	path       string
+	size       int64
+	lastAccess time.Time
+	keep       bool
+}
+
+type quotaRef struct {
+	dir        string
+	objects    []string
+	size       int64
+	lastAccess time.Time
+	state      refState
+	hasState   bool
+}
+
+// EvictionUnits lists each cached ref as one unit with the blobs no other ref
+// lists, and blobs no ref lists as expired units. Evicting a ref deletes its
+// state and manifest together with the blobs no remaining ref lists, so refs
+// never point at evicted blobs. Blobs linked into hosted repositories and
+// other hosted content are never listed.
+func (h *handler) EvictionUnits(ctx context.Context, access *httpcache.AccessIndex) ([]httpcache.EvictionUnit, error) {
+	started := time.Now().UTC()
+	refs := map[string]*quotaRef{}
+	err := fs.WalkDir(h.store.TenantFS(h.name), "oci/refs", func(current string, entry fs.DirEntry, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil || entry.IsDir() {
+			return nil
+		}
+		info, statErr := h.store.StatObject(ctx, h.name, current)
+		if statErr != nil {
+			return nil
+		}
+		dir := path.Dir(current)
+		ref := refs[dir]
+		if ref == nil {
+			ref = &quotaRef{dir: dir}
+			refs[dir] = ref
+		}
+		ref.objects = append(ref.objects, current)
+		ref.size += info.Size
+		if at, ok := access.LastAccess(h.name, current, info.Options); ok && at.After(ref.lastAccess) {
+			ref.lastAccess = at
+		}
+		if path.Base(current) == "state.yaml" {
+			if state, readErr := h.readState(ctx, current); readErr == nil {
+				ref.state, ref.hasState = state, true
+			}
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	hosted := map[string]struct{}{}
+	if err := h.collectHostedBlobs(ctx, hosted); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	blobs := map[string]*quotaBlob{}
+	err = fs.WalkDir(h.store.TenantFS(h.name), "oci/blobs", func(current string, entry fs.DirEntry, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil || entry.IsDir() {
+			return nil
+		}
+		info, statErr := h.store.StatObject(ctx, h.name, current)
+		if statErr != nil {
+			return nil
+		}
+		algo, hex := path.Split(strings.TrimPrefix(current, "oci/blobs/"))
+		digest := strings.TrimSuffix(algo, "/") + ":" + hex
+		_, linked := hosted[digest]
+		blob := &quotaBlob{path: current, size: info.Size, keep: linked}
+		blob.lastAccess, _ = access.LastAccess(h.name, current, info.Options)
+		if fetchedAt, parseErr := utils.ParseFetchedAt(info.Options["fetched-at"]); parseErr != nil || fetchedAt.After(started) {
+			// Blobs fetched during the walk may belong to refs it missed.
+			blob.keep = true
+		}
+		blobs[digest] = blob
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	listed := map[string]int{}
+	for _, ref := range refs {
+		ref.state.BlobDigests = slices.Compact(slices.Sorted(slices.Values(ref.state.BlobDigests)))
+		for _, digest := range ref.state.BlobDigests {
+			listed[digest]++
+		}
+	}
+	evictBlob := func(ctx context.Context, digest string) (int64, error) {
+		blob, ok := blobs[digest]
+		if !ok || blob.keep || listed[digest] > 0 {
+			return 0, nil
+		}
+		if err := h.store.DeleteObject(ctx, h.name, blob.path); err != nil {
+			return 0, err
+		}
+		delete(blobs, digest)
+		h.forgetBlob(digest)
+		access.Forget(h.name, blob.path)
+		return blob.size, nil
+	}
+
+	var units []httpcache.EvictionUnit
+	for _, ref := range refs {
+		if !ref.hasState {
+			continue
+		}
+		unit := httpcache.EvictionUnit{
+			Name:       ref.dir,
+			Size:       ref.size,
+			LastAccess: ref.lastAccess,
+			Expired: h.stateExpired(ref.state) &&
+				!h.withinStale(ref.state, h.policy.WhileRevalidate) && !h.withinStale(ref.state, h.policy.IfError),
+		}
+		for _, digest := range ref.state.BlobDigests {
+			blob, ok := blobs[digest]
+			if !ok {
+				continue
+			}
+			if blob.lastAccess.After(unit.LastAccess) {
+				unit.LastAccess = blob.lastAccess
+			}
+			if !blob.keep && listed[digest] == 1 {
+				unit.Size += blob.size
+			}
+		}
+		unit.Evict = func(ctx context.Context) (int64, error) {
+			if err := h.deleteTree(ctx, ref.dir); err != nil {
+				return 0, err
+			}
+			reclaimed := ref.size
+			for _, objectPath := range ref.objects {
+				access.Forget(h.name, objectPath)
+			}
+			for _, digest := range ref.state.BlobDigests {
+				listed[digest]--
+			}
+			for _, digest := range ref.state.BlobDigests {
+				size, err := evictBlob(ctx, digest)
+				if err != nil {
+					return reclaimed, err
+				}
+				reclaimed += size
+			}
+			return reclaimed, nil
+		}
+		units = append(units, unit)
+	}
+	for digest, blob := range blobs {
+		if blob.keep || listed[digest] > 0 {
+			continue
+		}
+		units = append(units, httpcache.EvictionUnit{
+			Name:       blob.path,
+			Size:       blob.size,
+			LastAccess: blob.lastAccess,
+			Expired:    true,
+			Evict: func(ctx context.Context) (int64, error) {
+				return evictBlob(ctx, digest)
+			},
+		})
+	}
+	return units, nil
+}
@@ -1,12 +1,15 @@
 package oci
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"io"
+	"io/fs"
 	"net/http"
 	"net/http/httptest"
+	"path"
 	"strconv"
 	"strings"
 	"sync"
@@ -17,8 +20,10 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/require"
 	"gopkg.d7z.net/blobfs"
+	"gopkg.in/yaml.v3"
 
 	"gopkg.d7z.net/cache-proxy/pkg/config"
+	"gopkg.d7z.net/cache-proxy/pkg/health"
 	"gopkg.d7z.net/cache-proxy/pkg/proxy/shared/httpcache"
 )
 
@@ -60,7 +65,7 @@ func TestResolveRequestMatchesRepoPolicy(t *testing.T) {
 	}
 
 	req := httptest.NewRequest(http.MethodGet, "/v2/library/alpine/manifests/latest", nil)
-	resolved, err := resolveRequest(req, cfg)
+	resolved, err := resolveRequest(req.URL.Path, cfg)
 	require.NoError(t, err)
 	require.Equal(t, requestManifest, resolved.kind)
 	require.Equal(t, "library/alpine", resolved.repo)
@@ -123,7 +128,7 @@ func TestOCIBearerTokenSingleflight(t *testing.T) {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			token, err := handler.ociBearerToken(ctx, challenge)
+			token, err := handler.ociBearerToken(ctx, handler.fallback.endpoints[0], challenge)
 			require.NoError(t, err)
 			results <- token
 		}()
@@ -202,10 +207,119 @@ func TestOCIManifestKeepsBlobUntilRefExpires(t *testing.T) {
 
 	require.NoError(t, handler.Cleanup(ctx, config.CleanupConfig{}))
 
-	_, err = store.OpenObject(ctx, handler.name, handler.refBlobPath("library/alpine", "latest", "sha256:layer"))
+	_, err = store.OpenObject(ctx, handler.name, handler.blobPath("sha256:layer"))
 	require.Error(t, err)
 }
 
+func TestOCIBlobsAreSharedAcrossRefs(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	layer := sha256Digest("shared-layer")
+	manifestBody := `{"schemaVersion":2,"layers":[{"digest":"` + layer + `"}]}`
+	var blobRequests atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/blobs/") {
+			blobRequests.Add(1)
+			_, _ = io.WriteString(w, "shared-layer")
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+		_, _ = io.WriteString(w, manifestBody)
+	}))
+	defer upstream.Close()
+
+	store, err := blobfs.Open(t.TempDir(), blobfs.DefaultConfig())
+	require.NoError(t, err)
+	defer store.Close()
+
+	handler := newHandler("oci", Block{
+		Upstream: upstream.URL,
+		Policy:   Policy{DefaultPolicy: config.PolicyImmutable},
+	}, config.Expiration(time.Hour), store, httpcache.NewStats(prometheus.NewRegistry()), nil)
+	serve := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequestWithContext(ctx, http.MethodGet, target, nil))
+		return rec
+	}
+
+	require.Equal(t, http.StatusOK, serve("/v2/library/node/manifests/20").Code)
+	require.Equal(t, http.StatusOK, serve("/v2/team/node/manifests/slim").Code)
+	require.Equal(t, "MISS", serve("/v2/library/node/blobs/"+layer).Header().Get("X-Cache"))
+	require.Equal(t, "HIT", serve("/v2/team/node/blobs/"+layer).Header().Get("X-Cache"))
+	require.Equal(t, int64(1), blobRequests.Load())
+
+	expire := func(repo, ref string) {
+		state, err := handler.readState(ctx, handler.refStatePath(repo, ref))
+		require.NoError(t, err)
+		state.FetchedAt = time.Now().Add(-2 * time.Hour)
+		require.NoError(t, handler.writeState(ctx, state))
+	}
+	expire("library/node", "20")
+	require.NoError(t, handler.Cleanup(ctx, config.CleanupConfig{}))
+	_, err = store.OpenObject(ctx, handler.name, handler.blobPath(layer))
+	require.NoError(t, err)
+
+	expire("team/node", "slim")
+	require.NoError(t, handler.Cleanup(ctx, config.CleanupConfig{}))
+	_, err = store.OpenObject(ctx, handler.name, handler.blobPath(layer))
+	require.Error(t, err)
+}
+
+func TestOCIManifestStaleIfErrorWindow(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	manifestBody := `{"schemaVersion":2,"layers":[]}`
+	var failing atomic.Bool
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			http.Error(w, "unavailable", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+		_, _ = io.WriteString(w, manifestBody)
+	}))
+	defer upstream.Close()
+
+	store, err := blobfs.Open(t.TempDir(), blobfs.DefaultConfig())
+	require.NoError(t, err)
+	defer store.Close()
+
+	handler := newHandler("oci", Block{
+		Upstream: upstream.URL,
+		Policy: Policy{
+			StaleWindows:  config.StaleWindows{IfError: config.Freshness(time.Hour)},
+			DefaultPolicy: config.PolicyImmutable,
+		},
+	}, config.Expiration(time.Hour), store, httpcache.NewStats(prometheus.NewRegistry()), nil)
+
+	get := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/library/alpine/manifests/latest", nil))
+		return rec
+	}
+	require.Equal(t, http.StatusOK, get().Code)
+
+	age := func(d time.Duration) {
+		statePath := handler.refStatePath("library/alpine", "latest")
+		state, err := handler.readState(ctx, statePath)
+		require.NoError(t, err)
+		state.FetchedAt = time.Now().Add(-d)
+		require.NoError(t, handler.writeState(ctx, state))
+	}
+	failing.Store(true)
+	age(90 * time.Minute)
+	require.NoError(t, handler.Cleanup(ctx, config.CleanupConfig{}))
+	rec := get()
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "STALE", rec.Header().Get("X-Cache"))
+	require.Equal(t, manifestBody, rec.Body.String())
+
+	age(3 * time.Hour)
+	require.Equal(t, http.StatusInternalServerError, get().Code)
+}
+
 func TestOCIBypassesBlobWithoutActiveRef(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
@@ -235,7 +349,7 @@ func TestOCIBypassesBlobWithoutActiveRef(t *testing.T) {
 	require.Equal(t, "BYPASS", rec.Header().Get("X-Cache"))
 	require.Equal(t, int64(1), blobRequests.Load())
 
-	_, err = store.OpenObject(ctx, handler.name, handler.refBlobPath("library/alpine", "latest", "sha256:layer"))
+	_, err = store.OpenObject(ctx, handler.name, handler.blobPath("sha256:layer"))
 	require.Error(t, err)
 	require.False(t, strings.Contains(rec.Body.String(), "Bad Gateway"))
 }
@@ -275,7 +389,7 @@ func TestOCIBlobFetchClearsBusyStateOnUpstreamError(t *testing.T) {
 	require.Equal(t, http.StatusInternalServerError, rec.Code)
 	require.Equal(t, "BYPASS", rec.Header().Get("X-Cache"))
 
-	objectPath := handler.refBlobPath("library/alpine", "latest", blobDigest)
+	objectPath := handler.blobPath(blobDigest)
 	_, busy := handler.downloads.Load(objectPath)
 	require.False(t, busy)
 }
@@ -342,11 +456,482 @@ func TestOCIBlobDigestMismatchIsNotCached(t *testing.T) {
 	require.Equal(t, http.StatusOK, rec.Code)
 	require.Equal(t, "wrong", rec.Body.String())
 	require.Eventually(t, func() bool {
-		_, err := store.OpenObject(ctx, handler.name, handler.refBlobPath("library/alpine", "latest", blobDigest))
+		_, err := store.OpenObject(ctx, handler.name, handler.blobPath(blobDigest))
 		return err != nil
 	}, time.Second, 10*time.Millisecond)
 }
 
+func TestOCIRoutesRegistriesByHostAndNamespace(t *testing.T) {
+	manifestBody := `{"schemaVersion":2}`
+	newUpstream := func(seen *[]string) *httptest.Server {
+		var mu sync.Mutex
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			*seen = append(*seen, r.URL.Path+" "+r.Header.Get("Authorization"))
+			mu.Unlock()
+			w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+			w.Header().Set("Docker-Content-Digest", sha256Digest(manifestBody))
+			_, _ = io.WriteString(w, manifestBody)
+		}))
+	}
+	var hubSeen, ghcrSeen []string
+	hub := newUpstream(&hubSeen)
+	defer hub.Close()
+	ghcr := newUpstream(&ghcrSeen)
+	defer ghcr.Close()
+
+	store, err := blobfs.Open(t.TempDir(), blobfs.DefaultConfig())
+	require.NoError(t, err)
+	defer store.Close()
+
+	handler := newHandler("oci", Block{
+		Upstreams: map[string]Registry{
+			"docker.io": {URL: hub.URL},
+			"ghcr.io": {
+				URL:   ghcr.URL,
+				Auth:  &AuthConfig{Type: "bearer", Token: "ghcr-token"},
+				Rules: []Rule{{Match: "org/**", Policy: config.PolicyImmutable}},
+			},
+		},
+		Policy: Policy{DefaultPolicy: config.PolicyBypass, BusyPolicy: config.BusyPolicyBypass},
+	}, config.Expiration(time.Hour), store, httpcache.NewStats(prometheus.NewRegistry()), nil)
+
+	serve := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec
+	}
+
+	rec := serve("/v2/")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "registry/2.0", rec.Header().Get("Docker-Distribution-API-Version"))
+
+	require.Equal(t, "MISS", serve("/v2/ghcr.io/org/app/manifests/v1").Header().Get("X-Cache"))
+	rec = serve("/v2/org/app/manifests/v1?ns=ghcr.io")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "HIT", rec.Header().Get("X-Cache"))
+	require.Equal(t, []string{"/v2/org/app/manifests/v1 Bearer ghcr-token"}, ghcrSeen)
+	_, err = handler.readState(context.Background(), handler.refStatePath("ghcr.io/org/app", "v1"))
+	require.NoError(t, err)
+
+	require.Equal(t, "BYPASS", serve("/v2/alpine/manifests/latest").Header().Get("X-Cache"))
+	require.Equal(t, "BYPASS", serve("/v2/alpine/manifests/latest?ns=docker.io").Header().Get("X-Cache"))
+	require.Equal(t, []string{"/v2/library/alpine/manifests/latest ", "/v2/library/alpine/manifests/latest "}, hubSeen)
+
+	require.Equal(t, http.StatusNotFound, serve("/v2/org/app/manifests/v1?ns=quay.io").Code)
+}
+
+func TestOCIReferrersAndSignatureTags(t *testing.T) {
+	subject := sha256Digest("image")
+	fallbackTag := strings.Replace(subject, ":", "-", 1)
+	index := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`
+	signature := `{"schemaVersion":2,"config":{"digest":"sha256:cfg"},"layers":[{"digest":"` + sha256Digest("sig") + `"}]}`
+	var failing atomic.Bool
+	var mu sync.Mutex
+	seen := map[string]int{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen[r.URL.Path]++
+		mu.Unlock()
+		if failing.Load() {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		switch r.URL.Path {
+		case "/v2/team/app/referrers/" + subject, "/v2/legacy/app/manifests/" + fallbackTag:
+			w.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+			_, _ = io.WriteString(w, index)
+		case "/v2/team/app/manifests/" + fallbackTag + ".sig":
+			w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+			_, _ = io.WriteString(w, signature)
+		case "/v2/team/app/blobs/" + sha256Digest("sig"):
+			_, _ = io.WriteString(w, "sig")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+
+	store, err := blobfs.Open(t.TempDir(), blobfs.DefaultConfig())
+	require.NoError(t, err)
+	defer store.Close()
+
+	handler := newHandler("oci", Block{
+		Upstream: upstream.URL,
+		Policy:   Policy{DefaultPolicy: config.PolicyImmutable, FreshFor: config.Freshness(time.Hour)},
+	}, config.Expiration(time.Hour), store, httpcache.NewStats(prometheus.NewRegistry()), nil)
+	serve := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec
+	}
+
+	rec := serve("/v2/team/app/referrers/" + subject)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "MISS", rec.Header().Get("X-Cache"))
+	require.Empty(t, rec.Header().Get("Docker-Content-Digest"))
+	require.Equal(t, index, rec.Body.String())
+	require.Equal(t, "HIT", serve("/v2/team/app/referrers/"+subject).Header().Get("X-Cache"))
+
+	rec = serve("/v2/legacy/app/referrers/" + subject)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, index, rec.Body.String())
+	require.Equal(t, 1, seen["/v2/legacy/app/referrers/"+subject])
+
+	require.Equal(t, "MISS", serve("/v2/team/app/manifests/"+fallbackTag+".sig").Header().Get("X-Cache"))
+	require.Equal(t, "MISS", serve("/v2/team/app/blobs/"+sha256Digest("sig")).Header().Get("X-Cache"))
+	require.Equal(t, "HIT", serve("/v2/team/app/blobs/"+sha256Digest("sig")).Header().Get("X-Cache"))
+
+	handler.policy.FreshFor = 0
+	failing.Store(true)
+	rec = serve("/v2/team/app/manifests/" + fallbackTag + ".sig")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "STALE", rec.Header().Get("X-Cache"))
+	require.Equal(t, signature, rec.Body.String())
+	require.Equal(t, 2, seen["/v2/team/app/manifests/"+fallbackTag+".sig"])
+}
+
+func TestOCIMirrorsServeDigestsAndPinTags(t *testing.T) {
+	layer := sha256Digest("layer")
+	manifestBody := `{"schemaVersion":2,"layers":[{"digest":"` + layer + `"}]}`
+	var primaryBlobs, mirrorManifests atomic.Int64
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/blobs/") {
+			primaryBlobs.Add(1)
+			http.Error(w, "rate limited", http.StatusTooManyRequests)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+		_, _ = io.WriteString(w, manifestBody)
+	}))
+	defer primary.Close()
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "replica" || pass != "secret" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="mirror"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if strings.Contains(r.URL.Path, "/manifests/") {
+			mirrorManifests.Add(1)
+		}
+		_, _ = io.WriteString(w, "layer")
+	}))
+	defer mirror.Close()
+
+	store, err := blobfs.Open(t.TempDir(), blobfs.DefaultConfig())
+	require.NoError(t, err)
+	defer store.Close()
+
+	handler := newHandler("oci", Block{
+		Upstream: primary.URL,
+		Mirrors:  []Mirror{{URL: mirror.URL, Auth: &AuthConfig{Type: "basic", Username: "replica", Password: "secret"}}},
+		Policy:   Policy{DefaultPolicy: config.PolicyImmutable},
+	}, config.Expiration(time.Hour), store, httpcache.NewStats(prometheus.NewRegistry()), nil)
+	handler.health = health.New("oci", config.ModeOCI, health.DefaultConfig(), handler.endpointURLs(), nil, "test")
+	require.Equal(t, []string{primary.URL, mirror.URL}, handler.endpointURLs())
+	serve := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec
+	}
+
+	require.Equal(t, http.StatusOK, serve("/v2/library/app/manifests/latest").Code)
+	rec := serve("/v2/library/app/blobs/" + layer)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "MISS", rec.Header().Get("X-Cache"))
+	require.Equal(t, "layer", rec.Body.String())
+	require.Equal(t, int64(1), primaryBlobs.Load())
+	require.Equal(t, int64(0), mirrorManifests.Load())
+}
+
+func TestOCIManifestByDigestFailsOverOnMismatch(t *testing.T) {
+	wanted := `{"schemaVersion":2,"layers":[]}`
+	other := `{"schemaVersion":2,"layers":[{"digest":"` + sha256Digest("other") + `"}]}`
+	registry := func(body string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+			w.Header().Set("Docker-Content-Digest", sha256Digest(body))
+			_, _ = io.WriteString(w, body)
+		}))
+	}
+	primary, mirror := registry(other), registry(wanted)
+	defer primary.Close()
+	defer mirror.Close()
+
+	store, err := blobfs.Open(t.TempDir(), blobfs.DefaultConfig())
+	require.NoError(t, err)
+	defer store.Close()
+
+	handler := newHandler("oci", Block{
+		Upstream: primary.URL,
+		Mirrors:  []Mirror{{URL: mirror.URL}},
+		Policy:   Policy{DefaultPolicy: config.PolicyImmutable},
+	}, config.Expiration(time.Hour), store, httpcache.NewStats(prometheus.NewRegistry()), nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/library/app/manifests/"+sha256Digest(wanted), nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, wanted, rec.Body.String())
+	require.Equal(t, sha256Digest(wanted), rec.Header().Get("Docker-Content-Digest"))
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/library/app/manifests/"+sha256Digest("missing"), nil))
+	require.Equal(t, http.StatusBadGateway, rec.Code)
+}
+
+func TestOCIHostedPushFlow(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var upstreamRequests atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamRequests.Add(1)
+		http.NotFound(w, r)
+	}))
+	defer upstream.Close()
+
+	store, err := blobfs.Open(t.TempDir(), blobfs.DefaultConfig())
+	require.NoError(t, err)
+	defer store.Close()
+
+	handler := newHandler("oci", Block{
+		Upstream: upstream.URL,
+		Hosted:   []string{"internal/**"},
+		Policy:   Policy{DefaultPolicy: config.PolicyImmutable},
+	}, config.Expiration(time.Hour), store, httpcache.NewStats(prometheus.NewRegistry()), nil)
+	serve := func(method, target, body string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequestWithContext(ctx, method, target, strings.NewReader(body))
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		if req.Header.Get(httpcache.IdentityHeader) == "" {
+			req.Header.Set(httpcache.IdentityHeader, "user:ci")
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	config1 := sha256Digest("config")
+	layer := sha256Digest("layer-data")
+	rec := serve(http.MethodPost, "/v2/internal/base/blobs/uploads/", "", nil)
+	require.Equal(t, http.StatusAccepted, rec.Code)
+	require.Equal(t, "0-0", rec.Header().Get("Range"))
+	location := rec.Header().Get("Location")
+	require.True(t, strings.HasPrefix(location, "/v2/internal/base/blobs/uploads/"))
+	rec = serve(http.MethodPatch, location, "layer-", http.Header{"Content-Range": {"0-5"}})
+	require.Equal(t, http.StatusAccepted, rec.Code)
+	require.Equal(t, "0-5", rec.Header().Get("Range"))
+	require.Equal(t, http.StatusRequestedRangeNotSatisfiable, serve(http.MethodPatch, location, "data", http.Header{"Content-Range": {"0-3"}}).Code)
+	require.Equal(t, http.StatusAccepted, serve(http.MethodPatch, location, "da", nil).Code)
+	require.Equal(t, http.StatusBadRequest, serve(http.MethodPut, location+"?digest="+config1, "ta", nil).Code)
+	rec = serve(http.MethodPut, location+"?digest="+layer, "ta", nil)
+	require.Equal(t, http.StatusCreated, rec.Code)
+	require.Equal(t, "/v2/internal/base/blobs/"+layer, rec.Header().Get("Location"))
+	require.Equal(t, http.StatusNotFound, serve(http.MethodGet, location, "", nil).Code)
+
+	require.Equal(t, http.StatusCreated, serve(http.MethodPost, "/v2/internal/base/blobs/uploads/?digest="+config1, "config", nil).Code)
+	rec = serve(http.MethodGet, "/v2/internal/base/blobs/"+layer, "", nil)
+	require.Equal(t, "layer-data", rec.Body.String())
+	require.Equal(t, hostedCache, rec.Header().Get("X-Cache"))
+
+	require.Equal(t, http.StatusNotFound, serve(http.MethodHead, "/v2/internal/app/blobs/"+layer, "", nil).Code)
+	rec = serve(http.MethodPost, "/v2/internal/app/blobs/uploads/?mount="+layer+"&from=internal/base", "", nil)
+	require.Equal(t, http.StatusCreated, rec.Code)
+	require.Equal(t, layer, rec.Header().Get("Docker-Content-Digest"))
+	require.Equal(t, http.StatusOK, serve(http.MethodHead, "/v2/internal/app/blobs/"+layer, "", nil).Code)
+
+	missing := sha256Digest("missing")
+	badManifest := `{"schemaVersion":2,"config":{"digest":"` + config1 + `"},"layers":[{"digest":"` + missing + `"}]}`
+	require.Equal(t, http.StatusBadRequest, serve(http.MethodPut, "/v2/internal/base/manifests/v1", badManifest, nil).Code)
+	manifest := `{"schemaVersion":2,"config":{"digest":"` + config1 + `"},"layers":[{"digest":"` + layer + `"}]}`
+	mediaType := http.Header{"Content-Type": {"application/vnd.oci.image.manifest.v1+json"}}
+	rec = serve(http.MethodPut, "/v2/internal/base/manifests/v1", manifest, mediaType)
+	require.Equal(t, http.StatusCreated, rec.Code)
+	digest := sha256Digest(manifest)
+	require.Equal(t, digest, rec.Header().Get("Docker-Content-Digest"))
+	require.Equal(t, http.StatusCreated, serve(http.MethodPut, "/v2/internal/base/manifests/latest", manifest, mediaType).Code)
+	require.Equal(t, http.StatusBadRequest, serve(http.MethodPut, "/v2/internal/base/manifests/"+missing, manifest, mediaType).Code)
+
+	rec = serve(http.MethodGet, "/v2/internal/base/manifests/v1", "", nil)
+	require.Equal(t, manifest, rec.Body.String())
+	require.Equal(t, digest, rec.Header().Get("Docker-Content-Digest"))
+	require.Equal(t, "application/vnd.oci.image.manifest.v1+json", rec.Header().Get("Content-Type"))
+	require.Equal(t, http.StatusOK, serve(http.MethodHead, "/v2/internal/base/manifests/"+digest, "", nil).Code)
+	require.JSONEq(t, `{"name":"internal/base","tags":["latest","v1"]}`, serve(http.MethodGet, "/v2/internal/base/tags/list", "", nil).Body.String())
+	require.JSONEq(t, `{"name":"internal/base","tags":["v1"]}`, serve(http.MethodGet, "/v2/internal/base/tags/list?last=latest&n=1", "", nil).Body.String())
+
+	require.Equal(t, http.StatusAccepted, serve(http.MethodDelete, "/v2/internal/base/manifests/latest", "", nil).Code)
+	require.Equal(t, http.StatusNotFound, serve(http.MethodGet, "/v2/internal/base/manifests/latest", "", nil).Code)
+	require.Equal(t, http.StatusOK, serve(http.MethodGet, "/v2/internal/base/manifests/v1", "", nil).Code)
+
+	require.Equal(t, http.StatusMethodNotAllowed, serve(http.MethodPost, "/v2/library/alpine/blobs/uploads/", "", nil).Code)
+	require.Zero(t, upstreamRequests.Load())
+}
+
+func TestOCIHostedWritesNeedIdentityAndSurviveCleanup(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	store, err := blobfs.Open(t.TempDir(), blobfs.DefaultConfig())
+	require.NoError(t, err)
+	defer store.Close()
+
+	handler := newHandler("oci", Block{
+		Upstream: "https://registry.invalid",
+		Hosted:   []string{"internal/**"},
+		Policy:   Policy{DefaultPolicy: config.PolicyImmutable},
+	}, config.Expiration(time.Minute), store, httpcache.NewStats(prometheus.NewRegistry()), nil)
+	serve := func(method, target, body, identity string) *httptest.ResponseRecorder {
+		req := httptest.NewRequestWithContext(ctx, method, target, strings.NewReader(body))
+		if identity != "" {
+			req.Header.Set(httpcache.IdentityHeader, identity)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	layer := sha256Digest("layer")
+	rec := serve(http.MethodPost, "/v2/internal/base/blobs/uploads/?digest="+layer, "layer", "")
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	require.Equal(t, `Basic realm="cache-proxy"`, rec.Header().Get("WWW-Authenticate"))
+	require.Contains(t, rec.Body.String(), `"UNAUTHORIZED"`)
+	require.Equal(t, http.StatusCreated, serve(http.MethodPost, "/v2/internal/base/blobs/uploads/?digest="+layer, "layer", "token:0").Code)
+	manifest := `{"schemaVersion":2,"layers":[{"digest":"` + layer + `"}]}`
+	require.Equal(t, http.StatusCreated, serve(http.MethodPut, "/v2/internal/base/manifests/v1", manifest, "token:0").Code)
+	require.Equal(t, http.StatusUnauthorized, serve(http.MethodDelete, "/v2/internal/base/manifests/v1", "", "").Code)
+	location := serve(http.MethodPost, "/v2/internal/base/blobs/uploads/", "", "token:0").Header().Get("Location")
+
+	uploads, err := fs.ReadDir(store.TenantFS(handler.name), "oci/uploads")
+	require.NoError(t, err)
+	require.Len(t, uploads, 1)
+	data, err := yaml.Marshal(&uploadState{Repo: "internal/base", StartedAt: time.Now().Add(-2 * hostedUploadTTL)})
+	require.NoError(t, err)
+	require.NoError(t, handler.storeObject(ctx, path.Join(uploadDir(uploads[0].Name()), "upload.yaml"), bytes.NewReader(data), nil))
+
+	require.NoError(t, handler.Cleanup(ctx, config.CleanupConfig{}))
+	require.Equal(t, "layer", serve(http.MethodGet, "/v2/internal/base/blobs/"+layer, "", "").Body.String())
+	require.Equal(t, manifest, serve(http.MethodGet, "/v2/internal/base/manifests/v1", "", "").Body.String())
+	require.Equal(t, http.StatusNotFound, serve(http.MethodGet, location, "", "token:0").Code)
+}
+
+func TestOCIHostedPushSurvivesQuotaEviction(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	store, err := blobfs.Open(t.TempDir(), blobfs.DefaultConfig())
+	require.NoError(t, err)
+	defer store.Close()
+
+	handler := newHandler("oci", Block{
+		Upstream: "https://registry.invalid",
+		Hosted:   []string{"internal/**"},
+		Policy:   Policy{DefaultPolicy: config.PolicyImmutable},
+	}, config.Expiration(time.Hour), store, httpcache.NewStats(prometheus.NewRegistry()), nil)
+	serve := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequestWithContext(ctx, method, target, strings.NewReader(body))
+		req.Header.Set(httpcache.IdentityHeader, "user:ci")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// base and pulled stand for blobs cached from the upstream; base is then
+	// mounted into the pushed image.
+	base, pulled, layer := sha256Digest("base-layer"), sha256Digest("pulled-layer"), sha256Digest("layer")
+	octet := http.Header{"Content-Type": {"application/octet-stream"}}
+	require.NoError(t, handler.putObjectFromReader(ctx, handler.blobPath(base), strings.NewReader("base-layer"), 10, octet, nil))
+	require.NoError(t, handler.putObjectFromReader(ctx, handler.blobPath(pulled), strings.NewReader("pulled-layer"), 12, octet, nil))
+
+	require.Equal(t, http.StatusCreated, serve(http.MethodPost, "/v2/internal/app/blobs/uploads/?digest="+layer, "layer").Code)
+	require.Equal(t, http.StatusCreated, serve(http.MethodPost, "/v2/internal/app/blobs/uploads/?mount="+base+"&from=library/base", "").Code)
+	manifest := `{"schemaVersion":2,"layers":[{"digest":"` + base + `"},{"digest":"` + layer + `"}]}`
+	require.Equal(t, http.StatusCreated, serve(http.MethodPut, "/v2/internal/app/manifests/v1", manifest).Code)
+
+	result, err := httpcache.EvictStoreTenants(ctx, store, nil, []string{handler.name},
+		map[string]httpcache.UnitEvictor{handler.name: handler}, 1, 0, config.CleanupConfig{})
+	require.NoError(t, err)
+	require.Equal(t, 1, result.Evicted)
+	_, err = store.StatObject(ctx, handler.name, handler.blobPath(pulled))
+	require.Error(t, err)
+
+	require.Equal(t, manifest, serve(http.MethodGet, "/v2/internal/app/manifests/v1", "").Body.String())
+	require.Equal(t, "base-layer", serve(http.MethodGet, "/v2/internal/app/blobs/"+base, "").Body.String())
+	require.Equal(t, "layer", serve(http.MethodGet, "/v2/internal/app/blobs/"+layer, "").Body.String())
+	require.NotEqual(t, "layer", serve(http.MethodGet, "/v2/library/app/blobs/"+layer, "").Body.String())
+
+	// Deleting the only manifest drops its links, so its blobs are cached
+	// content again.
+	require.Equal(t, http.StatusAccepted, serve(http.MethodDelete, "/v2/internal/app/manifests/"+sha256Digest(manifest), "").Code)
+	require.Equal(t, http.StatusNotFound, serve(http.MethodGet, "/v2/internal/app/blobs/"+layer, "").Code)
+	result, err = httpcache.EvictStoreTenants(ctx, store, nil, []string{handler.name},
+		map[string]httpcache.UnitEvictor{handler.name: handler}, 1, 0, config.CleanupConfig{})
+	require.NoError(t, err)
+	require.Equal(t, 2, result.Evicted)
+	for _, blob := range []string{base, layer} {
+		_, err = store.StatObject(ctx, handler.name, handler.blobPath(blob))
+		require.Error(t, err)
+	}
+}
+
+func TestOCIQuotaEvictsRefsWithTheirUnsharedBlobs(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	store, err := blobfs.Open(t.TempDir(), blobfs.DefaultConfig())
+	require.NoError(t, err)
+	defer store.Close()
+
+	stats := httpcache.NewStats(prometheus.NewRegistry())
+	handler := newHandler("oci", Block{
+		Upstream: "https://registry.invalid",
+		Policy:   Policy{DefaultPolicy: config.PolicyImmutable},
+	}, config.Expiration(time.Hour), store, stats, nil)
+
+	octet := http.Header{"Content-Type": {"application/octet-stream"}}
+	shared, onlyA, onlyB := sha256Digest("shared-blob"), sha256Digest("blob-of-a"), sha256Digest("blob-of-b")
+	for digest, body := range map[string]string{shared: "shared-blob", onlyA: "blob-of-a", onlyB: "blob-of-b"} {
+		require.NoError(t, handler.putObjectFromReader(ctx, handler.blobPath(digest), strings.NewReader(body), int64(len(body)), octet, nil))
+	}
+	for ref, digests := range map[string][]string{"a": {shared, onlyA}, "b": {shared, onlyB}} {
+		require.NoError(t, handler.putObjectFromReader(ctx, handler.refManifestPath("library/app", ref), strings.NewReader("{}"), 2, http.Header{}, nil))
+		require.NoError(t, handler.writeState(ctx, refState{Repo: "library/app", Ref: ref, FetchedAt: time.Now().UTC(), BlobDigests: digests}))
+	}
+	stats.Access().Touch(handler.name, handler.refManifestPath("library/app", "b"))
+
+	usage := collectUsage(t, store, handler.name)
+	result, err := httpcache.EvictStoreTenants(ctx, store, stats.Access(), []string{handler.name},
+		map[string]httpcache.UnitEvictor{handler.name: handler}, 1, usage-1, config.CleanupConfig{})
+	require.NoError(t, err)
+	require.Equal(t, 1, result.Evicted)
+
+	_, err = store.StatObject(ctx, handler.name, handler.refStatePath("library/app", "a"))
+	require.Error(t, err)
+	_, err = store.StatObject(ctx, handler.name, handler.blobPath(onlyA))
+	require.Error(t, err)
+	for _, objectPath := range []string{handler.refStatePath("library/app", "b"), handler.blobPath(shared), handler.blobPath(onlyB)} {
+		_, err = store.StatObject(ctx, handler.name, objectPath)
+		require.NoError(t, err, objectPath)
+	}
+	require.Equal(t, usage-collectUsage(t, store, handler.name), result.ReclaimedBytes)
+}
+
+func collectUsage(t *testing.T, store *blobfs.Store, tenant string) int64 {
+	t.Helper()
+	var usage int64
+	require.NoError(t, fs.WalkDir(store.TenantFS(tenant), ".", func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		info, err := entry.Info()
+		if err == nil {
+			usage += info.Size()
+		}
+		return err
+	}))
+	return usage
+}
+
 func TestOCITokenPurgeExpired(t *testing.T) {
 	handler := &handler{auth: authHandler{tokens: map[string]ociToken{}}}
 
@@ -8,12 +8,16 @@ import (
 	"gopkg.d7z.net/blobfs"
 
 	"gopkg.d7z.net/cache-proxy/pkg/config"
+	"gopkg.d7z.net/cache-proxy/pkg/health"
+	"gopkg.d7z.net/cache-proxy/pkg/proxy/shared/deny"
 	"gopkg.d7z.net/cache-proxy/pkg/proxy/shared/httpcache"
 	"gopkg.d7z.net/cache-proxy/pkg/utils"
 )
 
 const manifestAccept = "application/vnd.oci.image.manifest.v1+json, application/vnd.oci.image.index.v1+json, application/vnd.oci.artifact.manifest.v1+json, application/vnd.docker.distribution.manifest.v2+json, application/vnd.docker.distribution.manifest.list.v2+json, application/vnd.docker.distribution.manifest.v1+json, application/json"
 
+const maxManifestSize = 50 << 20
+
 type authHandler struct {
 	tokenMu sync.Mutex
 	tokens  map[string]ociToken
@@ -29,6 +33,11 @@ type refState struct {
 	BlobDigests    []string          `yaml:"blob_digests,omitempty"`
 }
 
+type uploadState struct {
+	Repo      string    `yaml:"repo"`
+	StartedAt time.Time `yaml:"started_at"`
+}
+
 type ociToken struct {
 	value  string
 	expire time.Time
@@ -44,11 +53,33 @@ type descriptor struct {
 	Digest string `json:"digest"`
 }
 
+// endpoint is one URL a registry is served from, with its credentials.
+type endpoint struct {
+	url  string
+	auth *AuthConfig
+}
+
+// registry is an upstream registry with the policy its repositories are
+// cached with. Host is empty for single-upstream instances. The first
+// endpoint is the primary; the others are its mirrors.
+type registry struct {
+	host      string
+	endpoints []*endpoint
+	policy    *Policy
+}
+
 type handler struct {
-	name             string
-	upstream         string
-	expireAfter      config.Expiration
-	policy           *Policy
+	name        string
+	expireAfter config.Expiration
+	policy      *Policy
+	// registries holds the upstreams of a multi-registry instance by host.
+	// fallback serves requests that name no registry: the single upstream,
+	// or Docker Hub when it is configured.
+	registries       map[string]*registry
+	fallback         *registry
+	hosted           []string
+	deny             *deny.List
+	health           *health.ServiceHealth
 	store            *blobfs.Store
 	stats            *httpcache.Stats
 	client           *utils.HttpClientWrapper
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/url"
 	"strings"
 	"time"
 
@@ -11,11 +12,15 @@ import (
 	containername "github.com/google/go-containerregistry/pkg/name"
 
 	"gopkg.d7z.net/cache-proxy/pkg/config"
+	"gopkg.d7z.net/cache-proxy/pkg/health"
+	"gopkg.d7z.net/cache-proxy/pkg/proxy/shared/httpcache"
 	proxyruntime "gopkg.d7z.net/cache-proxy/pkg/runtime"
 	"gopkg.d7z.net/cache-proxy/pkg/scheduler"
 )
 
 type Policy struct {
+	config.StaleWindows `yaml:",inline"`
+
 	Auth          *AuthConfig      `json:"auth,omitempty" yaml:"auth,omitempty"`
 	DefaultPolicy string           `json:"defaultPolicy,omitempty" yaml:"default_policy,omitempty"`
 	FreshFor      config.Freshness `json:"freshFor,omitempty" yaml:"fresh_for,omitempty"`
@@ -36,15 +41,65 @@ type AuthConfig struct {
 	Token    string `json:"token,omitempty" yaml:"token,omitempty"`
 }
 
+// Mirror is another endpoint serving the content of a registry, such as a
+// replica. It is tried for pulls by digest when the primary is unhealthy.
+type Mirror struct {
+	URL  string      `json:"url" yaml:"url"`
+	Auth *AuthConfig `json:"auth,omitempty" yaml:"auth,omitempty"`
+}
+
+// Registry is one upstream of a multi-registry instance, keyed by the
+// registry host clients route by. URL defaults to https://<host>; rules
+// default to the instance rules.
+type Registry struct {
+	URL           string      `json:"url,omitempty" yaml:"url,omitempty"`
+	Auth          *AuthConfig `json:"auth,omitempty" yaml:"auth,omitempty"`
+	Mirrors       []Mirror    `json:"mirrors,omitempty" yaml:"mirrors,omitempty"`
+	DefaultPolicy string      `json:"defaultPolicy,omitempty" yaml:"default_policy,omitempty"`
+	Rules         []Rule      `json:"rules,omitempty" yaml:"rules,omitempty"`
+}
+
+// Block is the oci instance configuration. Hosted lists repository globs
+// that are served from the store and accept pushes instead of being proxied.
 type Block struct {
 	ExpireAfter config.Expiration       `yaml:"expire_after"`
 	Bind        string                  `yaml:"bind"`
+	TLS         *config.TLSConfig       `yaml:"tls,omitempty"`
 	DisplayURL  string                  `yaml:"display_url,omitempty"`
 	Upstream    string                  `yaml:"upstream"`
+	Upstreams   map[string]Registry     `yaml:"upstreams,omitempty"`
+	Mirrors     []Mirror                `yaml:"mirrors,omitempty"`
+	Hosted      []string                `yaml:"hosted,omitempty"`
 	Transport   *config.TransportConfig `yaml:"transport,omitempty"`
 	Policy      `yaml:",inline"`
 }
 
+// dockerHubHost is the registry host Docker clients use for Docker Hub.
+const dockerHubHost = "docker.io"
+
+// upstreamURL returns the registry URL of host.
+func (r Registry) upstreamURL(host string) string {
+	switch {
+	case r.URL != "":
+		return strings.TrimRight(r.URL, "/")
+	case host == dockerHubHost:
+		return "https://registry-1.docker.io"
+	}
+	return "https://" + host
+}
+
+// policy returns the instance policy with the overrides of r applied.
+func (r Registry) policy(base Policy) Policy {
+	base.Auth = r.Auth
+	if r.DefaultPolicy != "" {
+		base.DefaultPolicy = r.DefaultPolicy
+	}
+	if r.Rules != nil {
+		base.Rules = r.Rules
+	}
+	return base
+}
+
 type Driver struct{}
 
 func NewDriver() proxyruntime.ModeDriver { return Driver{} }
@@ -55,8 +110,14 @@ func (Driver) Plan(_ context.Context, plan *proxyruntime.InstancePlan) error {
 	if err := plan.Decode(&block); err != nil {
 		return err
 	}
-	if block.Upstream == "" {
-		return fmt.Errorf("instance %s: oci mode requires one upstream", plan.Name())
+	if (block.Upstream == "") == (len(block.Upstreams) == 0) {
+		return fmt.Errorf("instance %s: oci mode requires either upstream or upstreams", plan.Name())
+	}
+	if len(block.Upstreams) > 0 && (block.Auth != nil || len(block.Mirrors) > 0) {
+		return fmt.Errorf("instance %s: oci upstreams take auth and mirrors per registry", plan.Name())
+	}
+	if block.Transport != nil && len(block.Transport.Auth) > 0 {
+		return fmt.Errorf("instance %s: oci mode authenticates with auth, not transport.auth", plan.Name())
 	}
 	if block.DefaultPolicy == "" {
 		block.DefaultPolicy = config.PolicyBypass
@@ -67,15 +128,54 @@ func (Driver) Plan(_ context.Context, plan *proxyruntime.InstancePlan) error {
 	if err := validate(block.Upstream, &block.Policy); err != nil {
 		return fmt.Errorf("instance %s: %w", plan.Name(), err)
 	}
+	if err := validateMirrors(block.Mirrors); err != nil {
+		return fmt.Errorf("instance %s: %w", plan.Name(), err)
+	}
+	for _, pattern := range block.Hosted {
+		if strings.TrimSpace(pattern) == "" || !doublestar.ValidatePattern(pattern) {
+			return fmt.Errorf("instance %s: invalid oci hosted pattern %q", plan.Name(), pattern)
+		}
+	}
+	for host, upstream := range block.Upstreams {
+		if _, err := containername.NewRegistry(host, containername.StrictValidation); err != nil || strings.Contains(host, "/") || host != strings.ToLower(host) {
+			return fmt.Errorf("instance %s: invalid oci upstreams key %q", plan.Name(), host)
+		}
+		policy := upstream.policy(block.Policy)
+		if err := validate(upstream.upstreamURL(host), &policy); err != nil {
+			return fmt.Errorf("instance %s: upstreams %s: %w", plan.Name(), host, err)
+		}
+		if err := validateMirrors(upstream.Mirrors); err != nil {
+			return fmt.Errorf("instance %s: upstreams %s: %w", plan.Name(), host, err)
+		}
+		upstream.Auth = policy.Auth
+		block.Upstreams[host] = upstream
+	}
 	expireAfter := config.DefaultExpireAfter
 	if !block.ExpireAfter.IsUnset() {
 		expireAfter = block.ExpireAfter
 	}
+	healthCfg := health.DefaultConfig()
+	if block.Transport != nil {
+		healthCfg = health.ApplyConfigPatch(healthCfg, block.Transport.Health)
+	}
+	if err := health.ValidateConfig(healthCfg); err != nil {
+		return fmt.Errorf("health: %w", err)
+	}
+	probeUserAgent := httpcache.DefaultUserAgent
+	if block.Transport != nil && block.Transport.UserAgent != "" {
+		probeUserAgent = block.Transport.UserAgent
+	}
 	handler := newHandler(plan.Name(), block, expireAfter, plan.Store(), plan.Stats(), plan.Downloads())
+	handler.deny = plan.Deny()
+	handler.health = health.New(plan.Name(), config.ModeOCI, healthCfg, handler.endpointURLs(), plan.Stats(), probeUserAgent)
+	handler.health.SetProbeScheduler(plan.ProbeScheduler())
+	handler.health.SetBus(plan.Bus())
+	httpcache.ConfigureProbeTransport(handler.health, plan.Name(), block.Transport)
 	plan.SetHomeSnippet(plan.RenderSnippet())
 	if block.DisplayURL != "" {
 		plan.SetHomeDisplayURL(block.DisplayURL)
 	}
+	plan.SetBindTLS(block.TLS)
 	plan.Scheduler().Register(scheduler.TaskDef{
 		Key:      scheduler.NewTaskKey(plan.Name(), scheduler.TypeExpireCleanup, ""),
 		Interval: 6 * time.Hour,
@@ -118,22 +218,42 @@ func validate(upstream string, policy *Policy) error {
 		}
 		policy.Rules[i] = rule
 	}
-	if policy.Auth == nil {
-		return nil
+	auth, err := validateAuth(policy.Auth)
+	policy.Auth = auth
+	return err
+}
+
+// validateAuth checks auth and returns nil for an auth of type none.
+func validateAuth(auth *AuthConfig) (*AuthConfig, error) {
+	if auth == nil {
+		return nil, nil
 	}
-	switch strings.ToLower(policy.Auth.Type) {
+	switch strings.ToLower(auth.Type) {
 	case "", "none":
-		policy.Auth = nil
+		return nil, nil
 	case "basic":
-		if policy.Auth.Username == "" || policy.Auth.Password == "" {
-			return errors.New("oci basic auth requires username and password")
+		if auth.Username == "" || auth.Password == "" {
+			return nil, errors.New("oci basic auth requires username and password")
 		}
 	case "bearer":
-		if policy.Auth.Token == "" {
-			return errors.New("oci bearer auth requires token")
+		if auth.Token == "" {
+			return nil, errors.New("oci bearer auth requires token")
 		}
 	default:
-		return fmt.Errorf("unsupported oci auth type %q", policy.Auth.Type)
+		return nil, fmt.Errorf("unsupported oci auth type %q", auth.Type)
+	}
+	return auth, nil
+}
+
+func validateMirrors(mirrors []Mirror) error {
+	for i, mirror := range mirrors {
+		parsed, err := url.Parse(mirror.URL)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("oci mirror %d: invalid url %q", i, mirror.URL)
+		}
+		if mirrors[i].Auth, err = validateAuth(mirror.Auth); err != nil {
+			return fmt.Errorf("oci mirror %d: %w", i, err)
+		}
 	}
 	return nil
 }
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"net/http"
 	"path"
+	"regexp"
 	"strings"
 
 	"github.com/bmatcuk/doublestar/v4"
@@ -20,16 +21,29 @@ const (
 	requestTags
 	requestManifest
 	requestBlob
+	requestReferrers
+	requestUpload
 	requestBypass
 )
 
+// referrerTag matches the tags that stand in for the referrers API:
+// sha256-<digest> from the OCI fallback schema and its cosign .sig, .att and
+// .sbom variants. Both change whenever a signature or attestation is pushed.
+var referrerTag = regexp.MustCompile(`^sha256-[0-9a-f]{64}(\.[a-z]+)?$`)
+
 type request struct {
 	kind         requestKind
+	registry     *registry
 	repo         string
 	ref          string
 	digest       string
 	upstreamPath string
 	match        repoMatch
+	// revalidate marks cached content that is refetched once fresh_for has
+	// passed instead of being kept until it expires.
+	revalidate bool
+	// hosted marks repositories served from the store that accept pushes.
+	hosted bool
 }
 
 type repoMatch struct {
@@ -38,8 +52,85 @@ type repoMatch struct {
 	expireAfter config.Expiration
 }
 
-func resolveRequest(req *http.Request, cfg *Policy) (request, error) {
+// resolve picks the registry of req and resolves the request within it. A
+// multi-registry instance takes the registry from the containerd ns query
+// parameter or from a leading host segment, and falls back to Docker Hub.
+// It answers pings itself, so they resolve without a registry. Hosted
+// repositories take precedence over every registry.
+func (h *handler) resolve(req *http.Request) (request, error) {
+	if resolved, ok := h.resolveHosted(req.URL.Path); ok {
+		return resolved, nil
+	}
+	if h.registries == nil {
+		resolved, err := resolveRequest(req.URL.Path, h.fallback.policy)
+		if err == nil && resolved.kind == requestUpload {
+			return request{}, errUploadNotProxied
+		}
+		resolved.registry = h.fallback
+		return resolved, err
+	}
 	cleanPath := strings.TrimPrefix(path.Clean("/"+req.URL.Path), "/")
+	if cleanPath == "v2" {
+		return request{kind: requestPing, upstreamPath: "v2"}, nil
+	}
+	rest, ok := strings.CutPrefix(cleanPath, "v2/")
+	if !ok {
+		return request{}, errors.New("invalid OCI request path")
+	}
+	reg := h.fallback
+	if ns := strings.ToLower(req.URL.Query().Get("ns")); ns != "" {
+		reg = h.registries[ns]
+	} else if host, repoPath, _ := strings.Cut(rest, "/"); h.registries[strings.ToLower(host)] != nil {
+		reg, rest = h.registries[strings.ToLower(host)], repoPath
+	}
+	if reg == nil {
+		return request{}, errors.New("unknown OCI registry")
+	}
+	resolved, err := resolveRequest("v2/"+rest, reg.policy)
+	if err == nil && reg.host == dockerHubHost && resolved.repo != "" && !strings.Contains(resolved.repo, "/") {
+		resolved, err = resolveRequest("v2/library/"+rest, reg.policy)
+	}
+	if err == nil && resolved.kind == requestUpload {
+		err = errUploadNotProxied
+	}
+	if err != nil {
+		return request{}, err
+	}
+	if resolved.repo != "" {
+		resolved.repo = path.Join(reg.host, resolved.repo)
+	}
+	resolved.registry = reg
+	return resolved, nil
+}
+
+// resolveHosted resolves lookupPath when it names a hosted repository.
+func (h *handler) resolveHosted(lookupPath string) (request, bool) {
+	if len(h.hosted) == 0 {
+		return request{}, false
+	}
+	resolved, err := resolveRequest(lookupPath, nil)
+	if err != nil || resolved.repo == "" {
+		return request{}, false
+	}
+	for _, pattern := range h.hosted {
+		if doublestar.MatchUnvalidated(pattern, resolved.repo) {
+			resolved.hosted = true
+			return resolved, true
+		}
+	}
+	return request{}, false
+}
+
+var errUploadNotProxied = errors.New("OCI blob uploads are not proxied")
+
+// byDigest reports whether r names content by digest, which every endpoint of
+// a registry serves identically.
+func (r request) byDigest() bool {
+	return r.kind == requestBlob || (r.kind == requestManifest && strings.Contains(r.ref, ":"))
+}
+
+func resolveRequest(lookupPath string, cfg *Policy) (request, error) {
+	cleanPath := strings.TrimPrefix(path.Clean("/"+lookupPath), "/")
 	if cleanPath == "v2" || cleanPath == "v2/" {
 		return request{kind: requestPing, upstreamPath: "v2"}, nil
 	}
@@ -48,8 +139,17 @@ func resolveRequest(req *http.Request, cfg *Policy) (request, error) {
 	}
 	parts := strings.Split(cleanPath, "/")
 	for i, part := range parts {
-		if part == "blobs" && i+2 < len(parts) && parts[i+1] == "uploads" {
-			return request{}, errors.New("OCI blob uploads are not proxied")
+		if part == "blobs" && i+1 < len(parts) && parts[i+1] == "uploads" {
+			repo := strings.Join(parts[1:i], "/")
+			if repo == "" || i+3 < len(parts) {
+				return request{}, errors.New("invalid OCI upload path")
+			}
+			// ref holds the upload session, empty when one is started.
+			resolved := request{kind: requestUpload, repo: repo, upstreamPath: cleanPath}
+			if i+2 < len(parts) {
+				resolved.ref = parts[i+2]
+			}
+			return resolved, nil
 		}
 		if part == "manifests" && i+1 < len(parts) {
 			repo := strings.Join(parts[1:i], "/")
@@ -63,6 +163,23 @@ func resolveRequest(req *http.Request, cfg *Policy) (request, error) {
 				ref:          ref,
 				upstreamPath: cleanPath,
 				match:        matchRepo(cfg, repo),
+				revalidate:   referrerTag.MatchString(ref),
+			}, nil
+		}
+		if part == "referrers" && i+1 < len(parts) {
+			repo := strings.Join(parts[1:i], "/")
+			digest := parts[i+1]
+			if repo == "" || !strings.Contains(digest, ":") {
+				return request{}, errors.New("invalid OCI referrers path")
+			}
+			return request{
+				kind:         requestReferrers,
+				repo:         repo,
+				ref:          "referrers/" + digest,
+				digest:       digest,
+				upstreamPath: cleanPath,
+				match:        matchRepo(cfg, repo),
+				revalidate:   true,
 			}, nil
 		}
 		if part == "blobs" && i+1 < len(parts) {
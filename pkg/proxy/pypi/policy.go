@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"gopkg.d7z.net/cache-proxy/pkg/config"
+	"gopkg.d7z.net/cache-proxy/pkg/proxy/shared/deny"
 	"gopkg.d7z.net/cache-proxy/pkg/proxy/shared/httpcache"
 	proxyruntime "gopkg.d7z.net/cache-proxy/pkg/runtime"
 	"gopkg.d7z.net/cache-proxy/pkg/scheduler"
@@ -20,6 +21,8 @@ import (
 const defaultCleanupInterval = 6 * time.Hour
 
 type Policy struct {
+	config.StaleWindows `yaml:",inline"`
+
 	IndexPolicy         string           `json:"indexPolicy,omitempty" yaml:"index_policy,omitempty"`
 	IndexFreshFor       config.Freshness `json:"indexFreshFor,omitempty" yaml:"index_fresh_for,omitempty"`
 	IndexBusyPolicy     string           `json:"indexBusyPolicy,omitempty" yaml:"index_busy_policy,omitempty"`
@@ -30,6 +33,7 @@ type Policy struct {
 	ProxyJSON           *bool            `json:"proxyJson,omitempty" yaml:"proxy_json,omitempty"`
 	ProxyCoreMetadata   bool             `json:"proxyCoreMetadata,omitempty" yaml:"proxy_core_metadata,omitempty"`
 	ProxySignatures     bool             `json:"proxySignatures,omitempty" yaml:"proxy_signatures,omitempty"`
+	NegativeTTL         config.Duration  `json:"negativeTTL,omitempty" yaml:"negative_ttl,omitempty"`
 }
 
 type Block struct {
@@ -39,6 +43,8 @@ type Block struct {
 	} `yaml:"route"`
 	Upstream  string                  `yaml:"upstream"`
 	Transport *config.TransportConfig `yaml:"transport,omitempty"`
+	// Snapshots serves point-in-time views under /@<date>/.
+	Snapshots bool `yaml:"snapshots,omitempty"`
 	Policy    `yaml:",inline"`
 }
 
@@ -74,8 +80,18 @@ func (Driver) Plan(_ context.Context, plan *proxyruntime.InstancePlan) error {
 		Transport:       block.Transport,
 		BusyPolicy:      block.CompanionBusyPolicy,
 		DefaultFreshFor: block.CompanionFreshFor,
+		DefaultStale:    block.StaleWindows,
+		NegativeTTL:     block.NegativeTTL,
 		DownloadLimiter: plan.Downloads(),
-	}, plan.Store(), &resolver{policy: &block.Policy, upstreams: upstreams}, plan.Stats(), nil)
+		Deny:            plan.Deny(),
+		MinReleaseAge:   plan.MinReleaseAge(),
+		Snapshots:       block.Snapshots,
+	}, plan.Store(), &resolver{
+		policy:    &block.Policy,
+		upstreams: upstreams,
+		deny:      plan.Deny(),
+		timed:     block.Snapshots || plan.MinReleaseAge() > 0,
+	}, plan.Stats(), nil)
 	plan.Scheduler().Register(scheduler.TaskDef{
 		Key:      scheduler.NewTaskKey(plan.Name(), scheduler.TypeExpireCleanup, ""),
 		Interval: defaultCleanupInterval,
@@ -137,16 +153,47 @@ func validate(policy *Policy) error {
 	if policy.CompanionFreshFor > 0 && policy.CompanionFreshFor.Duration() < time.Second {
 		return fmt.Errorf("pypi companion fresh_for must be at least 1s")
 	}
+	if policy.NegativeTTL < 0 {
+		return fmt.Errorf("pypi negative_ttl must not be negative")
+	}
 	return nil
 }
 
 type resolver struct {
 	policy    *Policy
 	upstreams []string
+	deny      *deny.List
+	// timed caches project pages in JSON form, which carries the upload
+	// times release age and snapshot views filter by, and renders them as
+	// HTML for clients that do not accept it.
+	timed bool
 }
 
 func (r *resolver) Resolve(req *http.Request) (httpcache.Route, error) {
-	return routeForPath(r.policy, r.upstreams, strings.TrimPrefix(path.Clean("/"+req.URL.Path), "/"))
+	route, err := routeForPath(r.policy, r.upstreams, strings.TrimPrefix(path.Clean("/"+req.URL.Path), "/"))
+	if err != nil {
+		return route, err
+	}
+	if r.timed && route.RewriteKind == "pypi-simple" && route.UpstreamPath != "simple/" {
+		route.ObjectPath = strings.TrimSuffix(route.ObjectPath, ".html") + ".json"
+		route.RequestHeaders = map[string]string{"Accept": "application/vnd.pypi.simple.v1+json"}
+	}
+	if r.deny == nil {
+		return route, nil
+	}
+	if project, ok := strings.CutPrefix(route.UpstreamPath, "simple/"); ok && project != "" {
+		route.Package = strings.TrimSuffix(project, "/")
+		route.Denied = r.deny.Match(route.Package, "")
+		return route, nil
+	}
+	source := route.TargetURL
+	if source == "" {
+		source = route.UpstreamPath
+	}
+	if project, version, ok := deny.PyPIFile(deny.URLFileName(source)); ok {
+		route.Denied = r.deny.Match(project, version)
+	}
+	return route, nil
 }
 
 func routeForPath(policy *Policy, upstreams []string, lookupPath string) (httpcache.Route, error) {
@@ -1,13 +1,17 @@
 package pypi
 
 import (
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/require"
+	"gopkg.d7z.net/blobfs"
 
 	"gopkg.d7z.net/cache-proxy/pkg/config"
+	"gopkg.d7z.net/cache-proxy/pkg/proxy/shared/httpcache"
 )
 
 func TestFileRouteLeavesForeignHostForHttpcacheValidation(t *testing.T) {
@@ -86,3 +90,83 @@ func TestResolveWithUpstreams(t *testing.T) {
 	require.Equal(t, "https://evil.com/malware.tar.gz", route.TargetURL)
 	require.Empty(t, route.UpstreamPath)
 }
+
+func TestResolverCachesProjectPagesAsJSONOnlyWhenTimed(t *testing.T) {
+	r := &resolver{policy: &Policy{IndexPolicy: config.PolicyRevalidate}}
+
+	route, err := r.Resolve(httptest.NewRequest(http.MethodGet, "/simple/Demo_Pkg/", nil))
+	require.NoError(t, err)
+	require.Equal(t, "pypi/simple/demo-pkg.html", route.ObjectPath)
+	require.Empty(t, route.RequestHeaders)
+
+	r.timed = true
+	route, err = r.Resolve(httptest.NewRequest(http.MethodGet, "/simple/Demo_Pkg/", nil))
+	require.NoError(t, err)
+	require.Equal(t, "pypi/simple/demo-pkg.json", route.ObjectPath)
+	require.Equal(t, "application/vnd.pypi.simple.v1+json", route.RequestHeaders["Accept"])
+
+	route, err = r.Resolve(httptest.NewRequest(http.MethodGet, "/simple/", nil))
+	require.NoError(t, err)
+	require.Equal(t, "pypi/simple/root.html", route.ObjectPath)
+	require.Empty(t, route.RequestHeaders)
+}
+
+func TestSnapshotViewSharesCachedProjectPage(t *testing.T) {
+	upstreamRequests := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamRequests++
+		w.Header().Set("Content-Type", "application/vnd.pypi.simple.v1+json")
+		_, _ = io.WriteString(w, `{"name":"demo","versions":["1.0","1.1"],"files":[
+			{"filename":"demo-1.0.tar.gz","url":"https://files.example/demo-1.0.tar.gz","hashes":{},"upload-time":"2026-01-10T08:00:00Z"},
+			{"filename":"demo-1.1.tar.gz","url":"https://files.example/demo-1.1.tar.gz","hashes":{},"upload-time":"2026-01-16T08:00:00Z"}]}`)
+	}))
+	defer upstream.Close()
+	store, err := blobfs.Open(t.TempDir(), blobfs.DefaultConfig())
+	require.NoError(t, err)
+	defer store.Close()
+	policy := &Policy{IndexPolicy: config.PolicyImmutable, FilePolicy: config.PolicyImmutable}
+	handler := httpcache.NewHandler("pypi", httpcache.RuntimeConfig{
+		Mode:      config.ModePyPI,
+		Upstreams: []string{upstream.URL},
+		Snapshots: true,
+	}, store, &resolver{policy: policy, upstreams: []string{upstream.URL}, timed: true}, httpcache.NewStats(prometheus.NewRegistry()), nil)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/simple/demo/", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), "demo-1.1.tar.gz")
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/@2026-01-15/simple/demo/", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), "demo-1.0.tar.gz")
+	require.NotContains(t, rec.Body.String(), "demo-1.1.tar.gz")
+	require.Equal(t, 1, upstreamRequests)
+}
+
+func TestSnapshotViewFailsForHTMLOnlyUpstream(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = io.WriteString(w, `<a href="https://files.example/demo-1.1.tar.gz">demo-1.1.tar.gz</a>`)
+	}))
+	defer upstream.Close()
+	store, err := blobfs.Open(t.TempDir(), blobfs.DefaultConfig())
+	require.NoError(t, err)
+	defer store.Close()
+	policy := &Policy{IndexPolicy: config.PolicyImmutable, FilePolicy: config.PolicyImmutable}
+	handler := httpcache.NewHandler("pypi", httpcache.RuntimeConfig{
+		Mode:      config.ModePyPI,
+		Upstreams: []string{upstream.URL},
+		Snapshots: true,
+	}, store, &resolver{policy: policy, upstreams: []string{upstream.URL}, timed: true}, httpcache.NewStats(prometheus.NewRegistry()), nil)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/simple/demo/", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), "demo-1.1.tar.gz")
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/@2026-01-15/simple/demo/", nil))
+	require.Equal(t, http.StatusBadGateway, rec.Code)
+	require.NotContains(t, rec.Body.String(), "demo-1.1.tar.gz")
+}
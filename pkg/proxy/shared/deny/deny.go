@@ -0,0 +1,191 @@
+package deny
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"gopkg.d7z.net/cache-proxy/pkg/config"
+)
+
+// Cache is the X-Cache value and cache outcome of requests blocked by a deny
+// rule.
+const Cache = "DENIED"
+
+// List holds the deny rules of an instance. A nil list blocks nothing.
+type List struct {
+	mode  string
+	rules []rule
+}
+
+type rule struct {
+	text     string
+	name     string
+	versions func(string) bool
+}
+
+type ruleParser func(text string) (name string, versions func(string) bool, err error)
+
+var parsers = map[string]ruleParser{
+	config.ModeNPM:   parseNPMRule,
+	config.ModePyPI:  parsePyPIRule,
+	config.ModeCargo: parseCargoRule,
+	config.ModeGo:    parseGoRule,
+	config.ModeMaven: parseMavenRule,
+	config.ModeOCI:   parseOCIRule,
+}
+
+// Parse parses entries with the package syntax of mode. It returns nil when
+// entries is empty.
+func Parse(mode string, entries []string) (*List, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	parse, ok := parsers[mode]
+	if !ok {
+		return nil, fmt.Errorf("deny is not supported in %s mode", mode)
+	}
+	list := &List{mode: mode}
+	for _, entry := range entries {
+		text := strings.TrimSpace(entry)
+		name, versions, err := parse(text)
+		if err == nil && strings.TrimSpace(name) == "" {
+			err = errors.New("missing package name")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("deny %q: %w", entry, err)
+		}
+		list.rules = append(list.rules, rule{text: text, name: normalizeName(mode, strings.TrimSpace(name)), versions: versions})
+	}
+	return list, nil
+}
+
+// Match returns why version of name is blocked, or "" when it is not. An
+// empty version only matches rules that block every version.
+func (l *List) Match(name, version string) string {
+	if l == nil {
+		return ""
+	}
+	key := normalizeName(l.mode, name)
+	for _, rule := range l.rules {
+		if rule.name != key {
+			continue
+		}
+		if rule.versions == nil || (version != "" && rule.versions(version)) {
+			subject := name
+			if version != "" {
+				subject += " " + version
+			}
+			return fmt.Sprintf("%s is blocked by deny rule %q", subject, rule.text)
+		}
+	}
+	return ""
+}
+
+// Blocks reports whether version of name is blocked.
+func (l *List) Blocks(name, version string) bool {
+	return l.Match(name, version) != ""
+}
+
+// Write answers 403 with the message returned by Match.
+func Write(w http.ResponseWriter, message string) {
+	w.Header().Set("X-Cache", Cache)
+	http.Error(w, message, http.StatusForbidden)
+}
+
+var pypiNameRE = regexp.MustCompile(`[-_.]+`)
+
+func normalizeName(mode, name string) string {
+	switch mode {
+	case config.ModeNPM:
+		return strings.ToLower(name)
+	case config.ModePyPI:
+		return pypiNameRE.ReplaceAllString(strings.ToLower(name), "-")
+	case config.ModeCargo:
+		return strings.ReplaceAll(strings.ToLower(name), "_", "-")
+	}
+	return name
+}
+
+// parseNPMRule parses name or name@range; scoped names keep their leading @.
+func parseNPMRule(text string) (string, func(string) bool, error) {
+	at := strings.LastIndex(text, "@")
+	if at <= 0 {
+		return text, nil, nil
+	}
+	versions, err := parseSemverRange(text[at+1:])
+	return text[:at], versions, err
+}
+
+// parseGoRule parses module or module@version-range.
+func parseGoRule(text string) (string, func(string) bool, error) {
+	module, spec, ok := strings.Cut(text, "@")
+	if !ok {
+		return module, nil, nil
+	}
+	versions, err := parseSemverRange(spec)
+	return module, versions, err
+}
+
+// parseCargoRule parses crate or crate/version-range.
+func parseCargoRule(text string) (string, func(string) bool, error) {
+	crate, spec, ok := strings.Cut(text, "/")
+	if !ok {
+		return crate, nil, nil
+	}
+	versions, err := parseSemverRange(strings.ReplaceAll(spec, ",", " "))
+	return crate, versions, err
+}
+
+var pypiRuleRE = regexp.MustCompile(`^([A-Za-z0-9][A-Za-z0-9._-]*)\s*(.*)$`)
+
+// parsePyPIRule parses a project name followed by an optional PEP 440
+// specifier set such as "requests>=2.0,<2.31".
+func parsePyPIRule(text string) (string, func(string) bool, error) {
+	match := pypiRuleRE.FindStringSubmatch(text)
+	if match == nil {
+		return "", nil, errors.New("invalid project name")
+	}
+	if strings.TrimSpace(match[2]) == "" {
+		return match[1], nil, nil
+	}
+	versions, err := parsePyPISpecifiers(match[2])
+	return match[1], versions, err
+}
+
+// parseMavenRule parses group:artifact or group:artifact:version, where
+// version is exact or a Maven range such as [2.0,2.17.1).
+func parseMavenRule(text string) (string, func(string) bool, error) {
+	parts := strings.SplitN(text, ":", 3)
+	if len(parts) < 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+		return "", nil, errors.New("expected group:artifact[:version]")
+	}
+	name := strings.TrimSpace(parts[0]) + ":" + strings.TrimSpace(parts[1])
+	if len(parts) == 2 {
+		return name, nil, nil
+	}
+	versions, err := parseMavenRange(parts[2])
+	return name, versions, err
+}
+
+// parseOCIRule parses repo, repo:tag or repo@digest.
+func parseOCIRule(text string) (string, func(string) bool, error) {
+	repo, ref := text, ""
+	if i := strings.Index(text, "@"); i >= 0 {
+		repo, ref = text[:i], text[i+1:]
+		if !strings.Contains(ref, ":") {
+			return "", nil, errors.New("digest must look like algorithm:hex")
+		}
+	} else if i := strings.LastIndex(text, ":"); i > strings.LastIndex(text, "/") {
+		repo, ref = text[:i], text[i+1:]
+	}
+	if repo != text && ref == "" {
+		return "", nil, errors.New("missing tag or digest")
+	}
+	if ref == "" {
+		return repo, nil, nil
+	}
+	return repo, func(version string) bool { return version == ref }, nil
+}
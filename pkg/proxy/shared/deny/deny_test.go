@@ -0,0 +1,183 @@
+package deny
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gopkg.d7z.net/cache-proxy/pkg/config"
+)
+
+func mustParse(t *testing.T, mode string, entries ...string) *List {
+	t.Helper()
+	list, err := Parse(mode, entries)
+	require.NoError(t, err)
+	return list
+}
+
+func TestNilListBlocksNothing(t *testing.T) {
+	var list *List
+	require.Empty(t, list.Match("lodash", "4.17.20"))
+	require.Equal(t, []byte("v1.0.0\n"), list.FilterGoList("example.com/m", []byte("v1.0.0\n")))
+	empty, err := Parse(config.ModeFile, nil)
+	require.NoError(t, err)
+	require.Nil(t, empty)
+}
+
+func TestParseRejectsUnsupportedModeAndBadRules(t *testing.T) {
+	for mode, entry := range map[string]string{
+		config.ModeFile:  "anything",
+		config.ModeNPM:   "lodash@not-a-version",
+		config.ModeCargo: "rand/",
+		config.ModePyPI:  "requests=>2",
+		config.ModeMaven: "org.example",
+		config.ModeOCI:   "library/nginx@latest",
+	} {
+		_, err := Parse(mode, []string{entry})
+		require.Error(t, err, "%s %s", mode, entry)
+	}
+}
+
+func TestNPMRanges(t *testing.T) {
+	list := mustParse(t, config.ModeNPM, "lodash@>=4.17.0 <4.17.21", "@scope/pkg@^1.2.0 || 3.0.0", "event-stream", "ua-parser-js@0.7.29 - 0.7.x")
+	require.NotEmpty(t, list.Match("lodash", "4.17.20"))
+	require.Empty(t, list.Match("lodash", "4.17.21"))
+	require.Empty(t, list.Match("lodash", "4.16.6"))
+	require.NotEmpty(t, list.Match("@scope/pkg", "1.9.0"))
+	require.Empty(t, list.Match("@scope/pkg", "2.0.0"))
+	require.Empty(t, list.Match("@scope/pkg", "2.0.0-rc.1"))
+	require.NotEmpty(t, list.Match("@scope/pkg", "3.0.0"))
+	require.NotEmpty(t, list.Match("event-stream", ""))
+	require.NotEmpty(t, list.Match("ua-parser-js", "0.7.31"))
+	require.Empty(t, list.Match("ua-parser-js", "0.8.0"))
+	require.Empty(t, list.Match("lodash", ""))
+	require.Equal(t, `lodash 4.17.20 is blocked by deny rule "lodash@>=4.17.0 <4.17.21"`, list.Match("lodash", "4.17.20"))
+}
+
+func TestSemverOperators(t *testing.T) {
+	cases := []struct {
+		spec    string
+		match   []string
+		noMatch []string
+	}{
+		{spec: "~1.2.3", match: []string{"1.2.3", "1.2.9"}, noMatch: []string{"1.3.0", "1.2.2"}},
+		{spec: "^0.2.3", match: []string{"0.2.3", "0.2.9"}, noMatch: []string{"0.3.0"}},
+		{spec: "^0.0.3", match: []string{"0.0.3"}, noMatch: []string{"0.0.4"}},
+		{spec: "1.x", match: []string{"1.0.0", "1.99.1"}, noMatch: []string{"2.0.0", "2.0.0-alpha"}},
+		{spec: "<=1.2", match: []string{"1.2.7"}, noMatch: []string{"1.3.0"}},
+		{spec: ">1.2", match: []string{"1.3.0"}, noMatch: []string{"1.2.9"}},
+		{spec: ">= 1.0.0-beta.2 < 1.0.0", match: []string{"1.0.0-beta.11"}, noMatch: []string{"1.0.0-beta.1", "1.0.0"}},
+	}
+	for _, tc := range cases {
+		matches, err := parseSemverRange(tc.spec)
+		require.NoError(t, err, tc.spec)
+		for _, version := range tc.match {
+			require.True(t, matches(version), "%s should match %s", tc.spec, version)
+		}
+		for _, version := range tc.noMatch {
+			require.False(t, matches(version), "%s should not match %s", tc.spec, version)
+		}
+	}
+}
+
+func TestGoCargoPyPIMavenOCIRules(t *testing.T) {
+	goList := mustParse(t, config.ModeGo, "example.com/bad@v1.2.3", "example.com/range@>=v1.0.0 <v1.5.0")
+	require.NotEmpty(t, goList.Match("example.com/bad", "v1.2.3"))
+	require.Empty(t, goList.Match("example.com/bad", "v1.2.4"))
+	require.NotEmpty(t, goList.Match("example.com/range", "v1.4.0-0.20240101000000-abcdefabcdef"))
+	require.Empty(t, goList.Match("example.com/range", "v2.0.0+incompatible"))
+
+	cargo := mustParse(t, config.ModeCargo, "rustdecimal/1.23.1", "Bad_Crate/>=0.1, <0.3")
+	require.NotEmpty(t, cargo.Match("rustdecimal", "1.23.1"))
+	require.Empty(t, cargo.Match("rustdecimal", "1.23.2"))
+	require.NotEmpty(t, cargo.Match("bad-crate", "0.2.9"))
+
+	pypi := mustParse(t, config.ModePyPI, "Requests>=2.0,<2.31", "ctx", "torchtriton ==2.0.*", "pkg~=1.4.5")
+	require.NotEmpty(t, pypi.Match("requests", "2.30.0"))
+	require.NotEmpty(t, pypi.Match("requests", "2.31.0rc1"))
+	require.Empty(t, pypi.Match("requests", "2.31.0"))
+	require.NotEmpty(t, pypi.Match("CTX", "0.1.2"))
+	require.NotEmpty(t, pypi.Match("torchtriton", "2.0.0.post1"))
+	require.Empty(t, pypi.Match("torchtriton", "2.1.0"))
+	require.NotEmpty(t, pypi.Match("pkg", "1.4.9"))
+	require.Empty(t, pypi.Match("pkg", "1.5.0"))
+
+	maven := mustParse(t, config.ModeMaven, "org.apache.logging.log4j:log4j-core:[2.0-beta9,2.17.1)", "com.example:lib:1.0", "com.example:gone")
+	require.NotEmpty(t, maven.Match("org.apache.logging.log4j:log4j-core", "2.14.1"))
+	require.NotEmpty(t, maven.Match("org.apache.logging.log4j:log4j-core", "2.0"))
+	require.Empty(t, maven.Match("org.apache.logging.log4j:log4j-core", "2.17.1"))
+	require.Empty(t, maven.Match("org.apache.logging.log4j:log4j-core", "2.0-alpha1"))
+	require.NotEmpty(t, maven.Match("com.example:lib", "1.0.0"))
+	require.Empty(t, maven.Match("com.example:lib", "1.0-SNAPSHOT"))
+	require.NotEmpty(t, maven.Match("com.example:gone", ""))
+
+	oci := mustParse(t, config.ModeOCI, "library/nginx:1.25", "evil/image", "team/app@sha256:abc")
+	require.NotEmpty(t, oci.Match("library/nginx", "1.25"))
+	require.Empty(t, oci.Match("library/nginx", "1.26"))
+	require.NotEmpty(t, oci.Match("evil/image", ""))
+	require.NotEmpty(t, oci.Match("team/app", "sha256:abc"))
+	require.Empty(t, oci.Match("team/app", "latest"))
+}
+
+func TestFilterPackumentMovesLatest(t *testing.T) {
+	list := mustParse(t, config.ModeNPM, "pkg@1.1.0")
+	var document any
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"name": "pkg",
+		"dist-tags": {"latest": "1.1.0", "next": "2.0.0-rc.1"},
+		"versions": {"1.0.0": {}, "1.1.0": {}, "2.0.0-rc.1": {}},
+		"time": {"1.0.0": "t0", "1.1.0": "t1"}
+	}`), &document))
+	require.True(t, list.FilterPackument("pkg", document))
+	doc := document.(map[string]any)
+	require.NotContains(t, doc["versions"], "1.1.0")
+	require.NotContains(t, doc["time"], "1.1.0")
+	require.Equal(t, map[string]any{"latest": "1.0.0", "next": "2.0.0-rc.1"}, doc["dist-tags"])
+	require.False(t, list.FilterPackument("other", document))
+}
+
+func TestFilterSimpleCargoAndGoList(t *testing.T) {
+	pypi := mustParse(t, config.ModePyPI, "demo==1.1")
+	page := `<a href="https://files.example/demo-1.0.tar.gz#sha256=aa">demo-1.0.tar.gz</a><br/>
+<a href="https://files.example/demo-1.1-py3-none-any.whl">demo-1.1-py3-none-any.whl</a><br/>
+<a href="https://files.example/demo-1.1.tar.gz">demo-1.1.tar.gz</a><br/>
+`
+	filtered := string(pypi.FilterSimple("demo", []byte(page), false))
+	require.Contains(t, filtered, "demo-1.0.tar.gz")
+	require.NotContains(t, filtered, "demo-1.1")
+
+	payload := `{"name":"demo","versions":["1.0","1.1"],"files":[{"filename":"demo-1.0.tar.gz"},{"filename":"demo-1.1.tar.gz"}]}`
+	var doc map[string]any
+	require.NoError(t, json.Unmarshal(pypi.FilterSimple("demo", []byte(payload), true), &doc))
+	require.Equal(t, []any{"1.0"}, doc["versions"])
+	require.Len(t, doc["files"], 1)
+
+	cargo := mustParse(t, config.ModeCargo, "demo/0.2.0")
+	index := "{\"name\":\"demo\",\"vers\":\"0.1.0\"}\n{\"name\":\"demo\",\"vers\":\"0.2.0\"}\n"
+	require.Equal(t, "{\"name\":\"demo\",\"vers\":\"0.1.0\"}\n", string(cargo.FilterCargoIndex([]byte(index))))
+
+	goList := mustParse(t, config.ModeGo, "example.com/m@v1.1.0")
+	require.Equal(t, "v1.0.0\nv1.2.0\n", string(goList.FilterGoList("example.com/m", []byte("v1.0.0\nv1.1.0\nv1.2.0\n"))))
+}
+
+func TestPyPIFileAndWrite(t *testing.T) {
+	for filename, want := range map[string][2]string{
+		"demo_pkg-1.0.0-py3-none-any.whl":          {"demo_pkg", "1.0.0"},
+		"demo-pkg-2.1.tar.gz":                      {"demo-pkg", "2.1"},
+		"demo_pkg-1.0.0-py3-none-any.whl.metadata": {"demo_pkg", "1.0.0"},
+	} {
+		name, version, ok := PyPIFile(filename)
+		require.True(t, ok, filename)
+		require.Equal(t, want, [2]string{name, version})
+	}
+	_, _, ok := PyPIFile("README")
+	require.False(t, ok)
+
+	rec := httptest.NewRecorder()
+	Write(rec, "demo 1.0 is blocked")
+	require.Equal(t, 403, rec.Code)
+	require.Equal(t, Cache, rec.Header().Get("X-Cache"))
+	require.Contains(t, rec.Body.String(), "demo 1.0 is blocked")
+}
@@ -0,0 +1,187 @@
+package deny
+
+import (
+	"bytes"
+	"encoding/json"
+	"html"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// FilterPackument removes blocked versions from the npm packument of name.
+// Dist-tags pointing at a removed version are dropped, except latest, which
+// moves to the highest remaining release. It reports whether document
+// changed.
+func (l *List) FilterPackument(name string, document any) bool {
+	doc, ok := document.(map[string]any)
+	if l == nil || !ok {
+		return false
+	}
+	versions, _ := doc["versions"].(map[string]any)
+	times, _ := doc["time"].(map[string]any)
+	changed := false
+	for version := range versions {
+		if l.Blocks(name, version) {
+			delete(versions, version)
+			delete(times, version)
+			changed = true
+		}
+	}
+	tags, _ := doc["dist-tags"].(map[string]any)
+	movedLatest := false
+	for tag, value := range tags {
+		if version, _ := value.(string); l.Blocks(name, version) {
+			delete(tags, tag)
+			movedLatest = movedLatest || tag == "latest"
+			changed = true
+		}
+	}
+	if movedLatest {
+		if latest := highestRelease(versions); latest != "" {
+			tags["latest"] = latest
+		}
+	}
+	return changed
+}
+
+func highestRelease(versions map[string]any) string {
+	var best string
+	var bestVersion semver
+	for version := range versions {
+		v, ok := parseSemver(version)
+		if !ok || len(v.pre) > 0 {
+			continue
+		}
+		if best == "" || v.compare(bestVersion) > 0 {
+			best, bestVersion = version, v
+		}
+	}
+	return best
+}
+
+// PyPIFile returns the project and version encoded in a distribution file
+// name. Companion files such as .metadata and .asc map to their
+// distribution.
+func PyPIFile(filename string) (string, string, bool) {
+	for _, suffix := range []string{".metadata", ".asc", ".sig", ".minisig", ".provenance"} {
+		filename = strings.TrimSuffix(filename, suffix)
+	}
+	for _, ext := range []string{".whl", ".egg"} {
+		if base, ok := strings.CutSuffix(filename, ext); ok {
+			parts := strings.Split(base, "-")
+			if len(parts) < 2 {
+				return "", "", false
+			}
+			return parts[0], parts[1], true
+		}
+	}
+	for _, ext := range []string{".tar.gz", ".tar.bz2", ".tar.xz", ".tgz", ".zip", ".tar"} {
+		if base, ok := strings.CutSuffix(filename, ext); ok {
+			i := strings.LastIndex(base, "-")
+			if i <= 0 {
+				return "", "", false
+			}
+			return base[:i], base[i+1:], true
+		}
+	}
+	return "", "", false
+}
+
+// URLFileName returns the last path element of rawURL.
+func URLFileName(rawURL string) string {
+	if parsed, err := url.Parse(rawURL); err == nil {
+		return path.Base(parsed.Path)
+	}
+	return path.Base(rawURL)
+}
+
+func (l *List) blocksPyPIFile(project, filename string) bool {
+	_, version, ok := PyPIFile(filename)
+	return ok && l.Blocks(project, version)
+}
+
+var anchorPattern = regexp.MustCompile(`(?is)<a\s[^>]*href="([^"]*)"[^>]*>.*?</a>[ \t]*(?:<br\s*/?>)?`)
+
+// FilterSimple removes files of blocked versions from a PyPI simple project
+// page in HTML or JSON form.
+func (l *List) FilterSimple(project string, data []byte, isJSON bool) []byte {
+	if l == nil {
+		return data
+	}
+	if !isJSON {
+		return anchorPattern.ReplaceAllFunc(data, func(match []byte) []byte {
+			href := anchorPattern.FindSubmatch(match)[1]
+			if l.blocksPyPIFile(project, URLFileName(html.UnescapeString(string(href)))) {
+				return nil
+			}
+			return match
+		})
+	}
+	var payload map[string]any
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return data
+	}
+	if files, ok := payload["files"].([]any); ok {
+		kept := files[:0]
+		for _, item := range files {
+			if obj, ok := item.(map[string]any); ok {
+				if filename, _ := obj["filename"].(string); l.blocksPyPIFile(project, filename) {
+					continue
+				}
+			}
+			kept = append(kept, item)
+		}
+		payload["files"] = kept
+	}
+	if versions, ok := payload["versions"].([]any); ok {
+		kept := versions[:0]
+		for _, item := range versions {
+			if version, _ := item.(string); l.Blocks(project, version) {
+				continue
+			}
+			kept = append(kept, item)
+		}
+		payload["versions"] = kept
+	}
+	next, err := json.Marshal(payload)
+	if err != nil {
+		return data
+	}
+	return next
+}
+
+// FilterCargoIndex removes blocked versions from a cargo sparse index file.
+func (l *List) FilterCargoIndex(data []byte) []byte {
+	if l == nil {
+		return data
+	}
+	var out bytes.Buffer
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		var entry struct {
+			Name string `json:"name"`
+			Vers string `json:"vers"`
+		}
+		if json.Unmarshal(line, &entry) == nil && entry.Name != "" && l.Blocks(entry.Name, entry.Vers) {
+			continue
+		}
+		out.Write(line)
+	}
+	return out.Bytes()
+}
+
+// FilterGoList removes blocked versions from a Go @v/list response.
+func (l *List) FilterGoList(module string, data []byte) []byte {
+	if l == nil {
+		return data
+	}
+	var out bytes.Buffer
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		if l.Blocks(module, string(bytes.TrimSpace(line))) {
+			continue
+		}
+		out.Write(line)
+	}
+	return out.Bytes()
+}
@@ -0,0 +1,253 @@
+package deny
+
+import (
+	"cmp"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type semver struct {
+	major, minor, patch uint64
+	pre                 []string
+}
+
+// parsePartial parses a possibly partial version such as 1, 1.2.x or
+// v1.2.3-rc.1 and returns how many numeric components it has. Build
+// metadata is ignored.
+func parsePartial(text string) (semver, int, bool) {
+	text = strings.TrimPrefix(strings.TrimSpace(text), "v")
+	text, _, _ = strings.Cut(text, "+")
+	core, pre, hasPre := strings.Cut(text, "-")
+	if core == "" || isWildcard(core) {
+		return semver{}, 0, !hasPre
+	}
+	parts := strings.Split(core, ".")
+	if len(parts) > 3 {
+		return semver{}, 0, false
+	}
+	var nums [3]uint64
+	n := 0
+	for _, part := range parts {
+		if isWildcard(part) {
+			break
+		}
+		num, err := strconv.ParseUint(part, 10, 64)
+		if err != nil {
+			return semver{}, 0, false
+		}
+		nums[n] = num
+		n++
+	}
+	for _, part := range parts[n:] {
+		if !isWildcard(part) {
+			return semver{}, 0, false
+		}
+	}
+	v := semver{major: nums[0], minor: nums[1], patch: nums[2]}
+	if hasPre {
+		if n < 3 || pre == "" {
+			return semver{}, 0, false
+		}
+		v.pre = strings.Split(pre, ".")
+	}
+	return v, n, true
+}
+
+func isWildcard(part string) bool {
+	return part == "x" || part == "X" || part == "*"
+}
+
+func parseSemver(text string) (semver, bool) {
+	v, n, ok := parsePartial(text)
+	return v, ok && n == 3
+}
+
+// compare orders versions by semver precedence.
+func (v semver) compare(o semver) int {
+	if c := cmp.Compare(v.major, o.major); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(v.minor, o.minor); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(v.patch, o.patch); c != 0 {
+		return c
+	}
+	switch {
+	case len(v.pre) == 0 && len(o.pre) == 0:
+		return 0
+	case len(v.pre) == 0:
+		return 1
+	case len(o.pre) == 0:
+		return -1
+	}
+	for i := 0; i < len(v.pre) && i < len(o.pre); i++ {
+		a, aErr := strconv.ParseUint(v.pre[i], 10, 64)
+		b, bErr := strconv.ParseUint(o.pre[i], 10, 64)
+		switch {
+		case aErr == nil && bErr == nil:
+			if c := cmp.Compare(a, b); c != 0 {
+				return c
+			}
+		case aErr == nil:
+			return -1
+		case bErr == nil:
+			return 1
+		default:
+			if c := strings.Compare(v.pre[i], o.pre[i]); c != 0 {
+				return c
+			}
+		}
+	}
+	return cmp.Compare(len(v.pre), len(o.pre))
+}
+
+// next returns the lowest version above every version that shares the first
+// n components of v, including its pre-releases.
+func (v semver) next(n int) semver {
+	switch n {
+	case 1:
+		return semver{major: v.major + 1, pre: []string{"0"}}
+	case 2:
+		return semver{major: v.major, minor: v.minor + 1, pre: []string{"0"}}
+	default:
+		return semver{major: v.major, minor: v.minor, patch: v.patch + 1, pre: []string{"0"}}
+	}
+}
+
+type comparator struct {
+	op string
+	v  semver
+}
+
+func (c comparator) matches(v semver) bool {
+	d := v.compare(c.v)
+	switch c.op {
+	case "<":
+		return d < 0
+	case "<=":
+		return d <= 0
+	case ">":
+		return d > 0
+	case ">=":
+		return d >= 0
+	}
+	return d == 0
+}
+
+// parseSemverRange parses an npm style range: comparator sets joined by ||,
+// with ^, ~, x-ranges and hyphen ranges. A bare version matches only itself.
+func parseSemverRange(text string) (func(string) bool, error) {
+	if strings.TrimSpace(text) == "" {
+		return nil, fmt.Errorf("missing version")
+	}
+	var sets [][]comparator
+	for _, alternative := range strings.Split(text, "||") {
+		set, err := parseComparatorSet(strings.Fields(alternative))
+		if err != nil {
+			return nil, err
+		}
+		sets = append(sets, set)
+	}
+	return func(version string) bool {
+		v, ok := parseSemver(version)
+		if !ok {
+			return false
+		}
+	sets:
+		for _, set := range sets {
+			for _, c := range set {
+				if !c.matches(v) {
+					continue sets
+				}
+			}
+			return true
+		}
+		return false
+	}, nil
+}
+
+func parseComparatorSet(fields []string) ([]comparator, error) {
+	if len(fields) == 3 && fields[1] == "-" {
+		low, _, lowOK := parsePartial(fields[0])
+		high, n, highOK := parsePartial(fields[2])
+		if !lowOK || !highOK {
+			return nil, fmt.Errorf("invalid range %q", strings.Join(fields, " "))
+		}
+		set := []comparator{{op: ">=", v: low}}
+		switch n {
+		case 0:
+		case 3:
+			set = append(set, comparator{op: "<=", v: high})
+		default:
+			set = append(set, comparator{op: "<", v: high.next(n)})
+		}
+		return set, nil
+	}
+	var set []comparator
+	for i := 0; i < len(fields); i++ {
+		token := fields[i]
+		if strings.Trim(token, "<>=~^") == "" && i+1 < len(fields) {
+			i++
+			token += fields[i]
+		}
+		comparators, err := parseComparator(token)
+		if err != nil {
+			return nil, err
+		}
+		set = append(set, comparators...)
+	}
+	return set, nil
+}
+
+func parseComparator(token string) ([]comparator, error) {
+	rest := strings.TrimLeft(token, "<>=~^")
+	op := token[:len(token)-len(rest)]
+	v, n, ok := parsePartial(rest)
+	if !ok {
+		return nil, fmt.Errorf("invalid version %q", token)
+	}
+	if n == 0 {
+		if op == "<" || op == ">" {
+			return nil, fmt.Errorf("range %q matches nothing", token)
+		}
+		return nil, nil
+	}
+	switch op {
+	case "", "=":
+		if n == 3 {
+			return []comparator{{op: "=", v: v}}, nil
+		}
+		return []comparator{{op: ">=", v: v}, {op: "<", v: v.next(n)}}, nil
+	case ">":
+		if n == 3 {
+			return []comparator{{op: ">", v: v}}, nil
+		}
+		return []comparator{{op: ">=", v: v.next(n)}}, nil
+	case ">=":
+		return []comparator{{op: ">=", v: v}}, nil
+	case "<":
+		if n < 3 {
+			v.pre = []string{"0"}
+		}
+		return []comparator{{op: "<", v: v}}, nil
+	case "<=":
+		if n == 3 {
+			return []comparator{{op: "<=", v: v}}, nil
+		}
+		return []comparator{{op: "<", v: v.next(n)}}, nil
+	case "~":
+		return []comparator{{op: ">=", v: v}, {op: "<", v: v.next(min(n, 2))}}, nil
+	case "^":
+		upper := v.next(3)
+		switch {
+		case v.major > 0 || n == 1:
+			upper = v.next(1)
+		case v.minor > 0 || n == 2:
+			upper = v.next(2)
+		}
+		return []comparator{{op: ">=", v: v}, {op: "<", v: upper}}, nil
+	}
+	return nil, fmt.Errorf("invalid operator in %q", token)
+}
@@ -0,0 +1,283 @@
+package deny
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// qualifierRanks orders the qualifiers Maven and PyPI versions share. The
+// empty qualifier stands for a release; unknown qualifiers sort after all of
+// these.
+var qualifierRanks = map[string]int{
+	"dev":       0,
+	"alpha":     1,
+	"a":         1,
+	"beta":      2,
+	"b":         2,
+	"milestone": 3,
+	"m":         3,
+	"rc":        4,
+	"cr":        4,
+	"c":         4,
+	"pre":       4,
+	"preview":   4,
+	"snapshot":  5,
+	"":          6,
+	"ga":        6,
+	"final":     6,
+	"release":   6,
+	"sp":        7,
+	"post":      8,
+	"rev":       8,
+	"r":         8,
+}
+
+const releaseRank = 6
+
+type versionToken struct {
+	numeric bool
+	num     uint64
+	text    string
+}
+
+// versionTokens splits a version into numeric and qualifier tokens, so
+// "1.0-RC1" and "1.0rc1" both become 1, 0, rc, 1.
+func versionTokens(version string) []versionToken {
+	var tokens []versionToken
+	fields := strings.FieldsFunc(strings.ToLower(strings.TrimSpace(version)), func(r rune) bool {
+		return r == '.' || r == '-' || r == '_' || r == '+'
+	})
+	for _, field := range fields {
+		for field != "" {
+			digits := unicode.IsDigit(rune(field[0]))
+			end := strings.IndexFunc(field, func(r rune) bool { return unicode.IsDigit(r) != digits })
+			if end < 0 {
+				end = len(field)
+			}
+			part := field[:end]
+			field = field[end:]
+			if digits {
+				num, err := strconv.ParseUint(part, 10, 64)
+				if err != nil {
+					num = ^uint64(0)
+				}
+				tokens = append(tokens, versionToken{numeric: true, num: num})
+				continue
+			}
+			tokens = append(tokens, versionToken{text: part})
+		}
+	}
+	return tokens
+}
+
+func validVersion(version string) bool {
+	tokens := versionTokens(version)
+	return len(tokens) > 0 && tokens[0].numeric
+}
+
+func (t versionToken) rank() int {
+	if rank, ok := qualifierRanks[t.text]; ok {
+		return rank
+	}
+	return len(qualifierRanks)
+}
+
+func (t versionToken) compare(o versionToken) int {
+	switch {
+	case t.numeric && o.numeric:
+		return cmp.Compare(t.num, o.num)
+	case t.numeric:
+		return compareNumberToQualifier(t, o)
+	case o.numeric:
+		return -compareNumberToQualifier(o, t)
+	}
+	if c := cmp.Compare(t.rank(), o.rank()); c != 0 {
+		return c
+	}
+	return strings.Compare(t.text, o.text)
+}
+
+// compareNumberToQualifier treats a release qualifier like a zero, so 1.0 and
+// 1.0.0 and 1.0-ga are equal, and ranks any other qualifier below numbers.
+func compareNumberToQualifier(number, qualifier versionToken) int {
+	if qualifier.rank() == releaseRank {
+		return cmp.Compare(number.num, 0)
+	}
+	return 1
+}
+
+// compareVersions orders Maven and PyPI versions token by token. Missing
+// tokens count as a release, so pre-releases sort before it and post
+// releases after it.
+func compareVersions(a, b string) int {
+	x, y := versionTokens(a), versionTokens(b)
+	for i := 0; i < len(x) || i < len(y); i++ {
+		var s, t versionToken
+		if i < len(x) {
+			s = x[i]
+		}
+		if i < len(y) {
+			t = y[i]
+		}
+		if c := s.compare(t); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// hasReleasePrefix reports whether version starts with the numeric
+// components of prefix, as in PEP 440 ==1.4.* matching.
+func hasReleasePrefix(version string, prefix []versionToken) bool {
+	tokens := versionTokens(version)
+	for i, want := range prefix {
+		got := versionToken{numeric: true}
+		if i < len(tokens) {
+			got = tokens[i]
+		}
+		if !got.numeric || got.num != want.num {
+			return false
+		}
+	}
+	return true
+}
+
+// parsePyPISpecifiers parses a comma separated PEP 440 specifier set.
+func parsePyPISpecifiers(text string) (func(string) bool, error) {
+	var checks []func(string) bool
+	for _, clause := range strings.Split(text, ",") {
+		clause = strings.TrimSpace(clause)
+		version := strings.TrimSpace(strings.TrimLeft(clause, "<>=!~"))
+		op := strings.TrimSpace(clause[:len(clause)-len(strings.TrimLeft(clause, "<>=!~"))])
+		if op == "===" {
+			checks = append(checks, func(v string) bool { return v == version })
+			continue
+		}
+		prefix, wildcard := strings.CutSuffix(version, ".*")
+		if !validVersion(prefix) {
+			return nil, fmt.Errorf("invalid version in %q", clause)
+		}
+		if wildcard && op != "==" && op != "!=" {
+			return nil, fmt.Errorf("wildcard is only valid with == and != in %q", clause)
+		}
+		check, err := pypiCheck(op, prefix, wildcard)
+		if err != nil {
+			return nil, fmt.Errorf("%w in %q", err, clause)
+		}
+		checks = append(checks, check)
+	}
+	return func(version string) bool {
+		if !validVersion(version) {
+			return false
+		}
+		for _, check := range checks {
+			if !check(version) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+func pypiCheck(op, version string, wildcard bool) (func(string) bool, error) {
+	equal := func(v string) bool { return compareVersions(v, version) == 0 }
+	if wildcard {
+		prefix := versionTokens(version)
+		equal = func(v string) bool { return hasReleasePrefix(v, prefix) }
+	}
+	switch op {
+	case "==":
+		return equal, nil
+	case "!=":
+		return func(v string) bool { return !equal(v) }, nil
+	case "<":
+		return func(v string) bool { return compareVersions(v, version) < 0 }, nil
+	case "<=":
+		return func(v string) bool { return compareVersions(v, version) <= 0 }, nil
+	case ">":
+		return func(v string) bool { return compareVersions(v, version) > 0 }, nil
+	case ">=":
+		return func(v string) bool { return compareVersions(v, version) >= 0 }, nil
+	case "~=":
+		var release []versionToken
+		for _, token := range versionTokens(version) {
+			if !token.numeric {
+				break
+			}
+			release = append(release, token)
+		}
+		if len(release) < 2 {
+			return nil, errors.New("~= needs at least two release components")
+		}
+		prefix := release[:len(release)-1]
+		return func(v string) bool { return compareVersions(v, version) >= 0 && hasReleasePrefix(v, prefix) }, nil
+	}
+	return nil, fmt.Errorf("invalid operator %q", op)
+}
+
+type mavenInterval struct {
+	low, high                   string
+	lowInclusive, highInclusive bool
+}
+
+func (r mavenInterval) contains(version string) bool {
+	if r.low != "" {
+		if c := compareVersions(version, r.low); c < 0 || (c == 0 && !r.lowInclusive) {
+			return false
+		}
+	}
+	if r.high != "" {
+		if c := compareVersions(version, r.high); c > 0 || (c == 0 && !r.highInclusive) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseMavenRange parses an exact version or Maven version ranges such as
+// [1.0,2.0) or (,1.0],[1.2,).
+func parseMavenRange(text string) (func(string) bool, error) {
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(text, "[") && !strings.HasPrefix(text, "(") {
+		if !validVersion(text) {
+			return nil, fmt.Errorf("invalid version %q", text)
+		}
+		return func(v string) bool { return compareVersions(v, text) == 0 }, nil
+	}
+	var intervals []mavenInterval
+	for rest := text; rest != ""; {
+		end := strings.IndexAny(rest, "])")
+		if end < 0 || (rest[0] != '[' && rest[0] != '(') {
+			return nil, fmt.Errorf("invalid range %q", text)
+		}
+		body := rest[1:end]
+		interval := mavenInterval{lowInclusive: rest[0] == '[', highInclusive: rest[end] == ']'}
+		low, high, isRange := strings.Cut(body, ",")
+		interval.low, interval.high = strings.TrimSpace(low), strings.TrimSpace(high)
+		if !isRange {
+			if !interval.lowInclusive || !interval.highInclusive {
+				return nil, fmt.Errorf("invalid range %q", text)
+			}
+			interval.high = interval.low
+		}
+		for _, bound := range []string{interval.low, interval.high} {
+			if bound != "" && !validVersion(bound) {
+				return nil, fmt.Errorf("invalid version %q in range %q", bound, text)
+			}
+		}
+		intervals = append(intervals, interval)
+		rest = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(rest[end+1:]), ","))
+	}
+	return func(version string) bool {
+		for _, interval := range intervals {
+			if interval.contains(version) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
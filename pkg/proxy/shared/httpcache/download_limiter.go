@@ -14,6 +14,7 @@ type DownloadLimiter struct {
 	perMax    int
 	active    int
 	perActive map[string]int
+	released  chan struct{}
 }
 
 func NewDownloadLimiter(maxActive, maxPerInstance int) *DownloadLimiter {
@@ -48,10 +49,39 @@ func (l *DownloadLimiter) Acquire(ctx context.Context, instance string) (func(),
 		if l.perActive[instance] <= 0 {
 			delete(l.perActive, instance)
 		}
+		if l.released != nil {
+			close(l.released)
+			l.released = nil
+		}
 		l.mu.Unlock()
 	}, nil
 }
 
+// Wait blocks until instance has a free download slot. It does not reserve
+// the slot, so callers must still handle ErrDownloadLimit.
+func (l *DownloadLimiter) Wait(ctx context.Context, instance string) error {
+	if l == nil {
+		return ctx.Err()
+	}
+	for {
+		l.mu.Lock()
+		if l.active < l.max && l.perActive[instance] < l.perMax {
+			l.mu.Unlock()
+			return ctx.Err()
+		}
+		if l.released == nil {
+			l.released = make(chan struct{})
+		}
+		released := l.released
+		l.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-released:
+		}
+	}
+}
+
 func (l *DownloadLimiter) Update(maxActive, maxPerInstance int) {
 	if l == nil || maxActive <= 0 || maxPerInstance <= 0 {
 		return
@@ -59,5 +89,9 @@ func (l *DownloadLimiter) Update(maxActive, maxPerInstance int) {
 	l.mu.Lock()
 	l.max = maxActive
 	l.perMax = maxPerInstance
+	if l.released != nil {
+		close(l.released)
+		l.released = nil
+	}
 	l.mu.Unlock()
 }
@@ -3,6 +3,7 @@ package httpcache
 import (
 	"context"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -46,3 +47,18 @@ func TestDownloadLimiterUpdate(t *testing.T) {
 	require.NoError(t, err)
 	releaseB()
 }
+
+func TestDownloadLimiterWaitBlocksUntilRelease(t *testing.T) {
+	limiter := NewDownloadLimiter(1, 1)
+	release, err := limiter.Acquire(context.Background(), "a")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, limiter.Wait(ctx, "a"), context.DeadlineExceeded)
+
+	done := make(chan error, 1)
+	go func() { done <- limiter.Wait(context.Background(), "a") }()
+	release()
+	require.NoError(t, <-done)
+}
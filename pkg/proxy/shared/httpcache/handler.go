@@ -2,17 +2,21 @@ package httpcache
 
 import (
 	"context"
+	"encoding/base64"
 	"errors"
 	"io"
 	"log/slog"
 	"net/http"
 	"net/url"
 	"sync"
+	"time"
 
 	"gopkg.d7z.net/blobfs"
 
+	"gopkg.d7z.net/cache-proxy/pkg/accesslog"
 	"gopkg.d7z.net/cache-proxy/pkg/config"
 	"gopkg.d7z.net/cache-proxy/pkg/health"
+	"gopkg.d7z.net/cache-proxy/pkg/proxy/shared/deny"
 	"gopkg.d7z.net/cache-proxy/pkg/utils"
 )
 
@@ -23,13 +27,22 @@ type Route struct {
 	AllowedTargetHosts     []string
 	Policy                 string
 	FreshFor               config.Freshness
+	MinFreshFor            config.Duration
+	MaxFreshFor            config.Duration
+	Stale                  config.StaleWindows
 	BusyPolicy             string
 	ExpireAfter            config.Expiration
+	NegativeTTL            config.Duration
 	RequestHeaders         map[string]string
 	RewriteKind            string
 	AuthRequired           bool
 	PreferredUpstream      string
 	ArtifactMirrorFallback bool
+	// Denied is the message returned with 403 when a deny rule blocks the
+	// request.
+	Denied string
+	// Package names the package whose metadata RewriteKind filters.
+	Package string
 }
 
 type Resolver interface {
@@ -43,13 +56,27 @@ type RuntimeConfig struct {
 	Transport          *config.TransportConfig
 	BusyPolicy         string
 	DefaultFreshFor    config.Freshness
+	DefaultStale       config.StaleWindows
+	NegativeTTL        config.Duration
 	PassHeaders        []string
 	AllowedTargetHosts []string
 	MetadataFunc       func(*http.Request, Route, map[string]string, string) map[string]string
 	VerifyFunc         func(*http.Request, Route, io.ReadSeeker) error
 	DownloadLimiter    *DownloadLimiter
+	Deny               *deny.List
+	MinReleaseAge      time.Duration
+	// Snapshots serves point-in-time metadata views under /@<date>/.
+	Snapshots bool
 }
 
+// ReleaseAgeHeader lets allowlisted clients replace the min_release_age of an
+// instance with another duration; 0 disables it.
+const ReleaseAgeHeader = "X-Cache-Proxy-Release-Age"
+
+// IdentityHeader carries the identity the app authenticated a request as. The
+// app replaces it on every instance request, so clients cannot forge it.
+const IdentityHeader = "X-Cache-Proxy-Identity"
+
 type Handler struct {
 	name                string
 	config              RuntimeConfig
@@ -79,7 +106,7 @@ const DefaultUserAgent = utils.DefaultUserAgent
 
 func NewHandler(name string, runtime RuntimeConfig, store *blobfs.Store, resolver Resolver, stats *Stats, svcHealth *health.ServiceHealth) *Handler {
 	client := utils.DefaultHttpClientWrapper()
-	ConfigureClientTransport(client, name, runtime.Transport)
+	ConfigureClientTransport(client, name, runtime.Upstreams, runtime.Transport)
 	hosts := make([]string, 0, len(runtime.Upstreams))
 	for _, u := range runtime.Upstreams {
 		if pu, err := url.Parse(u); err == nil && pu.Host != "" {
@@ -89,19 +116,39 @@ func NewHandler(name string, runtime RuntimeConfig, store *blobfs.Store, resolve
 	return &Handler{name: name, config: runtime, store: store, client: client, locks: utils.NewRWLockGroup(), resolver: resolver, stats: stats, health: svcHealth, downloadLimiter: runtime.DownloadLimiter, parsedUpstreamHosts: hosts}
 }
 
-func ConfigureClientTransport(client *utils.HttpClientWrapper, name string, transport *config.TransportConfig) {
+// ConfigureClientTransport applies transport to client. Auth blocks without
+// an upstream prefix are scoped to each of upstreams.
+func ConfigureClientTransport(client *utils.HttpClientWrapper, name string, upstreams []string, transport *config.TransportConfig) {
 	client.UserAgent = DefaultUserAgent
 	if transport == nil {
 		return
 	}
+	if err := client.SetCredentials(upstreamCredentials(upstreams, transport.Auth)); err != nil {
+		slog.Warn("invalid transport auth", "instance", name, "err", err)
+	}
 	if transport.UserAgent != "" {
 		client.UserAgent = transport.UserAgent
 	}
+	if transport.IdleBodyTimeout > 0 {
+		client.IdleBodyTimeout = transport.IdleBodyTimeout.Duration()
+	}
+	if transport.MaxRequestDuration > 0 {
+		client.Timeout = transport.MaxRequestDuration.Duration()
+	}
 	baseTransport, ok := client.Transport.(*http.Transport)
 	if !ok {
 		slog.Warn("cannot configure transport, unexpected transport type", "instance", name)
 		return
 	}
+	ConfigureHTTPTransport(baseTransport, name, transport)
+}
+
+// ConfigureHTTPTransport applies the connection settings of transport: proxy,
+// timeouts, connection limits and TLS.
+func ConfigureHTTPTransport(baseTransport *http.Transport, name string, transport *config.TransportConfig) {
+	if transport == nil {
+		return
+	}
 	if transport.Proxy != "" {
 		if proxyURL, err := url.Parse(transport.Proxy); err == nil {
 			baseTransport.Proxy = http.ProxyURL(proxyURL)
@@ -115,12 +162,6 @@ func ConfigureClientTransport(client *utils.HttpClientWrapper, name string, tran
 	if transport.HeaderTimeout > 0 {
 		baseTransport.ResponseHeaderTimeout = transport.HeaderTimeout.Duration()
 	}
-	if transport.IdleBodyTimeout > 0 {
-		client.IdleBodyTimeout = transport.IdleBodyTimeout.Duration()
-	}
-	if transport.MaxRequestDuration > 0 {
-		client.Timeout = transport.MaxRequestDuration.Duration()
-	}
 	if transport.MaxIdleConns > 0 {
 		baseTransport.MaxIdleConns = transport.MaxIdleConns
 		baseTransport.MaxIdleConnsPerHost = transport.MaxIdleConns
@@ -128,6 +169,48 @@ func ConfigureClientTransport(client *utils.HttpClientWrapper, name string, tran
 	if transport.MaxConnsPerHost > 0 {
 		baseTransport.MaxConnsPerHost = transport.MaxConnsPerHost
 	}
+	if transport.TLS != nil {
+		tlsConfig, err := transport.TLS.ClientConfig()
+		if err != nil {
+			slog.Warn("invalid transport tls", "instance", name, "err", err)
+			return
+		}
+		baseTransport.TLSClientConfig = tlsConfig
+	}
+}
+
+// ConfigureProbeTransport gives the active health probes of sh the same
+// connection settings as the instance's upstream client.
+func ConfigureProbeTransport(sh *health.ServiceHealth, name string, transport *config.TransportConfig) {
+	if sh == nil || transport == nil {
+		return
+	}
+	probeTransport := http.DefaultTransport.(*http.Transport).Clone()
+	ConfigureHTTPTransport(probeTransport, name, transport)
+	sh.SetProbeTransport(probeTransport)
+}
+
+func upstreamCredentials(upstreams []string, auth config.UpstreamAuthList) []utils.UpstreamCredential {
+	var credentials []utils.UpstreamCredential
+	for _, item := range auth {
+		header, value := "Authorization", ""
+		switch item.Type {
+		case "basic":
+			value = "Basic " + base64.StdEncoding.EncodeToString([]byte(item.Username+":"+item.Password))
+		case "bearer":
+			value = "Bearer " + item.Token
+		default:
+			header, value = item.Header, item.Value
+		}
+		prefixes := upstreams
+		if item.Upstream != "" {
+			prefixes = []string{item.Upstream}
+		}
+		for _, prefix := range prefixes {
+			credentials = append(credentials, utils.UpstreamCredential{Prefix: prefix, Header: header, Value: value})
+		}
+	}
+	return credentials
 }
 
 func (h *Handler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
@@ -137,6 +220,15 @@ func (h *Handler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 		h.stats.RecordRequest(h.name, h.config.Mode, req.Method, "ERROR", http.StatusMethodNotAllowed, 0)
 		return
 	}
+	if h.config.Snapshots {
+		next, ok := snapshotRequest(req)
+		if !ok {
+			http.Error(resp, "invalid snapshot time", http.StatusBadRequest)
+			h.stats.RecordRequest(h.name, h.config.Mode, req.Method, "ERROR", http.StatusBadRequest, 0)
+			return
+		}
+		req = next
+	}
 	result, err := h.handle(req.Context(), req)
 	if err != nil {
 		slog.Info("proxy request failed", "instance", h.name, "mode", h.config.Mode, "method", req.Method, "path", req.URL.Path, "err", err)
@@ -156,6 +248,7 @@ func (h *Handler) flushResult(req *http.Request, resp http.ResponseWriter, resul
 	status := result.StatusCode
 	cache := result.Headers["X-Cache"]
 	bytes := ResponseBytes(result.Headers)
+	accesslog.SetUpstream(req.Context(), result.Headers[responseSourceUpstreamHeader])
 	StripInternal(result.Headers)
 	if err := result.FlushClose(req, resp); err != nil {
 		slog.Info(logMsg, "instance", h.name, "err", err)
@@ -11,8 +11,9 @@ import (
 	"net/http"
 	"path"
 	"strconv"
-	"time"
+	"strings"
 
+	"gopkg.d7z.net/cache-proxy/pkg/accesslog"
 	"gopkg.d7z.net/cache-proxy/pkg/config"
 	"gopkg.d7z.net/cache-proxy/pkg/utils"
 )
@@ -24,6 +25,9 @@ func (h *Handler) handle(ctx context.Context, req *http.Request) (*utils.Respons
 	if err != nil {
 		return nil, err
 	}
+	if route.Denied != "" {
+		return deniedResponse(route.Denied), nil
+	}
 	slog.Debug("proxy route resolved", "instance", h.name, "mode", h.config.Mode, "method", req.Method, "path", req.URL.Path, "object", route.ObjectPath, "upstream_path", route.UpstreamPath, "policy", route.Policy)
 	if route.Policy == config.PolicyBypass {
 		return h.bypass(ctx, req, route)
@@ -35,16 +39,24 @@ func (h *Handler) handle(ctx context.Context, req *http.Request) (*utils.Respons
 	}
 	defer lock.Unlock()
 
+	if h.negativeTTL(route) > 0 {
+		if negative, ok := h.openNegative(ctx, route); ok {
+			return negative, nil
+		}
+	}
 	if req.Header.Get("Range") != "" {
 		cached, err := h.openValidCached(ctx, route)
 		if err == nil {
 			cached.Headers["X-Cache"] = "HIT"
 			return h.rewriteResponse(req, route, cached), nil
 		}
+		if req.Method == http.MethodGet {
+			h.startRangeFill(ctx, req, route)
+		}
 		return h.bypass(ctx, req, route)
 	}
 
-	if _, downloading := h.downloads.LoadOrStore(route.ObjectPath, struct{}{}); downloading {
+	if _, downloading := h.downloads.LoadOrStore(route.ObjectPath, NewInflightDownload()); downloading {
 		return h.lockBusy(ctx, req, route)
 	}
 
@@ -54,36 +66,86 @@ func (h *Handler) handle(ctx context.Context, req *http.Request) (*utils.Respons
 		return h.streamDownload(ctx, req, route, "MISS")
 	}
 	if route.Policy == config.PolicyImmutable {
-		h.downloads.Delete(route.ObjectPath)
+		h.finishDownload(route.ObjectPath, nil)
 		cached.Headers["X-Cache"] = "HIT"
 		return h.rewriteResponse(req, route, cached), nil
 	}
 	if h.fresh(route, cached.Headers) {
-		h.downloads.Delete(route.ObjectPath)
+		h.finishDownload(route.ObjectPath, nil)
 		cached.Headers["X-Cache"] = "FRESH"
 		return h.rewriteResponse(req, route, cached), nil
 	}
+	windows := h.staleWindows(route)
+	if h.withinStale(route, cached.Headers, windows.WhileRevalidate) {
+		h.revalidateInBackground(ctx, req, route, copyHeadersMap(cached.Headers))
+		cached.Headers["X-Cache"] = "STALE"
+		return h.rewriteResponse(req, route, cached), nil
+	}
 	valid, err := h.validateCached(ctx, route, cached.Headers)
 	if err != nil {
 		_ = cached.Close()
-		slog.Debug("cache validation error, serving stale", "instance", h.name, "object", route.ObjectPath, "err", err)
-		staleCached, openErr := h.openCached(ctx, route)
-		if openErr == nil {
-			h.downloads.Delete(route.ObjectPath)
-			staleCached.Headers["X-Cache"] = "STALE"
-			return h.rewriteResponse(req, route, staleCached), nil
+		if windows.IfError.IsUnset() || h.withinStale(route, cached.Headers, windows.IfError) {
+			slog.Debug("cache validation error, serving stale", "instance", h.name, "object", route.ObjectPath, "err", err)
+			if stale, ok := h.openStale(ctx, route); ok {
+				h.finishDownload(route.ObjectPath, nil)
+				return h.rewriteResponse(req, route, stale), nil
+			}
 		}
-		h.downloads.Delete(route.ObjectPath)
-		return ErrorResponse(http.StatusServiceUnavailable, err), nil
+		// Past the stale_if_error window the cached copy is withheld; an
+		// unreachable upstream answers 503 and any other failure 502.
+		h.finishDownload(route.ObjectPath, err)
+		return nil, err
 	}
 	if valid {
-		h.downloads.Delete(route.ObjectPath)
+		h.finishDownload(route.ObjectPath, nil)
 		cached.Headers["X-Cache"] = "HIT"
 		return h.rewriteResponse(req, route, cached), nil
 	}
 	_ = cached.Close()
 	slog.Debug("cache stale", "instance", h.name, "object", route.ObjectPath)
-	return h.streamDownload(ctx, req, route, "REFRESH")
+	resp, err := h.streamDownload(ctx, req, route, "REFRESH")
+	if (err != nil || resp.StatusCode >= http.StatusInternalServerError) && h.withinStale(route, cached.Headers, windows.IfError) {
+		if stale, ok := h.openStale(ctx, route); ok {
+			slog.Debug("cache refresh failed, serving stale", "instance", h.name, "object", route.ObjectPath, "err", err)
+			if resp != nil {
+				_ = resp.Close()
+			}
+			return h.rewriteResponse(req, route, stale), nil
+		}
+	}
+	return resp, err
+}
+
+// openStale reopens the cached copy to mask an upstream failure.
+func (h *Handler) openStale(ctx context.Context, route Route) (*utils.ResponseWrapper, bool) {
+	cached, err := h.openCached(ctx, route)
+	if err != nil {
+		return nil, false
+	}
+	cached.Headers["X-Cache"] = "STALE"
+	return cached, true
+}
+
+// revalidateInBackground checks a copy that was served stale against
+// upstream and refetches it when it changed. The caller holds the download
+// marker, which is released here.
+func (h *Handler) revalidateInBackground(ctx context.Context, req *http.Request, route Route, cached map[string]string) {
+	bgCtx := context.WithoutCancel(ctx)
+	bgReq := req.Clone(bgCtx)
+	bgReq.Method = http.MethodGet
+	h.wait.Add(1)
+	go func() {
+		defer h.wait.Done()
+		valid, err := h.validateCached(bgCtx, route, cached)
+		if err != nil || valid {
+			if err != nil {
+				slog.Debug("background revalidation failed", "instance", h.name, "object", route.ObjectPath, "err", err)
+			}
+			h.finishDownload(route.ObjectPath, err)
+			return
+		}
+		h.drainDownload(bgCtx, bgReq, route, "REFRESH")
+	}()
 }
 
 func (h *Handler) lockBusy(ctx context.Context, req *http.Request, route Route) (*utils.ResponseWrapper, error) {
@@ -100,29 +162,98 @@ func (h *Handler) lockBusy(ctx context.Context, req *http.Request, route Route)
 			return h.rewriteResponse(req, route, cached), nil
 		}
 	}
-	if route.Policy == config.PolicyImmutable && req.Header.Get("Range") == "" {
-		cached, err := h.waitForImmutableDownload(ctx, route)
-		if err == nil {
-			cached.Headers["X-Cache"] = "HIT"
-			return h.rewriteResponse(req, route, cached), nil
+	// A background revalidation holds the download marker; serve the stale
+	// copy instead of waiting on it.
+	if window := h.staleWindows(route).WhileRevalidate; req.Header.Get("Range") == "" && (route.Policy == config.PolicyRevalidate || route.Policy == config.PolicyUpstream) && !window.IsUnset() {
+		if cached, err := h.openCached(ctx, route); err == nil {
+			if h.withinStale(route, cached.Headers, window) {
+				cached.Headers["X-Cache"] = "STALE"
+				if h.fresh(route, cached.Headers) {
+					cached.Headers["X-Cache"] = "FRESH"
+				}
+				return h.rewriteResponse(req, route, cached), nil
+			}
+			_ = cached.Close()
+		}
+	}
+	if req.Header.Get("Range") == "" {
+		if value, downloading := h.downloads.Load(route.ObjectPath); downloading {
+			if inflight, ok := value.(*InflightDownload); ok {
+				cached, err := h.attachDownload(ctx, route, inflight)
+				if err == nil {
+					return h.rewriteResponse(req, route, cached), nil
+				}
+				slog.Debug("attach in-flight download failed", "instance", h.name, "object", route.ObjectPath, "err", err)
+			}
 		}
 	}
 	slog.Debug("cache lock busy, bypass upstream", "instance", h.name, "object", route.ObjectPath)
 	return h.bypass(ctx, req, route)
 }
 
-func (h *Handler) waitForImmutableDownload(ctx context.Context, route Route) (*utils.ResponseWrapper, error) {
-	ticker := time.NewTicker(25 * time.Millisecond)
-	defer ticker.Stop()
-	for {
-		if _, downloading := h.downloads.Load(route.ObjectPath); !downloading {
-			return h.openCached(ctx, route)
-		}
-		select {
-		case <-ctx.Done():
-			return nil, ctx.Err()
-		case <-ticker.C:
+// attachDownload streams the object from the leader's temp file, or from the
+// cache once the leader finished without downloading.
+func (h *Handler) attachDownload(ctx context.Context, route Route, inflight *InflightDownload) (*utils.ResponseWrapper, error) {
+	body, headers, err := inflight.attach(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if body == nil {
+		cached, err := h.openCached(ctx, route)
+		if err != nil {
+			return nil, err
 		}
+		cached.Headers["X-Cache"] = "HIT"
+		return cached, nil
+	}
+	// The object is still being fetched for the leader, so the follower is
+	// served a miss as well.
+	headers["X-Cache"] = "MISS"
+	return &utils.ResponseWrapper{StatusCode: http.StatusOK, Headers: headers, Body: body}, nil
+}
+
+func (h *Handler) finishDownload(objectPath string, err error) {
+	value, ok := h.downloads.LoadAndDelete(objectPath)
+	if !ok {
+		return
+	}
+	if inflight, ok := value.(*InflightDownload); ok {
+		inflight.finish(err)
+	}
+}
+
+// startRangeFill downloads the whole object in the background after a Range
+// miss so later Range requests for the same object can be served from cache.
+func (h *Handler) startRangeFill(ctx context.Context, req *http.Request, route Route) {
+	if _, downloading := h.downloads.LoadOrStore(route.ObjectPath, NewInflightDownload()); downloading {
+		return
+	}
+	fillCtx := context.WithoutCancel(ctx)
+	fillReq := req.Clone(fillCtx)
+	fillReq.Header = req.Header.Clone()
+	fillReq.Header.Del("Range")
+	fillReq.Header.Del("If-Range")
+	h.wait.Add(1)
+	go func() {
+		defer h.wait.Done()
+		h.drainDownload(fillCtx, fillReq, route, "MISS")
+	}()
+}
+
+// drainDownload runs streamDownload without a client so the object lands in
+// the cache. The caller holds the download marker.
+func (h *Handler) drainDownload(ctx context.Context, req *http.Request, route Route, status string) {
+	resp, err := h.streamDownload(ctx, req, route, status)
+	if err != nil {
+		slog.Debug("background cache fill failed", "instance", h.name, "object", route.ObjectPath, "err", err)
+		return
+	}
+	defer resp.Close()
+	if resp.Headers["X-Cache"] != status {
+		return
+	}
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		slog.Debug("background cache fill aborted", "instance", h.name, "object", route.ObjectPath, "err", err)
 	}
 }
 
@@ -147,6 +278,10 @@ func (h *Handler) openCached(ctx context.Context, route Route) (*utils.ResponseW
 		return nil, err
 	}
 	info := reader.Info()
+	if info.Options["negative"] != "" {
+		_ = reader.Close()
+		return nil, errNegativeCached
+	}
 	headers := map[string]string{"Content-Length": strconv.FormatInt(info.Size, 10)}
 	for key, value := range info.Options {
 		headers[HeaderName(key)] = value
@@ -158,6 +293,7 @@ func (h *Handler) openCached(ctx context.Context, route Route) (*utils.ResponseW
 	}
 	setContentType(headers, route.ObjectPath)
 	h.addCacheDebugHeaders(headers, route, info.Options["fetched-at"])
+	h.stats.Access().Touch(h.name, route.ObjectPath)
 	return &utils.ResponseWrapper{StatusCode: http.StatusOK, Headers: headers, Body: reader}, nil
 }
 
@@ -222,26 +358,40 @@ func (h *Handler) validateCached(ctx context.Context, route Route, cached map[st
 }
 
 func (h *Handler) streamDownload(ctx context.Context, req *http.Request, route Route, status string) (*utils.ResponseWrapper, error) {
+	var inflight *InflightDownload
+	if value, ok := h.downloads.Load(route.ObjectPath); ok {
+		inflight, _ = value.(*InflightDownload)
+	}
+	// Followers may be streaming from this download, so the leader going
+	// away must not cancel the upstream fetch.
 	resp, err := h.openRemote(
-		ctx,
+		context.WithoutCancel(ctx),
 		http.MethodGet,
 		route.UpstreamPath,
 		remoteOptionsForRoute(route, true),
 		h.remoteHeaders(req, route, nil),
 	)
 	if err != nil {
-		h.downloads.Delete(route.ObjectPath)
+		h.finishDownload(route.ObjectPath, err)
 		return nil, err
 	}
+	accesslog.SetUpstream(ctx, resp.Headers[responseSourceUpstreamHeader])
 	if resp.StatusCode != http.StatusOK {
-		h.downloads.Delete(route.ObjectPath)
+		h.finishDownload(route.ObjectPath, errInflightAborted)
 		resp.Headers["X-Cache"] = "BYPASS"
+		return h.rewriteResponse(req, route, h.storeNegative(ctx, route, resp)), nil
+	}
+	if route.Policy == config.PolicyUpstream && !upstreamStorable(resp.Headers) {
+		h.finishDownload(route.ObjectPath, errInflightAborted)
+		_ = h.store.DeleteObject(context.WithoutCancel(ctx), h.name, route.ObjectPath)
+		resp.Headers["X-Cache"] = "BYPASS"
+		setContentType(resp.Headers, route.ObjectPath)
 		return h.rewriteResponse(req, route, resp), nil
 	}
 	if route.ArtifactMirrorFallback && route.PreferredUpstream != "" &&
 		resp.Headers[responseSourceUpstreamHeader] != "" &&
 		resp.Headers[responseSourceUpstreamHeader] != route.PreferredUpstream {
-		h.downloads.Delete(route.ObjectPath)
+		h.finishDownload(route.ObjectPath, errInflightAborted)
 		resp.Headers["X-Cache"] = "RESCUE"
 		setContentType(resp.Headers, route.ObjectPath)
 		return h.rewriteResponse(req, route, resp), nil
@@ -251,13 +401,16 @@ func (h *Handler) streamDownload(ctx context.Context, req *http.Request, route R
 
 	if parent := path.Dir(route.ObjectPath); parent != "." {
 		if err = h.store.MkdirAll(h.name+"/"+parent, 0o755); err != nil {
-			h.downloads.Delete(route.ObjectPath)
+			h.finishDownload(route.ObjectPath, err)
 			resp.Close()
 			return nil, err
 		}
 	}
 
 	meta := metadata(resp.Headers, h.config.Mode, status)
+	if route.Policy == config.PolicyUpstream {
+		storeFreshness(meta, resp.Headers)
+	}
 	if h.config.MetadataFunc != nil {
 		for key, value := range h.config.MetadataFunc(req, route, copyHeadersMap(resp.Headers), status) {
 			if value != "" {
@@ -266,11 +419,20 @@ func (h *Handler) streamDownload(ctx context.Context, req *http.Request, route R
 		}
 	}
 
+	headers := map[string]string{"X-Cache": status}
+	for key, value := range meta {
+		headers[HeaderName(key)] = value
+	}
+	setContentType(headers, route.ObjectPath)
+	h.addCacheDebugHeaders(headers, route, meta["fetched-at"])
+	inflight.setHeaders(headers)
+
 	pr, err := StreamToPipe(ctx, StreamConfig{
 		Body:       resp.Body,
 		Instance:   h.name,
 		ObjectPath: route.ObjectPath,
 		Downloads:  &h.downloads,
+		Inflight:   inflight,
 		Wait:       &h.wait,
 		Limiter:    h.downloadLimiter,
 		StatsStart: func() { h.stats.AddActiveDownload(h.name, h.config.Mode, 1) },
@@ -287,16 +449,9 @@ func (h *Handler) streamDownload(ctx context.Context, req *http.Request, route R
 		},
 	})
 	if err != nil {
-		h.downloads.Delete(route.ObjectPath)
+		h.finishDownload(route.ObjectPath, err)
 		return nil, err
 	}
-
-	headers := map[string]string{"X-Cache": status}
-	for key, value := range meta {
-		headers[HeaderName(key)] = value
-	}
-	setContentType(headers, route.ObjectPath)
-	h.addCacheDebugHeaders(headers, route, meta["fetched-at"])
 	return &utils.ResponseWrapper{StatusCode: http.StatusOK, Headers: headers, Body: pr}, nil
 }
 
@@ -331,7 +486,9 @@ func (h *Handler) rewriteResponse(req *http.Request, route Route, response *util
 			response.Body = io.NopCloser(bytes.NewReader(body))
 			return response
 		}
-		if RewriteNPMTarballs(document, h.config.Upstreams, publicBaseURL(req)) {
+		filtered := h.config.Deny.FilterPackument(route.Package, document)
+		filtered = filterNPMReleaseAge(document, h.releaseCutoff(req)) || filtered
+		if RewriteNPMTarballs(document, h.config.Upstreams, publicBaseURL(req)) || filtered {
 			body, err = json.Marshal(document)
 			if err != nil {
 				return ErrorResponse(http.StatusBadGateway, err)
@@ -346,11 +503,29 @@ func (h *Handler) rewriteResponse(req *http.Request, route Route, response *util
 		response.Headers["Content-Type"] = "application/json"
 		response.Headers["Content-Length"] = strconv.Itoa(len(body))
 	case "pypi-simple":
+		isJSON := strings.Contains(response.Headers["Content-Type"], "json")
+		if route.Package != "" {
+			body = h.config.Deny.FilterSimple(route.Package, body, isJSON)
+		}
+		cutoff := h.releaseCutoff(req)
+		if isJSON {
+			body = filterPyPIReleaseAge(body, cutoff)
+		} else if !cutoff.IsZero() && strings.Contains(route.RequestHeaders["Accept"], "json") {
+			// Upstreams that only serve HTML give no upload times, and an
+			// unfiltered page would hide that the view is not applied.
+			return ErrorResponse(http.StatusBadGateway, errors.New("pypi upstream serves no upload times to filter by"))
+		}
 		body, response.Headers, err = rewritePyPISimple(req, h.config.Upstreams, route, response.Headers, body)
 		if err != nil {
 			return ErrorResponse(http.StatusBadGateway, err)
 		}
 		response.Headers["Content-Length"] = strconv.Itoa(len(body))
+	case "cargo-index":
+		body = filterCargoReleaseAge(h.config.Deny.FilterCargoIndex(body), h.releaseCutoff(req))
+		response.Headers["Content-Length"] = strconv.Itoa(len(body))
+	case "go-list":
+		body = h.config.Deny.FilterGoList(route.Package, body)
+		response.Headers["Content-Length"] = strconv.Itoa(len(body))
 	}
 	response.Body = io.NopCloser(bytes.NewReader(body))
 	return response
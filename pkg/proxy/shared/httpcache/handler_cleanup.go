@@ -13,13 +13,35 @@ import (
 	"gopkg.d7z.net/cache-proxy/pkg/utils"
 )
 
+// NegativeRoutes is implemented by resolvers whose rules can give routes a
+// NegativeTTL of their own.
+type NegativeRoutes interface {
+	NegativeRoutes() bool
+}
+
 func (h *Handler) Cleanup(ctx context.Context, opts config.CleanupConfig) error {
 	if h.config.ExpireAfter.IsNever() || h.config.ExpireAfter.IsUnset() {
-		return nil
+		// Nothing expires and no tombstones are written, so skip the walk.
+		if !h.negativeCaching() {
+			return nil
+		}
+		return CleanupStoreTenant(ctx, h.store, h.name, 0, opts)
 	}
 	return CleanupStoreTenant(ctx, h.store, h.name, h.config.ExpireAfter.Duration(), opts)
 }
 
+// negativeCaching reports whether the instance or any of its routes caches
+// negative responses.
+func (h *Handler) negativeCaching() bool {
+	if h.config.NegativeTTL > 0 {
+		return true
+	}
+	routes, ok := h.resolver.(NegativeRoutes)
+	return ok && routes.NegativeRoutes()
+}
+
+// CleanupStoreTenant deletes objects fetched more than expireAfter ago and
+// expired negative entries. A zero expireAfter only removes negative entries.
 func CleanupStoreTenant(ctx context.Context, store *blobfs.Store, tenant string, expireAfter time.Duration, opts config.CleanupConfig) error {
 	deleted := 0
 	return fs.WalkDir(store.TenantFS(tenant), ".", func(objectPath string, entry fs.DirEntry, err error) error {
@@ -36,12 +58,21 @@ func CleanupStoreTenant(ctx context.Context, store *blobfs.Store, tenant string,
 		if statErr != nil || info.State != "ACTIVE" {
 			return nil
 		}
-		fetchedAt, parseErr := utils.ParseFetchedAt(info.Options["fetched-at"])
-		if parseErr == nil && time.Since(fetchedAt) <= expireAfter {
-			return nil
-		}
-		if parseErr != nil {
-			slog.Debug("cleanup parse fetched-at failed", "instance", tenant, "path", objectPath, "err", parseErr)
+		if info.Options["negative"] != "" {
+			if !negativeExpired(info.Options) {
+				return nil
+			}
+		} else {
+			if expireAfter <= 0 {
+				return nil
+			}
+			fetchedAt, parseErr := utils.ParseFetchedAt(info.Options["fetched-at"])
+			if parseErr == nil && time.Since(fetchedAt) <= expireAfter {
+				return nil
+			}
+			if parseErr != nil {
+				slog.Debug("cleanup parse fetched-at failed", "instance", tenant, "path", objectPath, "err", parseErr)
+			}
 		}
 		if opts.DryRun {
 			deleted++
@@ -0,0 +1,154 @@
+package httpcache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.d7z.net/cache-proxy/pkg/utils"
+)
+
+// freshnessHeaders are the upstream response headers the upstream policy
+// derives freshness from. They are kept as internal upstream-* metadata so
+// they never reach clients.
+var freshnessHeaders = []string{"Cache-Control", "Expires", "Date", "Age"}
+
+func freshnessKey(header string) string {
+	return "upstream-" + strings.ToLower(header)
+}
+
+// heuristicFraction is the share of the Last-Modified age used as freshness
+// lifetime when upstream sends no explicit expiry (RFC 9111 section 4.2.2).
+const heuristicFraction = 10
+
+func cacheDirectives(headers map[string]string) map[string]string {
+	directives := map[string]string{}
+	for _, part := range strings.Split(headers[freshnessKey("Cache-Control")], ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			directives[name] = strings.Trim(strings.TrimSpace(value), `"`)
+		}
+	}
+	return directives
+}
+
+// upstreamStorable reports whether a shared cache may store the response.
+func upstreamStorable(headers map[string]string) bool {
+	directives := cacheDirectives(headers)
+	_, noStore := directives["no-store"]
+	_, private := directives["private"]
+	return !noStore && !private
+}
+
+// upstreamMustRevalidate reports whether a stale copy must not be served
+// without a successful revalidation.
+func upstreamMustRevalidate(headers map[string]string) bool {
+	directives := cacheDirectives(headers)
+	for _, name := range []string{"must-revalidate", "proxy-revalidate", "no-cache"} {
+		if _, ok := directives[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// upstreamLifetime returns the freshness lifetime of a stored response per
+// RFC 9111, clamped to the route's min/max. Without explicit or heuristic
+// freshness the route's fresh_for applies.
+func (h *Handler) upstreamLifetime(route Route, headers map[string]string) time.Duration {
+	lifetime, explicit := explicitLifetime(headers)
+	if !explicit {
+		lifetime, explicit = heuristicLifetime(headers)
+	}
+	if !explicit {
+		if freshFor := h.freshFor(route); freshFor > 0 {
+			lifetime = freshFor.Duration()
+		}
+	}
+	if route.MinFreshFor > 0 && lifetime < route.MinFreshFor.Duration() {
+		lifetime = route.MinFreshFor.Duration()
+	}
+	if route.MaxFreshFor > 0 && lifetime > route.MaxFreshFor.Duration() {
+		lifetime = route.MaxFreshFor.Duration()
+	}
+	return lifetime
+}
+
+func explicitLifetime(headers map[string]string) (time.Duration, bool) {
+	directives := cacheDirectives(headers)
+	if _, ok := directives["no-cache"]; ok {
+		return 0, true
+	}
+	for _, name := range []string{"s-maxage", "max-age"} {
+		if value, ok := directives[name]; ok {
+			seconds, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || seconds < 0 {
+				return 0, true
+			}
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+	value := headers[freshnessKey("Expires")]
+	if value == "" {
+		return 0, false
+	}
+	expires, err := http.ParseTime(value)
+	if err != nil {
+		return 0, true
+	}
+	lifetime := expires.Sub(responseDate(headers))
+	if lifetime < 0 {
+		lifetime = 0
+	}
+	return lifetime, true
+}
+
+func heuristicLifetime(headers map[string]string) (time.Duration, bool) {
+	lastModified, err := http.ParseTime(headers["Last-Modified"])
+	if err != nil {
+		return 0, false
+	}
+	age := responseDate(headers).Sub(lastModified)
+	if age <= 0 {
+		return 0, false
+	}
+	return age / heuristicFraction, true
+}
+
+// responseDate is the upstream Date, falling back to when the copy was fetched.
+func responseDate(headers map[string]string) time.Time {
+	if date, err := http.ParseTime(headers[freshnessKey("Date")]); err == nil {
+		return date
+	}
+	fetchedAt, _ := utils.ParseFetchedAt(headers["fetched-at"])
+	return fetchedAt
+}
+
+// upstreamAge is the current age of a stored response: the Age it arrived
+// with plus the time it has been resident.
+func upstreamAge(headers map[string]string) (time.Duration, bool) {
+	fetchedAt, err := utils.ParseFetchedAt(headers["fetched-at"])
+	if err != nil {
+		return 0, false
+	}
+	age := time.Since(fetchedAt)
+	if seconds, err := strconv.ParseInt(headers[freshnessKey("Age")], 10, 64); err == nil && seconds > 0 {
+		age += time.Duration(seconds) * time.Second
+	}
+	return age, true
+}
+
+func (h *Handler) upstreamFresh(route Route, headers map[string]string) bool {
+	age, ok := upstreamAge(headers)
+	return ok && age < h.upstreamLifetime(route, headers)
+}
+
+// storeFreshness copies the upstream freshness headers into object metadata.
+func storeFreshness(meta map[string]string, headers map[string]string) {
+	for _, header := range freshnessHeaders {
+		if value := headers[freshnessKey(header)]; value != "" {
+			meta[freshnessKey(header)] = value
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package httpcache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"gopkg.d7z.net/cache-proxy/pkg/utils"
+)
+
+// maxNegativeBody caps the upstream error body kept in a tombstone.
+const maxNegativeBody = 64 << 10
+
+var errNegativeCached = errors.New("cached object is a negative entry")
+
+func (h *Handler) negativeTTL(route Route) time.Duration {
+	if route.NegativeTTL > 0 {
+		return route.NegativeTTL.Duration()
+	}
+	return h.config.NegativeTTL.Duration()
+}
+
+func negativeStatus(status int) bool {
+	return status == http.StatusNotFound || status == http.StatusGone
+}
+
+// negativeExpired reports whether a tombstone's negative-until has passed.
+func negativeExpired(options map[string]string) bool {
+	until, err := time.Parse(time.RFC3339Nano, options["negative-until"])
+	return err != nil || time.Now().After(until)
+}
+
+// openNegative serves a live tombstone for route. Expired tombstones are
+// removed so the request falls through to upstream.
+func (h *Handler) openNegative(ctx context.Context, route Route) (*utils.ResponseWrapper, bool) {
+	reader, err := h.store.OpenObject(ctx, h.name, route.ObjectPath)
+	if err != nil {
+		return nil, false
+	}
+	info := reader.Info()
+	status, _ := strconv.Atoi(info.Options["negative"])
+	if status == 0 {
+		_ = reader.Close()
+		return nil, false
+	}
+	if negativeExpired(info.Options) {
+		_ = reader.Close()
+		_ = h.store.DeleteObject(ctx, h.name, route.ObjectPath)
+		return nil, false
+	}
+	headers := map[string]string{
+		"Content-Length": strconv.FormatInt(info.Size, 10),
+		"Content-Type":   info.Options["content-type"],
+		"X-Cache":        "NEGATIVE",
+	}
+	if headers["Content-Type"] == "" {
+		headers["Content-Type"] = "text/plain; charset=utf-8"
+	}
+	// Hide the seeker so the response keeps the tombstone status instead of
+	// going through http.ServeContent.
+	body := struct {
+		io.Reader
+		io.Closer
+	}{reader, reader}
+	return &utils.ResponseWrapper{StatusCode: status, Headers: headers, Body: body}, true
+}
+
+// storeNegative records a 404/410 upstream response as a tombstone when the
+// route has a negative TTL, and returns a response replaying its body. Bodies
+// above maxNegativeBody are passed through uncached.
+func (h *Handler) storeNegative(ctx context.Context, route Route, resp *utils.ResponseWrapper) *utils.ResponseWrapper {
+	ttl := h.negativeTTL(route)
+	if ttl <= 0 || !negativeStatus(resp.StatusCode) || resp.Body == nil {
+		return resp
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxNegativeBody+1))
+	if err != nil {
+		_ = resp.Body.Close()
+		return ErrorResponse(http.StatusBadGateway, err)
+	}
+	if len(body) > maxNegativeBody {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return resp
+	}
+	_ = resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.Headers["Content-Length"] = strconv.Itoa(len(body))
+
+	now := time.Now().UTC()
+	meta := map[string]string{
+		"mode":           h.config.Mode,
+		"cache":          "NEGATIVE",
+		"fetched-at":     now.Format(time.RFC3339Nano),
+		"accessed-at":    now.Format(time.RFC3339Nano),
+		"negative":       strconv.Itoa(resp.StatusCode),
+		"negative-until": now.Add(ttl).Format(time.RFC3339Nano),
+	}
+	if contentType := resp.Headers["Content-Type"]; contentType != "" {
+		meta["content-type"] = contentType
+	}
+	storeCtx := context.WithoutCancel(ctx)
+	if parent := path.Dir(route.ObjectPath); parent != "." {
+		if err := h.store.MkdirAll(h.name+"/"+parent, 0o755); err != nil {
+			return resp
+		}
+	}
+	if _, err := h.store.Put(storeCtx, h.name, route.ObjectPath, bytes.NewReader(body), meta); err != nil {
+		slog.Warn("negative cache write failed", "path", route.ObjectPath, "err", err)
+	}
+	return resp
+}
@@ -0,0 +1,272 @@
+package httpcache
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.d7z.net/blobfs"
+
+	"gopkg.d7z.net/cache-proxy/pkg/config"
+	"gopkg.d7z.net/cache-proxy/pkg/utils"
+)
+
+// PinnedOption marks objects that are the only copy of their content, such
+// as pushed images, so quota eviction keeps them.
+const PinnedOption = "pinned"
+
+type QuotaResult struct {
+	Usage          int64
+	ReclaimedBytes int64
+	Evicted        int
+}
+
+// EvictionUnit is a set of objects quota eviction removes together. Expired
+// units go first, the rest by last access.
+type EvictionUnit struct {
+	Name       string
+	Size       int64
+	LastAccess time.Time
+	Expired    bool
+	// Evict deletes the unit and returns the bytes it reclaimed.
+	Evict func(context.Context) (int64, error)
+}
+
+// UnitEvictor is implemented by handlers whose objects reference each other,
+// such as OCI refs sharing blobs. Quota eviction removes the units they list
+// instead of single objects of their tenant.
+type UnitEvictor interface {
+	EvictionUnits(ctx context.Context, access *AccessIndex) ([]EvictionUnit, error)
+}
+
+type quotaCandidate struct {
+	tenant string
+	EvictionUnit
+}
+
+// AccessIndex records when cached objects were last served, so quota eviction
+// can order them by use without rewriting their bodies. It is kept in memory
+// and persisted by the app with Save and Load.
+type AccessIndex struct {
+	mu    sync.Mutex
+	times map[string]map[string]time.Time
+}
+
+// Touch records that objectPath of tenant was served now.
+func (x *AccessIndex) Touch(tenant, objectPath string) {
+	if x == nil {
+		return
+	}
+	now := time.Now().UTC()
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.times == nil {
+		x.times = map[string]map[string]time.Time{}
+	}
+	paths := x.times[tenant]
+	if paths == nil {
+		paths = map[string]time.Time{}
+		x.times[tenant] = paths
+	}
+	paths[objectPath] = now
+}
+
+// Forget drops the access time of an object that was deleted.
+func (x *AccessIndex) Forget(tenant, objectPath string) {
+	if x == nil {
+		return
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	delete(x.times[tenant], objectPath)
+}
+
+// retain drops the access times of tenant objects that are not in seen.
+func (x *AccessIndex) retain(tenant string, seen map[string]struct{}) {
+	if x == nil {
+		return
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for objectPath := range x.times[tenant] {
+		if _, ok := seen[objectPath]; !ok {
+			delete(x.times[tenant], objectPath)
+		}
+	}
+}
+
+// LastAccess returns when an object was last served: its recorded access
+// time, else its accessed-at or fetched-at option. Objects with none of them
+// are not cached copies, such as state kept next to them, and report false.
+func (x *AccessIndex) LastAccess(tenant, objectPath string, options map[string]string) (time.Time, bool) {
+	var stamp time.Time
+	found := false
+	for _, key := range []string{"accessed-at", "fetched-at"} {
+		if at, err := utils.ParseFetchedAt(options[key]); err == nil {
+			stamp, found = at, true
+			break
+		}
+	}
+	if !found {
+		return time.Time{}, false
+	}
+	if x != nil {
+		x.mu.Lock()
+		at, ok := x.times[tenant][objectPath]
+		x.mu.Unlock()
+		if ok && at.After(stamp) {
+			stamp = at
+		}
+	}
+	return stamp, true
+}
+
+// Load replaces the recorded access times with the ones saved at objectPath
+// of tenant. A missing file leaves the index empty.
+func (x *AccessIndex) Load(ctx context.Context, store *blobfs.Store, tenant, objectPath string) error {
+	reader, err := store.OpenObject(ctx, tenant, objectPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	times := map[string]map[string]time.Time{}
+	if err := json.NewDecoder(reader).Decode(&times); err != nil {
+		return err
+	}
+	x.mu.Lock()
+	x.times = times
+	x.mu.Unlock()
+	return nil
+}
+
+// Save writes the recorded access times to objectPath of tenant.
+func (x *AccessIndex) Save(ctx context.Context, store *blobfs.Store, tenant, objectPath string) error {
+	x.mu.Lock()
+	data, err := json.Marshal(x.times)
+	x.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	_, err = store.Put(ctx, tenant, objectPath, bytes.NewReader(data), map[string]string{"content-type": "application/json"})
+	return err
+}
+
+// EvictStoreTenants deletes the least recently served objects of the given
+// tenants once their combined usage exceeds limit, until usage drops to target.
+// Objects with the pinned option are never evicted, and tenants with an entry
+// in evictors are evicted by the units it lists.
+func EvictStoreTenants(
+	ctx context.Context,
+	store *blobfs.Store,
+	access *AccessIndex,
+	tenants []string,
+	evictors map[string]UnitEvictor,
+	limit int64,
+	target int64,
+	opts config.CleanupConfig,
+) (QuotaResult, error) {
+	var result QuotaResult
+	var candidates []quotaCandidate
+	for _, tenant := range tenants {
+		_, custom := evictors[tenant]
+		seen := map[string]struct{}{}
+		err := fs.WalkDir(store.TenantFS(tenant), ".", func(objectPath string, entry fs.DirEntry, err error) error {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err != nil || entry.IsDir() {
+				return nil
+			}
+			fileInfo, infoErr := entry.Info()
+			if infoErr != nil {
+				return nil
+			}
+			result.Usage += fileInfo.Size()
+			seen[objectPath] = struct{}{}
+			if custom {
+				return nil
+			}
+			info, statErr := store.StatObject(ctx, tenant, objectPath)
+			if statErr != nil || info.State != "ACTIVE" || info.Options[PinnedOption] != "" {
+				return nil
+			}
+			at, ok := access.LastAccess(tenant, objectPath, info.Options)
+			if !ok {
+				return nil
+			}
+			candidates = append(candidates, quotaCandidate{tenant: tenant, EvictionUnit: EvictionUnit{
+				Name:       objectPath,
+				Size:       fileInfo.Size(),
+				LastAccess: at,
+				Evict: func(ctx context.Context) (int64, error) {
+					if err := store.DeleteObject(ctx, tenant, objectPath); err != nil {
+						return 0, err
+					}
+					access.Forget(tenant, objectPath)
+					return fileInfo.Size(), nil
+				},
+			}})
+			return nil
+		})
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return result, err
+		}
+		access.retain(tenant, seen)
+	}
+	if result.Usage <= limit {
+		return result, nil
+	}
+	for _, tenant := range tenants {
+		evictor, ok := evictors[tenant]
+		if !ok {
+			continue
+		}
+		units, err := evictor.EvictionUnits(ctx, access)
+		if err != nil {
+			return result, err
+		}
+		for _, unit := range units {
+			candidates = append(candidates, quotaCandidate{tenant: tenant, EvictionUnit: unit})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].Expired != candidates[j].Expired {
+			return candidates[i].Expired
+		}
+		return candidates[i].LastAccess.Before(candidates[j].LastAccess)
+	})
+	usage := result.Usage
+	for _, candidate := range candidates {
+		if usage <= target || (opts.BatchSize > 0 && result.Evicted >= opts.BatchSize) {
+			break
+		}
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+		reclaimed := candidate.Size
+		if opts.DryRun {
+			slog.Info("quota dry-run evict", "instance", candidate.tenant, "path", candidate.Name, "bytes", candidate.Size)
+		} else {
+			var err error
+			if reclaimed, err = candidate.Evict(ctx); err != nil {
+				if !errors.Is(err, context.Canceled) {
+					slog.Info("quota evict failed", "instance", candidate.tenant, "path", candidate.Name, "err", err)
+				}
+				continue
+			}
+		}
+		usage -= reclaimed
+		result.ReclaimedBytes += reclaimed
+		result.Evicted++
+	}
+	return result, nil
+}
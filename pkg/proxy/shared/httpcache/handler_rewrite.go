@@ -4,11 +4,18 @@ import (
 	"bytes"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"html"
 	"net/http"
 	"net/url"
 	stdpath "path"
 	"regexp"
 	"strings"
+	"time"
+
+	"golang.org/x/mod/semver"
+
+	"gopkg.d7z.net/cache-proxy/pkg/proxy/shared/deny"
 )
 
 type CargoConfig struct {
@@ -41,6 +48,11 @@ func rewritePyPISimple(req *http.Request, upstreams []string, route Route, heade
 		if err != nil {
 			return nil, nil, err
 		}
+		if !strings.HasSuffix(req.URL.Path, "/json") && !strings.Contains(req.Header.Get("Accept"), "application/vnd.pypi.simple.v1+json") {
+			return renderPyPISimpleHTML(next), map[string]string{
+				"Content-Type": "text/html; charset=utf-8",
+			}, nil
+		}
 		return next, map[string]string{
 			"Content-Type": "application/vnd.pypi.simple.v1+json",
 		}, nil
@@ -72,6 +84,67 @@ func rewritePyPISimpleJSON(req *http.Request, upstreamPageURL string, data []byt
 	return json.Marshal(payload)
 }
 
+// renderPyPISimpleHTML renders a rewritten JSON project page as the HTML
+// page of the simple API, for clients that do not accept JSON.
+func renderPyPISimpleHTML(data []byte) []byte {
+	var payload struct {
+		Files []struct {
+			Filename         string            `json:"filename"`
+			URL              string            `json:"url"`
+			Hashes           map[string]string `json:"hashes"`
+			RequiresPython   string            `json:"requires-python"`
+			CoreMetadata     any               `json:"core-metadata"`
+			DistInfoMetadata any               `json:"dist-info-metadata"`
+			GPGSig           *bool             `json:"gpg-sig"`
+			Yanked           any               `json:"yanked"`
+		} `json:"files"`
+	}
+	_ = json.Unmarshal(data, &payload)
+	var out bytes.Buffer
+	out.WriteString("<!DOCTYPE html>\n<html>\n<body>\n")
+	for _, file := range payload.Files {
+		href := file.URL
+		if sum := file.Hashes["sha256"]; sum != "" {
+			href += "#sha256=" + sum
+		}
+		attrs := ""
+		if file.RequiresPython != "" {
+			attrs += fmt.Sprintf(` data-requires-python="%s"`, html.EscapeString(file.RequiresPython))
+		}
+		metadata := file.CoreMetadata
+		if metadata == nil {
+			metadata = file.DistInfoMetadata
+		}
+		// PEP 714 clients read data-core-metadata, older ones the
+		// data-dist-info-metadata name it replaced.
+		switch metadata := metadata.(type) {
+		case bool:
+			if metadata {
+				attrs += ` data-core-metadata="true" data-dist-info-metadata="true"`
+			}
+		case map[string]any:
+			if sum, _ := metadata["sha256"].(string); sum != "" {
+				value := html.EscapeString("sha256=" + sum)
+				attrs += fmt.Sprintf(` data-core-metadata="%s" data-dist-info-metadata="%s"`, value, value)
+			}
+		}
+		if file.GPGSig != nil {
+			attrs += fmt.Sprintf(` data-gpg-sig="%t"`, *file.GPGSig)
+		}
+		switch yanked := file.Yanked.(type) {
+		case bool:
+			if yanked {
+				attrs += ` data-yanked=""`
+			}
+		case string:
+			attrs += fmt.Sprintf(` data-yanked="%s"`, html.EscapeString(yanked))
+		}
+		fmt.Fprintf(&out, "<a href=\"%s\"%s>%s</a><br/>\n", html.EscapeString(href), attrs, html.EscapeString(file.Filename))
+	}
+	out.WriteString("</body>\n</html>\n")
+	return out.Bytes()
+}
+
 var hrefPattern = regexp.MustCompile(`href="([^"]+)"`)
 
 func rewritePyPISimpleHTML(base, upstreamPageURL string, data []byte) []byte {
@@ -152,3 +225,147 @@ func normalizedProxyPrefix(value string) string {
 func joinBaseAndPath(base, suffix string) string {
 	return strings.TrimRight(base, "/") + "/" + strings.TrimLeft(suffix, "/")
 }
+
+// releaseCutoff returns the publish time after which versions are hidden from
+// req: the earlier of its snapshot time and the release age cutoff, or the
+// zero time when neither applies.
+func (h *Handler) releaseCutoff(req *http.Request) time.Time {
+	snapshot := SnapshotTime(req.Context())
+	age := h.config.MinReleaseAge
+	if age <= 0 {
+		return snapshot
+	}
+	if value := req.Header.Get(ReleaseAgeHeader); value != "" {
+		if override, err := time.ParseDuration(value); err == nil && override >= 0 {
+			age = override
+		}
+	}
+	if age == 0 {
+		return snapshot
+	}
+	cutoff := time.Now().Add(-age)
+	if !snapshot.IsZero() && snapshot.Before(cutoff) {
+		return snapshot
+	}
+	return cutoff
+}
+
+// publishedAfter reports whether value is a timestamp after cutoff.
+func publishedAfter(value any, cutoff time.Time) bool {
+	text, _ := value.(string)
+	published, err := time.Parse(time.RFC3339, text)
+	return err == nil && published.After(cutoff)
+}
+
+// filterNPMReleaseAge removes versions published after cutoff from an npm
+// packument. Dist-tags of removed versions move to the highest remaining
+// version below them; latest only moves to releases. It reports whether
+// document changed.
+func filterNPMReleaseAge(document any, cutoff time.Time) bool {
+	doc, ok := document.(map[string]any)
+	if !ok || cutoff.IsZero() {
+		return false
+	}
+	versions, _ := doc["versions"].(map[string]any)
+	times, _ := doc["time"].(map[string]any)
+	removed := map[string]bool{}
+	for version, published := range times {
+		if version == "created" || version == "modified" || !publishedAfter(published, cutoff) {
+			continue
+		}
+		delete(versions, version)
+		delete(times, version)
+		removed[version] = true
+	}
+	if len(removed) == 0 {
+		return false
+	}
+	tags, _ := doc["dist-tags"].(map[string]any)
+	for tag, value := range tags {
+		version, _ := value.(string)
+		if !removed[version] {
+			continue
+		}
+		if previous := previousNPMVersion(versions, version, tag == "latest"); previous != "" {
+			tags[tag] = previous
+		} else {
+			delete(tags, tag)
+		}
+	}
+	return true
+}
+
+func previousNPMVersion(versions map[string]any, target string, releasesOnly bool) string {
+	best := ""
+	for version := range versions {
+		v := "v" + version
+		if !semver.IsValid(v) || semver.Compare(v, "v"+target) >= 0 || (releasesOnly && semver.Prerelease(v) != "") {
+			continue
+		}
+		if best == "" || semver.Compare(v, "v"+best) > 0 {
+			best = version
+		}
+	}
+	return best
+}
+
+// filterPyPIReleaseAge removes files uploaded after cutoff from a JSON
+// project page, and versions left without files.
+func filterPyPIReleaseAge(data []byte, cutoff time.Time) []byte {
+	var payload map[string]any
+	if cutoff.IsZero() || json.Unmarshal(data, &payload) != nil {
+		return data
+	}
+	files, _ := payload["files"].([]any)
+	kept := files[:0]
+	dropped, remaining := map[string]bool{}, map[string]bool{}
+	for _, item := range files {
+		obj, _ := item.(map[string]any)
+		filename, _ := obj["filename"].(string)
+		_, version, _ := deny.PyPIFile(filename)
+		if publishedAfter(obj["upload-time"], cutoff) {
+			dropped[version] = true
+			continue
+		}
+		remaining[version] = true
+		kept = append(kept, item)
+	}
+	if len(dropped) == 0 {
+		return data
+	}
+	payload["files"] = kept
+	if versions, ok := payload["versions"].([]any); ok {
+		keptVersions := versions[:0]
+		for _, item := range versions {
+			if version, _ := item.(string); dropped[version] && !remaining[version] {
+				continue
+			}
+			keptVersions = append(keptVersions, item)
+		}
+		payload["versions"] = keptVersions
+	}
+	next, err := json.Marshal(payload)
+	if err != nil {
+		return data
+	}
+	return next
+}
+
+// filterCargoReleaseAge removes sparse index entries whose pubtime is after
+// cutoff. Entries without a pubtime are kept.
+func filterCargoReleaseAge(data []byte, cutoff time.Time) []byte {
+	if cutoff.IsZero() {
+		return data
+	}
+	var out bytes.Buffer
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		var entry struct {
+			PubTime any `json:"pubtime"`
+		}
+		if json.Unmarshal(line, &entry) == nil && publishedAfter(entry.PubTime, cutoff) {
+			continue
+		}
+		out.Write(line)
+	}
+	return out.Bytes()
+}
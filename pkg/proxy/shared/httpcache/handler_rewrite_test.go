@@ -0,0 +1,110 @@
+package httpcache
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var releaseNow = time.Date(2026, 3, 10, 0, 0, 0, 0, time.UTC)
+
+func TestReleaseCutoffHonorsOverrideHeader(t *testing.T) {
+	h := &Handler{config: RuntimeConfig{MinReleaseAge: 72 * time.Hour}}
+	req := httptest.NewRequest(http.MethodGet, "/pkg", nil)
+	require.WithinDuration(t, time.Now().Add(-72*time.Hour), h.releaseCutoff(req), time.Minute)
+	req.Header.Set(ReleaseAgeHeader, "0")
+	require.True(t, h.releaseCutoff(req).IsZero())
+	req.Header.Set(ReleaseAgeHeader, "1h")
+	require.WithinDuration(t, time.Now().Add(-time.Hour), h.releaseCutoff(req), time.Minute)
+
+	h.config.MinReleaseAge = 0
+	require.True(t, h.releaseCutoff(req).IsZero())
+}
+
+func TestFilterNPMReleaseAgeRepointsTags(t *testing.T) {
+	var document any
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"dist-tags": {"latest": "2.0.0", "next": "3.0.0-rc.2", "legacy": "1.0.0"},
+		"versions": {"1.0.0": {}, "1.1.0": {}, "2.0.0-rc.1": {}, "2.0.0": {}, "3.0.0-rc.1": {}, "3.0.0-rc.2": {}},
+		"time": {
+			"created": "2025-01-01T00:00:00Z",
+			"modified": "2026-03-09T00:00:00Z",
+			"1.0.0": "2025-01-01T00:00:00Z",
+			"1.1.0": "2025-06-01T00:00:00Z",
+			"2.0.0-rc.1": "2026-02-01T00:00:00Z",
+			"2.0.0": "2026-03-08T00:00:00Z",
+			"3.0.0-rc.1": "2026-02-20T00:00:00Z",
+			"3.0.0-rc.2": "2026-03-09T12:00:00.000Z"
+		}
+	}`), &document))
+	require.True(t, filterNPMReleaseAge(document, releaseNow.Add(-7*24*time.Hour)))
+	doc := document.(map[string]any)
+	require.NotContains(t, doc["versions"], "2.0.0")
+	require.NotContains(t, doc["time"], "3.0.0-rc.2")
+	require.Contains(t, doc["time"], "modified")
+	require.Equal(t, map[string]any{"latest": "1.1.0", "next": "3.0.0-rc.1", "legacy": "1.0.0"}, doc["dist-tags"])
+	require.False(t, filterNPMReleaseAge(document, time.Time{}))
+}
+
+func TestFilterPyPIAndCargoReleaseAge(t *testing.T) {
+	cutoff := releaseNow.Add(-7 * 24 * time.Hour)
+	page := `{"name":"demo","versions":["1.0","1.1"],"files":[
+		{"filename":"demo-1.0.tar.gz","upload-time":"2025-01-01T00:00:00.123456Z"},
+		{"filename":"demo-1.1-py3-none-any.whl","upload-time":"2026-03-09T00:00:00Z"},
+		{"filename":"demo-1.1.tar.gz","upload-time":"2026-03-09T00:00:00Z"}
+	]}`
+	var payload map[string]any
+	require.NoError(t, json.Unmarshal(filterPyPIReleaseAge([]byte(page), cutoff), &payload))
+	require.Equal(t, []any{"1.0"}, payload["versions"])
+	require.Len(t, payload["files"], 1)
+
+	index := "{\"name\":\"demo\",\"vers\":\"0.1.0\",\"pubtime\":\"2025-01-01T00:00:00Z\"}\n" +
+		"{\"name\":\"demo\",\"vers\":\"0.1.1\"}\n" +
+		"{\"name\":\"demo\",\"vers\":\"0.2.0\",\"pubtime\":\"2026-03-09T00:00:00Z\"}\n"
+	require.Equal(t, "{\"name\":\"demo\",\"vers\":\"0.1.0\",\"pubtime\":\"2025-01-01T00:00:00Z\"}\n{\"name\":\"demo\",\"vers\":\"0.1.1\"}\n",
+		string(filterCargoReleaseAge([]byte(index), cutoff)))
+}
+
+func TestRewritePyPISimpleRendersHTMLFromJSON(t *testing.T) {
+	page := `{"files":[{"filename":"demo-1.0.tar.gz","url":"https://files.example/demo-1.0.tar.gz","hashes":{"sha256":"ab"},"requires-python":">=3.8","yanked":"broken"}]}`
+	req := httptest.NewRequest(http.MethodGet, "http://proxy/pypi/simple/demo/", nil)
+	body, headers, err := rewritePyPISimple(req, nil, Route{}, map[string]string{"Content-Type": "application/vnd.pypi.simple.v1+json"}, []byte(page))
+	require.NoError(t, err)
+	require.Equal(t, "text/html; charset=utf-8", headers["Content-Type"])
+	require.Contains(t, string(body), `<a href="http://proxy/pypi/files/68747470733a2f2f66696c65732e6578616d706c652f64656d6f2d312e302e7461722e677a#sha256=ab" data-requires-python="&gt;=3.8" data-yanked="broken">demo-1.0.tar.gz</a>`)
+
+	signed := `{"files":[{"filename":"demo-1.1.tar.gz","url":"https://files.example/demo-1.1.tar.gz","hashes":{},"dist-info-metadata":{"sha256":"cd"},"gpg-sig":true}]}`
+	body, _, err = rewritePyPISimple(req, nil, Route{}, map[string]string{"Content-Type": "application/vnd.pypi.simple.v1+json"}, []byte(signed))
+	require.NoError(t, err)
+	require.Contains(t, string(body), ` data-core-metadata="sha256=cd" data-dist-info-metadata="sha256=cd" data-gpg-sig="true">demo-1.1.tar.gz</a>`)
+
+	req.Header.Set("Accept", "application/vnd.pypi.simple.v1+json, text/html;q=0.01")
+	_, headers, err = rewritePyPISimple(req, nil, Route{}, map[string]string{"Content-Type": "application/vnd.pypi.simple.v1+json"}, []byte(page))
+	require.NoError(t, err)
+	require.Equal(t, "application/vnd.pypi.simple.v1+json", headers["Content-Type"])
+}
+
+func TestSnapshotRequestStripsSegment(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/@2026-01-15T12:00:00Z/simple/demo/", nil)
+	next, ok := snapshotRequest(req)
+	require.True(t, ok)
+	require.Equal(t, "/simple/demo/", next.URL.Path)
+	require.Equal(t, "/@2026-01-15T12:00:00Z", next.Header.Get("X-Cache-Proxy-Prefix"))
+	require.Equal(t, time.Date(2026, 1, 15, 12, 0, 0, 0, time.UTC), SnapshotTime(next.Context()))
+	require.Equal(t, "/@2026-01-15T12:00:00Z/simple/demo/", req.URL.Path)
+
+	next, ok = snapshotRequest(httptest.NewRequest(http.MethodGet, "/@2026-01-15", nil))
+	require.True(t, ok)
+	require.Equal(t, "/", next.URL.Path)
+	require.Equal(t, time.Date(2026, 1, 16, 0, 0, 0, 0, time.UTC), SnapshotTime(next.Context()).Add(time.Nanosecond))
+
+	next, ok = snapshotRequest(httptest.NewRequest(http.MethodGet, "/@scope/pkg", nil))
+	require.True(t, ok)
+	require.True(t, SnapshotTime(next.Context()).IsZero())
+	_, ok = snapshotRequest(httptest.NewRequest(http.MethodGet, "/@2026-13-01/pkg", nil))
+	require.False(t, ok)
+}
@@ -0,0 +1,60 @@
+package httpcache
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// snapshotSegment matches the leading /@<date>/ path segment of a
+// point-in-time view, with a date or an RFC 3339 timestamp.
+var snapshotSegment = regexp.MustCompile(`^@\d{4}-\d{2}-\d{2}(T[^/]*)?$`)
+
+type snapshotKey struct{}
+
+// SnapshotTime returns the point in time a request views metadata at, or the
+// zero time for live requests.
+func SnapshotTime(ctx context.Context) time.Time {
+	t, _ := ctx.Value(snapshotKey{}).(time.Time)
+	return t
+}
+
+// parseSnapshot parses the time of a snapshot segment without its @. A date
+// covers the whole day in UTC.
+func parseSnapshot(value string) (time.Time, bool) {
+	if t, err := time.Parse(time.DateOnly, value); err == nil {
+		return t.Add(24*time.Hour - time.Nanosecond), true
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	return t, err == nil
+}
+
+// snapshotRequest strips a leading /@<time> segment from req. The segment is
+// appended to X-Cache-Proxy-Prefix so rewritten URLs stay in the view, and
+// its time is stored for SnapshotTime. It reports false for a segment that
+// looks like a snapshot but does not parse.
+func snapshotRequest(req *http.Request) (*http.Request, bool) {
+	segment, _, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, "/"), "/")
+	if !snapshotSegment.MatchString(segment) {
+		return req, true
+	}
+	at, ok := parseSnapshot(segment[1:])
+	if !ok {
+		return nil, false
+	}
+	next := req.WithContext(context.WithValue(req.Context(), snapshotKey{}, at))
+	u := *req.URL
+	next.URL = &u
+	next.URL.Path = strings.TrimPrefix(req.URL.Path, "/"+segment)
+	if next.URL.RawPath != "" {
+		next.URL.RawPath = strings.TrimPrefix(req.URL.RawPath, "/"+segment)
+	}
+	if next.URL.Path == "" {
+		next.URL.Path = "/"
+	}
+	next.Header = req.Header.Clone()
+	next.Header.Set("X-Cache-Proxy-Prefix", strings.TrimRight(req.Header.Get("X-Cache-Proxy-Prefix"), "/")+"/"+segment)
+	return next, true
+}
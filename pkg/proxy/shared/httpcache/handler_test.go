@@ -2,13 +2,20 @@ package httpcache
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -74,7 +81,7 @@ func TestStripInternal(t *testing.T) {
 
 func TestConfigureClientTransportTimeouts(t *testing.T) {
 	client := utils.DefaultHttpClientWrapper()
-	ConfigureClientTransport(client, "test", &config.TransportConfig{
+	ConfigureClientTransport(client, "test", nil, &config.TransportConfig{
 		DialTimeout:        config.Duration(2 * time.Second),
 		HeaderTimeout:      config.Duration(3 * time.Second),
 		IdleBodyTimeout:    config.Duration(4 * time.Second),
@@ -96,11 +103,101 @@ func TestConfigureClientTransportTimeouts(t *testing.T) {
 
 func TestConfigureClientTransportUserAgentOverride(t *testing.T) {
 	client := utils.DefaultHttpClientWrapper()
-	ConfigureClientTransport(client, "test", &config.TransportConfig{UserAgent: "custom-client/2"})
+	ConfigureClientTransport(client, "test", nil, &config.TransportConfig{UserAgent: "custom-client/2"})
 
 	require.Equal(t, "custom-client/2", client.UserAgent)
 }
 
+func TestConfigureClientTransportAuthStaysOnUpstream(t *testing.T) {
+	seen := map[string]string{}
+	var mu sync.Mutex
+	record := func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen[r.Host+r.URL.Path] = r.Header.Get("Authorization") + "|" + r.Header.Get("X-Api-Key")
+		mu.Unlock()
+	}
+	third := httptest.NewServer(http.HandlerFunc(record))
+	defer third.Close()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/repo/moved" {
+			http.Redirect(w, r, third.URL+"/file", http.StatusFound)
+			return
+		}
+		record(w, r)
+	}))
+	defer upstream.Close()
+
+	client := utils.DefaultHttpClientWrapper()
+	ConfigureClientTransport(client, "test", []string{upstream.URL + "/repo"}, &config.TransportConfig{
+		Auth: config.UpstreamAuthList{
+			{Type: "basic", Username: "ci", Password: "secret"},
+			{Type: "header", Upstream: upstream.URL + "/private", Header: "X-Api-Key", Value: "key"},
+		},
+	})
+	get := func(target string) {
+		req, err := http.NewRequest(http.MethodGet, target, nil)
+		require.NoError(t, err)
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+	}
+	get(upstream.URL + "/repo/a.jar")
+	get(upstream.URL + "/private/b.tgz")
+	get(upstream.URL + "/repository/c.whl")
+	get(upstream.URL + "/repo/moved")
+
+	upstreamHost := strings.TrimPrefix(upstream.URL, "http://")
+	thirdHost := strings.TrimPrefix(third.URL, "http://")
+	require.Equal(t, "Basic Y2k6c2VjcmV0|", seen[upstreamHost+"/repo/a.jar"])
+	require.Equal(t, "|key", seen[upstreamHost+"/private/b.tgz"])
+	require.Equal(t, "|", seen[upstreamHost+"/repository/c.whl"])
+	require.Equal(t, "|", seen[thirdHost+"/file"])
+}
+
+func TestConfigureClientTransportTLS(t *testing.T) {
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.TLS.PeerCertificates[0].Subject.Organization[0])
+	}))
+	upstream.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	// The test server certificate doubles as CA and client certificate.
+	cert := upstream.TLS.Certificates[0]
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0o600))
+
+	get := func(transport *config.TransportConfig) (string, error) {
+		client := utils.DefaultHttpClientWrapper()
+		ConfigureClientTransport(client, "test", nil, transport)
+		target := strings.Replace(upstream.URL, "127.0.0.1", "localhost", 1)
+		req, err := http.NewRequest(http.MethodGet, target, nil)
+		require.NoError(t, err)
+		resp, err := client.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer func() { _ = resp.Body.Close() }()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+	_, err = get(nil)
+	require.ErrorContains(t, err, "certificate")
+	body, err := get(&config.TransportConfig{TLS: &config.UpstreamTLSConfig{
+		CAFile:     certFile,
+		ClientCert: certFile,
+		ClientKey:  keyFile,
+		ServerName: "example.com",
+		MinVersion: "1.3",
+	}})
+	require.NoError(t, err)
+	require.Equal(t, "Acme Co", body)
+}
+
 func TestCacheDebugHeadersOnCacheHit(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
@@ -343,11 +440,17 @@ func (r *staticResolver) Resolve(req *http.Request) (Route, error) {
 		AllowedTargetHosts: append([]string(nil), r.route.AllowedTargetHosts...),
 		Policy:             r.route.Policy,
 		FreshFor:           r.route.FreshFor,
+		Stale:              r.route.Stale,
 		BusyPolicy:         r.route.BusyPolicy,
 		ExpireAfter:        r.route.ExpireAfter,
+		NegativeTTL:        r.route.NegativeTTL,
 	}, nil
 }
 
+func (r *staticResolver) NegativeRoutes() bool {
+	return r.route.NegativeTTL > 0
+}
+
 type literalResolver struct {
 	route Route
 }
@@ -860,6 +963,319 @@ func TestStaleCacheOnValidationError(t *testing.T) {
 	require.Equal(t, "hello", rec.Body.String())
 }
 
+func TestStaleWhileRevalidateRefreshesInBackground(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var version atomic.Int32
+	version.Store(1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := fmt.Sprintf("v%d", version.Load())
+		w.Header().Set("ETag", strconv.Quote(body))
+		if r.Method == http.MethodHead {
+			time.Sleep(300 * time.Millisecond)
+			return
+		}
+		_, _ = io.WriteString(w, body)
+	}))
+	defer upstream.Close()
+
+	store, err := blobfs.Open(t.TempDir(), blobfs.DefaultConfig())
+	require.NoError(t, err)
+	defer store.Close()
+
+	resolver := &staticResolver{route: Route{
+		ObjectPath:   "test/swr",
+		UpstreamPath: "test/swr",
+		Policy:       config.PolicyRevalidate,
+		FreshFor:     config.Freshness(time.Nanosecond),
+	}}
+	handler := NewHandler("test", RuntimeConfig{
+		Mode:         "test",
+		ExpireAfter:  config.Expiration(72 * time.Hour),
+		Upstreams:    []string{upstream.URL},
+		DefaultStale: config.StaleWindows{WhileRevalidate: config.Freshness(time.Hour)},
+	}, store, resolver, NewStats(prometheus.NewRegistry()), nil)
+	defer handler.Close()
+
+	get := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequestWithContext(ctx, http.MethodGet, "/test/swr", nil))
+		return rec
+	}
+	require.Equal(t, "v1", get().Body.String())
+
+	version.Store(2)
+	started := time.Now()
+	rec := get()
+	require.Less(t, time.Since(started), 200*time.Millisecond)
+	require.Equal(t, "STALE", rec.Header().Get("X-Cache"))
+	require.Equal(t, "v1", rec.Body.String())
+
+	require.Eventually(t, func() bool {
+		return get().Body.String() == "v2"
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestStaleIfErrorMasksUpstreamFailuresWithinWindow(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var failing, changed atomic.Bool
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() && (r.Method == http.MethodGet || !changed.Load()) {
+			http.Error(w, "unavailable", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		if changed.Load() {
+			w.Header().Set("ETag", `"v2"`)
+		}
+		_, _ = io.WriteString(w, "hello")
+	}))
+	defer upstream.Close()
+
+	store, err := blobfs.Open(t.TempDir(), blobfs.DefaultConfig())
+	require.NoError(t, err)
+	defer store.Close()
+
+	resolver := &staticResolver{route: Route{
+		ObjectPath:   "test/sie",
+		UpstreamPath: "test/sie",
+		Policy:       config.PolicyRevalidate,
+		FreshFor:     config.Freshness(time.Nanosecond),
+		Stale:        config.StaleWindows{IfError: config.Freshness(300 * time.Millisecond)},
+	}}
+	handler := NewHandler("test", RuntimeConfig{
+		Mode:        "test",
+		ExpireAfter: config.Expiration(72 * time.Hour),
+		Upstreams:   []string{upstream.URL},
+	}, store, resolver, NewStats(prometheus.NewRegistry()), nil)
+	defer handler.Close()
+
+	get := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequestWithContext(ctx, http.MethodGet, "/test/sie", nil))
+		return rec
+	}
+	require.Equal(t, "MISS", get().Header().Get("X-Cache"))
+
+	failing.Store(true)
+	rec := get()
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "STALE", rec.Header().Get("X-Cache"))
+
+	changed.Store(true)
+	rec = get()
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "STALE", rec.Header().Get("X-Cache"))
+	require.Equal(t, "hello", rec.Body.String())
+
+	changed.Store(false)
+	time.Sleep(400 * time.Millisecond)
+	require.Equal(t, http.StatusServiceUnavailable, get().Code)
+}
+
+func TestStaleIfErrorExceededReturnsServiceUnavailable(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var failing atomic.Bool
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = io.WriteString(w, "hello")
+	}))
+	defer upstream.Close()
+
+	store, err := blobfs.Open(t.TempDir(), blobfs.DefaultConfig())
+	require.NoError(t, err)
+	defer store.Close()
+
+	resolver := &staticResolver{route: Route{
+		ObjectPath:   "test/sie-exceeded",
+		UpstreamPath: "test/sie-exceeded",
+		Policy:       config.PolicyRevalidate,
+		FreshFor:     config.Freshness(time.Nanosecond),
+		Stale:        config.StaleWindows{IfError: config.Freshness(time.Nanosecond)},
+	}}
+	handler := NewHandler("test", RuntimeConfig{
+		Mode:        "test",
+		ExpireAfter: config.Expiration(72 * time.Hour),
+		Upstreams:   []string{upstream.URL},
+	}, store, resolver, NewStats(prometheus.NewRegistry()), nil)
+	defer handler.Close()
+
+	get := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequestWithContext(ctx, http.MethodGet, "/test/sie-exceeded", nil))
+		return rec
+	}
+	require.Equal(t, "MISS", get().Header().Get("X-Cache"))
+
+	// Once the cached copy is too old to serve, a failing upstream answers
+	// 503 and a failure of the proxy itself 502.
+	failing.Store(true)
+	time.Sleep(10 * time.Millisecond)
+	require.Equal(t, http.StatusServiceUnavailable, get().Code)
+	resolver.route.TargetURL = "ftp://example.com/file"
+	require.Equal(t, http.StatusBadGateway, get().Code)
+}
+
+func TestNegativeCacheStoresNotFoundTombstone(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var gets atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gets.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = io.WriteString(w, `{"error":"not found"}`)
+	}))
+	defer upstream.Close()
+
+	store, err := blobfs.Open(t.TempDir(), blobfs.DefaultConfig())
+	require.NoError(t, err)
+	defer store.Close()
+
+	resolver := &staticResolver{route: Route{
+		ObjectPath:  "test/missing",
+		Policy:      config.PolicyImmutable,
+		NegativeTTL: config.Duration(200 * time.Millisecond),
+	}}
+	handler := NewHandler("test", RuntimeConfig{
+		Mode:        "test",
+		ExpireAfter: config.ExpirationNever,
+		Upstreams:   []string{upstream.URL},
+	}, store, resolver, NewStats(prometheus.NewRegistry()), nil)
+
+	get := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequestWithContext(ctx, http.MethodGet, "/test/missing", nil))
+		return rec
+	}
+	rec := get()
+	require.Equal(t, http.StatusNotFound, rec.Code)
+	require.Equal(t, "BYPASS", rec.Header().Get("X-Cache"))
+
+	rec = get()
+	require.Equal(t, http.StatusNotFound, rec.Code)
+	require.Equal(t, "NEGATIVE", rec.Header().Get("X-Cache"))
+	require.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	require.Equal(t, `{"error":"not found"}`, rec.Body.String())
+	require.Empty(t, rec.Header().Get("negative-until"))
+	require.Equal(t, int32(1), gets.Load())
+
+	time.Sleep(300 * time.Millisecond)
+	require.NoError(t, handler.Cleanup(ctx, config.CleanupConfig{}))
+	_, err = store.StatObject(ctx, "test", "test/missing")
+	require.Error(t, err)
+
+	require.Equal(t, "BYPASS", get().Header().Get("X-Cache"))
+	require.Equal(t, int32(2), gets.Load())
+}
+
+func TestCleanupSkipsNeverExpiringTenantWithoutNegativeCache(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	store, err := blobfs.Open(t.TempDir(), blobfs.DefaultConfig())
+	require.NoError(t, err)
+	defer store.Close()
+
+	_, err = store.Put(ctx, "test", "test/stale-tombstone", strings.NewReader("gone"), map[string]string{
+		"negative":       "404",
+		"negative-until": time.Now().Add(-time.Hour).Format(time.RFC3339Nano),
+	})
+	require.NoError(t, err)
+
+	resolver := &staticResolver{route: Route{ObjectPath: "test/stale-tombstone", Policy: config.PolicyImmutable}}
+	handler := NewHandler("test", RuntimeConfig{
+		Mode:        "test",
+		ExpireAfter: config.ExpirationNever,
+	}, store, resolver, NewStats(prometheus.NewRegistry()), nil)
+
+	require.NoError(t, handler.Cleanup(ctx, config.CleanupConfig{}))
+	_, err = store.StatObject(ctx, "test", "test/stale-tombstone")
+	require.NoError(t, err)
+
+	resolver.route.NegativeTTL = config.Duration(time.Minute)
+	require.NoError(t, handler.Cleanup(ctx, config.CleanupConfig{}))
+	_, err = store.StatObject(ctx, "test", "test/stale-tombstone")
+	require.Error(t, err)
+}
+
+func TestUpstreamPolicyHonorsCacheControl(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var mu sync.Mutex
+	hits := map[string]int{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits[r.Method+" "+r.URL.Path]++
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/max-age":
+			w.Header().Set("Cache-Control", "public, max-age=60")
+		case "/expired":
+			w.Header().Set("Expires", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat))
+		case "/no-store":
+			w.Header().Set("Cache-Control", "no-store")
+		case "/clamped":
+			w.Header().Set("Cache-Control", "max-age=0")
+		}
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = io.WriteString(w, "body")
+	}))
+	defer upstream.Close()
+
+	store, err := blobfs.Open(t.TempDir(), blobfs.DefaultConfig())
+	require.NoError(t, err)
+	defer store.Close()
+
+	cache := func(name string, minFreshFor config.Duration) []string {
+		handler := NewHandler("test", RuntimeConfig{
+			Mode:        "test",
+			ExpireAfter: config.ExpirationNever,
+			Upstreams:   []string{upstream.URL},
+		}, store, literalResolver{route: Route{
+			ObjectPath:   "test/" + name,
+			UpstreamPath: name,
+			Policy:       config.PolicyUpstream,
+			MinFreshFor:  minFreshFor,
+		}}, NewStats(prometheus.NewRegistry()), nil)
+		var outcomes []string
+		for i := 0; i < 2; i++ {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequestWithContext(ctx, http.MethodGet, "/"+name, nil))
+			require.Equal(t, http.StatusOK, rec.Code)
+			require.Equal(t, "body", rec.Body.String())
+			require.Empty(t, rec.Header().Get("upstream-cache-control"))
+			outcomes = append(outcomes, rec.Header().Get("X-Cache"))
+		}
+		return outcomes
+	}
+
+	require.Equal(t, []string{"MISS", "FRESH"}, cache("max-age", 0))
+	require.Equal(t, []string{"MISS", "HIT"}, cache("expired", 0))
+	require.Equal(t, []string{"BYPASS", "BYPASS"}, cache("no-store", 0))
+	require.Equal(t, []string{"MISS", "FRESH"}, cache("clamped", config.Duration(time.Minute)))
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, 1, hits["GET /max-age"])
+	require.Equal(t, 1, hits["HEAD /expired"])
+	require.Equal(t, 2, hits["GET /no-store"])
+	require.Equal(t, 1, hits["GET /clamped"])
+	_, err = store.StatObject(ctx, "test", "test/no-store")
+	require.Error(t, err)
+}
+
 func TestErrorResponseHidesInternalDetails(t *testing.T) {
 	resp := ErrorResponse(http.StatusBadGateway, errors.New("sensitive data"))
 	body, err := io.ReadAll(resp.Body)
@@ -946,6 +1362,49 @@ func TestStreamToPipeRemovesTempFileOnVerifyFailure(t *testing.T) {
 	require.Empty(t, entries)
 }
 
+func TestStreamToPipeFollowersSeeWritesAndVerification(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	body, upstream := io.Pipe()
+	inflight := NewInflightDownload()
+	var downloads sync.Map
+	var wait sync.WaitGroup
+	leader, err := StreamToPipe(ctx, StreamConfig{
+		Body:       body,
+		ObjectPath: "test/object",
+		Downloads:  &downloads,
+		Inflight:   inflight,
+		Wait:       &wait,
+		VerifyFn: func(io.ReadSeeker) error {
+			return errors.New("verify failed")
+		},
+		StoreFn: func(context.Context, io.Reader) error {
+			t.Fatal("store must not run after verify failure")
+			return nil
+		},
+	})
+	require.NoError(t, err)
+	go func() { _, _ = io.Copy(io.Discard, leader) }()
+	follower, _, err := inflight.attach(ctx)
+	require.NoError(t, err)
+	defer follower.Close()
+
+	// The first chunk reaches the follower while the upstream is still
+	// sending.
+	_, err = io.WriteString(upstream, "partial")
+	require.NoError(t, err)
+	buf := make([]byte, 16)
+	n, err := follower.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "partial", string(buf[:n]))
+
+	require.NoError(t, upstream.Close())
+	_, err = io.ReadAll(follower)
+	require.ErrorContains(t, err, "verify failed")
+	wait.Wait()
+}
+
 func TestAllUpstreamsUnavailableReturns503(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -983,3 +1442,184 @@ type roundTripFunc func(*http.Request) (*http.Response, error)
 func (fn roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
 	return fn(req)
 }
+
+func TestEvictStoreTenantsRemovesLeastRecentlyServed(t *testing.T) {
+	ctx := context.Background()
+	store, err := blobfs.Open(t.TempDir(), blobfs.DefaultConfig())
+	require.NoError(t, err)
+	defer store.Close()
+
+	base := time.Now().Add(-time.Hour)
+	for i, name := range []string{"a", "b", "c"} {
+		_, err := store.Put(ctx, "test", name, strings.NewReader("0123456789"), map[string]string{
+			"fetched-at":  base.Format(time.RFC3339Nano),
+			"accessed-at": base.Add(time.Duration(i) * time.Minute).Format(time.RFC3339Nano),
+		})
+		require.NoError(t, err)
+	}
+	_, err = store.Put(ctx, "test", "legacy", strings.NewReader("0123456789"), map[string]string{
+		"fetched-at": base.Add(30 * time.Second).Format(time.RFC3339Nano),
+	})
+	require.NoError(t, err)
+	_, err = store.Put(ctx, "test", "pushed", strings.NewReader("0123456789"), map[string]string{
+		"fetched-at": base.Add(-time.Hour).Format(time.RFC3339Nano),
+		PinnedOption: "true",
+	})
+	require.NoError(t, err)
+	_, err = store.Put(ctx, "test", "state", strings.NewReader("0123456789"), map[string]string{
+		"content-type": "application/yaml",
+	})
+	require.NoError(t, err)
+
+	var access AccessIndex
+	access.Touch("test", "a")
+	access.Touch("test", "gone")
+	at, ok := access.LastAccess("test", "a", map[string]string{"fetched-at": base.Format(time.RFC3339Nano)})
+	require.True(t, ok)
+	require.WithinDuration(t, time.Now(), at, time.Minute)
+
+	result, err := EvictStoreTenants(ctx, store, &access, []string{"test"}, nil, 55, 30, config.CleanupConfig{})
+	require.NoError(t, err)
+	require.Equal(t, int64(60), result.Usage)
+	require.Equal(t, int64(30), result.ReclaimedBytes)
+	require.Equal(t, 3, result.Evicted)
+
+	for _, name := range []string{"a", "pushed", "state"} {
+		_, err = store.StatObject(ctx, "test", name)
+		require.NoError(t, err, name)
+	}
+	for _, name := range []string{"b", "c", "legacy"} {
+		_, err = store.OpenObject(ctx, "test", name)
+		require.Error(t, err, name)
+	}
+	require.NotContains(t, access.times["test"], "gone")
+
+	require.NoError(t, store.MkdirAll("meta/", 0o755))
+	require.NoError(t, access.Save(ctx, store, "meta", "access.json"))
+	var restored AccessIndex
+	require.NoError(t, restored.Load(ctx, store, "meta", "access.json"))
+	require.True(t, access.times["test"]["a"].Equal(restored.times["test"]["a"]))
+
+	result, err = EvictStoreTenants(ctx, store, &restored, []string{"test"}, nil, 55, 30, config.CleanupConfig{})
+	require.NoError(t, err)
+	require.Zero(t, result.Evicted)
+}
+
+func TestRangeMissFillsCacheInBackground(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var mu sync.Mutex
+	var ranged, full int
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		if r.Header.Get("Range") != "" {
+			ranged++
+		} else {
+			full++
+		}
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader("0123456789"))
+	}))
+	defer upstream.Close()
+
+	store, err := blobfs.Open(t.TempDir(), blobfs.DefaultConfig())
+	require.NoError(t, err)
+	defer store.Close()
+
+	resolver := &staticResolver{route: Route{
+		ObjectPath:   "test/ranged",
+		UpstreamPath: "test/ranged",
+		Policy:       config.PolicyImmutable,
+	}}
+	handler := NewHandler("test", RuntimeConfig{
+		Mode:        "test",
+		ExpireAfter: config.Expiration(72 * time.Hour),
+		Upstreams:   []string{upstream.URL},
+	}, store, resolver, NewStats(prometheus.NewRegistry()), nil)
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequestWithContext(ctx, http.MethodGet, "/test/ranged", nil)
+	req.Header.Set("Range", "bytes=2-4")
+	handler.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusPartialContent, rec.Code)
+	require.Equal(t, "BYPASS", rec.Header().Get("X-Cache"))
+	require.Equal(t, "234", rec.Body.String())
+
+	require.Eventually(t, func() bool {
+		_, downloading := handler.downloads.Load("test/ranged")
+		return !downloading
+	}, 5*time.Second, 10*time.Millisecond)
+
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequestWithContext(ctx, http.MethodGet, "/test/ranged", nil)
+	req.Header.Set("Range", "bytes=5-7")
+	handler.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusPartialContent, rec.Code)
+	require.Equal(t, "HIT", rec.Header().Get("X-Cache"))
+	require.Equal(t, "567", rec.Body.String())
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, 1, ranged)
+	require.Equal(t, 1, full)
+}
+
+func TestConcurrentMissesShareInflightDownload(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	payload := strings.Repeat("0123456789", 8<<10)
+	var gets atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		gets.Add(1)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Length", strconv.Itoa(len(payload)))
+		half := len(payload) / 2
+		_, _ = io.WriteString(w, payload[:half])
+		w.(http.Flusher).Flush()
+		time.Sleep(200 * time.Millisecond)
+		_, _ = io.WriteString(w, payload[half:])
+	}))
+	defer upstream.Close()
+
+	store, err := blobfs.Open(t.TempDir(), blobfs.DefaultConfig())
+	require.NoError(t, err)
+	defer store.Close()
+
+	resolver := &staticResolver{route: Route{
+		ObjectPath:   "test/shared",
+		UpstreamPath: "test/shared",
+		Policy:       config.PolicyRevalidate,
+	}}
+	handler := NewHandler("test", RuntimeConfig{
+		Mode:        "test",
+		ExpireAfter: config.Expiration(72 * time.Hour),
+		Upstreams:   []string{upstream.URL},
+	}, store, resolver, NewStats(prometheus.NewRegistry()), nil)
+
+	var wg sync.WaitGroup
+	bodies := make([]string, 8)
+	for i := range bodies {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequestWithContext(ctx, http.MethodGet, "/test/shared", nil))
+			bodies[i] = rec.Body.String()
+		}()
+	}
+	wg.Wait()
+
+	for _, body := range bodies {
+		require.Equal(t, payload, body)
+	}
+	require.Equal(t, int32(1), gets.Load())
+}
@@ -3,6 +3,7 @@ package httpcache
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"io"
 	"mime"
 	"net/http"
@@ -13,11 +14,14 @@ import (
 	"sync"
 	"time"
 
+	"gopkg.d7z.net/cache-proxy/pkg/config"
+	"gopkg.d7z.net/cache-proxy/pkg/proxy/shared/deny"
 	"gopkg.d7z.net/cache-proxy/pkg/utils"
 )
 
 var internalHeaders = map[string]struct{}{
 	"fetched-at":                {},
+	"accessed-at":               {},
 	"mode":                      {},
 	"cache":                     {},
 	"indexed":                   {},
@@ -29,6 +33,12 @@ var internalHeaders = map[string]struct{}{
 	"indexed-digest":            {},
 	"indexed-digest-verifiable": {},
 	"source-upstream":           {},
+	"negative":                  {},
+	"negative-until":            {},
+	"upstream-cache-control":    {},
+	"upstream-expires":          {},
+	"upstream-date":             {},
+	"upstream-age":              {},
 }
 
 func StripInternal(headers map[string]string) {
@@ -51,10 +61,13 @@ func (h *Handler) addCacheDebugHeaders(headers map[string]string, route Route, f
 	if !expireAfter.IsNever() && !expireAfter.IsUnset() {
 		headers["X-Cache-Expires-At"] = t.Add(expireAfter.Duration()).UTC().Format(time.RFC3339)
 	}
-	freshFor := route.FreshFor
-	if freshFor.IsUnset() {
-		freshFor = h.config.DefaultFreshFor
+	if route.Policy == config.PolicyUpstream {
+		if age, ok := upstreamAge(headers); ok {
+			headers["X-Cache-Fresh-Until"] = time.Now().Add(h.upstreamLifetime(route, headers) - age).UTC().Format(time.RFC3339)
+		}
+		return
 	}
+	freshFor := h.freshFor(route)
 	if freshFor > 0 && !freshFor.IsForever() {
 		headers["X-Cache-Fresh-Until"] = t.Add(freshFor.Duration()).UTC().Format(time.RFC3339)
 	}
@@ -81,11 +94,18 @@ func (h *Handler) expired(route Route, options map[string]string) bool {
 	return err == nil && time.Since(fetchedAt) > expireAfter.Duration()
 }
 
+func (h *Handler) freshFor(route Route) config.Freshness {
+	if route.FreshFor.IsUnset() {
+		return h.config.DefaultFreshFor
+	}
+	return route.FreshFor
+}
+
 func (h *Handler) fresh(route Route, headers map[string]string) bool {
-	freshFor := route.FreshFor
-	if freshFor.IsUnset() {
-		freshFor = h.config.DefaultFreshFor
+	if route.Policy == config.PolicyUpstream {
+		return h.upstreamFresh(route, headers)
 	}
+	freshFor := h.freshFor(route)
 	if freshFor.IsUnset() {
 		return false
 	}
@@ -96,6 +116,37 @@ func (h *Handler) fresh(route Route, headers map[string]string) bool {
 	return err == nil && time.Since(fetchedAt) <= freshFor.Duration()
 }
 
+func (h *Handler) staleWindows(route Route) config.StaleWindows {
+	return route.Stale.Merge(h.config.DefaultStale)
+}
+
+// withinStale reports whether the cached copy is at most window past its
+// freshness lifetime.
+func (h *Handler) withinStale(route Route, headers map[string]string, window config.Freshness) bool {
+	if window.IsUnset() {
+		return false
+	}
+	if window.IsForever() {
+		return true
+	}
+	if route.Policy == config.PolicyUpstream {
+		age, ok := upstreamAge(headers)
+		if !ok || upstreamMustRevalidate(headers) {
+			return false
+		}
+		return age-h.upstreamLifetime(route, headers) <= window.Duration()
+	}
+	fetchedAt, err := utils.ParseFetchedAt(headers["fetched-at"])
+	if err != nil {
+		return false
+	}
+	age := time.Since(fetchedAt)
+	if freshFor := h.freshFor(route); freshFor > 0 {
+		age -= freshFor.Duration()
+	}
+	return age <= window.Duration()
+}
+
 func (h *Handler) busyPolicy(route Route) string {
 	if route.BusyPolicy != "" {
 		return route.BusyPolicy
@@ -122,6 +173,12 @@ func ErrorResponse(status int, err error) *utils.ResponseWrapper {
 	return &utils.ResponseWrapper{StatusCode: status, Headers: map[string]string{"Content-Type": "text/plain; charset=utf-8", "X-Cache": "ERROR"}, Body: io.NopCloser(strings.NewReader(body))}
 }
 
+func deniedResponse(message string) *utils.ResponseWrapper {
+	response := ErrorResponse(http.StatusForbidden, errors.New(message))
+	response.Headers["X-Cache"] = deny.Cache
+	return response
+}
+
 func responseFromHTTP(client *utils.HttpClientWrapper, response *http.Response) *utils.ResponseWrapper {
 	body := client.WrapBody(response.Body)
 	return &utils.ResponseWrapper{StatusCode: response.StatusCode, Headers: copyHeaders(response.Header), Body: utils.NewRateLimitReader(body)}
@@ -146,6 +203,11 @@ func copyHeaders(headers http.Header) map[string]string {
 			result[key] = value
 		}
 	}
+	for _, key := range freshnessHeaders {
+		if value := headers.Get(key); value != "" {
+			result[freshnessKey(key)] = value
+		}
+	}
 	return result
 }
 
@@ -170,7 +232,8 @@ func ResponseBytes(headers map[string]string) uint64 {
 }
 
 func metadata(headers map[string]string, mode, status string) map[string]string {
-	result := map[string]string{"mode": mode, "cache": status, "fetched-at": time.Now().UTC().Format(time.RFC3339Nano)}
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	result := map[string]string{"mode": mode, "cache": status, "fetched-at": now, "accessed-at": now}
 	for _, key := range []string{"Content-Type", "Content-Length", "Last-Modified", "ETag", "Docker-Content-Digest"} {
 		if value := headers[key]; value != "" {
 			result[strings.ToLower(key)] = value
@@ -0,0 +1,198 @@
+package httpcache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"maps"
+	"os"
+	"sync"
+)
+
+var errInflightAborted = errors.New("in-flight download aborted")
+
+// InflightDownload tracks an object download so concurrent requests can read
+// the leader's temp file as it grows instead of fetching upstream again.
+type InflightDownload struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	headers   map[string]string
+	tempPath  string
+	written   int64
+	streaming bool
+	complete  bool
+	closed    bool
+	err       error
+	followers int
+}
+
+func NewInflightDownload() *InflightDownload {
+	d := &InflightDownload{}
+	d.cond = sync.NewCond(&d.mu)
+	return d
+}
+
+func (d *InflightDownload) setHeaders(headers map[string]string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	d.headers = maps.Clone(headers)
+	d.mu.Unlock()
+}
+
+func (d *InflightDownload) publish(tempPath string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	d.tempPath = tempPath
+	d.streaming = true
+	d.cond.Broadcast()
+	d.mu.Unlock()
+}
+
+func (d *InflightDownload) advance(n int) {
+	if d == nil || n <= 0 {
+		return
+	}
+	d.mu.Lock()
+	d.written += int64(n)
+	d.cond.Broadcast()
+	d.mu.Unlock()
+}
+
+func (d *InflightDownload) markComplete() {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	d.complete = true
+	d.cond.Broadcast()
+	d.mu.Unlock()
+}
+
+// finish releases waiting followers; it must run before the temp file is removed.
+func (d *InflightDownload) finish(err error) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	if !d.complete && d.err == nil {
+		d.err = err
+		if d.streaming && err == nil {
+			d.err = errInflightAborted
+		}
+	}
+	d.closed = true
+	d.cond.Broadcast()
+	d.mu.Unlock()
+}
+
+func (d *InflightDownload) hasFollowers() bool {
+	if d == nil {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.followers > 0
+}
+
+// attach waits until the leader starts streaming and returns a reader over the
+// temp file. A nil reader with a nil error means the leader finished without
+// streaming and the cached object should be opened instead.
+func (d *InflightDownload) attach(ctx context.Context) (io.ReadCloser, map[string]string, error) {
+	stop := context.AfterFunc(ctx, func() {
+		d.mu.Lock()
+		d.cond.Broadcast()
+		d.mu.Unlock()
+	})
+	d.mu.Lock()
+	for !d.streaming && !d.closed && ctx.Err() == nil {
+		d.cond.Wait()
+	}
+	if err := ctx.Err(); err != nil {
+		d.mu.Unlock()
+		stop()
+		return nil, nil, err
+	}
+	if d.closed {
+		err := d.err
+		d.mu.Unlock()
+		stop()
+		return nil, nil, err
+	}
+	file, err := os.Open(d.tempPath)
+	if err != nil {
+		d.mu.Unlock()
+		stop()
+		return nil, nil, err
+	}
+	d.followers++
+	headers := maps.Clone(d.headers)
+	d.mu.Unlock()
+	return &inflightReader{ctx: ctx, download: d, file: file, stop: stop}, headers, nil
+}
+
+type inflightReader struct {
+	ctx      context.Context
+	download *InflightDownload
+	file     *os.File
+	offset   int64
+	stop     func() bool
+	once     sync.Once
+}
+
+func (r *inflightReader) Read(p []byte) (int, error) {
+	d := r.download
+	d.mu.Lock()
+	for r.offset >= d.written && !d.complete && !d.closed && r.ctx.Err() == nil {
+		d.cond.Wait()
+	}
+	written, complete, failure := d.written, d.complete, d.err
+	d.mu.Unlock()
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if r.offset >= written {
+		if complete {
+			return 0, io.EOF
+		}
+		if failure == nil {
+			failure = errInflightAborted
+		}
+		return 0, failure
+	}
+	if remaining := written - r.offset; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := r.file.ReadAt(p, r.offset)
+	r.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *inflightReader) Close() error {
+	var err error
+	r.once.Do(func() {
+		r.stop()
+		err = r.file.Close()
+		r.download.mu.Lock()
+		r.download.followers--
+		r.download.mu.Unlock()
+	})
+	return err
+}
+
+type inflightWriter struct {
+	file     *os.File
+	download *InflightDownload
+}
+
+func (w inflightWriter) Write(p []byte) (int, error) {
+	n, err := w.file.Write(p)
+	w.download.advance(n)
+	return n, err
+}
@@ -88,6 +88,7 @@ type instanceEntry struct {
 type Stats struct {
 	instances sync.Map // string -> *instanceEntry
 	mc        *metricsCollector
+	access    AccessIndex
 
 	totalRequests      atomic.Uint64
 	totalErrors        atomic.Uint64
@@ -162,6 +163,14 @@ func NewStats(reg prometheus.Registerer) *Stats {
 	}
 }
 
+// Access returns the index of when cached objects were last served.
+func (s *Stats) Access() *AccessIndex {
+	if s == nil {
+		return nil
+	}
+	return &s.access
+}
+
 func (s *Stats) RecordRequest(instance, mode, method, cache string, status int, bytes uint64) {
 	if s == nil {
 		return
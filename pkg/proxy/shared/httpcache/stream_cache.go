@@ -1,7 +1,6 @@
 package httpcache
 
 import (
-	"bufio"
 	"context"
 	"io"
 	"log/slog"
@@ -14,6 +13,7 @@ type StreamConfig struct {
 	Instance   string
 	ObjectPath string
 	Downloads  *sync.Map
+	Inflight   *InflightDownload
 	Wait       *sync.WaitGroup
 	Limiter    *DownloadLimiter
 	StatsStart func()
@@ -41,6 +41,7 @@ func StreamToPipe(ctx context.Context, cfg StreamConfig) (io.ReadCloser, error)
 		cfg.StatsStart()
 	}
 	slog.Debug("download started", "path", cfg.ObjectPath, "temp", tempFile.Name())
+	cfg.Inflight.publish(tempFile.Name())
 	storeCtx := context.WithoutCancel(ctx)
 	go func() {
 		defer func() {
@@ -57,40 +58,70 @@ func StreamToPipe(ctx context.Context, cfg StreamConfig) (io.ReadCloser, error)
 			tempFile.Close()
 			os.Remove(tempFile.Name())
 		}()
+		var copyErr error
+		defer func() { cfg.Inflight.finish(copyErr) }()
 		if cfg.StatsDone != nil {
 			defer cfg.StatsDone()
 		}
 
-		bw := bufio.NewWriterSize(tempFile, 256<<10)
-		tee := io.TeeReader(cfg.Body, bw)
-		if _, copyErr := io.Copy(pw, tee); copyErr == nil {
-			if err := bw.Flush(); err != nil {
-				slog.Warn("download temp flush failed", "path", cfg.ObjectPath, "err", err)
-				return
-			}
-			if _, seekErr := tempFile.Seek(0, io.SeekStart); seekErr != nil {
-				slog.Warn("download temp rewind failed", "path", cfg.ObjectPath, "err", seekErr)
+		// Followers read the temp file up to the bytes written so far and
+		// see the end only once the download is verified.
+		temp := inflightWriter{file: tempFile, download: cfg.Inflight}
+		if copyErr = teeDownload(pw, temp, cfg.Body, cfg.Inflight); copyErr != nil {
+			slog.Debug("download aborted", "path", cfg.ObjectPath, "err", copyErr)
+			return
+		}
+		if _, copyErr = tempFile.Seek(0, io.SeekStart); copyErr != nil {
+			slog.Warn("download temp rewind failed", "path", cfg.ObjectPath, "err", copyErr)
+			return
+		}
+		if cfg.VerifyFn != nil {
+			if copyErr = cfg.VerifyFn(tempFile); copyErr != nil {
+				slog.Warn("cache store verification failed", "path", cfg.ObjectPath, "err", copyErr)
 				return
 			}
-			if cfg.VerifyFn != nil {
-				if err := cfg.VerifyFn(tempFile); err != nil {
-					slog.Warn("cache store verification failed", "path", cfg.ObjectPath, "err", err)
-					return
-				}
-				if _, seekErr := tempFile.Seek(0, io.SeekStart); seekErr != nil {
-					slog.Warn("download temp rewind failed", "path", cfg.ObjectPath, "err", seekErr)
-					return
-				}
-			}
-			if err := cfg.StoreFn(storeCtx, tempFile); err != nil {
-				slog.Warn("cache store write failed", "path", cfg.ObjectPath, "err", err)
+			if _, copyErr = tempFile.Seek(0, io.SeekStart); copyErr != nil {
+				slog.Warn("download temp rewind failed", "path", cfg.ObjectPath, "err", copyErr)
 				return
 			}
-			slog.Debug("download completed", "path", cfg.ObjectPath)
-		} else {
-			slog.Debug("download aborted", "path", cfg.ObjectPath, "err", copyErr)
 		}
+		cfg.Inflight.markComplete()
+		if err := cfg.StoreFn(storeCtx, tempFile); err != nil {
+			slog.Warn("cache store write failed", "path", cfg.ObjectPath, "err", err)
+			return
+		}
+		slog.Debug("download completed", "path", cfg.ObjectPath)
 	}()
 
 	return pr, nil
 }
+
+// teeDownload copies the upstream body into the temp file and the leader's
+// pipe. If the leader goes away while followers are attached, the download
+// continues into the temp file only.
+func teeDownload(pw *io.PipeWriter, temp io.Writer, body io.Reader, inflight *InflightDownload) error {
+	buf := make([]byte, 32<<10)
+	leader := true
+	for {
+		n, readErr := body.Read(buf)
+		if n > 0 {
+			if _, err := temp.Write(buf[:n]); err != nil {
+				return err
+			}
+			if leader {
+				if _, err := pw.Write(buf[:n]); err != nil {
+					if !inflight.hasFollowers() {
+						return err
+					}
+					leader = false
+				}
+			}
+		}
+		if readErr == io.EOF {
+			return nil
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+}
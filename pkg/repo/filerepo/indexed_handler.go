@@ -73,10 +73,11 @@ func NewIndexedHandler(name, mode, objectRoot string, inspector PathInspector, u
 		Transport:       transport,
 		PassHeaders:     append([]string(nil), policy.PassHeaders...),
 		BusyPolicy:      policy.AuxiliaryBusyPolicy,
+		DefaultStale:    policy.StaleWindows,
 		DownloadLimiter: downloads,
 	}, store, &generationResolver{handler: handler, policy: policy}, stats, svcHealth)
 	handler.client = utils.DefaultHttpClientWrapper()
-	httpcache.ConfigureClientTransport(handler.client, name, transport)
+	httpcache.ConfigureClientTransport(handler.client, name, upstreams, transport)
 	handler.reportMetadataState()
 	return handler
 }
@@ -214,3 +214,22 @@ func (h *IndexedHandler) currentPath(rootID string) string {
 func (h *IndexedHandler) snapshotPath(rootID, generation string) string {
 	return path.Join(h.objectRoot, ".roots", pathEscapeKey(rootID), "snapshots", generation+".yaml")
 }
+
+// PurgePath maps generation-scoped artifact and auxiliary objects back to their
+// request path. Generation metadata and root state are left to refresh and GC.
+func (h *IndexedHandler) PurgePath(objectPath string) (string, bool) {
+	rest, ok := strings.CutPrefix(objectPath, path.Join(h.objectRoot, ".roots")+"/")
+	if !ok {
+		return objectPath, true
+	}
+	parts := strings.SplitN(rest, "/", 5)
+	if len(parts) != 5 || parts[1] != "generations" {
+		return "", false
+	}
+	switch parts[3] {
+	case "artifacts", "auxiliary":
+		return parts[4], true
+	default:
+		return "", false
+	}
+}
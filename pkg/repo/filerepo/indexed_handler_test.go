@@ -1290,3 +1290,16 @@ func TestRefreshSkipsRebuildWhenMetadataHeadReturns200(t *testing.T) {
 	require.NoError(t, handler.RefreshRoot(ctx, "root"))
 	require.Equal(t, 2, builderCalls, "should rebuild since ETag changed")
 }
+
+func TestPurgePathMapsGenerationScopedObjects(t *testing.T) {
+	h := &IndexedHandler{objectRoot: "deb"}
+	artifact := h.generationContentPath("root", "g1", ResourceArtifact, "pool/main/a.deb")
+	cleanPath, ok := h.PurgePath(artifact)
+	require.True(t, ok)
+	require.Equal(t, "pool/main/a.deb", cleanPath)
+
+	_, ok = h.PurgePath(h.generationMetadataPath("root", "g1", "dists/stable/Release"))
+	require.False(t, ok)
+	_, ok = h.PurgePath(h.currentPath("root"))
+	require.False(t, ok)
+}
@@ -8,6 +8,8 @@ import (
 )
 
 type Policy struct {
+	config.StaleWindows `yaml:",inline"`
+
 	PassHeaders          []string          `json:"passHeaders,omitempty" yaml:"pass_headers,omitempty"`
 	ArtifactPolicy       string            `json:"artifactPolicy,omitempty" yaml:"artifact_policy,omitempty"`
 	ArtifactFreshFor     config.Freshness  `json:"artifactFreshFor,omitempty" yaml:"artifact_fresh_for,omitempty"`
@@ -20,6 +22,8 @@ type Policy struct {
 }
 
 type BasicPolicy struct {
+	config.StaleWindows `yaml:",inline"`
+
 	PassHeaders          []string          `json:"passHeaders,omitempty" yaml:"pass_headers,omitempty"`
 	ArtifactPolicy       string            `json:"artifactPolicy,omitempty" yaml:"artifact_policy,omitempty"`
 	ArtifactFreshFor     config.Freshness  `json:"artifactFreshFor,omitempty" yaml:"artifact_fresh_for,omitempty"`
@@ -42,6 +46,7 @@ func (p BasicPolicy) AsPolicy() *Policy {
 		AuxiliaryFreshFor:    p.AuxiliaryFreshFor,
 		AuxiliaryBusyPolicy:  p.AuxiliaryBusyPolicy,
 		AuxiliaryExpireAfter: p.AuxiliaryExpireAfter,
+		StaleWindows:         p.StaleWindows,
 	}
 }
 
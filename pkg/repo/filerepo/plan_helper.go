@@ -64,6 +64,7 @@ func PlanRepoMode(
 	sh := health.New(plan.Name(), mode, healthCfg, upstreams, plan.Stats(), probeUserAgent)
 	sh.SetProbeScheduler(plan.ProbeScheduler())
 	sh.SetBus(plan.Bus())
+	httpcache.ConfigureProbeTransport(sh, plan.Name(), block.Transport)
 	handler := NewIndexedHandler(
 		plan.Name(),
 		mode,
@@ -2,6 +2,7 @@ package runtime
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
@@ -16,6 +17,7 @@ import (
 	"gopkg.d7z.net/cache-proxy/pkg/bus"
 	"gopkg.d7z.net/cache-proxy/pkg/config"
 	"gopkg.d7z.net/cache-proxy/pkg/health"
+	"gopkg.d7z.net/cache-proxy/pkg/proxy/shared/deny"
 	"gopkg.d7z.net/cache-proxy/pkg/proxy/shared/httpcache"
 	"gopkg.d7z.net/cache-proxy/pkg/scheduler"
 )
@@ -33,6 +35,13 @@ type StatusSource interface {
 	DashboardStatus() (color, label, extra string)
 }
 
+// PurgeMapper lets an Instance with generation-scoped storage map a stored
+// object back to the request path it serves. Objects reported as not ok are
+// never purged.
+type PurgeMapper interface {
+	PurgePath(objectPath string) (string, bool)
+}
+
 type RepositoryAttribute struct {
 	LabelKey string
 	Value    string
@@ -111,7 +120,9 @@ type Entry struct {
 	Enabled     bool
 	Path        string
 	Bind        string
+	TLS         *config.TLSConfig
 	ExpireAfter config.Expiration
+	Quota       config.Size
 	Runtime     Instance
 	Home        HomeEntry
 	Ctx         context.Context
@@ -142,6 +153,7 @@ type InstancePlan struct {
 	decl     config.Instance
 	selected config.SelectedMode
 	entry    *Entry
+	deny     *deny.List
 	bound    bool
 }
 
@@ -180,17 +192,37 @@ func (p *PlanContext) Instance(decl config.Instance, selected config.SelectedMod
 	if _, exists := p.entries[name]; exists {
 		return nil, fmt.Errorf("duplicate instance name %q", name)
 	}
+	denyList, err := deny.Parse(selected.Mode, decl.Deny)
+	if err != nil {
+		return nil, fmt.Errorf("instance %s: %w", name, err)
+	}
+	if err := validateReleaseAge(selected.Mode, decl.MinReleaseAge); err != nil {
+		return nil, fmt.Errorf("instance %s: %w", name, err)
+	}
 	entry := &Entry{
 		Name:    name,
 		Mode:    selected.Mode,
 		Enabled: selected.Enabled,
+		Quota:   decl.Quota,
 		Home: HomeEntry{
 			Name: name,
 			Mode: selected.Mode,
 		},
 	}
 	p.entries[name] = entry
-	return &InstancePlan{ctx: p, decl: decl, selected: selected, entry: entry}, nil
+	return &InstancePlan{ctx: p, decl: decl, selected: selected, entry: entry, deny: denyList}, nil
+}
+
+// validateReleaseAge accepts min_release_age only in modes whose metadata
+// carries publish times.
+func validateReleaseAge(mode string, age config.Duration) error {
+	switch {
+	case age < 0:
+		return errors.New("min_release_age must not be negative")
+	case age == 0, mode == config.ModeNPM, mode == config.ModePyPI, mode == config.ModeCargo:
+		return nil
+	}
+	return fmt.Errorf("min_release_age is not supported in %s mode", mode)
 }
 
 func (p *PlanContext) Finalize() (*Result, error) {
@@ -230,6 +262,8 @@ func (i *InstancePlan) CleanupConfig() config.CleanupConfig    { return i.ctx.cl
 func (i *InstancePlan) Scheduler() *scheduler.Scheduler        { return i.ctx.scheduler }
 func (i *InstancePlan) ProbeScheduler() *health.ProbeScheduler { return i.ctx.probes }
 func (i *InstancePlan) Bus() *bus.Bus                          { return i.ctx.bus }
+func (i *InstancePlan) Deny() *deny.List                       { return i.deny }
+func (i *InstancePlan) MinReleaseAge() time.Duration           { return i.decl.MinReleaseAge.Duration() }
 
 func (i *InstancePlan) Decode(target any) error {
 	if i.selected.Block == nil {
@@ -255,6 +289,11 @@ func (i *InstancePlan) BindAddr(addr string, expireAfter config.Expiration, runt
 	return nil
 }
 
+// SetBindTLS serves the instance's dedicated bind over TLS.
+func (i *InstancePlan) SetBindTLS(tls *config.TLSConfig) {
+	i.entry.TLS = tls
+}
+
 func (i *InstancePlan) SetHomeSnippet(snippet string) {
 	i.entry.Home.Snippet = strings.TrimSpace(snippet)
 }
@@ -3,6 +3,7 @@ package scheduler
 import (
 	"context"
 	"errors"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -18,8 +19,10 @@ type TaskType string
 const (
 	TypeBlobGC          TaskType = "blob_gc"
 	TypeExpireCleanup   TaskType = "expire_cleanup"
+	TypeQuotaEvict      TaskType = "quota_evict"
 	TypeMetadataRefresh TaskType = "metadata_refresh"
 	TypeMetadataGC      TaskType = "metadata_gc"
+	TypeCacheWarm       TaskType = "cache_warm"
 )
 
 type TaskStatus string
@@ -36,10 +39,11 @@ type TaskHandler func(ctx context.Context) (*TaskOutcome, error)
 
 // TaskOutcome describes the semantic result of a completed task.
 type TaskOutcome struct {
-	Result     string
-	ReasonCode string
-	Detail     string
-	Message    string
+	Result         string
+	ReasonCode     string
+	Detail         string
+	Message        string
+	ReclaimedBytes int64
 }
 
 var ErrTaskSkipped = errors.New("task skipped")
@@ -80,7 +84,9 @@ func (k TaskKey) RootID() string   { return k.rootID }
 type TaskDef struct {
 	Key      TaskKey
 	Interval time.Duration
-	Handler  TaskHandler
+	// Timeout bounds the run time of a job passed to Submit.
+	Timeout time.Duration
+	Handler TaskHandler
 }
 
 type TaskInfo struct {
@@ -95,15 +101,16 @@ type TaskInfo struct {
 }
 
 type TaskRun struct {
-	Key        TaskKey
-	StartedAt  time.Time
-	FinishedAt time.Time
-	Duration   time.Duration
-	Result     string
-	ReasonCode string
-	Detail     string
-	Message    string
-	Err        string
+	Key            TaskKey
+	StartedAt      time.Time
+	FinishedAt     time.Time
+	Duration       time.Duration
+	Result         string
+	ReasonCode     string
+	Detail         string
+	Message        string
+	ReclaimedBytes int64
+	Err            string
 }
 
 type TaskFactory struct {
@@ -131,6 +138,7 @@ const (
 	cmdUnregister
 	cmdInfo
 	cmdSnapshot
+	cmdUnregisterInstance
 )
 
 type cmd struct {
@@ -163,6 +171,9 @@ type Scheduler struct {
 	runObserver   func(TaskRun)
 	observerMu    sync.RWMutex
 
+	jobsMu sync.Mutex
+	jobs   map[TaskKey]context.CancelFunc
+
 	ctx    context.Context
 	cancel context.CancelFunc
 	wg     sync.WaitGroup
@@ -230,6 +241,45 @@ func (s *Scheduler) Unregister(key TaskKey) {
 	<-respCh
 }
 
+// UnregisterInstance removes every task and the metadata factory of instance.
+func (s *Scheduler) UnregisterInstance(instance string) {
+	if s.stopped.Load() {
+		return
+	}
+	if s.withPreStart(func() {
+		delete(s.factories, instance)
+		for key := range s.preStartTasks {
+			if key.Instance() == instance {
+				delete(s.preStartTasks, key)
+			}
+		}
+	}) {
+		return
+	}
+	<-s.startGate
+	respCh := make(chan any, 1)
+	s.cmdCh <- cmd{kind: cmdUnregisterInstance, key: NewTaskKey(instance, "", ""), respCh: respCh}
+	<-respCh
+}
+
+// Pending returns the tasks and factories registered before Start, so a plan
+// can be staged on an unstarted scheduler and moved to a running one.
+func (s *Scheduler) Pending() ([]TaskDef, []TaskFactory) {
+	s.startMu.Lock()
+	defer s.startMu.Unlock()
+	defs := make([]TaskDef, 0, len(s.preStartTasks))
+	for _, def := range s.preStartTasks {
+		defs = append(defs, def)
+	}
+	sort.Slice(defs, func(i, j int) bool { return defs[i].Key.String() < defs[j].Key.String() })
+	factories := make([]TaskFactory, 0, len(s.factories))
+	for _, factory := range s.factories {
+		factories = append(factories, *factory)
+	}
+	sort.Slice(factories, func(i, j int) bool { return factories[i].Instance < factories[j].Instance })
+	return defs, factories
+}
+
 func (s *Scheduler) Info(key TaskKey) (TaskInfo, bool) {
 	if s.stopped.Load() {
 		return TaskInfo{}, false
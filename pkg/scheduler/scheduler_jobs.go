@@ -0,0 +1,114 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+var (
+	ErrJobRunning       = errors.New("job already running")
+	ErrSchedulerStopped = errors.New("scheduler not running")
+)
+
+// Submit runs def once in its own goroutine so long jobs do not hold up
+// periodic tasks. A positive Timeout bounds the job's run time; the job also
+// stops when Cancel is called for its key or the scheduler stops.
+func (s *Scheduler) Submit(def TaskDef) error {
+	if s.stopped.Load() {
+		return ErrSchedulerStopped
+	}
+	s.startMu.Lock()
+	started := s.started
+	s.startMu.Unlock()
+	if !started {
+		return ErrSchedulerStopped
+	}
+	s.jobsMu.Lock()
+	if _, running := s.jobs[def.Key]; running {
+		s.jobsMu.Unlock()
+		return ErrJobRunning
+	}
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if def.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(s.ctx, def.Timeout)
+	} else {
+		ctx, cancel = context.WithCancel(s.ctx)
+	}
+	if s.jobs == nil {
+		s.jobs = map[TaskKey]context.CancelFunc{}
+	}
+	s.jobs[def.Key] = cancel
+	s.jobsMu.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer func() {
+			s.jobsMu.Lock()
+			delete(s.jobs, def.Key)
+			s.jobsMu.Unlock()
+			cancel()
+		}()
+		start := time.Now()
+		outcome, err := safeCall(ctx, def.Handler)
+		s.finishJob(def.Key, start, time.Since(start), outcome, err)
+	}()
+	return nil
+}
+
+// Cancel stops a submitted job. It reports whether a job was running.
+func (s *Scheduler) Cancel(key TaskKey) bool {
+	s.jobsMu.Lock()
+	cancel, ok := s.jobs[key]
+	s.jobsMu.Unlock()
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+func (s *Scheduler) finishJob(key TaskKey, start time.Time, dur time.Duration, outcome *TaskOutcome, err error) {
+	run := TaskRun{
+		Key:        key,
+		StartedAt:  start,
+		FinishedAt: start.Add(dur),
+		Duration:   dur,
+		Result:     "success",
+	}
+	if outcome != nil {
+		run.ReasonCode = outcome.ReasonCode
+		run.Detail = outcome.Detail
+		run.Message = outcome.Message
+		run.ReclaimedBytes = outcome.ReclaimedBytes
+		if outcome.Result != "" {
+			run.Result = outcome.Result
+		}
+	}
+	if err != nil {
+		run.Err = taskErrorString(err)
+		switch {
+		case errors.Is(err, context.Canceled):
+			run.Result = "cancelled"
+		case errors.Is(err, context.DeadlineExceeded):
+			run.Result = "timeout"
+		case errors.Is(err, errHandlerPanic):
+			run.Result = "panic"
+		default:
+			run.Result = "failed"
+		}
+		slog.Info("scheduler job failed", "key", key.String(), "err", err, "duration", dur)
+	}
+	if s.m != nil {
+		s.m.runs.WithLabelValues(key.Instance(), string(key.Type()), run.Result).Inc()
+		s.m.duration.WithLabelValues(key.Instance(), string(key.Type()), run.Result).Observe(dur.Seconds())
+	}
+	s.observerMu.RLock()
+	runObserver := s.runObserver
+	s.observerMu.RUnlock()
+	if runObserver != nil {
+		runObserver(run)
+	}
+}
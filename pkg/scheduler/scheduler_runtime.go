@@ -59,6 +59,17 @@ func (s *Scheduler) handleCmd(c cmd) {
 		s.refreshMetrics()
 		s.saveState()
 		c.respCh <- struct{}{}
+	case cmdUnregisterInstance:
+		instance := c.key.Instance()
+		delete(s.factories, instance)
+		for key := range s.tasks {
+			if key.Instance() == instance {
+				s.unregisterLocked(key, "removed")
+			}
+		}
+		s.refreshMetrics()
+		s.saveState()
+		c.respCh <- struct{}{}
 	case cmdInfo:
 		ts, ok := s.tasks[c.key]
 		if ok {
@@ -250,11 +261,13 @@ func (s *Scheduler) execute(ts *taskState) {
 
 	result := "success"
 	var reasonCode, detail, message string
+	var reclaimed int64
 	if outcome != nil {
 		result = outcome.Result
 		reasonCode = outcome.ReasonCode
 		detail = outcome.Detail
 		message = outcome.Message
+		reclaimed = outcome.ReclaimedBytes
 	}
 	if result == "" {
 		result = "success"
@@ -311,15 +324,16 @@ func (s *Scheduler) execute(ts *taskState) {
 	s.observerMu.RUnlock()
 	if runObserver != nil {
 		runObserver(TaskRun{
-			Key:        ts.Key,
-			StartedAt:  start,
-			FinishedAt: start.Add(dur),
-			Duration:   dur,
-			Result:     result,
-			ReasonCode: reasonCode,
-			Detail:     detail,
-			Message:    message,
-			Err:        ts.LastError,
+			Key:            ts.Key,
+			StartedAt:      start,
+			FinishedAt:     start.Add(dur),
+			Duration:       dur,
+			Result:         result,
+			ReasonCode:     reasonCode,
+			Detail:         detail,
+			Message:        message,
+			ReclaimedBytes: reclaimed,
+			Err:            ts.LastError,
 		})
 	}
 
@@ -441,7 +455,7 @@ func (s *Scheduler) refreshMetrics() {
 		}
 	}
 	for inst := range s.metricInstances {
-		for _, typ := range []TaskType{TypeBlobGC, TypeExpireCleanup, TypeMetadataRefresh, TypeMetadataGC} {
+		for _, typ := range []TaskType{TypeBlobGC, TypeExpireCleanup, TypeQuotaEvict, TypeMetadataRefresh, TypeMetadataGC} {
 			key := [2]string{inst, string(typ)}
 			s.m.active.WithLabelValues(inst, string(typ)).Set(active[key])
 			s.m.nextDelay.WithLabelValues(inst, string(typ)).Set(nextDelay[key])
@@ -137,6 +137,25 @@ func TestRegisterAndUnregisterAfterStart(t *testing.T) {
 	require.NoError(t, sched.Stop(context.Background()))
 }
 
+func TestUnregisterInstanceRemovesOnlyThatInstance(t *testing.T) {
+	sched, _ := newTestScheduler(t, newTestStore(t))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sched.Start(ctx)
+
+	gone := NewTaskKey("gone", TypeExpireCleanup, "")
+	kept := NewTaskKey("kept", TypeExpireCleanup, "")
+	sched.Register(TaskDef{Key: gone, Interval: time.Hour, Handler: noopTask})
+	sched.Register(TaskDef{Key: kept, Interval: time.Hour, Handler: noopTask})
+
+	sched.UnregisterInstance("gone")
+	_, ok := sched.Info(gone)
+	require.False(t, ok)
+	_, ok = sched.Info(kept)
+	require.True(t, ok)
+	require.NoError(t, sched.Stop(context.Background()))
+}
+
 func TestTaskOutcomeDefaultsToSuccess(t *testing.T) {
 	sched, _ := newTestScheduler(t, newTestStore(t))
 	ctx, cancel := context.WithCancel(context.Background())
@@ -702,3 +721,65 @@ func TestStopTimeoutMarksStopped(t *testing.T) {
 
 	require.True(t, sched.stopped.Load(), "stopped flag should be set after timeout")
 }
+
+func TestSubmitRunsJobAndCancelStopsIt(t *testing.T) {
+	sched, _ := newTestScheduler(t, newTestStore(t))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	require.ErrorIs(t, sched.Submit(TaskDef{Key: NewTaskKey("test", TypeCacheWarm, "a"), Handler: noopTask}), ErrSchedulerStopped)
+
+	runs := make(chan TaskRun, 1)
+	sched.SetRunObserver(func(run TaskRun) { runs <- run })
+	sched.Start(ctx)
+
+	started := make(chan struct{})
+	key := NewTaskKey("test", TypeCacheWarm, "a")
+	require.NoError(t, sched.Submit(TaskDef{
+		Key: key,
+		Handler: func(ctx context.Context) (*TaskOutcome, error) {
+			close(started)
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	}))
+	<-started
+	require.ErrorIs(t, sched.Submit(TaskDef{Key: key, Handler: noopTask}), ErrJobRunning)
+	require.True(t, sched.Cancel(key))
+
+	select {
+	case run := <-runs:
+		require.Equal(t, key, run.Key)
+		require.Equal(t, "cancelled", run.Result)
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "job run was not observed")
+	}
+	require.Eventually(t, func() bool { return !sched.Cancel(key) }, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, sched.Stop(context.Background()))
+}
+
+func TestSubmitTimeoutStopsJob(t *testing.T) {
+	sched, _ := newTestScheduler(t, newTestStore(t))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runs := make(chan TaskRun, 1)
+	sched.SetRunObserver(func(run TaskRun) { runs <- run })
+	sched.Start(ctx)
+
+	require.NoError(t, sched.Submit(TaskDef{
+		Key:      NewTaskKey("test", TypeCacheWarm, "slow"),
+		Interval: time.Hour,
+		Timeout:  20 * time.Millisecond,
+		Handler: func(ctx context.Context) (*TaskOutcome, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	}))
+	select {
+	case run := <-runs:
+		require.NotEqual(t, "success", run.Result)
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "job did not time out")
+	}
+	require.NoError(t, sched.Stop(context.Background()))
+}
@@ -22,9 +22,9 @@ func init() {
 
 	options := &slog.HandlerOptions{Level: level}
 	if os.Getenv("DEBUG") == "true" {
-		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, options)))
+		slog.SetDefault(slog.New(redactHandler{next: slog.NewTextHandler(os.Stderr, options)}))
 		slog.Debug("当前为调试模式,请注意敏感信息泄漏")
 		return
 	}
-	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, options)))
+	slog.SetDefault(slog.New(redactHandler{next: slog.NewJSONHandler(os.Stderr, options)}))
 }
@@ -25,6 +25,8 @@ type HttpClientWrapper struct {
 	*http.Client
 	UserAgent       string
 	IdleBodyTimeout time.Duration
+
+	credentials []upstreamCredential
 }
 
 func DefaultDialContext(timeout time.Duration) func(ctx context.Context, network, addr string) (net.Conn, error) {
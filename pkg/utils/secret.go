@@ -0,0 +1,105 @@
+package utils
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const redacted = "[REDACTED]"
+
+// minSecretLength is the shortest value Redact hides. Shorter values, such as
+// a one-letter password, would mask unrelated text all over the logs.
+const minSecretLength = 6
+
+var secrets struct {
+	mu     sync.RWMutex
+	values []string
+}
+
+// SetSecrets replaces the values Redact hides, so secrets of a config that
+// is no longer loaded stop being tracked. Values shorter than
+// minSecretLength are not tracked.
+func SetSecrets(values []string) {
+	next := make([]string, 0, len(values))
+	seen := make(map[string]struct{}, len(values))
+	for _, value := range values {
+		if len(strings.TrimSpace(value)) < minSecretLength {
+			continue
+		}
+		if _, ok := seen[value]; ok {
+			continue
+		}
+		seen[value] = struct{}{}
+		next = append(next, value)
+	}
+	// Longest first so a secret containing another is hidden as a whole.
+	sort.Slice(next, func(i, j int) bool {
+		return len(next[i]) > len(next[j])
+	})
+	secrets.mu.Lock()
+	secrets.values = next
+	secrets.mu.Unlock()
+}
+
+// Redact replaces every registered secret in text.
+func Redact(text string) string {
+	secrets.mu.RLock()
+	defer secrets.mu.RUnlock()
+	for _, value := range secrets.values {
+		text = strings.ReplaceAll(text, value, redacted)
+	}
+	return text
+}
+
+// redactHandler redacts registered secrets from log messages and attributes.
+type redactHandler struct {
+	next slog.Handler
+}
+
+func (h redactHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h redactHandler) Handle(ctx context.Context, record slog.Record) error {
+	clean := slog.NewRecord(record.Time, record.Level, Redact(record.Message), record.PC)
+	record.Attrs(func(attr slog.Attr) bool {
+		clean.AddAttrs(redactAttr(attr))
+		return true
+	})
+	return h.next.Handle(ctx, clean)
+}
+
+func (h redactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clean := make([]slog.Attr, len(attrs))
+	for i, attr := range attrs {
+		clean[i] = redactAttr(attr)
+	}
+	return redactHandler{next: h.next.WithAttrs(clean)}
+}
+
+func (h redactHandler) WithGroup(name string) slog.Handler {
+	return redactHandler{next: h.next.WithGroup(name)}
+}
+
+func redactAttr(attr slog.Attr) slog.Attr {
+	value := attr.Value.Resolve()
+	switch value.Kind() {
+	case slog.KindString:
+		return slog.String(attr.Key, Redact(value.String()))
+	case slog.KindGroup:
+		group := value.Group()
+		clean := make([]any, len(group))
+		for i, item := range group {
+			clean[i] = redactAttr(item)
+		}
+		return slog.Group(attr.Key, clean...)
+	case slog.KindAny:
+		if err, ok := value.Any().(error); ok {
+			return slog.String(attr.Key, Redact(err.Error()))
+		}
+	}
+	return slog.Attr{Key: attr.Key, Value: value}
+}
@@ -0,0 +1,14 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedactSkipsShortSecretsAndPrefersLongest(t *testing.T) {
+	SetSecrets([]string{"abc", "secret", "secret-token", "  "})
+	t.Cleanup(func() { SetSecrets(nil) })
+
+	require.Equal(t, "abc [REDACTED] [REDACTED]", Redact("abc secret secret-token"))
+}
@@ -0,0 +1,90 @@
+package utils
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// UpstreamCredential sets Header to Value on requests to URLs under Prefix.
+type UpstreamCredential struct {
+	Prefix string
+	Header string
+	Value  string
+}
+
+type upstreamCredential struct {
+	UpstreamCredential
+	scheme string
+	host   string
+	path   string
+}
+
+// SetCredentials installs the credentials sent with upstream requests. Each
+// request, including every redirect hop, only carries the credentials of the
+// longest matching prefix, so third-party hosts never receive them.
+func (receiver *HttpClientWrapper) SetCredentials(credentials []UpstreamCredential) error {
+	parsed := make([]upstreamCredential, 0, len(credentials))
+	for _, credential := range credentials {
+		prefix, err := url.Parse(credential.Prefix)
+		if err != nil || prefix.Host == "" {
+			return errors.New("invalid upstream auth url " + credential.Prefix)
+		}
+		parsed = append(parsed, upstreamCredential{
+			UpstreamCredential: credential,
+			scheme:             strings.ToLower(prefix.Scheme),
+			host:               strings.ToLower(prefix.Host),
+			path:               strings.TrimRight(prefix.Path, "/"),
+		})
+	}
+	receiver.credentials = parsed
+	if len(parsed) == 0 {
+		return nil
+	}
+	receiver.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		for _, credential := range receiver.credentials {
+			req.Header.Del(credential.Header)
+		}
+		receiver.applyCredentials(req)
+		return nil
+	}
+	return nil
+}
+
+// Do sends req with the matching upstream credentials.
+func (receiver *HttpClientWrapper) Do(req *http.Request) (*http.Response, error) {
+	receiver.applyCredentials(req)
+	return receiver.Client.Do(req)
+}
+
+func (receiver *HttpClientWrapper) applyCredentials(req *http.Request) {
+	var match *upstreamCredential
+	for i := range receiver.credentials {
+		credential := &receiver.credentials[i]
+		if !credential.matches(req.URL) {
+			continue
+		}
+		if match == nil || len(credential.path) > len(match.path) {
+			match = credential
+		}
+	}
+	if match == nil {
+		return
+	}
+	for _, credential := range receiver.credentials {
+		if credential.Prefix == match.Prefix {
+			req.Header.Set(credential.Header, credential.Value)
+		}
+	}
+}
+
+func (c upstreamCredential) matches(target *url.URL) bool {
+	if !strings.EqualFold(target.Scheme, c.scheme) || !strings.EqualFold(target.Host, c.host) {
+		return false
+	}
+	return c.path == "" || target.Path == c.path || strings.HasPrefix(target.Path, c.path+"/")
+}